@@ -7,7 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"time"
+	"strings"
 
 	"github.com/uc-cdis/mariner/wflib"
 )
@@ -33,83 +33,38 @@ type AccessToken struct {
 // clearly this is problematic and needs to be fixed
 // for now.. duplicating the type definitions here
 
-// RunLog ..
+// RunLog is the WES RunLog object
 type RunLog struct {
-	Path      string           `json:"-"`
-	Request   *WorkflowRequest `json:"request"`
-	Main      *Log             `json:"main"`
-	ByProcess map[string]*Log  `json:"byProcess"`
-}
-
-// LogJSON ..
-type LogJSON struct {
-	Log *RunLog `json:"log"`
+	RunID    string                 `json:"run_id"`
+	State    string                 `json:"state"`
+	RunLog   *Log                   `json:"run_log"`
+	TaskLogs []*Log                 `json:"task_logs"`
+	Outputs  map[string]interface{} `json:"outputs"`
 }
 
 // StatusJSON ..
 type StatusJSON struct {
-	Status string `json:"status"`
+	RunID string `json:"run_id"`
+	State string `json:"state"`
 }
 
 // RunIDJSON ..
 type RunIDJSON struct {
-	RunID string `json:"runID"`
-}
-
-// CancelRunJSON ..
-type CancelRunJSON struct {
-	// RunID  string `json:"runID"`
-	Result string `json:"result"` // success or failed
+	RunID string `json:"run_id"`
 }
 
-// Log ..
+// Log is the WES Log object
 type Log struct {
-	Created        string                 `json:"created,omitempty"`
-	CreatedObj     time.Time              `json:"-"`
-	LastUpdated    string                 `json:"lastUpdated,omitempty"`
-	LastUpdatedObj time.Time              `json:"-"`
-	JobID          string                 `json:"jobID,omitempty"`
-	JobName        string                 `json:"jobName,omitempty"`
-	Status         string                 `json:"status"`
-	Stats          *Stats                 `json:"stats"`
-	Event          EventLog               `json:"eventLog,omitempty"`
-	Input          map[string]interface{} `json:"input"`
-	Scatter        map[int]*Log           `json:"scatter,omitempty"`
-	Output         map[string]interface{} `json:"output"` // okay
-}
-
-// Stats holds performance stats for a given process
-// recorded for tasks as well as workflows
-// Runtime for a workflow is the sum of runtime of that workflow's steps
-type Stats struct {
-	CPUReq        ResourceRequirement `json:"cpuReq"` // in-progress
-	MemoryReq     ResourceRequirement `json:"memReq"` // in-progress
-	ResourceUsage ResourceUsage       `json:"resourceUsage"`
-	Duration      float64             `json:"duration"`  // okay - currently measured in minutes
-	DurationObj   time.Duration       `json:"-"`         // okay
-	NFailures     int                 `json:"nfailures"` // TODO
-	NRetries      int                 `json:"nretries"`  // TODO
+	Name       string   `json:"name"`
+	Cmd        []string `json:"cmd"`
+	StartTime  string   `json:"start_time"`
+	EndTime    string   `json:"end_time"`
+	Stdout     string   `json:"stdout"`
+	Stderr     string   `json:"stderr"`
+	ExitCode   *int32   `json:"exit_code"`
+	SystemLogs []string `json:"system_logs,omitempty"`
 }
 
-type ResourceRequirement struct {
-	Min int64 `json:"min"`
-	Max int64 `json:"max"`
-}
-
-type ResourceUsage struct {
-	Series         ResourceUsageSeries `json:"data"`
-	SamplingPeriod int                 `json:"samplingPeriod"`
-}
-
-type ResourceUsageSeries []ResourceUsageSamplePoint
-
-type ResourceUsageSamplePoint struct {
-	CPU    int64 `json:"cpu"`
-	Memory int64 `json:"mem"`
-}
-
-type EventLog []string
-
 const (
 	// Runner.Environment == "mattgarvin1.planx-pla.net"
 	tokenEndpt   = "https://%v/user/credentials/api/access_token"
@@ -163,17 +118,10 @@ func (r *Runner) cancelRun(url string) error {
 		return err
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	j := &CancelRunJSON{}
-	if err = json.Unmarshal(b, j); err != nil {
-		return err
-	}
-	if j.Result == "failed" {
-		return fmt.Errorf("mariner failed to cancel run")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("mariner failed to cancel run: %v", strings.TrimSpace(string(b)))
 	}
 
 	return nil
@@ -194,7 +142,7 @@ func (r *Runner) status(url string) (string, error) {
 	if err = json.Unmarshal(b, s); err != nil {
 		return "", err
 	}
-	return s.Status, nil
+	return s.State, nil
 }
 
 // return output JSON from test run with given runID
@@ -205,7 +153,7 @@ func (r *Runner) fetchRunLog(runID *RunIDJSON) (*RunLog, error) {
 		return nil, err
 	}
 
-	j := &LogJSON{}
+	j := &RunLog{}
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -216,7 +164,7 @@ func (r *Runner) fetchRunLog(runID *RunIDJSON) (*RunLog, error) {
 		return nil, err
 	}
 
-	return j.Log, nil
+	return j, nil
 }
 
 func (r *Runner) requestRun(wf *wflib.WorkflowJSON, in map[string]interface{}, tags map[string]string) (*http.Response, error) {
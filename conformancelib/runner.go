@@ -155,7 +155,7 @@ func (r *Runner) run(test *TestCase) (err error) {
 	// case handling for +/- tests
 	var match bool
 	switch {
-	case !test.ShouldFail && status == "completed":
+	case !test.ShouldFail && status == "COMPLETE":
 		fmt.Printf("--- %v - matching output\n", test.ID)
 		match, err = r.matchOutput(test, runLog)
 		if err != nil {
@@ -168,7 +168,7 @@ func (r *Runner) run(test *TestCase) (err error) {
 		}
 
 		// fixme: make status values constants
-	case (!test.ShouldFail && status == "failed") || status == "timeout":
+	case (!test.ShouldFail && (status == "EXECUTOR_ERROR" || status == "SYSTEM_ERROR")) || status == "timeout":
 		r.fail(test, runLog, status)
 	case test.ShouldFail:
 		/*
@@ -180,7 +180,7 @@ func (r *Runner) run(test *TestCase) (err error) {
 				i.e., when it is packed,
 				and/or when the run request is POSTed to mariner server
 			2. the job may dispatch but fail mid-run
-				i.e., status during r.waitForDone() should reach "failed"
+				i.e., status during r.waitForDone() should reach "EXECUTOR_ERROR"
 			3. the job may run to completion but return nothing or the incorrect output
 
 			so, until I figure out where/how to check
@@ -197,7 +197,7 @@ func (r *Runner) run(test *TestCase) (err error) {
 
 // return whether desired and actual test output match
 func (r *Runner) matchOutput(test *TestCase, runLog *RunLog) (bool, error) {
-	res, err := test.matchOutput(runLog.Main.Output)
+	res, err := test.matchOutput(runLog.Outputs)
 	if err != nil {
 		return false, err
 	}
@@ -241,11 +241,9 @@ func (r *Runner) waitForDone(test *TestCase, runID *RunIDJSON) (status string, e
 		}
 
 		switch status {
-		case "running":
+		case "QUEUED", "INITIALIZING", "RUNNING":
 			// do nothing
-		case "completed":
-			done = true
-		case "failed":
+		case "COMPLETE", "EXECUTOR_ERROR", "SYSTEM_ERROR", "CANCELED":
 			done = true
 		default:
 			// fmt.Println("unexpected status: ", status)
@@ -300,7 +298,7 @@ func (r *Runner) fail(test *TestCase, runLog *RunLog, status string) {
 		MarinerError: []string{},
 	}
 	// collect all error messages from main mariner log
-	for _, msg := range runLog.Main.Event {
+	for _, msg := range runLog.RunLog.SystemLogs {
 		if strings.Contains(msg, "- ERROR -") {
 			log.MarinerError = append(log.MarinerError, msg)
 		}
@@ -308,8 +306,7 @@ func (r *Runner) fail(test *TestCase, runLog *RunLog, status string) {
 	if status == "timeout" {
 		log.TimeOut = true
 
-		// note: engine jobName is the runID - need to clarify this in all mariner code
-		cancelEndpt := fmt.Sprintf(fcancelEndpt, r.Environment, runLog.Main.JobName)
+		cancelEndpt := fmt.Sprintf(fcancelEndpt, r.Environment, runLog.RunID)
 		if err := r.cancelRun(cancelEndpt); err != nil {
 			log.FailedToKillJob = true
 			fmt.Printf("--- %v - failed to kill job: %v\n", test.ID, err)
@@ -18,6 +18,8 @@ usage:
  - to setup the mariner server: `mariner listen`
  - to run a workflow: `mariner run $RUN_ID`
  	 (runs workflow in /engine-workspace/workflowRuns/{runID}/request.json, which is s3://workflow-engine-garvin/userID/workflow-run-timestamp/request.json)
+ - to plan a workflow run without running anything: `mariner plan request.json`
+ 	 (prints the resolved task graph and job specs, and what's wrong with the request - exits 1 if anything is)
 */
 
 func main() {
@@ -26,8 +28,16 @@ func main() {
 		mariner.RunServer() // should this function return an error?
 	case "run":
 		runID := os.Args[2]
+		// exits non-zero, so the engine job fails if the run does
 		if err := mariner.Engine(runID); err != nil {
-			log.Printf("engine failed: %v", err)
+			log.Fatalf("engine failed: %v", err)
+		}
+	case "plan":
+		if len(os.Args) < 3 {
+			log.Fatal("usage: mariner plan request.json")
+		}
+		if err := mariner.Plan(os.Args[2]); err != nil {
+			log.Fatalf("plan failed: %v", err)
 		}
 	}
 }
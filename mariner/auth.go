@@ -0,0 +1,364 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/uc-cdis/go-authutils/authutils"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// this file contains code for the pluggable auth backends
+// which are selected by the "auth" block of the mariner config
+//
+// identity - a TokenDecoder turns the bearer token into claims
+// ----- "jwks" (default): fence JWTs, verified against the JWKS endpoint
+// ----- "hs256": JWTs signed with a shared secret - for dev and CI
+// ----- "static": a fixed map of token -> username - for dev and CI
+// authorization - an Authorizer decides whether a user may do a method on a resource
+// ----- "arborist" (default): asks arborist
+// ----- "local": a YAML policy file, with the same resource/method semantics as arborist
+//
+// either way, the resources and methods are the ones described in authz.go
+
+const (
+	jwksTokenDecoder   = "jwks"
+	hs256TokenDecoder  = "hs256"
+	staticTokenDecoder = "static"
+
+	arboristAuthorizer = "arborist"
+	localAuthorizer    = "local"
+)
+
+// TokenDecoder decodes and verifies a bearer token, returning its claims
+// the username is read from the claims at context.user.name, like in fence JWTs
+type TokenDecoder interface {
+	Decode(string) (*map[string]interface{}, error)
+}
+
+// Authorizer decides what a user may do
+type Authorizer interface {
+	// true if the user may do the method on the resource
+	Authorize(user *TokenInfo, resource, method string) (bool, error)
+	// the methods the user has on each resource - see authMapping
+	Mapping(user *TokenInfo) (authMapping, error)
+}
+
+// AuthConfig selects the auth backends - an empty config means the gen3 defaults, fence JWTs and arborist
+type AuthConfig struct {
+	TokenDecoder string `json:"token_decoder"` // "jwks" (default), "hs256" or "static"
+	Authorizer   string `json:"authorizer"`    // "arborist" (default) or "local"
+
+	// "hs256" only - the secret the tokens are signed with
+	HS256Secret string `json:"hs256_secret,omitempty"`
+
+	// "static" only - token -> username
+	StaticTokens map[string]string `json:"static_tokens,omitempty"`
+
+	// "local" only - path to the YAML policy file
+	PolicyFile string `json:"policy_file,omitempty"`
+}
+
+func (conf *AuthConfig) tokenDecoderName() string {
+	if conf.TokenDecoder == "" {
+		return jwksTokenDecoder
+	}
+	return conf.TokenDecoder
+}
+
+func (conf *AuthConfig) authorizerName() string {
+	if conf.Authorizer == "" {
+		return arboristAuthorizer
+	}
+	return conf.Authorizer
+}
+
+// returns the configured token decoder
+// jwksURL is only used by the "jwks" decoder
+func (conf *AuthConfig) tokenDecoder(jwksURL string) (TokenDecoder, error) {
+	switch conf.tokenDecoderName() {
+	case jwksTokenDecoder:
+		return authutils.NewJWTApplication(jwksURL), nil
+	case hs256TokenDecoder:
+		if conf.HS256Secret == "" {
+			return nil, fmt.Errorf("auth.hs256_secret is required for the hs256 token decoder")
+		}
+		return &hs256Decoder{secret: []byte(conf.HS256Secret)}, nil
+	case staticTokenDecoder:
+		if len(conf.StaticTokens) == 0 {
+			return nil, fmt.Errorf("auth.static_tokens is required for the static token decoder")
+		}
+		return &staticDecoder{tokens: conf.StaticTokens}, nil
+	}
+	return nil, fmt.Errorf("unknown token decoder %q - must be one of jwks, hs256, static", conf.TokenDecoder)
+}
+
+// returns the configured authorizer
+func (conf *AuthConfig) authorizer() (Authorizer, error) {
+	switch conf.authorizerName() {
+	case arboristAuthorizer:
+		return &arborist{}, nil
+	case localAuthorizer:
+		if conf.PolicyFile == "" {
+			return nil, fmt.Errorf("auth.policy_file is required for the local authorizer")
+		}
+		return loadLocalPolicy(conf.PolicyFile)
+	}
+	return nil, fmt.Errorf("unknown authorizer %q - must be one of arborist, local", conf.Authorizer)
+}
+
+//// token decoders ////
+
+// verifies HS256 JWTs signed with a shared secret
+type hs256Decoder struct {
+	secret []byte
+}
+
+func (d *hs256Decoder) Decode(token string) (*map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed.Headers) == 0 || parsed.Headers[0].Algorithm != "HS256" {
+		return nil, fmt.Errorf("token is not signed with HS256")
+	}
+	std := jwt.Claims{}
+	claims := map[string]interface{}{}
+	if err = parsed.Claims(d.secret, &std, &claims); err != nil {
+		return nil, err
+	}
+	if err = std.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// looks the token up in a fixed map of token -> username
+type staticDecoder struct {
+	tokens map[string]string
+}
+
+func (d *staticDecoder) Decode(token string) (*map[string]interface{}, error) {
+	username, ok := d.tokens[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown token")
+	}
+	// same shape as the claims of a fence JWT
+	claims := map[string]interface{}{
+		"context": map[string]interface{}{
+			"user": map[string]interface{}{
+				"name": username,
+			},
+		},
+	}
+	return &claims, nil
+}
+
+//// arborist ////
+
+// asks arborist, forwarding the user's token
+type arborist struct{}
+
+func (a *arborist) Authorize(user *TokenInfo, resource, method string) (bool, error) {
+	b, err := json.Marshal(&RequestJSON{
+		User: &UserJSON{Token: user.Token},
+		Request: &AuthRequest{
+			Resource: resource,
+			Action: &AuthAction{
+				Service: marinerService,
+				Method:  method,
+			},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("error building auth request: %v", err)
+	}
+	client := &http.Client{Timeout: arboristTimeout}
+	start := time.Now()
+	resp, err := client.Post(arboristAuthURL, "application/json", bytes.NewBuffer(b))
+	observeDependency(arboristDependency, "auth", start, err)
+	if err != nil {
+		return false, fmt.Errorf("error asking arborist: %v", err)
+	}
+	authResponse := &ArboristResponse{}
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("error reading arborist response body: %v", err)
+	}
+	err = json.Unmarshal(b, authResponse)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling arborist response to struct: %v", err)
+	}
+	return authResponse.Auth, nil
+}
+
+func (a *arborist) Mapping(user *TokenInfo) (authMapping, error) {
+	req, err := http.NewRequest("POST", arboristMappingURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(authHeader, "Bearer "+user.Token)
+	client := &http.Client{Timeout: arboristTimeout}
+	start := time.Now()
+	resp, err := client.Do(req)
+	observeDependency(arboristDependency, "mapping", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error asking arborist: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("arborist responded with status %v", resp.StatusCode)
+	}
+	mapping := authMapping{}
+	if err = json.NewDecoder(resp.Body).Decode(&mapping); err != nil {
+		return nil, fmt.Errorf("error unmarshalling arborist auth mapping: %v", err)
+	}
+	return mapping, nil
+}
+
+//// local policy file ////
+
+// LocalPolicyFile is the YAML policy file of the local authorizer
+// it's a small subset of arborist's user.yaml - e.g.,
+//
+// policies:
+//   - id: mariner_admin
+//     resource_paths: ["/mariner"]
+//     actions: [{service: mariner, method: "*"}]
+//   - id: mariner_submitter
+//     resource_paths: ["/mariner/runs"]
+//     actions: [{service: mariner, method: submit}]
+//
+// groups:
+//   - name: admins
+//     users: [alice]
+//     policies: [mariner_admin]
+//
+// users:
+//
+//	bob:
+//	  policies: [mariner_submitter]
+//
+// groups named "authenticated" apply to every user with a valid token, like in arborist
+type LocalPolicyFile struct {
+	Policies []*LocalPolicy        `yaml:"policies"`
+	Groups   []*LocalGroup         `yaml:"groups"`
+	Users    map[string]*LocalUser `yaml:"users"`
+}
+
+// LocalPolicy grants the actions on each of the resources (and everything under them)
+type LocalPolicy struct {
+	ID            string        `yaml:"id"`
+	ResourcePaths []string      `yaml:"resource_paths"`
+	Actions       []*AuthAction `yaml:"actions"`
+}
+
+// LocalGroup grants its policies to its users
+type LocalGroup struct {
+	Name     string   `yaml:"name"`
+	Users    []string `yaml:"users"`
+	Policies []string `yaml:"policies"`
+}
+
+// LocalUser lists the policies granted to the user directly
+type LocalUser struct {
+	Policies []string `yaml:"policies"`
+}
+
+const authenticatedGroup = "authenticated"
+
+// the local authorizer - the policy file is read once, at startup
+type localPolicy struct {
+	mappings      map[string]authMapping // username -> mapping
+	authenticated authMapping            // granted to everyone
+}
+
+func loadLocalPolicy(path string) (*localPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy file: %v", err)
+	}
+	file := &LocalPolicyFile{}
+	if err = yaml.UnmarshalStrict(b, file); err != nil {
+		return nil, fmt.Errorf("unmarshalling policy file: %v", err)
+	}
+	return file.policy()
+}
+
+// resolves the policy ids of each user and group into auth mappings
+func (file *LocalPolicyFile) policy() (*localPolicy, error) {
+	byID := make(map[string]*LocalPolicy)
+	for _, p := range file.Policies {
+		if p.ID == "" {
+			return nil, fmt.Errorf("policy without an id")
+		}
+		byID[p.ID] = p
+	}
+	grant := func(mapping authMapping, ids []string) error {
+		for _, id := range ids {
+			p, ok := byID[id]
+			if !ok {
+				return fmt.Errorf("unknown policy %q", id)
+			}
+			for _, path := range p.ResourcePaths {
+				mapping[path] = append(mapping[path], p.Actions...)
+			}
+		}
+		return nil
+	}
+
+	local := &localPolicy{
+		mappings:      make(map[string]authMapping),
+		authenticated: authMapping{},
+	}
+	mappingOf := func(username string) authMapping {
+		if local.mappings[username] == nil {
+			local.mappings[username] = authMapping{}
+		}
+		return local.mappings[username]
+	}
+	for username, user := range file.Users {
+		if err := grant(mappingOf(username), user.Policies); err != nil {
+			return nil, fmt.Errorf("user %v: %v", username, err)
+		}
+	}
+	for _, group := range file.Groups {
+		if group.Name == authenticatedGroup {
+			if err := grant(local.authenticated, group.Policies); err != nil {
+				return nil, fmt.Errorf("group %v: %v", group.Name, err)
+			}
+			continue
+		}
+		for _, username := range group.Users {
+			if err := grant(mappingOf(username), group.Policies); err != nil {
+				return nil, fmt.Errorf("group %v: %v", group.Name, err)
+			}
+		}
+	}
+	return local, nil
+}
+
+func (local *localPolicy) Authorize(user *TokenInfo, resource, method string) (bool, error) {
+	mapping, err := local.Mapping(user)
+	if err != nil {
+		return false, err
+	}
+	return mapping.allows(resource, method), nil
+}
+
+func (local *localPolicy) Mapping(user *TokenInfo) (authMapping, error) {
+	mapping := authMapping{}
+	for path, actions := range local.authenticated {
+		mapping[path] = append(mapping[path], actions...)
+	}
+	for path, actions := range local.mappings[user.UserID] {
+		mapping[path] = append(mapping[path], actions...)
+	}
+	return mapping, nil
+}
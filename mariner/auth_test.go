@@ -0,0 +1,121 @@
+package mariner
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const testPolicyFile = `
+policies:
+  - id: mariner_admin
+    resource_paths: ["/mariner"]
+    actions: [{service: mariner, method: "*"}]
+  - id: mariner_submitter
+    resource_paths: ["/mariner/runs"]
+    actions: [{service: mariner, method: submit}]
+  - id: lab_reader
+    resource_paths: ["/mariner/projects/lab"]
+    actions: [{service: mariner, method: read}]
+groups:
+  - name: admins
+    users: [alice]
+    policies: [mariner_admin]
+  - name: authenticated
+    policies: [mariner_submitter]
+users:
+  bob:
+    policies: [lab_reader]
+`
+
+func TestLocalPolicy(t *testing.T) {
+	file := &LocalPolicyFile{}
+	if err := yaml.UnmarshalStrict([]byte(testPolicyFile), file); err != nil {
+		t.Fatal(err)
+	}
+	local, err := file.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		userID   string
+		resource string
+		method   string
+		allowed  bool
+	}{
+		{"admin - anything under /mariner", "alice", "/mariner/projects/lab/runs/run-1", deleteAction, true},
+		{"admin - outside /mariner", "alice", "/programs/ndh", readAction, false},
+		{"authenticated group applies to everyone", "carol", "/mariner/runs", submitAction, true},
+		{"authenticated group - only its method", "carol", "/mariner/runs/run-1", readAction, false},
+		{"user policy", "bob", "/mariner/projects/lab/runs/run-1", readAction, true},
+		{"user policy - and the authenticated group's", "bob", "/mariner/runs", submitAction, true},
+		{"user policy - other project", "bob", "/mariner/projects/other/runs/run-1", readAction, false},
+		{"unknown user - authenticated group only", "dave", "/mariner/projects/lab", readAction, false},
+	}
+	for _, c := range cases {
+		allowed, err := local.Authorize(&TokenInfo{UserID: c.userID}, c.resource, c.method)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if allowed != c.allowed {
+			t.Errorf("%v: expected allowed=%v, got %v", c.name, c.allowed, allowed)
+		}
+	}
+
+	// the mapping of one user doesn't leak into the shared authenticated mapping
+	local.Mapping(&TokenInfo{UserID: "alice"})
+	if allowed, _ := local.Authorize(&TokenInfo{UserID: "carol"}, "/mariner/runs/run-1", deleteAction); allowed {
+		t.Errorf("alice's policies leaked to carol")
+	}
+}
+
+func TestInvalidLocalPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+	}{
+		{"policy without an id", `policies: [{resource_paths: ["/mariner"], actions: [{service: mariner, method: "*"}]}]`},
+		{"user with an unknown policy", `users: {bob: {policies: [nope]}}`},
+		{"group with an unknown policy", `groups: [{name: admins, users: [alice], policies: [nope]}]`},
+	}
+	for _, c := range cases {
+		file := &LocalPolicyFile{}
+		if err := yaml.UnmarshalStrict([]byte(c.file), file); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if _, err := file.policy(); err == nil {
+			t.Errorf("%v: expected an error", c.name)
+		}
+	}
+}
+
+func TestStaticDecoder(t *testing.T) {
+	conf := &AuthConfig{TokenDecoder: staticTokenDecoder, StaticTokens: map[string]string{"t0k3n": "alice"}}
+	decoder, err := conf.tokenDecoder("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		token    string
+		username string // "" - the token is rejected
+	}{
+		{"t0k3n", "alice"},
+		{"other", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		claims, err := decoder.Decode(c.token)
+		switch {
+		case c.username == "" && err == nil:
+			t.Errorf("%q: expected the token to be rejected", c.token)
+		case c.username != "" && err != nil:
+			t.Errorf("%q: unexpected error: %v", c.token, err)
+		case c.username != "":
+			name := (*claims)["context"].(map[string]interface{})["user"].(map[string]interface{})["name"]
+			if name != c.username {
+				t.Errorf("%q: expected username %v, got %v", c.token, c.username, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package mariner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+)
+
+// this file contains code for per-run authorization
+//
+// every run is an arborist resource:
+// "/mariner/runs/{runID}" - or "/mariner/projects/{project}/runs/{runID}" if the run was submitted to a project
+// and each endpoint needs one of the methods "submit", "read", "cancel", "delete" on the run's resource
+//
+// - every endpoint needs some mariner policy on "/mariner" or a resource under it - checked in the auth middleware
+// - submitting needs "submit" on "/mariner/runs" (or "/mariner/projects/{project}/runs")
+// - users may read, cancel and delete their own runs as long as they may still submit runs where the run was submitted
+// ----- or if they have the method on the run's resource
+// - acting on someone else's run needs the method on the run's resource - nothing else
+// ----- since arborist resources are hierarchical, a policy on "/mariner" covers every run (admins)
+// ----- and a policy on "/mariner/projects/{project}" covers every run in that project (team leads)
+// - the legacy method "access" counts as "submit" (and "register") - so it lets users act on their own runs, never on someone else's
+// - registering a workflow version needs "register" on "/mariner/workflows/{name}", see registry.go
+//
+// runs are stored under their owner's userID prefix, so to find someone else's run
+// the server keeps an index of runs: "_mariner/runIndex/{runID}/{userID}" - or "_mariner/runIndex/{runID}/{userID}/{project}" (empty objects)
+// ----- the index has the run's project, so listing runs across users only fetches the logs of the runs the user may read, see list.go
+
+const (
+	marinerService = "mariner"
+
+	submitAction   = "submit"
+	readAction     = "read"
+	cancelAction   = "cancel"
+	deleteAction   = "delete"
+	registerAction = "register" // registering workflow versions, see registry.go
+	accessAction   = "access"   // legacy - allows everything
+
+	marinerResource      = "/mariner"
+	marinerRunsResource  = "/mariner/runs"
+	projectRunsResourcef = "/mariner/projects/%v/runs"
+
+	runIndexPrefix = "_mariner/runIndex/"
+
+	arboristTimeout = 10 * time.Second
+)
+
+// project names end up in resource paths, so they're restricted to one path segment
+var projectPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type contextKey string
+
+// the userID under which the run being requested is stored
+const runOwnerKey contextKey = "runOwner"
+
+// where the runs of the given project live in arborist
+func runsResource(project string) string {
+	if project == "" {
+		return marinerRunsResource
+	}
+	return fmt.Sprintf(projectRunsResourcef, project)
+}
+
+func runResource(project, runID string) string {
+	return runsResource(project) + "/" + runID
+}
+
+// the arborist method needed for a request on a run
+// resuming a run starts a new one, so it needs "submit"
+func runAction(r *http.Request) string {
+	switch {
+	case r.Method == "DELETE":
+		return deleteAction
+	case strings.HasSuffix(r.URL.Path, "/cancel"):
+		return cancelAction
+	case strings.HasSuffix(r.URL.Path, "/resume"):
+		return submitAction
+	}
+	return readAction
+}
+
+// true if the user has any mariner policy on "/mariner" or a resource under it - one call to the authorizer
+func (server *Server) mayUseMariner(r *http.Request) (bool, error) {
+	mapping, err := server.authMapping(r)
+	if err != nil {
+		return false, err
+	}
+	return mapping.grantsUnder(marinerResource), nil
+}
+
+// true if the authorizer allows the method on the resource
+// falls back to the legacy "access" method, so existing policies keep working
+// NOTE: only for collections (e.g., "/mariner/runs") and workflows - never for a single run,
+// ----- since "access" on "/mariner" would then cover every user's runs
+func (server *Server) authorize(r *http.Request, resource, method string) (bool, error) {
+	ok, err := server.authZ(r, resource, method)
+	if err != nil || ok {
+		return ok, err
+	}
+	return server.authZ(r, resource, accessAction)
+}
+
+// for requests on a run - finds the run's owner and checks the caller may act on it
+// puts the owner in the request context, see uniqueKey()
+func (server *Server) authorizeRun(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	callerID := server.userID(r)
+	runID := mux.Vars(r)["runID"]
+	owner, err := server.runOwner(callerID, runID)
+	if err != nil {
+		fmt.Println("error finding run owner: ", err)
+		writeRunError(w, err, "failed to find run")
+		return r, false
+	}
+	request, err := server.fetchRequest(owner, runID)
+	if err != nil {
+		fmt.Println("error fetching workflow request: ", err)
+		writeRunError(w, err, "failed to find run")
+		return r, false
+	}
+	ok, err := server.mayActOnRun(r, owner == callerID, request.Project, runID)
+	if err != nil {
+		fmt.Println("error checking auth: ", err)
+		writeError(w, 500, "failed to check authorization")
+		return r, false
+	}
+	if !ok {
+		writeError(w, 403, "user not authorized to access this run")
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), runOwnerKey, owner)), true
+}
+
+// true if the caller may do the request's method on the run
+// the method on the run's resource is enough for anyone - no "access" fallback here
+// owners may also act on their runs while they may submit runs where the run was submitted
+func (server *Server) mayActOnRun(r *http.Request, owner bool, project, runID string) (bool, error) {
+	ok, err := server.authZ(r, runResource(project, runID), runAction(r))
+	if err != nil || ok || !owner {
+		return ok, err
+	}
+	return server.authorize(r, runsResource(project), submitAction)
+}
+
+//// run index ////
+
+// records who owns the run and its project, so other users can find it
+func (server *Server) writeRunIndex(userID, runID, project string) error {
+	ref := &runRef{UserID: userID, RunID: runID, Project: project}
+	svc := s3.New(server.S3FileManager.newS3Session())
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(ref.key(runIndexPrefix)),
+		Body:   bytes.NewReader([]byte{}),
+	})
+	return err
+}
+
+// takes the run out of the run index
+func (server *Server) deleteRunIndex(runID string) error {
+	refs, err := server.listRunIndex(runID + "/")
+	if err != nil {
+		return err
+	}
+	svc := s3.New(server.S3FileManager.newS3Session())
+	for _, ref := range refs {
+		_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(server.S3FileManager.S3BucketName),
+			Key:    aws.String(ref.key(runIndexPrefix)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the userID the run is stored under
+// runs submitted before the index existed are only found under the caller's own prefix
+func (server *Server) runOwner(callerID, runID string) (string, error) {
+	refs, err := server.listRunIndex(runID + "/")
+	if err != nil {
+		return "", err
+	}
+	if len(refs) > 0 {
+		return refs[0].UserID, nil
+	}
+	return callerID, nil
+}
+
+// runRef identifies a run - runs are stored under their owner's prefix
+type runRef struct {
+	UserID  string
+	RunID   string
+	Project string // run index only
+}
+
+// "{root}{runID}/{userID}", or "{root}{runID}/{userID}/{project}"
+func (ref *runRef) key(root string) string {
+	key := root + ref.RunID + "/" + ref.UserID
+	if ref.Project != "" {
+		key += "/" + ref.Project
+	}
+	return key
+}
+
+// lists the runs in the run index under the given prefix
+func (server *Server) listRunIndex(prefix string) ([]*runRef, error) {
+	return server.listRunRefs(runIndexPrefix, prefix)
+}
+
+// lists the "{root}{runID}/{userID}" objects under root+prefix - see runRef.key()
+// the run index and the run queue (see quota.go) are both laid out like this
+func (server *Server) listRunRefs(root, prefix string) ([]*runRef, error) {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	refs := []*runRef{}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Prefix: aws.String(root + prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			parts := strings.SplitN(strings.TrimPrefix(aws.StringValue(obj.Key), root), "/", 3)
+			if len(parts) < 2 || parts[1] == "" {
+				continue
+			}
+			ref := &runRef{RunID: parts[0], UserID: parts[1]}
+			if len(parts) == 3 {
+				ref.Project = parts[2]
+			}
+			refs = append(refs, ref)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+//// visibility ////
+
+// an auth mapping, in arborist's format - the methods the user has on each resource
+type authMapping map[string][]*AuthAction
+
+// the user's auth mapping - used to filter the runs a user may see, with one call to the authorizer
+func (server *Server) authMapping(r *http.Request) (authMapping, error) {
+	user, err := server.tokenInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	return server.authz.Mapping(user)
+}
+
+// true if the mapping allows the method on the resource or on one of its ancestors
+// methods match exactly, like in arborist - "access" is just another method here, see authorize()
+func (mapping authMapping) allows(resource, method string) bool {
+	for path, actions := range mapping {
+		if !underResource(resource, path) {
+			continue
+		}
+		for _, action := range actions {
+			if action.Service != marinerService && action.Service != "*" {
+				continue
+			}
+			if action.Method == method || action.Method == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// true if the mapping has any mariner action on the resource, on one of its ancestors or on anything under it
+func (mapping authMapping) grantsUnder(resource string) bool {
+	for path, actions := range mapping {
+		if !underResource(resource, path) && !underResource(path, resource) {
+			continue
+		}
+		for _, action := range actions {
+			if action.Service == marinerService || action.Service == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// true if the resource is the given path or a descendant of it
+func underResource(resource, path string) bool {
+	return resource == path || strings.HasPrefix(resource, strings.TrimSuffix(path, "/")+"/")
+}
@@ -0,0 +1,104 @@
+package mariner
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunAction(t *testing.T) {
+	cases := []struct {
+		method, path string
+		action       string
+	}{
+		{"GET", "/runs/run-1", readAction},
+		{"GET", "/runs/run-1/status", readAction},
+		{"POST", "/runs/run-1/cancel", cancelAction},
+		{"POST", "/runs/run-1/resume", submitAction},
+		{"DELETE", "/runs/run-1", deleteAction},
+		{"GET", "/ga4gh/wes/v1/runs/run-1", readAction},
+		{"POST", "/ga4gh/wes/v1/runs/run-1/cancel", cancelAction},
+	}
+	for _, c := range cases {
+		if action := runAction(httptest.NewRequest(c.method, c.path, nil)); action != c.action {
+			t.Errorf("%v %v: expected %v, got %v", c.method, c.path, c.action, action)
+		}
+	}
+}
+
+func TestRunResource(t *testing.T) {
+	cases := []struct {
+		project, runID string
+		resource       string
+	}{
+		{"", "run-1", "/mariner/runs/run-1"},
+		{"lab", "run-1", "/mariner/projects/lab/runs/run-1"},
+	}
+	for _, c := range cases {
+		if resource := runResource(c.project, c.runID); resource != c.resource {
+			t.Errorf("%q, %q: expected %v, got %v", c.project, c.runID, c.resource, resource)
+		}
+	}
+}
+
+func TestAuthMapping(t *testing.T) {
+	mapping := authMapping{
+		"/mariner/projects/lab":  {{Service: marinerService, Method: readAction}},
+		"/mariner/runs":          {{Service: marinerService, Method: accessAction}},
+		"/mariner/workflows/bwa": {{Service: "*", Method: "*"}},
+		"/programs/ndh":          {{Service: "peregrine", Method: "*"}},
+	}
+	cases := []struct {
+		name     string
+		resource string
+		method   string
+		allows   bool
+	}{
+		{"method on the resource", "/mariner/projects/lab", readAction, true},
+		{"method on an ancestor", "/mariner/projects/lab/runs/run-1", readAction, true},
+		{"other method", "/mariner/projects/lab/runs/run-1", deleteAction, false},
+		{"sibling with a common prefix", "/mariner/projects/lab2/runs/run-1", readAction, false},
+		{"access is just another method", "/mariner/runs/run-1", readAction, false},
+		{"access itself", "/mariner/runs/run-1", accessAction, true},
+		{"wildcard service and method", "/mariner/workflows/bwa", registerAction, true},
+		{"another service's policy", "/programs/ndh", readAction, false},
+		{"descendant doesn't grant the ancestor", "/mariner/projects", readAction, false},
+	}
+	for _, c := range cases {
+		if allows := mapping.allows(c.resource, c.method); allows != c.allows {
+			t.Errorf("%v: expected allows=%v, got %v", c.name, c.allows, allows)
+		}
+	}
+
+	grants := []struct {
+		name    string
+		mapping authMapping
+		grants  bool
+	}{
+		{"policy on /mariner", authMapping{"/mariner": {{Service: marinerService, Method: "*"}}}, true},
+		{"policy under /mariner", authMapping{"/mariner/projects/lab": {{Service: marinerService, Method: readAction}}}, true},
+		{"policy on the root", authMapping{"/": {{Service: "*", Method: "*"}}}, true},
+		{"another service's policy under /mariner", authMapping{"/mariner/runs": {{Service: "peregrine", Method: "*"}}}, false},
+		{"policy on a sibling with a common prefix", authMapping{"/marinerx": {{Service: marinerService, Method: "*"}}}, false},
+		{"no policies", authMapping{}, false},
+	}
+	for _, c := range grants {
+		if grants := c.mapping.grantsUnder(marinerResource); grants != c.grants {
+			t.Errorf("%v: expected grantsUnder=%v, got %v", c.name, c.grants, grants)
+		}
+	}
+}
+
+func TestRunRefKey(t *testing.T) {
+	cases := []struct {
+		ref *runRef
+		key string
+	}{
+		{&runRef{UserID: "alice", RunID: "run-1"}, runIndexPrefix + "run-1/alice"},
+		{&runRef{UserID: "alice", RunID: "run-1", Project: "lab"}, runIndexPrefix + "run-1/alice/lab"},
+	}
+	for _, c := range cases {
+		if key := c.ref.key(runIndexPrefix); key != c.key {
+			t.Errorf("%+v: expected %v, got %v", c.ref, c.key, key)
+		}
+	}
+}
@@ -0,0 +1,653 @@
+package mariner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// this file contains code for call caching
+// i.e., reusing the outputs of a CommandLineTool which already ran on the same inputs, in any earlier run
+//
+// each CommandLineTool invocation gets a cache key - the sha256 of
+// ----- the tool's CWL (as packed, minus its requirements and hints)
+// ----- the requirements and hints in effect for the tool - its own, and those it inherits from its workflows and steps, see requirements.go -
+// ----- minus ResourceRequirement - resources don't change outputs
+// ----- the digest of its docker image
+// ----- its resolved inputs, where each file is identified by its content (the s3 ETag, or the commons GUID), not by its path
+//
+// the cache is an index in s3, per user - or per project, for runs submitted to a project:
+// "_mariner/callCache/users/{userID}/{key}.json" or "_mariner/callCache/projects/{project}/{key}.json"
+// ----- tools with commons data inputs are cached per user all the same - the key doesn't say whether the user may read the data,
+// ----- (the task job would find out, when it mounts it) so a project hit could hand over outputs of data the user has no access to
+// each entry records the run, working dir and outputs of the invocation
+//
+// on a hit the task job isn't dispatched - the task takes the outputs of the entry
+// ----- outputs in the user's own space are referenced where they are
+// ----- outputs of another user in the project are copied into the task's working dir
+// an entry whose output files are gone is a miss
+//
+// call caching is off unless "call_cache": {"enabled": true} is in the mariner config
+// a tool opts out with the CWL WorkReuse requirement or hint: {"class": "WorkReuse", "enableReuse": false} - which it may inherit, too
+// the output files of cached tasks are not deleted when the run's intermediate files are cleaned up
+
+const (
+	callCachePrefix         = "_mariner/callCache/"
+	userCallCacheKeyf       = callCachePrefix + "users/%v/%v.json"    // fill with userID, key
+	projectCallCacheKeyf    = callCachePrefix + "projects/%v/%v.json" // fill with project, key
+	cwlWorkReuseRequirement = "WorkReuse"
+
+	dockerHubRegistry = "registry-1.docker.io"
+	registryTimeout   = 10 * time.Second
+)
+
+// CallCacheConfig turns call caching on
+type CallCacheConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// CallCacheLog goes in the log of each task which was looked up in the call cache
+type CallCacheLog struct {
+	Key string `json:"key"`
+	Hit bool   `json:"hit"`
+	Run string `json:"run,omitempty"` // on a hit, the run which produced the outputs
+}
+
+// CallCacheEntry is an entry in the call cache index
+type CallCacheEntry struct {
+	Key            string                 `json:"key"`
+	UserID         string                 `json:"user"`
+	RunID          string                 `json:"runID"`
+	TaskID         string                 `json:"taskID"`
+	WorkingDir     string                 `json:"workingDir"`
+	JobName        string                 `json:"jobName"`
+	ContainerImage string                 `json:"containerImage"`
+	Command        []string               `json:"command"`
+	Output         map[string]interface{} `json:"output"`
+	Created        string                 `json:"created"`
+}
+
+// the engine's call cache state
+type callCache struct {
+	sync.Mutex
+	processes map[string]map[string]interface{} // the packed CWL of each process, by id
+	digests   map[string]string                 // docker image -> digest
+	keep      map[string]bool                   // output paths of the tasks put in the cache
+}
+
+// called when the workflow request is loaded
+func newCallCache(workflow json.RawMessage) (*callCache, error) {
+	processes, err := packedProcesses(workflow)
+	if err != nil {
+		return nil, err
+	}
+	cache := &callCache{
+		processes: processes,
+		digests:   make(map[string]string),
+		keep:      make(map[string]bool),
+	}
+	return cache, nil
+}
+
+// the packed CWL of each process in the workflow, by id
+func packedProcesses(workflow json.RawMessage) (map[string]map[string]interface{}, error) {
+	packed := struct {
+		Graph []map[string]interface{} `json:"$graph"`
+	}{}
+	if err := json.Unmarshal(workflow, &packed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal packed workflow: %v", err)
+	}
+	processes := make(map[string]map[string]interface{})
+	for _, process := range packed.Graph {
+		if id, ok := process["id"].(string); ok {
+			processes[id] = process
+		}
+	}
+	return processes, nil
+}
+
+// true if the outputs of the tool were taken from the call cache
+// called in place of running the tool
+func (engine *K8sEngine) cachedOutputs(tool *Tool) bool {
+	if engine.callCache == nil || tool.Task.Root.Class != CWLCommandLineTool {
+		return false
+	}
+	key, err := engine.cacheKey(tool)
+	if err != nil {
+		tool.Task.warnf("not using the call cache for this task: %v", err)
+		return false
+	}
+	if key == "" {
+		tool.Task.infof("WorkReuse is disabled for this tool - not using the call cache")
+		return false
+	}
+	tool.CacheKey = key
+	tool.Task.Log.CallCache = &CallCacheLog{Key: key}
+
+	entry, err := engine.cacheEntry(tool)
+	if err != nil {
+		tool.Task.warnf("failed to look up call cache entry: %v", err)
+	}
+	if entry == nil || !engine.restoreCacheEntry(tool, entry) {
+		metrics.inc(callCacheMetric, labels("result", "miss"))
+		return false
+	}
+	tool.Task.Log.CallCache.Hit = true
+	tool.Task.Log.CallCache.Run = entry.RunID
+	metrics.inc(callCacheMetric, labels("result", "hit"))
+	tool.Task.infof("call cache hit: reusing outputs of this task from run %v", entry.RunID)
+	return true
+}
+
+// puts the outputs of the tool in the call cache - called once the outputs are collected
+func (engine *K8sEngine) cacheOutputs(tool *Tool) {
+	if engine.callCache == nil || tool.CacheKey == "" {
+		return
+	}
+	normalized, err := normalizeJSON(tool.Task.Outputs)
+	output, ok := normalized.(map[string]interface{})
+	if err != nil || !ok {
+		tool.Task.warnf("failed to put outputs in the call cache: %v", err)
+		return
+	}
+	log := tool.Task.Log
+	entry := &CallCacheEntry{
+		Key:            tool.CacheKey,
+		UserID:         engine.UserID,
+		RunID:          engine.RunID,
+		TaskID:         tool.Task.Root.ID,
+		WorkingDir:     log.WorkingDir,
+		JobName:        log.JobName,
+		ContainerImage: log.ContainerImage,
+		Command:        log.Command,
+		Output:         output,
+		Created:        timef(time.Now()),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		tool.Task.warnf("failed to marshal call cache entry: %v", err)
+		return
+	}
+	uploader := s3manager.NewUploader(engine.S3FileManager.newS3Session())
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(engine.cacheEntryKey(tool)),
+		Body:   bytes.NewReader(b),
+	})
+	if err != nil {
+		tool.Task.warnf("failed to write call cache entry: %v", err)
+		return
+	}
+
+	// the cached outputs outlive the run's intermediate file cleanup
+	engine.callCache.Lock()
+	walkFiles(entry.Output, func(f map[string]interface{}) error {
+		if path, err := filePath(f); err == nil {
+			engine.callCache.keep[path] = true
+		}
+		return nil
+	})
+	engine.callCache.Unlock()
+	tool.Task.infof("put outputs of this task in the call cache: %v", tool.CacheKey)
+}
+
+// per project for runs submitted to a project, else per user - and per user for tools with commons data inputs
+func (engine *K8sEngine) cacheEntryKey(tool *Tool) string {
+	if project := engine.Log.Request.Project; project != "" && !hasCommonsInputs(tool.Task.Log.Input) {
+		return fmt.Sprintf(projectCallCacheKeyf, project, tool.CacheKey)
+	}
+	return fmt.Sprintf(userCallCacheKeyf, engine.UserID, tool.CacheKey)
+}
+
+// true if any of the input files (or their secondaryFiles) is commons data - or if that can't be told
+func hasCommonsInputs(inputs interface{}) bool {
+	normalized, err := normalizeJSON(inputs)
+	if err != nil {
+		return true
+	}
+	commons := false
+	walkFiles(normalized, func(f map[string]interface{}) error {
+		path, err := filePath(f)
+		commons = commons || err != nil || strings.HasPrefix(path, pathToCommonsData)
+		return nil
+	})
+	return commons
+}
+
+// returns nil if there's no entry for the tool's key
+func (engine *K8sEngine) cacheEntry(tool *Tool) (*CallCacheEntry, error) {
+	downloader := s3manager.NewDownloader(engine.S3FileManager.newS3Session())
+	buf := &aws.WriteAtBuffer{}
+	_, err := downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(engine.cacheEntryKey(tool)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entry := &CallCacheEntry{}
+	if err = json.Unmarshal(buf.Bytes(), entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// gives the tool the outputs of the cache entry - returns false if they can't be had
+func (engine *K8sEngine) restoreCacheEntry(tool *Tool, entry *CallCacheEntry) bool {
+	prior := &Log{
+		Output:         entry.Output,
+		WorkingDir:     entry.WorkingDir,
+		JobName:        entry.JobName,
+		ContainerImage: entry.ContainerImage,
+		Command:        entry.Command,
+	}
+	for _, output := range tool.Task.Root.Outputs {
+		if _, ok := entry.Output[output.ID]; !ok {
+			return false
+		}
+	}
+	if entry.UserID == engine.UserID {
+		if !engine.outputFilesExist(entry.Output) {
+			tool.Task.infof("call cache entry found, but some of its output files are gone")
+			return false
+		}
+	} else {
+		// another user's outputs - copy them into this task's working dir
+		if err := engine.copyCachedOutputs(tool, entry); err != nil {
+			tool.Task.warnf("failed to copy outputs of call cache entry: %v", err)
+			return false
+		}
+		prior.WorkingDir = tool.WorkingDir
+	}
+	tool.reuse(prior)
+	return true
+}
+
+// copies the output files of another user's cache entry to this task's working dir, and points the entry's outputs at the copies
+// fixme - CopyObject only handles objects up to 5GB
+func (engine *K8sEngine) copyCachedOutputs(tool *Tool, entry *CallCacheEntry) error {
+	svc := s3.New(engine.S3FileManager.newS3Session())
+	bucket := engine.S3FileManager.S3BucketName
+	return walkFiles(entry.Output, func(f map[string]interface{}) error {
+		path, err := filePath(f)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(path, "/"+engineWorkspaceVolumeName+"/") {
+			// e.g., commons data - the same for everyone
+			return nil
+		}
+		newPath := tool.WorkingDir + filepath.Base(path)
+		if strings.HasPrefix(path, entry.WorkingDir) {
+			newPath = tool.WorkingDir + strings.TrimPrefix(path, entry.WorkingDir)
+		}
+		src := strings.TrimPrefix(engine.S3FileManager.s3Key(path, entry.UserID), "/")
+		_, err = svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			CopySource: aws.String(url.PathEscape(bucket + "/" + src)),
+			Key:        aws.String(strings.TrimPrefix(engine.localPathToS3Key(newPath), "/")),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy %v: %v", path, err)
+		}
+		for _, field := range []string{"path", "location"} {
+			if f[field] == path {
+				f[field] = newPath
+			}
+		}
+		f["dirname"] = filepath.Dir(newPath)
+		return nil
+	})
+}
+
+// calls fn on every File in the json value - including secondaryFiles
+func walkFiles(val interface{}, fn func(map[string]interface{}) error) error {
+	switch v := val.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if err := walkFiles(item, fn); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if isFile(v) {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		for _, item := range v {
+			if err := walkFiles(item, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//// cache key ////
+
+// returns "" if the tool disables WorkReuse
+func (engine *K8sEngine) cacheKey(tool *Tool) (string, error) {
+	engine.callCache.Lock()
+	process, ok := engine.callCache.processes[tool.Task.Root.ID]
+	engine.callCache.Unlock()
+	if !ok {
+		return "", fmt.Errorf("tool %v not found in the packed workflow", tool.Task.Root.ID)
+	}
+	reqs := engine.effectiveRequirements(tool.Task)
+	if !workReuse(reqs) {
+		return "", nil
+	}
+
+	digest, err := engine.imageDigest(tool.dockerImage())
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest of docker image: %v", err)
+	}
+
+	inputs, err := normalizeJSON(tool.Task.Log.Input)
+	if err != nil {
+		return "", err
+	}
+	if inputs, err = engine.contentAddressed(inputs); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(struct {
+		Tool         interface{} `json:"tool"`
+		Requirements interface{} `json:"requirements"`
+		Image        string      `json:"image"`
+		Inputs       interface{} `json:"inputs"`
+	}{
+		Tool:         withoutRequirements(process),
+		Requirements: reqs.withoutResources(),
+		Image:        digest,
+		Inputs:       inputs,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// false if the WorkReuse requirement or hint in effect has enableReuse false
+// an expression for enableReuse can't be evaluated here, so that's taken as false too
+func workReuse(reqs *ProcessRequirements) bool {
+	req := reqs.find(cwlWorkReuseRequirement)
+	if req == nil {
+		return true
+	}
+	switch enable := req["enableReuse"].(type) {
+	case nil:
+		return true
+	case bool:
+		return enable
+	}
+	return false
+}
+
+// requirements and hints may be a list, or a map keyed by class
+func cwlRequirements(val interface{}) []map[string]interface{} {
+	reqs := []map[string]interface{}{}
+	switch v := val.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if req, ok := item.(map[string]interface{}); ok {
+				reqs = append(reqs, req)
+			}
+		}
+	case map[string]interface{}:
+		for class, item := range v {
+			if req, ok := item.(map[string]interface{}); ok {
+				withClass := map[string]interface{}{"class": class}
+				for k, v := range req {
+					withClass[k] = v
+				}
+				reqs = append(reqs, withClass)
+			}
+		}
+	}
+	return reqs
+}
+
+// a copy of the process without its requirements and hints - those go in the key as they're in effect, see withoutResources()
+// json.Marshal sorts map keys, so this marshals canonically
+func withoutRequirements(process map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	for k, v := range process {
+		if k != "requirements" && k != "hints" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// a copy of the requirements and hints without ResourceRequirement
+func (reqs *ProcessRequirements) withoutResources() *ProcessRequirements {
+	out := reqs.with(nil)
+	delete(out.Requirements, CWLResourceRequirement)
+	delete(out.Hints, CWLResourceRequirement)
+	return out
+}
+
+// replaces each file in the inputs with its name and the identity of its content
+// so the key doesn't depend on which run's working dir an input came from
+func (engine *K8sEngine) contentAddressed(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			addressed, err := engine.contentAddressed(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = addressed
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		if isFile(v) {
+			path, err := filePath(v)
+			if err != nil {
+				return nil, err
+			}
+			content, err := engine.contentID(path)
+			if err != nil {
+				return nil, err
+			}
+			out["class"] = CWLFileType
+			out["basename"] = filepath.Base(path)
+			out["content"] = content
+			secondary, err := engine.contentAddressed(v["secondaryFiles"])
+			if err != nil {
+				return nil, err
+			}
+			out["secondaryFiles"] = secondary
+			return out, nil
+		}
+		for k, item := range v {
+			addressed, err := engine.contentAddressed(item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = addressed
+		}
+		return out, nil
+	}
+	return val, nil
+}
+
+// commons data is identified by GUID, DRS objects by host and object ID, files in the user's space by their s3 ETag
+func (engine *K8sEngine) contentID(path string) (string, error) {
+	switch {
+	case strings.HasPrefix(path, pathToCommonsData):
+		return "guid:" + strings.TrimPrefix(path, pathToCommonsData), nil
+	case strings.Contains(path, "/"+drsInputDir+"/"):
+		// "{working dir}_mariner_drs/{host}/{object-id}/{name}"
+		return "drs:" + path[strings.Index(path, "/"+drsInputDir+"/")+len(drsInputDir)+2:], nil
+	case strings.HasPrefix(path, "/"+engineWorkspaceVolumeName+"/"):
+		svc := s3.New(engine.S3FileManager.newS3Session())
+		obj, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(engine.S3FileManager.S3BucketName),
+			Key:    aws.String(strings.TrimPrefix(engine.localPathToS3Key(path), "/")),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get etag of input file %v: %v", path, err)
+		}
+		return "etag:" + aws.StringValue(obj.ETag), nil
+	}
+	return "path:" + path, nil
+}
+
+//// docker image digests ////
+
+// resolved once per image per run
+func (engine *K8sEngine) imageDigest(image string) (string, error) {
+	engine.callCache.Lock()
+	digest, ok := engine.callCache.digests[image]
+	engine.callCache.Unlock()
+	if ok {
+		return digest, nil
+	}
+	digest, err := resolveImageDigest(image)
+	if err != nil {
+		return "", err
+	}
+	engine.callCache.Lock()
+	engine.callCache.digests[image] = digest
+	engine.callCache.Unlock()
+	return digest, nil
+}
+
+var (
+	manifestMediaTypes = []string{
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.oci.image.manifest.v1+json",
+	}
+	authParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// asks the image's registry for the digest of the image's tag
+// registries which need credentials to pull aren't supported - their images aren't cached
+func resolveImageDigest(image string) (string, error) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[i+1:], nil
+	}
+	registry, repo, tag := parseImageRef(image)
+	manifestURL := fmt.Sprintf("https://%v/v2/%v/manifests/%v", registry, repo, tag)
+	resp, err := headManifest(manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := registryToken(resp.Header.Get("Www-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		if resp, err = headManifest(manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry responded to %v with status %v", manifestURL, resp.StatusCode)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry didn't return a digest for %v", image)
+	}
+	return digest, nil
+}
+
+// "ubuntu" -> registry-1.docker.io, library/ubuntu, latest
+// "quay.io/org/tool:1.2" -> quay.io, org/tool, 1.2
+func parseImageRef(image string) (registry, repo, tag string) {
+	registry, repo, tag = dockerHubRegistry, image, "latest"
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	if parts := strings.SplitN(repo, "/", 2); len(parts) == 2 &&
+		(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, repo = parts[0], parts[1]
+	}
+	if registry == dockerHubRegistry && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return registry, repo, tag
+}
+
+func headManifest(manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set(authHeader, "Bearer "+token)
+	}
+	client := &http.Client{Timeout: registryTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error asking registry for manifest: %v", err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// gets an anonymous pull token, as the registry's auth challenge says to
+func registryToken(challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported registry auth challenge: %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, match := range authParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry auth challenge has no realm: %q", challenge)
+	}
+	query := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			query.Set(k, params[k])
+		}
+	}
+	client := &http.Client{Timeout: registryTimeout}
+	resp, err := client.Get(params["realm"] + "?" + query.Encode())
+	if err != nil {
+		return "", fmt.Errorf("error asking registry for token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token endpoint responded with status %v", resp.StatusCode)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error decoding registry token: %v", err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
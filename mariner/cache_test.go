@@ -0,0 +1,93 @@
+package mariner
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+// the requirements and hints in effect for "#tool.cwl" in inheritanceWorkflowf - see requirements_test.go
+func inheritedRequirements(t *testing.T, workflow, step, tool string) *ProcessRequirements {
+	processes, err := packedProcesses([]byte(fmt.Sprintf(inheritanceWorkflowf, workflow, step, tool)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := &K8sEngine{processes: processes}
+	main := &Task{Root: &cwl.Root{ID: mainProcessID}}
+	return engine.effectiveRequirements(&Task{Root: &cwl.Root{ID: "#tool.cwl"}, Inherited: engine.stepRequirements(main, "#main/step")})
+}
+
+func TestWorkReuse(t *testing.T) {
+	disabled := `"requirements": [{"class": "WorkReuse", "enableReuse": false}],`
+	cases := []struct {
+		name                 string
+		workflow, step, tool string
+		reuse                bool
+	}{
+		{"no WorkReuse", "", "", "", true},
+		{"disabled by the tool", "", "", disabled, false},
+		{"disabled by the workflow", disabled, "", "", false},
+		{"disabled by the step", "", disabled, "", false},
+		{"enabled by the tool over the workflow", disabled, "", `"requirements": [{"class": "WorkReuse", "enableReuse": true}],`, true},
+		{"expressions aren't evaluated", "", "", `"hints": [{"class": "WorkReuse", "enableReuse": "$(true)"}],`, false},
+	}
+	for _, c := range cases {
+		if reuse := workReuse(inheritedRequirements(t, c.workflow, c.step, c.tool)); reuse != c.reuse {
+			t.Errorf("%v: expected reuse=%v, got %v", c.name, c.reuse, reuse)
+		}
+	}
+}
+
+func TestCacheKeyRequirements(t *testing.T) {
+	envVar := func(val string) string {
+		return fmt.Sprintf(`"requirements": [{"class": "EnvVarRequirement", "envDef": [{"envName": "X", "envValue": "%v"}]}],`, val)
+	}
+	resources := func(cores int) string {
+		return fmt.Sprintf(`"hints": [{"class": "ResourceRequirement", "coresMin": %v}],`, cores)
+	}
+	cases := []struct {
+		name  string
+		a, b  [3]string // workflow, step and tool requirements
+		equal bool
+	}{
+		{"same requirements", [3]string{envVar("1"), "", ""}, [3]string{envVar("1"), "", ""}, true},
+		{"inherited EnvVar differs", [3]string{envVar("1"), "", ""}, [3]string{envVar("2"), "", ""}, false},
+		{"EnvVar from the step vs the tool", [3]string{"", envVar("1"), ""}, [3]string{"", "", envVar("1")}, true},
+		{"resources differ", [3]string{resources(1), "", ""}, [3]string{"", "", resources(4)}, true},
+	}
+	for _, c := range cases {
+		a := inheritedRequirements(t, c.a[0], c.a[1], c.a[2]).withoutResources()
+		b := inheritedRequirements(t, c.b[0], c.b[1], c.b[2]).withoutResources()
+		if reflect.DeepEqual(a, b) != c.equal {
+			t.Errorf("%v: expected equal=%v, got %v and %v", c.name, c.equal, a, b)
+		}
+	}
+}
+
+func TestHasCommonsInputs(t *testing.T) {
+	file := func(path string) map[string]interface{} {
+		return map[string]interface{}{"class": CWLFileType, "location": path}
+	}
+	userFile := "/" + engineWorkspaceVolumeName + "/workflowRuns/run-1/step/out.txt"
+	cases := []struct {
+		name    string
+		inputs  interface{}
+		commons bool
+	}{
+		{"no files", map[string]interface{}{"n": 1.0}, false},
+		{"user file", map[string]interface{}{"f": file(userFile)}, false},
+		{"commons file", map[string]interface{}{"f": file(pathToCommonsData + "guid-1")}, true},
+		{"commons file in an array", map[string]interface{}{"fs": []interface{}{file(userFile), file(pathToCommonsData + "guid-1")}}, true},
+		{"commons secondary file", map[string]interface{}{"f": map[string]interface{}{
+			"class": CWLFileType, "location": userFile, "secondaryFiles": []interface{}{file(pathToCommonsData + "guid-2")},
+		}}, true},
+		{"file without a path", map[string]interface{}{"f": map[string]interface{}{"class": CWLFileType}}, true},
+	}
+	for _, c := range cases {
+		if commons := hasCommonsInputs(c.inputs); commons != c.commons {
+			t.Errorf("%v: expected %v, got %v", c.name, c.commons, commons)
+		}
+	}
+}
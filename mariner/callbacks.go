@@ -0,0 +1,383 @@
+package mariner
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// this file contains code for completion webhooks
+// a workflow request may list callbacks - URLs which get POSTed a summary of the run when it finishes
+// the body is signed with the callback's secret, along with the time it was sent - so receivers can turn away replays:
+// header "X-Mariner-Timestamp: <unix seconds>"
+// header "X-Mariner-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">"
+// every delivery attempt is recorded in the run log
+//
+// the secrets aren't kept in the request or the run log, which users can read back -
+// the server takes them out of the request, into their own file in the run's directory, see startRun()
+// ----- if that file can't be read, the callbacks aren't sent - unsigned, they'd look like forgeries to the receiver
+//
+// the server and the engine make the requests from inside the cluster, so callbacks can't point at anything internal:
+// - loopback, private and link-local addresses are turned away, as are cluster hostnames (no dots, ".svc", ".local", ".internal")
+// - the "callbacks" config may list the only hosts which may be called back, and/or hosts which may not, see CallbacksConfig
+// ----- the url is checked when the request is validated, and again when it's sent - the address it resolves to, and every redirect
+
+const (
+	signatureHeader = "X-Mariner-Signature"
+	timestampHeader = "X-Mariner-Timestamp"
+
+	// the callback secrets of a run, by callback index - "/$USER_ID/workflowRuns/$RUN_ID/callbackSecrets.json"
+	callbackSecretsFile = "callbackSecrets.json"
+
+	maxCallbackAttempts   = 5
+	callbackBackoff       = 2 * time.Second // doubles after each failed attempt
+	callbackClientTimeout = 10 * time.Second
+)
+
+// CallbacksConfig restricts the hosts callbacks may go to, e.g.,
+//
+//	"callbacks": {"allowed_hosts": ["hooks.example.org"], "denied_hosts": ["internal.example.org"]}
+//
+// hosts are matched exactly, without the port
+// no allowed hosts means any host which isn't denied (or internal)
+type CallbacksConfig struct {
+	AllowedHosts []string `json:"allowed_hosts"`
+	DeniedHosts  []string `json:"denied_hosts"`
+}
+
+// true if callbacks may go to the host
+func (config *CallbacksConfig) allowed(host string) bool {
+	for _, denied := range config.DeniedHosts {
+		if strings.EqualFold(host, denied) {
+			return false
+		}
+	}
+	if len(config.AllowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range config.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopback, private, link-local (e.g., the cloud metadata service) and other addresses which aren't on the internet
+var internalNetworks = func() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func internalIP(ip net.IP) bool {
+	for _, n := range internalNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if the hostname (or IP) may only mean something inside the cluster
+func internalHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return internalIP(ip)
+	}
+	if !strings.Contains(host, ".") {
+		// e.g., "localhost", or a service in the same namespace
+		return true
+	}
+	for _, suffix := range []string{".svc", ".svc.cluster.local", ".cluster.local", ".local", ".localhost", ".internal"} {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns an error if the url isn't an absolute http(s) url, or if callbacks may not go to its host
+func checkCallbackURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("invalid url %q - must be an absolute http(s) url", rawURL)
+	}
+	if internalHost(u.Hostname()) {
+		return fmt.Errorf("host %v is internal", u.Hostname())
+	}
+	if Config != nil && !Config.Callbacks.allowed(u.Hostname()) {
+		return fmt.Errorf("host %v is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// a client which won't connect to internal addresses, whatever the hostname resolved to, nor follow redirects to disallowed urls
+func callbackClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: callbackClientTimeout,
+		// called with the resolved address, right before connecting
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return fmt.Errorf("callback address %v is internal", address)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   callbackClientTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return checkCallbackURL(req.URL.String())
+		},
+	}
+}
+
+// Callback is a URL to notify when the run finishes
+type Callback struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// CallbackJSON is what gets POSTed to each callback URL
+type CallbackJSON struct {
+	RunID     string                 `json:"run_id"`
+	State     string                 `json:"state"`
+	StartTime string                 `json:"start_time"`
+	EndTime   string                 `json:"end_time"`
+	Duration  float64                `json:"duration"`
+	Tags      map[string]string      `json:"tags"`
+	Outputs   map[string]interface{} `json:"outputs"`
+}
+
+// CallbackLog records the delivery attempts for one callback
+type CallbackLog struct {
+	URL       string             `json:"url"`
+	Delivered bool               `json:"delivered"`
+	Attempts  []*CallbackAttempt `json:"attempts"`
+}
+
+// CallbackAttempt ..
+type CallbackAttempt struct {
+	Time       string `json:"time"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// waits for the final state of the run, then notifies the callbacks
+func (engine *K8sEngine) notifyCallbacksOnFinish(events <-chan *Event, done chan<- struct{}) {
+	defer close(done)
+	for e := range events {
+		if e.final() {
+			engine.notifyCallbacks()
+		}
+	}
+}
+
+func (engine *K8sEngine) notifyCallbacks() {
+	if engine.Log.Request == nil || len(engine.Log.Request.Callbacks) == 0 {
+		return
+	}
+	secrets, err := fetchCallbackSecrets(engine.S3FileManager, engine.UserID, engine.RunID)
+	if err != nil {
+		engine.warnf("failed to fetch callback secrets - not notifying callbacks: %v", err)
+	}
+	callbacks := notifyCallbacks(engine.RunID, engine.Log, secrets, err)
+	engine.Log.Lock()
+	engine.Log.Callbacks = callbacks
+	engine.Log.Unlock()
+	engine.writeLogToS3()
+}
+
+// POSTs the run summary to each callback - returns a log of the attempts
+// secrets are by callback index, see fetchCallbackSecrets() - if they couldn't be fetched (secretsErr), nothing gets sent
+func notifyCallbacks(runID string, runLog *MainLog, secrets []string, secretsErr error) []*CallbackLog {
+	if secretsErr != nil {
+		logs := []*CallbackLog{}
+		for _, callback := range runLog.Request.Callbacks {
+			logs = append(logs, &CallbackLog{URL: callback.URL, Attempts: []*CallbackAttempt{{
+				Time:  ts(),
+				Error: fmt.Sprintf("not sent - failed to fetch callback secrets: %v", secretsErr),
+			}}})
+		}
+		return logs
+	}
+	summary := runSummaryJSON(runID, runLog)
+	body, err := json.Marshal(&CallbackJSON{
+		RunID:     runID,
+		State:     summary.State,
+		StartTime: summary.StartTime,
+		EndTime:   summary.EndTime,
+		Duration:  runLog.Main.Stats.Duration,
+		Tags:      summary.Tags,
+		Outputs:   wesOutputs(runLog.Main.Output),
+	})
+	if err != nil {
+		fmt.Println("failed to marshal callback body: ", err)
+		return nil
+	}
+	logs := []*CallbackLog{}
+	for i, callback := range runLog.Request.Callbacks {
+		secret := ""
+		if i < len(secrets) {
+			secret = secrets[i]
+		}
+		logs = append(logs, callback.notify(body, secret))
+	}
+	return logs
+}
+
+// retries with exponential backoff on connection errors, 5xx and 429
+func (callback *Callback) notify(body []byte, secret string) *CallbackLog {
+	log := &CallbackLog{URL: callback.URL, Attempts: []*CallbackAttempt{}}
+	if err := checkCallbackURL(callback.URL); err != nil {
+		log.Attempts = append(log.Attempts, &CallbackAttempt{Time: ts(), Error: err.Error()})
+		return log
+	}
+	client := callbackClient()
+	backoff := callbackBackoff
+	for i := 0; i < maxCallbackAttempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		attempt := &CallbackAttempt{Time: ts()}
+		log.Attempts = append(log.Attempts, attempt)
+
+		req, err := http.NewRequest("POST", callback.URL, bytes.NewReader(body))
+		if err != nil {
+			attempt.Error = err.Error()
+			return log
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(timestampHeader, timestamp)
+			req.Header.Set(signatureHeader, "sha256="+sign(timestamp, body, secret))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			attempt.Error = err.Error()
+			continue
+		}
+		resp.Body.Close()
+		attempt.StatusCode = resp.StatusCode
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			log.Delivered = true
+			return log
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			continue
+		default:
+			// the receiver rejected it - retrying won't help
+			return log
+		}
+	}
+	return log
+}
+
+// hex HMAC-SHA256 of "<timestamp>.<body>"
+func sign(timestamp string, body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// takes the secrets out of the request's callbacks - returns them by callback index, nil if there are none
+func (r *WorkflowRequest) takeCallbackSecrets() []string {
+	secrets := make([]string, len(r.Callbacks))
+	signed := false
+	for i, callback := range r.Callbacks {
+		if callback.Secret != "" {
+			secrets[i], callback.Secret = callback.Secret, ""
+			signed = true
+		}
+	}
+	if !signed {
+		return nil
+	}
+	return secrets
+}
+
+// puts the secrets back on the request's callbacks - e.g., for a resumed run, see resume.go
+func (r *WorkflowRequest) restoreCallbackSecrets(secrets []string) {
+	for i := 0; i < len(secrets) && i < len(r.Callbacks); i++ {
+		r.Callbacks[i].Secret = secrets[i]
+	}
+}
+
+func writeCallbackSecrets(fm *S3FileManager, userID, runID string, secrets []string) error {
+	b, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(fm.newS3Session())
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(fm.S3BucketName),
+		Key:    aws.String(fmt.Sprintf("/%s/workflowRuns/%s/%s", userID, runID, callbackSecretsFile)),
+		Body:   bytes.NewReader(b),
+	})
+	return err
+}
+
+// returns nil if the run's callbacks have no secrets
+func fetchCallbackSecrets(fm *S3FileManager, userID, runID string) ([]string, error) {
+	svc := s3.New(fm.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(fm.S3BucketName),
+		Key:    aws.String(fmt.Sprintf("/%s/workflowRuns/%s/%s", userID, runID, callbackSecretsFile)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	b, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []string{}
+	if err = json.Unmarshal(b, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// the server's side of fetchCallbackSecrets()
+func (server *Server) callbackSecrets(userID, runID string) ([]string, error) {
+	secrets, err := fetchCallbackSecrets(server.S3FileManager, userID, runID)
+	if err != nil {
+		fmt.Println("error fetching callback secrets: ", err)
+	}
+	return secrets, err
+}
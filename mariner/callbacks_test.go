@@ -0,0 +1,117 @@
+package mariner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"run_id":"run-1","state":"COMPLETE"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	cases := []struct {
+		name      string
+		timestamp string
+		body      []byte
+		secret    string
+		match     bool
+	}{
+		{"same timestamp, body and secret", "1700000000", body, "secret", true},
+		{"other timestamp", "1700000001", body, "secret", false},
+		{"other body", "1700000000", []byte(`{"run_id":"run-1","state":"CANCELED"}`), "secret", false},
+		{"other secret", "1700000000", body, "secret2", false},
+		{"timestamp moved into the body", "170000000", []byte("0." + string(body)), "secret", false},
+	}
+	for _, c := range cases {
+		if got := sign(c.timestamp, c.body, c.secret); (got == expected) != c.match {
+			t.Errorf("%v: expected match=%v, got signature %v", c.name, c.match, got)
+		}
+	}
+}
+
+func TestTakeCallbackSecrets(t *testing.T) {
+	cases := []struct {
+		name      string
+		callbacks []*Callback
+		secrets   []string
+	}{
+		{"no callbacks", nil, nil},
+		{"no secrets", []*Callback{{URL: "https://a"}, {URL: "https://b"}}, nil},
+		{"some secrets", []*Callback{{URL: "https://a"}, {URL: "https://b", Secret: "s"}}, []string{"", "s"}},
+	}
+	for _, c := range cases {
+		r := &WorkflowRequest{Callbacks: c.callbacks}
+		secrets := r.takeCallbackSecrets()
+		if !reflect.DeepEqual(secrets, c.secrets) {
+			t.Errorf("%v: expected secrets %v, got %v", c.name, c.secrets, secrets)
+		}
+		for i, callback := range r.Callbacks {
+			if callback.Secret != "" {
+				t.Errorf("%v: callback %v kept its secret", c.name, i)
+			}
+		}
+		r.restoreCallbackSecrets(secrets)
+		for i, callback := range r.Callbacks {
+			if i < len(c.secrets) && callback.Secret != c.secrets[i] {
+				t.Errorf("%v: callback %v: expected secret %q after restoring, got %q", c.name, i, c.secrets[i], callback.Secret)
+			}
+		}
+	}
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	cases := []struct {
+		name    string
+		config  CallbacksConfig
+		url     string
+		allowed bool
+	}{
+		{"public host", CallbacksConfig{}, "https://hooks.example.org/mariner", true},
+		{"public host with a port", CallbacksConfig{}, "http://hooks.example.org:8080/", true},
+		{"public ip", CallbacksConfig{}, "https://8.8.8.8/", true},
+		{"not http", CallbacksConfig{}, "ftp://hooks.example.org/", false},
+		{"relative url", CallbacksConfig{}, "/mariner", false},
+		{"localhost", CallbacksConfig{}, "http://localhost:8000/", false},
+		{"loopback ip", CallbacksConfig{}, "http://127.0.0.1/", false},
+		{"ipv6 loopback", CallbacksConfig{}, "http://[::1]/", false},
+		{"private ip", CallbacksConfig{}, "http://10.1.2.3/", false},
+		{"link-local ip - metadata service", CallbacksConfig{}, "http://169.254.169.254/latest/meta-data/", false},
+		{"service in the namespace", CallbacksConfig{}, "http://fence-service/", false},
+		{"service in another namespace", CallbacksConfig{}, "http://fence-service.default.svc/", false},
+		{"service fqdn", CallbacksConfig{}, "http://fence-service.default.svc.cluster.local./", false},
+		{"allowed host", CallbacksConfig{AllowedHosts: []string{"hooks.example.org"}}, "https://HOOKS.example.org/", true},
+		{"host not allowed", CallbacksConfig{AllowedHosts: []string{"hooks.example.org"}}, "https://other.example.org/", false},
+		{"allowed host can't be internal", CallbacksConfig{AllowedHosts: []string{"127.0.0.1"}}, "http://127.0.0.1/", false},
+		{"denied host", CallbacksConfig{DeniedHosts: []string{"hooks.example.org"}}, "https://hooks.example.org/", false},
+		{"host not denied", CallbacksConfig{DeniedHosts: []string{"hooks.example.org"}}, "https://other.example.org/", true},
+	}
+	for _, c := range cases {
+		Config = &MarinerConfig{Callbacks: c.config}
+		if err := checkCallbackURL(c.url); (err == nil) != c.allowed {
+			t.Errorf("%v: expected allowed=%v, got error %v", c.name, c.allowed, err)
+		}
+	}
+}
+
+func TestNotifyCallbacksWithoutSecrets(t *testing.T) {
+	runLog := &MainLog{
+		Main:    &Log{Output: map[string]interface{}{}},
+		Request: &WorkflowRequest{Callbacks: []*Callback{{URL: "https://a.example.org"}, {URL: "https://b.example.org"}}},
+	}
+	logs := notifyCallbacks("run-1", runLog, nil, fmt.Errorf("access denied"))
+	if len(logs) != 2 {
+		t.Fatalf("expected a log for each callback, got %v", logs)
+	}
+	for i, log := range logs {
+		if log.Delivered || len(log.Attempts) != 1 || log.Attempts[0].Error == "" || log.Attempts[0].StatusCode != 0 {
+			t.Errorf("callback %v: expected one failed attempt, got %+v", i, log)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for cancelling runs
+//
+// POST /runs/{runID}/cancel doesn't kill anything itself - it writes a cancel request,
+// "{userID}/workflowRuns/{runID}/cancel", which the engine watches for. Once the engine sees it, the engine
+// - stops dispatching tasks
+// - deletes its task jobs - every job and pod of a run carries the label "mariner-run={runID}", see jobSpec()
+// - waits until the run's task pods are gone, then marks the run (and every unfinished task) cancelled
+//
+// the run is CANCELING from the request until the engine is done, then CANCELED
+//
+// as a backstop, the server keeps a ref of each cancel request, "_mariner/cancelRequests/{runID}/{userID}",
+// and sweeps those runs periodically:
+// - runs which finished get any leftover jobs deleted
+// - runs whose engine hasn't finished cancelling within cancelGracePeriod (e.g., the engine is gone or stuck)
+// ----- get all their jobs (engine included) deleted by label, and get marked cancelled by the server once no pods remain
+// refs live in s3, so the sweep picks up where it left off if the server restarts
+
+const (
+	cancelFile           = "cancel"
+	cancelRequestsPrefix = "_mariner/cancelRequests/"
+
+	// every job and pod of a run is labelled with the runID
+	runIDLabel = "mariner-run"
+
+	// how often the engine checks for a cancel request
+	cancelPollPeriod = 10 * time.Second
+
+	// how long the engine waits for its task pods to go away before giving up on them
+	cancelPodsTimeout = 10 * time.Minute
+
+	// the server's sweep
+	cancelSweepPeriod = 30 * time.Second
+	cancelGracePeriod = 5 * time.Minute
+
+	// seconds task pods get to shut down
+	cancelJobGracePeriod = 30
+)
+
+// CancelRequestJSON is the cancel request the engine watches for
+type CancelRequestJSON struct {
+	RequestedBy string `json:"requested_by"`
+	Requested   string `json:"requested"`
+}
+
+func cancelKey(userID, runID string) string {
+	return fmt.Sprintf(pathToUserRunsf, userID) + runID + "/" + cancelFile
+}
+
+//// server ////
+
+// queued runs are cancelled right away, finished runs are left alone
+// otherwise the cancel request gets written for the engine to pick up
+func (server *Server) cancelRun(userID, runID, callerID string) (*RunIDJSON, error) {
+	j := &RunIDJSON{RunID: runID}
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err == errRunNotFound {
+		// no log yet - the run may be queued, see quota.go
+		wasQueued, qErr := server.cancelQueuedRun(userID, runID)
+		if qErr != nil {
+			return j, qErr
+		}
+		if wasQueued {
+			return j, nil
+		}
+	}
+	if err != nil {
+		return j, err
+	}
+	if finishedStatus(runLog.Main.Status) {
+		fmt.Printf("run %v is already %v - nothing to cancel\n", runID, runLog.Main.Status)
+		return j, nil
+	}
+
+	fmt.Println("requesting cancellation of run: ", runID)
+	cancelRequest := &CancelRequestJSON{
+		RequestedBy: callerID,
+		Requested:   timef(time.Now()),
+	}
+	b, err := json.Marshal(cancelRequest)
+	if err != nil {
+		return j, err
+	}
+	svc := s3.New(server.S3FileManager.newS3Session())
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(server.S3FileManager.S3BucketName),
+		Key:         aws.String(cancelKey(userID, runID)),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return j, fmt.Errorf("failed to write cancel request: %v", err)
+	}
+	if err = server.putRunRef(cancelRequestsPrefix, userID, runID); err != nil {
+		// the engine still sees the request - the run just isn't swept if the engine doesn't
+		fmt.Println("error writing cancel request ref: ", err)
+	}
+	return j, nil
+}
+
+func (server *Server) fetchCancelRequest(userID, runID string) (*CancelRequestJSON, error) {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(cancelKey(userID, runID)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errRunNotFound
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	cancelRequest := &CancelRequestJSON{}
+	if err = json.NewDecoder(obj.Body).Decode(cancelRequest); err != nil {
+		return nil, err
+	}
+	return cancelRequest, nil
+}
+
+// the run log is written by the engine, which may not have seen the cancel request yet -
+// so an unfinished run with a cancel request is reported as canceling
+func (server *Server) checkCanceling(userID, runID string, runLog *MainLog) {
+	if finishedStatus(runLog.Main.Status) || runLog.Main.Status == canceling {
+		return
+	}
+	if _, err := server.fetchCancelRequest(userID, runID); err == nil {
+		runLog.Main.Status = canceling
+	}
+}
+
+// background process which sees every cancel request through, see the top of this file
+func (server *Server) sweepCancelledRuns() {
+	for {
+		time.Sleep(cancelSweepPeriod)
+		refs, err := server.listRunRefs(cancelRequestsPrefix, "")
+		if err != nil {
+			fmt.Println("error listing cancel requests: ", err)
+			continue
+		}
+		for _, ref := range refs {
+			if err = server.sweepCancelledRun(ref.UserID, ref.RunID); err != nil {
+				fmt.Printf("error sweeping cancelled run %v: %v\n", ref.RunID, err)
+			}
+		}
+	}
+}
+
+func (server *Server) sweepCancelledRun(userID, runID string) error {
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err == errRunNotFound {
+		// the run got deleted
+		return server.deleteRunRef(cancelRequestsPrefix, userID, runID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if finishedStatus(runLog.Main.Status) {
+		// the engine is done - anything left over goes
+		gone, err := deleteRunJobsByLabel(runSelector(runID, ""))
+		if err != nil || !gone {
+			return err
+		}
+		return server.deleteRunRef(cancelRequestsPrefix, userID, runID)
+	}
+
+	cancelRequest, err := server.fetchCancelRequest(userID, runID)
+	if err != nil {
+		return err
+	}
+	requested, err := time.Parse(timefLayout, cancelRequest.Requested)
+	if err == nil && time.Since(requested) < cancelGracePeriod {
+		// the engine is on it
+		return nil
+	}
+
+	fmt.Printf("engine didn't finish cancelling run %v in time - deleting its jobs\n", runID)
+	gone, err := deleteRunJobsByLabel(runSelector(runID, ""))
+	if err != nil || !gone {
+		// next sweep
+		return err
+	}
+
+	// the engine is gone, so finishing the run log and notifying the callbacks is up to us
+	runLog.Main.Event.warn("engine didn't finish cancelling the run - the server cancelled it")
+	cancelLog(runLog)
+	if err = server.writeLog(runLog, userID, runID); err != nil {
+		return err
+	}
+	if runLog.Request != nil && len(runLog.Request.Callbacks) > 0 {
+		secrets, err := server.callbackSecrets(userID, runID)
+		runLog.Callbacks = notifyCallbacks(runID, runLog, secrets, err)
+		server.writeLog(runLog, userID, runID)
+	}
+	return server.deleteRunRef(cancelRequestsPrefix, userID, runID)
+}
+
+// marks the run, and every task which hadn't finished, cancelled
+func cancelLog(runLog *MainLog) {
+	for _, task := range runLog.ByProcess {
+		if !finishedStatus(task.Status) {
+			task.Status = cancelled
+		}
+		for _, subtask := range task.Scatter {
+			if !finishedStatus(subtask.Status) {
+				subtask.Status = cancelled
+			}
+		}
+	}
+	if !finishedStatus(runLog.Main.Status) {
+		runLog.Main.finish()
+	}
+	runLog.Main.Status = cancelled
+	runLog.Main.Event.info("run cancelled")
+}
+
+//// engine ////
+
+// true once the engine has seen a cancel request
+// NOTE: doesn't take the engine lock - it gets called with the lock held, see finishTaskLog()
+func (engine *K8sEngine) cancelRequested() bool {
+	select {
+	case <-engine.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// background process which polls for a cancel request until it sees one
+func (engine *K8sEngine) watchForCancel() {
+	svc := s3.New(engine.S3FileManager.newS3Session())
+	for {
+		_, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(engine.S3FileManager.S3BucketName),
+			Key:    aws.String(cancelKey(engine.UserID, engine.RunID)),
+		})
+		switch {
+		case err == nil:
+			engine.cancel()
+			return
+		case !isNotFound(err):
+			engine.warnf("failed to check for cancel request: %v", err)
+		}
+		time.Sleep(cancelPollPeriod)
+	}
+}
+
+// stops dispatching tasks and kills the task jobs which are running
+// the tasks which were running then fail to finish, and the run winds down - see finishCancel()
+func (engine *K8sEngine) cancel() {
+	engine.cancelOnce.Do(func() { close(engine.cancelled) })
+	engine.Log.Main.Status = canceling // #race #ok
+	engine.warnf("run cancellation requested - not dispatching any more tasks")
+	engine.writeLogToS3()
+	engine.publishRunEvent()
+	if _, err := deleteRunJobsByLabel(runSelector(engine.RunID, marinerTask)); err != nil {
+		engine.warnf("failed to delete task jobs: %v", err)
+	}
+}
+
+// once the workflow stops running - waits until the run's task pods are gone, then marks the run cancelled
+func (engine *K8sEngine) finishCancel() {
+	engine.infof("begin finish run cancellation")
+	selector := runSelector(engine.RunID, marinerTask)
+	deadline := time.Now().Add(cancelPodsTimeout)
+	for {
+		// jobs dispatched just before the engine saw the request may have slipped through the first delete
+		gone, err := deleteRunJobsByLabel(selector)
+		if err != nil {
+			engine.warnf("failed to delete task jobs: %v", err)
+		}
+		if gone {
+			break
+		}
+		if time.Now().After(deadline) {
+			engine.warnf("task pods still around after %v - leaving them to the server", cancelPodsTimeout)
+			break
+		}
+		time.Sleep(cancelPollPeriod)
+	}
+	engine.Log.Lock()
+	cancelLog(engine.Log)
+	engine.Log.Unlock()
+	engine.writeLogToS3()
+	engine.infof("end finish run cancellation")
+}
+
+//// k8s ////
+
+// selects the jobs and pods of the run - of the given component (mariner-engine, mariner-task), or all of them if ""
+func runSelector(runID, component string) string {
+	selector := fmt.Sprintf("%v=%v", runIDLabel, runID)
+	if component != "" {
+		selector += ",app=" + component
+	}
+	return selector
+}
+
+// deletes the jobs which match the selector - returns true once no pods match it either
+func deleteRunJobsByLabel(selector string) (bool, error) {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return false, err
+	}
+	_, _, podsClient, _, err := k8sClient(k8sPodAPI)
+	if err != nil {
+		return false, err
+	}
+	jobs, err := jobsClient.List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return false, err
+	}
+	deleteOption := metav1.NewDeleteOptions(cancelJobGracePeriod)
+	var deletionPropagation metav1.DeletionPropagation = "Background"
+	deleteOption.PropagationPolicy = &deletionPropagation
+	for _, job := range jobs.Items {
+		if job.DeletionTimestamp != nil {
+			// already on its way out
+			continue
+		}
+		fmt.Println("deleting job: ", job.Name)
+		if err = jobsClient.Delete(job.Name, deleteOption); err != nil {
+			fmt.Println("error deleting job: ", job.Name, err)
+		}
+	}
+	pods, err := podsClient.List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return false, err
+	}
+	return len(jobs.Items) == 0 && len(pods.Items) == 0, nil
+}
@@ -22,6 +22,15 @@ func (engine *K8sEngine) collectKeepFiles() {
 	pathToLog := fmt.Sprintf(pathToLogf, engine.RunID)
 	engine.KeepFiles[pathToLog] = true
 
+	// nor the outputs in the call cache, see cache.go
+	if engine.callCache != nil {
+		engine.callCache.Lock()
+		for path := range engine.callCache.keep {
+			engine.KeepFiles[path] = true
+		}
+		engine.callCache.Unlock()
+	}
+
 	// iterate through main workflow outputs
 	// collect paths from all file param outputs
 	var path string
@@ -70,6 +79,10 @@ func (engine *K8sEngine) basicCleanup() {
 	var parentDir string
 	runDir := fmt.Sprintf(pathToRunf, engine.RunID)
 	_ = filepath.Walk(runDir, func(path string, info os.FileInfo, err error) error {
+		// task stdout/stderr logs are kept for the task logs endpoint
+		if filepath.Base(filepath.Dir(path))+"/" == taskLogDir {
+			return nil
+		}
 		if (!info.IsDir() && !engine.KeepFiles[path]) || isEmptyDir(path) {
 			if err = os.Remove(path); err != nil {
 				engine.Log.Main.Event.warnf("failed to delete file: %v; error: %v", path, err)
@@ -276,8 +289,7 @@ func (engine *K8sEngine) monitorParamDeps(task *Task, stepID string, param strin
 	for depStepID := range condition.DependentSteps {
 		go func(task *Task, depStepID string, condition *DeleteCondition) {
 			// wait for depTask to finish
-			for !(*task.Children[depStepID].Done) {
-			}
+			task.Children[depStepID].wait()
 			// now depTask is done running - remove it from this param's dep queue
 			condition.Queue.delete(depStepID)
 		}(task, depStepID, condition)
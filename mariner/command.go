@@ -83,6 +83,7 @@ func (tool *Tool) generateCommand() (err error) {
 		cmd = append(cmd, cmdElt.Value...)
 	}
 	tool.Command = exec.Command(cmd[0], cmd[1:]...)
+	tool.Task.Log.Command = cmd
 	tool.Task.infof("end generate command")
 	return nil
 }
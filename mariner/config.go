@@ -51,6 +51,35 @@ const (
 	unknown    = "unknown"
 	success    = "success"
 	cancelled  = "cancelled"
+	canceling  = "canceling" // cancel requested, the run's jobs are being killed - see cancel.go
+	skipped    = "skipped"   // a step the task depends on failed, so the task never ran - see failure.go
+
+	// WES run states
+	// see: https://github.com/ga4gh/workflow-execution-service-schemas/blob/master/openapi/workflow_execution_service.swagger.yaml
+	stateQueued        = "QUEUED"
+	stateInitializing  = "INITIALIZING"
+	stateRunning       = "RUNNING"
+	stateComplete      = "COMPLETE"
+	stateExecutorError = "EXECUTOR_ERROR"
+	stateSystemError   = "SYSTEM_ERROR"
+	stateCanceled      = "CANCELED"
+	stateCanceling     = "CANCELING"
+	stateUnknown       = "UNKNOWN"
+
+	// WES workflow type
+	workflowTypeCWL = "CWL"
+
+	// WES workflow_engine_parameters recognized by mariner
+	manifestParam           = "manifest"
+	serviceAccountNameParam = "serviceAccountName"
+	callbacksParam          = "callbacks"
+	projectParam            = "project"
+	resumedFromParam        = "resumed_from"
+	workflowDigestParam     = "workflow_digest"
+	maxRuntimeParam         = "max_runtime"
+
+	// where to point WES clients for how to authenticate
+	authInstructionsURL = "https://github.com/uc-cdis/mariner#auth-and-user-yaml"
 
 	k8sJobAPI     = "k8sJobAPI"
 	k8sPodAPI     = "k8sPodAPI"
@@ -93,6 +122,17 @@ const (
 	// HTTP
 	authHeader = "Authorization"
 
+	// arborist - the gen3 policy engine
+	arboristAuthURL    = "http://arborist-service/auth/request"
+	arboristMappingURL = "http://arborist-service/auth/mapping"
+	arboristHealthURL  = "http://arborist-service/health"
+
+	// the mariner config, mounted from the configmap `mariner-config`
+	marinerConfigPath = "/mariner-config/mariner-config.json"
+
+	// layout of the timestamps written by timef()
+	timefLayout = "2006/1/2 15:4:5"
+
 	// metrics collection sampling period (in seconds)
 	metricsSamplingPeriod = 30
 
@@ -115,8 +155,18 @@ var (
 	mountPropagationHostToContainer = k8sv1.MountPropagationHostToContainer
 	mountPropagationBidirectional   = k8sv1.MountPropagationBidirectional
 	workflowVolumeList              = []string{engineWorkspaceVolumeName, commonsDataVolumeName, conformanceVolumeName}
+
+	// reported by the WES service-info endpoint
+	// v1.1 and v1.2 aren't supported yet - e.g., conditional steps ("when", "pickValue") don't run as the spec says
+	supportedCWLVersions         = []string{"v1.0"}
+	supportedWESVersions         = []string{"1.0.0"}
+	supportedFilesystemProtocols = []string{"s3", "gen3"}
 )
 
+// marinerVersion is set at build time
+// e.g., go build -ldflags "-X github.com/uc-cdis/mariner/mariner.marinerVersion=1.0.0"
+var marinerVersion = "dev"
+
 // for mounting aws-user-creds secret to s3sidecar
 var envVarAWSUserCreds = &k8sv1.EnvVarSource{
 	SecretKeyRef: &k8sv1.SecretKeySelector{
@@ -159,10 +209,17 @@ var k8sTolerations = []k8sv1.Toleration{
 
 // MarinerConfig ..
 type MarinerConfig struct {
-	Containers Containers `json:"containers"`
-	Jobs       Jobs       `json:"jobs"`
-	Secrets    Secrets    `json:"secrets"`
-	Storage    Storage    `json:"storage"`
+	Containers Containers      `json:"containers"`
+	Jobs       Jobs            `json:"jobs"`
+	Secrets    Secrets         `json:"secrets"`
+	Storage    Storage         `json:"storage"`
+	Auth       AuthConfig      `json:"auth"`       // see auth.go
+	Quotas     QuotaConfig     `json:"quotas"`     // see quota.go
+	CallCache  CallCacheConfig `json:"call_cache"` // see cache.go
+	Callbacks  CallbacksConfig `json:"callbacks"`  // see callbacks.go
+	DRS        DRSConfig       `json:"drs"`        // see drs.go
+	Retries    RetryConfig     `json:"retries"`    // see retry.go
+	TRS        TRSConfig       `json:"trs"`        // see trs.go
 }
 
 // Storage ..
@@ -228,6 +285,10 @@ type JobConfig struct {
 	Labels         map[string]string `json:"labels"`
 	ServiceAccount string            `json:"serviceaccount"`
 	RestartPolicy  string            `json:"restart_policy"`
+	MaxRestarts    int               `json:"max_restarts"` // engine only - see recovery.go
+
+	// service accounts which workflow requests may ask for, besides the default one above
+	AllowedServiceAccounts []string `json:"allowed_service_accounts"`
 }
 
 // Secrets ..
@@ -371,15 +432,23 @@ func (conf *JobConfig) restartPolicy() (policy k8sv1.RestartPolicy) {
 // unmarshal into go config struct FullMarinerConfig
 // path is "/mariner-config/mariner-config.json"
 func loadConfig(path string) (marinerConfig *MarinerConfig) {
-	config, err := ioutil.ReadFile(path)
+	marinerConfig, err := readConfig(path)
 	if err != nil {
-		fmt.Printf("ERROR reading in config: %v", err)
+		fmt.Printf("ERROR %v", err)
 		// log
 	}
+	return marinerConfig
+}
+
+// NOTE: the readiness check calls this too, to check that the mounted config still parses
+func readConfig(path string) (marinerConfig *MarinerConfig, err error) {
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading in config: %v", err)
+	}
 	err = json.Unmarshal(config, &marinerConfig)
 	if err != nil {
-		fmt.Printf("ERROR unmarshalling config into MarinerConfig struct: %v", err)
-		// log
+		return marinerConfig, fmt.Errorf("unmarshalling config into MarinerConfig struct: %v", err)
 	}
-	return marinerConfig
+	return marinerConfig, nil
 }
@@ -0,0 +1,344 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for deleting runs
+//
+// DELETE /runs/{runID} - deletes everything the run left behind:
+// - every s3 object under "{userID}/workflowRuns/{runID}/" - the run log, the request, task working dirs, task logs, ..
+// - the run's k8s jobs (the engine job and task jobs) and the task PVCs ("{task job name}-claim") which are still around
+// - the run's entries in the run index and the run queue
+// and leaves a tombstone - "_mariner/tombstones/{runID}/{userID}" - recording who deleted the run, and when
+//
+// only finished runs can be deleted, unless "force=true" is given - in which case the run gets cancelled first,
+// i.e., its jobs are killed without a grace period
+//
+// NOTE: runs resumed from this run, and call cache hits from it, may reference its files - those references break
+// the call cache checks that the files exist before using them, so later runs just miss the cache
+
+const (
+	tombstonePrefix = "_mariner/tombstones/"
+
+	// max keys per DeleteObjects request
+	s3DeleteBatchSize = 1000
+)
+
+// RunTombstoneJSON records a deleted run
+type RunTombstoneJSON struct {
+	RunID          string `json:"run_id"`
+	UserID         string `json:"user"`
+	Project        string `json:"project,omitempty"`
+	State          string `json:"state"` // the WES state of the run when it was deleted
+	DeletedBy      string `json:"deleted_by"`
+	Deleted        string `json:"deleted"`
+	ObjectsDeleted int    `json:"objects_deleted"`
+}
+
+// '/runs/{runID}' - DELETE
+func (server *Server) handleRunDELETE(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	force := r.URL.Query().Get("force") == "true"
+
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err == errRunNotFound {
+		// no log yet - the run may be queued, see quota.go
+		if tombstone, tErr := server.fetchTombstone(userID, runID); tErr == nil {
+			writeError(w, 410, fmt.Sprintf("run was deleted by %v at %v", tombstone.DeletedBy, tombstone.Deleted))
+			return
+		}
+		queued, qErr := server.listRunRefs(runQueuePrefix, runID+"/")
+		if qErr == nil && len(queued) > 0 {
+			if !force {
+				writeError(w, 409, "run is queued - cancel it first, or pass force=true")
+				return
+			}
+			if _, err = server.cancelQueuedRun(userID, runID); err == nil {
+				runLog, err = server.fetchMainLog(userID, runID)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println("error fetching run log: ", err)
+		writeRunError(w, err, "failed to fetch run log")
+		return
+	}
+
+	state := runState(runLog)
+	if !finishedStatus(runLog.Main.Status) {
+		if !force {
+			writeError(w, 409, fmt.Sprintf("run is %v - cancel it first, or pass force=true", state))
+			return
+		}
+		server.killRun(runLog, runID)
+		state = stateCanceled
+	}
+
+	tombstone, err := server.deleteRun(runLog, userID, runID)
+	if err != nil {
+		fmt.Println("error deleting run: ", err)
+		writeError(w, 500, fmt.Sprintf("failed to delete run: %v", err))
+		return
+	}
+	tombstone.State = state
+	tombstone.DeletedBy = server.userID(r)
+	if err = server.writeTombstone(tombstone); err != nil {
+		fmt.Println("error writing tombstone: ", err)
+	}
+	writeJSON(w, tombstone)
+}
+
+// force=true - kills the run's jobs right away, and lets the callbacks know the run was cancelled
+// unlike cancelRun(), nothing gets written back to the run log - it's about to be deleted
+func (server *Server) killRun(runLog *MainLog, runID string) {
+	fmt.Println("killing run before deleting it: ", runID)
+	if err := deleteRunJobs(runLog, runID, 0); err != nil {
+		fmt.Println("error killing run jobs: ", err)
+	}
+	// task jobs the run log doesn't know about yet
+	if _, err := deleteRunJobsByLabel(runSelector(runID, "")); err != nil {
+		fmt.Println("error killing run jobs: ", err)
+	}
+	runLog.Main.Status = cancelled
+	if runLog.Request != nil && len(runLog.Request.Callbacks) > 0 {
+		// the secrets are fetched before the run's files get deleted
+		secrets, err := server.callbackSecrets(runLog.Request.UserID, runID)
+		go notifyCallbacks(runID, runLog, secrets, err)
+	}
+}
+
+// deletes the run's jobs, PVCs, s3 objects and refs - attempts everything, and returns the errors at the end
+func (server *Server) deleteRun(runLog *MainLog, userID, runID string) (*RunTombstoneJSON, error) {
+	errs := []string{}
+	tombstone := &RunTombstoneJSON{
+		RunID:   runID,
+		UserID:  userID,
+		Deleted: timef(time.Now()),
+	}
+	if runLog.Request != nil {
+		tombstone.Project = runLog.Request.Project
+	}
+
+	// jobs which finished are normally cleaned up by the jobs monitor - whatever is still around goes now
+	if err := deleteRunJobs(runLog, runID, 120); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to delete jobs: %v", err))
+	}
+	// jobs the run log doesn't know about - e.g., the engine crashed before logging them
+	if _, err := deleteRunJobsByLabel(runSelector(runID, "")); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to delete jobs by label: %v", err))
+	}
+	if err := deleteRunPVCs(runLog); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to delete PVCs: %v", err))
+	}
+
+	n, err := server.deleteS3Prefix(fmt.Sprintf(pathToUserRunsf, userID) + runID + "/")
+	tombstone.ObjectsDeleted = n
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("failed to delete s3 objects: %v", err))
+	}
+
+	if err = server.deleteRunIndex(runID); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove run from run index: %v", err))
+	}
+	if err = server.deleteRunRef(runQueuePrefix, userID, runID); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove run from run queue: %v", err))
+	}
+	if err = server.deleteRunRef(cancelRequestsPrefix, userID, runID); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove cancel request: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return tombstone, fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return tombstone, nil
+}
+
+// the engine job's name is the runID, and task job names are in the run log
+// ----- including those of scattered subtasks, and of each attempt of a task which got retried, see retry.go
+func runJobNames(runLog *MainLog, runID string) map[string]bool {
+	names := map[string]bool{runID: true}
+	addLogJobNames(runLog.Main, names)
+	for _, task := range runLog.ByProcess {
+		addLogJobNames(task, names)
+	}
+	return names
+}
+
+func addLogJobNames(log *Log, names map[string]bool) {
+	if log == nil {
+		return
+	}
+	if log.JobName != "" {
+		names[log.JobName] = true
+	}
+	for _, attempt := range log.Attempts {
+		if attempt.JobName != "" {
+			names[attempt.JobName] = true
+		}
+	}
+	for _, subtask := range log.Scatter {
+		addLogJobNames(subtask, names)
+	}
+}
+
+// deletes the run's jobs which still exist - engine job first, so it can't dispatch any more task jobs
+func deleteRunJobs(runLog *MainLog, runID string, gracePeriodSeconds int64) error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	jobs, err := listMarinerJobs(jobsClient)
+	if err != nil {
+		return err
+	}
+	names := runJobNames(runLog, runID)
+	deleteOption := metav1.NewDeleteOptions(gracePeriodSeconds)
+	var deletionPropagation metav1.DeletionPropagation = "Background"
+	deleteOption.PropagationPolicy = &deletionPropagation
+
+	errs := []string{}
+	del := func(name string) {
+		fmt.Println("deleting job: ", name)
+		if err := jobsClient.Delete(name, deleteOption); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+	for _, job := range jobs {
+		if job.Name == runID {
+			del(job.Name)
+		}
+	}
+	for _, job := range jobs {
+		if names[job.Name] && job.Name != runID {
+			del(job.Name)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// task PVCs are named "{task job name}-claim", see k8s.go
+func deleteRunPVCs(runLog *MainLog) error {
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		return err
+	}
+	pvcs := coreClient.PersistentVolumeClaims(os.Getenv("GEN3_NAMESPACE"))
+	list, err := pvcs.List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	claims := make(map[string]bool)
+	for name := range runJobNames(runLog, "") {
+		if name != "" {
+			claims[fmt.Sprintf("%s-claim", name)] = true
+		}
+	}
+	errs := []string{}
+	for _, pvc := range list.Items {
+		if !claims[pvc.Name] {
+			continue
+		}
+		fmt.Println("deleting PVC: ", pvc.Name)
+		if err = pvcs.Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", pvc.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// deletes every object under the prefix, in batches - returns how many objects got deleted
+func (server *Server) deleteS3Prefix(prefix string) (int, error) {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	deleted := 0
+	var deleteErr error
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(server.S3FileManager.S3BucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(s3DeleteBatchSize),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := []*s3.ObjectIdentifier{}
+		for _, obj := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: obj.Key})
+		}
+		out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(server.S3FileManager.S3BucketName),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			deleteErr = err
+			return false
+		}
+		deleted += len(objects) - len(out.Errors)
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			deleteErr = fmt.Errorf("failed to delete %v objects, e.g., %v: %v", len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, deleteErr
+}
+
+//// tombstones ////
+
+func tombstoneKey(userID, runID string) string {
+	return tombstonePrefix + runID + "/" + userID
+}
+
+func (server *Server) writeTombstone(tombstone *RunTombstoneJSON) error {
+	b, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(server.S3FileManager.newS3Session())
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(server.S3FileManager.S3BucketName),
+		Key:         aws.String(tombstoneKey(tombstone.UserID, tombstone.RunID)),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (server *Server) fetchTombstone(userID, runID string) (*RunTombstoneJSON, error) {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(tombstoneKey(userID, runID)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errRunNotFound
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	tombstone := &RunTombstoneJSON{}
+	if err = json.NewDecoder(obj.Body).Decode(tombstone); err != nil {
+		return nil, err
+	}
+	return tombstone, nil
+}
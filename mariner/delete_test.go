@@ -0,0 +1,40 @@
+package mariner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRunJobNames(t *testing.T) {
+	cases := []struct {
+		name     string
+		runLog   *MainLog
+		expected []string
+	}{
+		{"engine job only", &MainLog{Main: &Log{}}, []string{"run-1"}},
+		{"tasks", &MainLog{Main: &Log{}, ByProcess: map[string]*Log{
+			"#main/a": {JobName: "task-a"}, "#main/b": {}},
+		}, []string{"run-1", "task-a"}},
+		{"scattered subtasks", &MainLog{Main: &Log{}, ByProcess: map[string]*Log{
+			"#main/a": {Scatter: map[int]*Log{1: {JobName: "task-a-1"}, 2: {JobName: "task-a-2"}}},
+		}}, []string{"run-1", "task-a-1", "task-a-2"}},
+		{"nested scatter", &MainLog{Main: &Log{}, ByProcess: map[string]*Log{
+			"#main/a": {Scatter: map[int]*Log{1: {Scatter: map[int]*Log{1: {JobName: "task-a-1-1"}}}}},
+		}}, []string{"run-1", "task-a-1-1"}},
+		{"retried task", &MainLog{Main: &Log{}, ByProcess: map[string]*Log{
+			"#main/a": {JobName: "task-a-2", Attempts: []*AttemptLog{{JobName: "task-a-1"}, {JobName: "task-a-2"}}},
+		}}, []string{"run-1", "task-a-1", "task-a-2"}},
+		{"retried subtask", &MainLog{Main: &Log{}, ByProcess: map[string]*Log{
+			"#main/a": {Scatter: map[int]*Log{1: {Attempts: []*AttemptLog{{JobName: "task-a-1"}}}}},
+		}}, []string{"run-1", "task-a-1"}},
+	}
+	for _, c := range cases {
+		expected := map[string]bool{}
+		for _, name := range c.expected {
+			expected[name] = true
+		}
+		if names := runJobNames(c.runLog, "run-1"); !reflect.DeepEqual(names, expected) {
+			t.Errorf("%v: expected %v, got %v", c.name, expected, names)
+		}
+	}
+}
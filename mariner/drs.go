@@ -0,0 +1,310 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// this file contains code for File inputs which live in a GA4GH Data Repository Service (DRS), e.g., another commons
+// see https://github.com/ga4gh/data-repository-service-schemas
+//
+// a File input's location may be a DRS URI:
+// - "drs://{host}/{object-id}" - the object is at "https://{host}/ga4gh/drs/v1/objects/{object-id}"
+// - "drs://{prefix}:{accession}" (compact) - the host comes from "drs.prefixes" in the config,
+// ----- else the URI gets resolved by the identifiers resolver, "drs.resolver" in the config (n2t.net by default)
+//
+// the engine fetches the object when it sets up the task, and lists it in the task's input file list
+// ----- the access URL is fetched last thing before the task's job gets created - signed URLs expire, and the task may wait on its quota,
+// ----- see dispatchTaskJob(). A retried task is set up again, so it gets a new access URL too
+// the sidecar downloads it into the task working dir - "{working dir}_mariner_drs/{host}/{object-id}/{name}" -
+// and checks it against the object's checksums. If that fails, the task command fails instead of running
+//
+// the engine only talks to the DRS servers in "drs.allowed_hosts" or "drs.prefixes" - it runs inside the cluster, so it mustn't be pointed anywhere else
+// ----- that goes for the servers compact identifiers resolve to, and for redirects too
+//
+// fixme - no credentials get passed to the DRS server, so only public objects (or objects with signed access URLs) work
+// fixme - secondaryFiles of DRS inputs aren't supported
+
+const (
+	drsPrefix      = "drs://"
+	drsAPIBasePath = "/ga4gh/drs/v1"
+	drsInputDir    = "_mariner_drs"
+
+	defaultDRSResolver = "https://n2t.net/"
+
+	drsTimeout         = 30 * time.Second
+	drsMaxResponseSize = 1 << 20 // 1MiB
+)
+
+// "drs://dg.4503:abc" or "drs://provider/dg.4503:abc"
+var compactDRSPattern = regexp.MustCompile(`^([A-Za-z0-9._-]+/)?([A-Za-z0-9._]+):([^/]+)$`)
+
+// DRSConfig ..
+// hosts are matched exactly - give the port too, if the DRS server isn't on the default one
+type DRSConfig struct {
+	Prefixes     map[string]string `json:"prefixes"`      // compact identifier prefix -> DRS host
+	Resolver     string            `json:"resolver"`      // resolves compact identifiers with no entry in Prefixes
+	AllowedHosts []string          `json:"allowed_hosts"` // DRS hosts, besides those in Prefixes
+}
+
+// true if the host is an allowed DRS server
+func (config *DRSConfig) allowed(host string) bool {
+	for _, allowed := range config.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	for _, allowed := range config.Prefixes {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// DRSInput is a DRS object for the sidecar to download, in the task's input file list
+// the sidecar has its own copy of this type
+type DRSInput struct {
+	URI       string         `json:"uri"`
+	Path      string         `json:"path"` // where the task sees the file
+	URL       string         `json:"url"`  // the access URL
+	Headers   []string       `json:"headers,omitempty"`
+	Size      int64          `json:"size"`
+	Checksums []*DRSChecksum `json:"checksums"`
+
+	objectURL string
+}
+
+// DRSChecksum ..
+type DRSChecksum struct {
+	Checksum string `json:"checksum"`
+	Type     string `json:"type"`
+}
+
+// DrsObject in the DRS API - bundles aren't supported
+type drsObject struct {
+	ID            string             `json:"id"`
+	Name          string             `json:"name"`
+	Size          int64              `json:"size"`
+	Checksums     []*DRSChecksum     `json:"checksums"`
+	AccessMethods []*drsAccessMethod `json:"access_methods"`
+	Contents      []json.RawMessage  `json:"contents"`
+}
+
+type drsAccessMethod struct {
+	Type      string        `json:"type"`
+	AccessID  string        `json:"access_id"`
+	AccessURL *drsAccessURL `json:"access_url"`
+}
+
+type drsAccessURL struct {
+	URL     string   `json:"url"`
+	Headers []string `json:"headers"`
+}
+
+// resolves the DRS object, points the file to where the sidecar will put it, and adds it to the tool's input file list
+// the access URL gets filled in when the job is about to be created, see resolveDRSAccess()
+func (tool *Tool) drsInput(obj *File) error {
+	uri := obj.Location
+	tool.Task.infof("begin resolve DRS object: %v", uri)
+	host, objectURL, err := drsObjectURL(uri)
+	if err != nil {
+		return tool.Task.errorf("%v", err)
+	}
+	object := &drsObject{}
+	if err = drsGet(drsClient(), objectURL, object); err != nil {
+		return tool.Task.errorf("failed to fetch DRS object %v: %v", uri, err)
+	}
+	if len(object.Contents) > 0 {
+		return tool.Task.errorf("DRS object %v is a bundle - bundles aren't supported", uri)
+	}
+
+	name := filepath.Base(object.Name)
+	if object.Name == "" || name == "." || name == ".." || name == "/" {
+		name = filepath.Base(strings.TrimSuffix(objectURL, "/"))
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+	}
+	id := object.ID
+	if id == "" {
+		id = name
+	}
+	path := fmt.Sprintf("%v%v/%v/%v/%v", tool.WorkingDir, drsInputDir, url.PathEscape(host), url.PathEscape(id), name)
+
+	// the same object may be given to more than one input of the tool
+	alreadyListed := false
+	for _, input := range tool.S3Input.DRS {
+		alreadyListed = alreadyListed || input.Path == path
+	}
+	if !alreadyListed {
+		tool.S3Input.DRS = append(tool.S3Input.DRS, &DRSInput{
+			URI:       uri,
+			Path:      path,
+			Size:      object.Size,
+			Checksums: object.Checksums,
+			objectURL: objectURL,
+		})
+	}
+
+	*obj = *fileObject(path)
+	tool.Task.infof("end resolve DRS object: %v -> %v", uri, path)
+	return nil
+}
+
+// fetches a fresh access URL for each of the tool's DRS inputs, and rewrites its input file list
+// called right before the tool's job gets created, see dispatchTaskJob()
+func (engine *K8sEngine) resolveDRSAccess(tool *Tool) error {
+	if len(tool.S3Input.DRS) == 0 {
+		return nil
+	}
+	tool.Task.infof("begin get DRS access URLs")
+	client := drsClient()
+	for _, input := range tool.S3Input.DRS {
+		object := &drsObject{}
+		if err := drsGet(client, input.objectURL, object); err != nil {
+			return fmt.Errorf("failed to fetch DRS object %v: %v", input.URI, err)
+		}
+		accessURL, err := drsAccess(client, input.objectURL, object)
+		if err != nil {
+			return fmt.Errorf("failed to get an access URL for DRS object %v: %v", input.URI, err)
+		}
+		input.URL, input.Headers = accessURL.URL, accessURL.Headers
+	}
+	if err := engine.writeFileInputListToS3(tool); err != nil {
+		return fmt.Errorf("failed to write file input list to s3: %v", err)
+	}
+	tool.Task.infof("end get DRS access URLs")
+	return nil
+}
+
+// only follows redirects to allowed DRS hosts
+func drsClient() *http.Client {
+	return &http.Client{
+		Timeout: drsTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			if !Config.DRS.allowed(req.URL.Host) {
+				return fmt.Errorf("redirect to DRS host %v is not allowed", req.URL.Host)
+			}
+			return nil
+		},
+	}
+}
+
+// returns the host of the DRS server and the URL of the object in the DRS API
+// returns an error if the host isn't an allowed DRS server
+func drsObjectURL(uri string) (host, objectURL string, err error) {
+	host, objectURL, err = parseDRSURI(uri)
+	if err == nil && !Config.DRS.allowed(host) {
+		return "", "", fmt.Errorf("DRS host %v of %v is not allowed", host, uri)
+	}
+	return host, objectURL, err
+}
+
+func parseDRSURI(uri string) (host, objectURL string, err error) {
+	rest := strings.TrimPrefix(uri, drsPrefix)
+	if m := compactDRSPattern.FindStringSubmatch(rest); m != nil {
+		prefix, accession := m[2], m[3]
+		if host, ok := Config.DRS.Prefixes[prefix]; ok {
+			return host, fmt.Sprintf("https://%v%v/objects/%v", host, drsAPIBasePath, url.PathEscape(accession)), nil
+		}
+		if objectURL, err = resolveCompactDRS(rest); err != nil {
+			return "", "", fmt.Errorf("failed to resolve DRS URI %v: %v", uri, err)
+		}
+		u, err := url.Parse(objectURL)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to resolve DRS URI %v: %v", uri, err)
+		}
+		return u.Host, objectURL, nil
+	}
+
+	i := strings.Index(rest, "/")
+	if i < 1 || i == len(rest)-1 {
+		return "", "", fmt.Errorf("invalid DRS URI %q - must be drs://{host}/{object-id} or drs://{prefix}:{accession}", uri)
+	}
+	host, id := rest[:i], rest[i+1:]
+	return host, fmt.Sprintf("https://%v%v/objects/%v", host, drsAPIBasePath, url.PathEscape(id)), nil
+}
+
+// the resolver redirects a compact identifier to the URL of the object
+func resolveCompactDRS(compact string) (string, error) {
+	resolver := Config.DRS.Resolver
+	if resolver == "" {
+		resolver = defaultDRSResolver
+	}
+	client := &http.Client{
+		Timeout: drsTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(strings.TrimSuffix(resolver, "/") + "/" + compact)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || location == "" {
+		return "", fmt.Errorf("resolver didn't redirect %v: %v", compact, resp.Status)
+	}
+	return location, nil
+}
+
+// picks an https access method - fetching its access URL if the object only gives an access_id
+func drsAccess(client *http.Client, objectURL string, object *drsObject) (*drsAccessURL, error) {
+	for _, method := range object.AccessMethods {
+		if method.Type != "https" && method.Type != "http" {
+			continue
+		}
+		if method.AccessURL != nil && method.AccessURL.URL != "" {
+			return method.AccessURL, nil
+		}
+		if method.AccessID == "" {
+			continue
+		}
+		accessURL := &drsAccessURL{}
+		if err := drsGet(client, objectURL+"/access/"+url.PathEscape(method.AccessID), accessURL); err != nil {
+			return nil, err
+		}
+		if accessURL.URL == "" {
+			return nil, fmt.Errorf("empty access URL for access_id %v", method.AccessID)
+		}
+		return accessURL, nil
+	}
+	return nil, fmt.Errorf("no https access method")
+}
+
+func drsGet(client *http.Client, resourceURL string, v interface{}) error {
+	req, err := http.NewRequest("GET", resourceURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", resourceURL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, drsMaxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > drsMaxResponseSize {
+		return fmt.Errorf("GET %v: response is larger than %v bytes", resourceURL, drsMaxResponseSize)
+	}
+	return json.Unmarshal(b, v)
+}
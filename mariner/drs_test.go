@@ -0,0 +1,98 @@
+package mariner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDRSObjectURL(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	// the resolver redirects "{prefix}:{accession}" to the object on its DRS server
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dg.ANV0:abc":
+			http.Redirect(w, r, "https://anvil.example.org/ga4gh/drs/v1/objects/dg.ANV0%2Fabc", http.StatusMovedPermanently)
+		case "/dg.EVIL:abc":
+			http.Redirect(w, r, "http://169.254.169.254/ga4gh/drs/v1/objects/abc", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer resolver.Close()
+	Config = &MarinerConfig{DRS: DRSConfig{
+		Prefixes:     map[string]string{"dg.4503": "nci-crdc.datacommons.io"},
+		Resolver:     resolver.URL,
+		AllowedHosts: []string{"drs.example.org", "anvil.example.org"},
+	}}
+
+	cases := []struct {
+		uri       string
+		host      string
+		objectURL string
+		valid     bool
+	}{
+		{"drs://drs.example.org/obj-1", "drs.example.org", "https://drs.example.org/ga4gh/drs/v1/objects/obj-1", true},
+		{"drs://drs.example.org/a/b", "drs.example.org", "https://drs.example.org/ga4gh/drs/v1/objects/a%2Fb", true},
+		{"drs://dg.4503:abc-123", "nci-crdc.datacommons.io", "https://nci-crdc.datacommons.io/ga4gh/drs/v1/objects/abc-123", true},
+		{"drs://provider/dg.4503:abc-123", "nci-crdc.datacommons.io", "https://nci-crdc.datacommons.io/ga4gh/drs/v1/objects/abc-123", true},
+		{"drs://dg.ANV0:abc", "anvil.example.org", "https://anvil.example.org/ga4gh/drs/v1/objects/dg.ANV0%2Fabc", true},
+		{"drs://dg.UNKNOWN:abc", "", "", false}, // the resolver doesn't know it
+		{"drs://dg.EVIL:abc", "", "", false},    // the resolver points somewhere not allowed
+		{"drs://other.example.org/obj-1", "", "", false},
+		{"drs://169.254.169.254/obj-1", "", "", false},
+		{"drs://drs.example.org", "", "", false},
+		{"drs://drs.example.org/", "", "", false},
+		{"drs:///obj-1", "", "", false},
+	}
+	for _, c := range cases {
+		host, objectURL, err := drsObjectURL(c.uri)
+		switch {
+		case c.valid && err != nil:
+			t.Errorf("%v: unexpected error: %v", c.uri, err)
+		case !c.valid && err == nil:
+			t.Errorf("%v: expected an error, got %v, %v", c.uri, host, objectURL)
+		case c.valid && (host != c.host || objectURL != c.objectURL):
+			t.Errorf("%v: expected %v, %v - got %v, %v", c.uri, c.host, c.objectURL, host, objectURL)
+		}
+	}
+}
+
+func TestDRSAccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ga4gh/drs/v1/objects/obj-1/access/s3-us" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"url": "https://signed.example.org/obj-1?sig=x", "headers": ["X-Token: t"]}`))
+	}))
+	defer server.Close()
+	objectURL := server.URL + "/ga4gh/drs/v1/objects/obj-1"
+
+	cases := []struct {
+		name    string
+		methods []*drsAccessMethod
+		url     string // "" - no access URL
+	}{
+		{"access url given", []*drsAccessMethod{{Type: "https", AccessURL: &drsAccessURL{URL: "https://a.example.org/obj-1"}}}, "https://a.example.org/obj-1"},
+		{"access id - fetched", []*drsAccessMethod{{Type: "https", AccessID: "s3-us"}}, "https://signed.example.org/obj-1?sig=x"},
+		{"non-http methods are skipped", []*drsAccessMethod{
+			{Type: "s3", AccessURL: &drsAccessURL{URL: "s3://bucket/obj-1"}},
+			{Type: "https", AccessURL: &drsAccessURL{URL: "https://a.example.org/obj-1"}},
+		}, "https://a.example.org/obj-1"},
+		{"only non-http methods", []*drsAccessMethod{{Type: "gs", AccessURL: &drsAccessURL{URL: "gs://bucket/obj-1"}}}, ""},
+		{"unknown access id", []*drsAccessMethod{{Type: "https", AccessID: "nope"}}, ""},
+		{"no methods", nil, ""},
+	}
+	for _, c := range cases {
+		accessURL, err := drsAccess(server.Client(), objectURL, &drsObject{AccessMethods: c.methods})
+		switch {
+		case c.url == "" && err == nil:
+			t.Errorf("%v: expected an error, got %v", c.name, accessURL.URL)
+		case c.url != "" && err != nil:
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+		case c.url != "" && accessURL.URL != c.url:
+			t.Errorf("%v: expected %v, got %v", c.name, c.url, accessURL.URL)
+		}
+	}
+}
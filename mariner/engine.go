@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -40,6 +41,16 @@ type K8sEngine struct {
 	Manifest        *Manifest           // to pass the manifest to the gen3fuse container of each task pod
 	Log             *MainLog            //
 	KeepFiles       map[string]bool     // all the paths to not delete during basic file cleanup
+	Events          *EventBus           // run and task state transitions get published here
+	Prior           *MainLog            // the log of the run being resumed, if this run resumes one - see resume.go
+	callCache       *callCache          // nil unless call caching is enabled - see cache.go
+	DryRun          bool                // true when planning a run - nothing gets written or created, see plan.go
+	cancelled       chan struct{}       // closed once the run is cancelled - see cancel.go
+	cancelOnce      sync.Once
+	jobs            *jobWatcher                       // status transitions of the run's task jobs - see watch.go
+	processes       map[string]map[string]interface{} // the packed CWL of each process, by id - for hints the cwl lib doesn't parse
+	checkpoint      *runCheckpoint                    // the state of the run, for an engine which restarts - see recovery.go
+	recovered       *MainLog                          // the run log from before the engine restarted, if it did
 }
 
 // Tool represents a leaf in the graph of a workflow
@@ -54,12 +65,20 @@ type K8sEngine struct {
 type Tool struct {
 	JobName          string // if a k8s job (i.e., if a CommandLineTool)
 	JobID            string // if a k8s job (i.e., if a CommandLineTool)
+	JobCreated       time.Time
 	WorkingDir       string
 	Command          *exec.Cmd
 	StepInputMap     map[string]*cwl.StepInput
 	ExpressionResult map[string]interface{}
 	Task             *Task
 	S3Input          *ToolS3Input
+	Resources        *StepResources // overrides the tool's ResourceRequirement, see resume.go
+	Reused           bool           // true if the outputs were taken from the run being resumed
+	CacheKey         string         // the tool's call cache key, if it has one - see cache.go
+	Attempt          int            // 1, then 2, 3, .. for retries - see retry.go
+	TransientFailure bool           // true if the tool's job failed in a way which may not happen again
+	TimeLimit        int64          // seconds the tool's job may run, 0 if no limit - see timelimit.go
+	jobDone          chan struct{}  // closed once the tool's job is done (or has failed)
 
 	// dev'ing
 	// need to load this with runtime context as per CWL spec
@@ -80,24 +99,74 @@ type TaskRuntimeJSContext struct {
 
 // ToolS3Input ..
 type ToolS3Input struct {
-	Paths []string `json:"paths"`
+	Paths []string    `json:"paths"`
+	DRS   []*DRSInput `json:"drs,omitempty"` // see drs.go
 }
 
 // Engine runs an instance of the mariner engine job
 func Engine(runID string) (err error) {
 	engine := engine(runID)
 
+	// the engine job restarts the engine if its pod goes away - the engine then picks up the run from its checkpoint
+	// before anything else, since nothing may write to the run log until it's loaded, see recovery.go
+	if finished, rErr := engine.recoverRun(); finished {
+		return rErr
+	}
+
+	// write events to s3 as they happen
+	eventsDone := make(chan struct{})
+	go engine.persistEvents(engine.Events.subscribe(), eventsDone)
+
+	// notify callbacks when the run finishes
+	callbacksDone := make(chan struct{})
+	go engine.notifyCallbacksOnFinish(engine.Events.subscribe(), callbacksDone)
+
+	// write metric snapshots for the server to pick up
+	metricsDone := make(chan struct{})
+	go engine.pushMetrics(engine.Events.subscribe(), metricsDone)
+
+	// last thing - publish the final state of the run, and wait for all events to be handled
+	defer func() {
+		engine.checkpointRun()
+		engine.publishRunEvent()
+		engine.Events.close()
+		<-eventsDone
+		<-callbacksDone
+		<-metricsDone
+	}()
+
 	defer func() {
 		if r := recover(); r != nil {
 			engine.Log.Main.Status = failed
 			err = engine.errorf("mariner panicked: %v", r)
+			engine.systemFailure(err.Error())
 		}
 	}()
 
+	engine.publishRunEvent()
 	if err = engine.loadRequest(); err != nil {
-		return engine.errorf("failed to load workflow request: %v", err)
+		engine.Log.Main.Status = failed
+		err = engine.errorf("failed to load workflow request: %v", err)
+		engine.systemFailure(err.Error())
+		return err
 	}
-	if err = engine.runWorkflow(); err != nil {
+	go engine.watchForCancel()
+	engine.jobs = newJobWatcher(runSelector(engine.RunID, marinerTask))
+	go engine.jobs.run()
+	stopClock := engine.enforceMaxRuntime()
+	err = engine.runWorkflow()
+	stopClock()
+	if engine.cancelRequested() {
+		// tasks killed by the cancellation fail - that's expected
+		engine.finishCancel()
+		return nil
+	}
+	if err != nil {
+		engine.Log.Main.Status = failed
+		if engine.Log.Main.FailureReason == "" {
+			// the workflow failed before any task did - e.g., it couldn't be parsed
+			engine.systemFailure(err.Error())
+		}
 		return engine.errorf("failed to run workflow: %v", err)
 	}
 
@@ -150,6 +219,8 @@ func engine(runID string) *K8sEngine {
 		RunID:           runID,
 		UserID:          os.Getenv(userIDEnvVar),
 		Log:             mainLog(fmt.Sprintf(pathToLogf, runID)),
+		Events:          newEventBus(),
+		cancelled:       make(chan struct{}),
 	}
 
 	fm := &S3FileManager{}
@@ -169,6 +240,20 @@ func (engine *K8sEngine) loadRequest() error {
 	}
 	engine.Manifest = &request.Manifest
 	engine.Log.Request = request
+	if request.ResumeFrom != "" {
+		// without the prior log, every task just runs again
+		if err = engine.loadPriorRun(); err != nil {
+			engine.warnf("%v - running every task", err)
+		}
+	}
+	if engine.processes, err = packedProcesses(request.Workflow); err != nil {
+		engine.warnf("failed to read hints: %v", err)
+	}
+	if Config.CallCache.Enabled {
+		if engine.callCache, err = newCallCache(request.Workflow); err != nil {
+			engine.warnf("call caching disabled for this run: %v", err)
+		}
+	}
 	engine.infof("end load workflow request")
 	return nil
 }
@@ -176,20 +261,59 @@ func (engine *K8sEngine) loadRequest() error {
 // DispatchTask does some setup for and dispatches workflow Tools
 func (engine *K8sEngine) dispatchTask(task *Task) (err error) {
 	engine.infof("begin dispatch task: %v", task.Root.ID)
+	if engine.cancelRequested() {
+		return engine.errorf("run cancelled - not dispatching task: %v", task.Root.ID)
+	}
 
-	engine.Lock()
-	tool := task.tool(engine.RunID) // #race #ok
-	engine.Unlock()
-
-	if err = engine.setupTool(tool); err != nil {
-		return engine.errorf("failed to setup tool: %v; error: %v", task.Root.ID, err)
+	// an engine which restarted picks up the task where it left off, see recovery.go
+	tool := engine.recoveredTool(task)
+	switch {
+	case tool == nil:
+		engine.Lock()
+		tool = task.tool(engine.RunID, 1) // #race #ok
+		tool.Resources = engine.stepResources(task)
+		engine.Unlock()
+
+		if err = engine.setupTool(tool); err != nil {
+			return engine.errorf("failed to setup tool: %v; error: %v", task.Root.ID, err)
+		}
+	case tool.Reused:
+		engine.infof("end dispatch task: %v - completed before the engine restarted", task.Root.ID)
+		return nil
+	}
+	if tool.Reused {
+		engine.infof("end dispatch task: %v - outputs reused from run %v", task.Root.ID, task.Log.ReusedFrom)
+		return nil
 	}
-	if err = engine.runTool(tool); err != nil {
-		return engine.errorf("failed to run tool: %v; error: %v", task.Root.ID, err)
+	if tool.JobID == "" && engine.cachedOutputs(tool) { // a job taken over after a restart is already running
+		engine.infof("end dispatch task: %v - call cache hit", task.Root.ID)
+		return nil
+	}
+	for {
+		err = engine.runTool(tool)
+		engine.recordAttempt(tool, err)
+		if err == nil {
+			break
+		}
+		if tool.JobID != "" {
+			if pvcErr := engine.deletePVC(tool); pvcErr != nil {
+				engine.warnf("failed to delete pvc for tool: %v", task.Root.ID)
+			}
+		}
+		if !engine.retryable(tool) {
+			engine.checkpointTool(tool, failed)
+			return engine.errorf("failed to run tool: %v; error: %v", task.Root.ID, err)
+		}
+		// see retry.go
+		if tool, err = engine.retryTool(tool); err != nil {
+			return engine.errorf("failed to set up retry of tool: %v; error: %v", task.Root.ID, err)
+		}
 	}
 	if err = engine.collectOutput(tool); err != nil {
 		return engine.errorf("failed to collect output for tool: %v; error: %v", task.Root.ID, err)
 	}
+	engine.cacheOutputs(tool)
+	engine.checkpointTool(tool, completed)
 	if err = engine.deletePVC(tool); err != nil {
 		engine.warnf("failed to delete pvc for tool: %v", task.Root.ID)
 	}
@@ -222,6 +346,7 @@ func (engine *K8sEngine) finishTask(task *Task) {
 	// task.Lock()
 	task.Done = &trueVal // #race #ok
 	// task.Unlock()
+	close(task.finishedChan())
 }
 
 // push newly started process onto the engine's stack of running processes
@@ -270,17 +395,19 @@ func (engine *K8sEngine) collectOutput(tool *Tool) (err error) {
 }
 
 // The Tool represents a workflow Tool and so is either a CommandLineTool or an ExpressionTool
-func (task *Task) tool(runID string) *Tool {
+func (task *Task) tool(runID string, attempt int) *Tool {
 	task.infof("begin make tool object")
 	task.Outputs = make(map[string]interface{}) // #race #ok
 	task.Log.Output = task.Outputs              // #race #ok
 	tool := &Tool{
 		Task:       task,
-		WorkingDir: task.workingDir(runID),
+		WorkingDir: task.workingDir(runID, attempt),
+		Attempt:    attempt,
 		S3Input: &ToolS3Input{
 			Paths: []string{},
 		},
 	}
+	task.Log.WorkingDir = tool.WorkingDir
 	tool.JSVM = tool.newJSVM()
 	task.infof("end make tool object")
 	return tool
@@ -313,7 +440,7 @@ func (tool *Tool) newJSVM() *otto.Otto {
 // probably need to do some more filtering of other potentially problematic characters
 // NOTE: should make the mount point a go constant - i.e., const MountPoint = "/engine-workspace/"
 // ----- could come up with a better/more uniform naming scheme
-func (task *Task) workingDir(runID string) string {
+func (task *Task) workingDir(runID string, attempt int) string {
 	task.infof("begin make task working dir")
 
 	safeID := strings.ReplaceAll(task.Root.ID, "#", "")
@@ -330,6 +457,9 @@ func (task *Task) workingDir(runID string) string {
 	if task.ScatterIndex > 0 {
 		dir = fmt.Sprintf("%v-scatter-%v", dir, task.ScatterIndex)
 	}
+	if attempt > 1 {
+		dir = fmt.Sprintf("%v-attempt-%v", dir, attempt)
+	}
 	dir += "/"
 	task.infof("end make task working dir: %v", dir)
 	return dir
@@ -374,6 +504,12 @@ func (engine *K8sEngine) setupTool(tool *Tool) (err error) {
 		return tool.Task.errorf("failed to load inputs to js vm: %v", err)
 	}
 
+	// resuming a run - the task doesn't run again if it already ran with these inputs
+	if tool.Reused = engine.reuseOutputs(tool); tool.Reused {
+		tool.Task.infof("end setup tool")
+		return nil
+	}
+
 	if err = engine.initWorkDirReq(tool); err != nil {
 		return tool.Task.errorf("failed to handle initWorkDir requirement: %v", err)
 	}
@@ -405,11 +541,21 @@ func (engine *K8sEngine) runTool(tool *Tool) (err error) {
 		// collect resource metrics via k8s api
 		// NOTE: at present, metrics are NOT collected for expressionTools
 		// this should be fixed
-		go engine.collectResourceMetrics(tool)
-
-		if err = engine.listenForDone(tool); err != nil {
+		// the metrics stop with the job, so each attempt gets its own series - see retry.go
+		tool.jobDone = make(chan struct{})
+		metricsDone := make(chan struct{})
+		go func() {
+			engine.collectResourceMetrics(tool)
+			close(metricsDone)
+		}()
+
+		err = engine.listenForDone(tool)
+		close(tool.jobDone)
+		<-metricsDone
+		if err != nil {
 			return engine.errorf("failed to listen for task to finish: %v; error: %v", tool.Task.Root.ID, err)
 		}
+		engine.collectTaskMetrics(tool)
 	default:
 		return engine.errorf("failed to run CWL object of unexpected class: %v", class)
 	}
@@ -426,6 +572,11 @@ func (engine *K8sEngine) runCommandLineTool(tool *Tool) (err error) {
 	if err != nil {
 		return engine.errorf("failed to generate command for tool: %v; error: %v", tool.Task.Root.ID, err)
 	}
+	if tool.JobID != "" {
+		// the job from before the engine restarted, see recovery.go
+		engine.infof("end run CommandLineTool: %v - took over job %v", tool.Task.Root.ID, tool.JobName)
+		return nil
+	}
 	err = engine.dispatchTaskJob(tool)
 	if err != nil {
 		return engine.errorf("failed to dispatch task job: %v; error: %v", tool.Task.Root.ID, err)
@@ -434,19 +585,37 @@ func (engine *K8sEngine) runCommandLineTool(tool *Tool) (err error) {
 	return nil
 }
 
-// ListenForDone listens to k8s until the job status is COMPLETED
+// ListenForDone waits for the job status to be COMPLETED - the job's status transitions come from the engine's job watch, see watch.go
 // once that happens, calls a function to collect output and update engine's proc stacks
-// TODO: implement error handling, listen for errors and failures, retries as well
-// ----- handle the cases where the job status is not COMPLETED or RUNNING
+// if the job fails instead, the reason gets recorded in the task's log, see failure.go
 func (engine *K8sEngine) listenForDone(tool *Tool) (err error) {
 	engine.infof("begin listen for task to finish: %v", tool.Task.Root.ID)
-	status := ""
-	for status != completed {
-		jobInfo, err := jobStatusByID(tool.JobID)
-		if err != nil {
-			return engine.errorf("failed to get task job info: %v; error: %v", tool.Task.Root.ID, err)
+	statuses := engine.jobs.subscribe(tool.JobID)
+	defer engine.jobs.unsubscribe(tool.JobID)
+	podCheck := time.NewTicker(podCheckPeriod)
+	defer podCheck.Stop()
+	for status := ""; status != completed; {
+		select {
+		case status = <-statuses:
+		case <-engine.cancelled:
+			return engine.errorf("run cancelled - task job deleted: %v", tool.Task.Root.ID)
+		case <-podCheck.C:
+			if reason, stuck := engine.checkTaskPod(tool); stuck {
+				if err = deleteTaskJob(tool.JobName); err != nil {
+					engine.warnf("failed to delete job of stuck task: %v; error: %v", tool.Task.Root.ID, err)
+				}
+				tool.TransientFailure = true
+				tool.Task.Log.FailureReason = reason
+				return engine.errorf("task job stuck: %v; %v", tool.Task.Root.ID, reason)
+			}
+		}
+		switch status {
+		case failed:
+			reason := engine.recordJobFailure(tool)
+			return engine.errorf("task job failed: %v; %v", tool.Task.Root.ID, reason)
+		case jobDeleted:
+			return engine.errorf("task job deleted before it finished: %v", tool.Task.Root.ID)
 		}
-		status = jobInfo.Status
 	}
 	engine.infof("end listen for task to finish: %v", tool.Task.Root.ID)
 	return nil
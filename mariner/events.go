@@ -0,0 +1,477 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// this file contains code for run events
+// i.e., the run-level and task-level state transitions of a workflow run
+//
+// engine side:
+// the engine publishes events on its event bus as tasks start and finish (see startTaskLog, finishTaskLog)
+// subscribers receive the events over channels - one subscriber writes each event to s3,
+// under the events/ prefix of the run, so the server can see them
+//
+// server side:
+// '/runs/{runID}/events' streams a run's events to the client as Server-Sent Events
+// one poller per run watches the run's events prefix in s3 and fans new events out to all the clients watching that run
+
+const (
+	// event types
+	runStateEvent     = "run_state"
+	taskStartedEvent  = "task_started"
+	taskFinishedEvent = "task_completed"
+	taskFailedEvent   = "task_failed"
+	taskRetriedEvent  = "task_retried"
+
+	// events are written to "<run prefix>/events/<seq>.json"
+	eventsDir    = "events/"
+	eventKeyf    = "%08d.json"
+	eventsBuffer = 1024
+
+	// how often the server checks s3 for new events
+	eventsPollPeriod = 2 * time.Second
+	// SSE comment sent to keep idle connections open
+	eventsKeepAlivePeriod = 15 * time.Second
+)
+
+// Event is a state transition of a run or of one of its tasks
+// state is the WES state the run or task transitioned to
+type Event struct {
+	Seq     int    `json:"seq"`
+	Time    string `json:"time"`
+	Type    string `json:"type"`
+	RunID   string `json:"run_id"`
+	TaskID  string `json:"task_id,omitempty"`
+	JobName string `json:"job_name,omitempty"`
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+}
+
+// a run-level event with a terminal state is the last event of the run
+func (e *Event) final() bool {
+	return e.Type == runStateEvent && finalState(e.State)
+}
+
+// true for the WES states a run ends in
+func finalState(state string) bool {
+	switch state {
+	case stateComplete, stateExecutorError, stateSystemError, stateCanceled:
+		return true
+	}
+	return false
+}
+
+//// engine side ////
+
+// EventBus delivers the engine's events to each of its subscribers, in order
+type EventBus struct {
+	sync.Mutex
+	seq         int
+	subscribers []chan *Event
+	closed      bool
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// the next event published gets the seq after the given one
+// for an engine which restarted, so the run's events carry on from the last one written, see recovery.go
+func (bus *EventBus) continueFrom(seq int) {
+	bus.Lock()
+	defer bus.Unlock()
+	bus.seq = seq
+}
+
+// returns a channel which receives every event published from now on
+// the channel is closed when the bus is closed
+func (bus *EventBus) subscribe() <-chan *Event {
+	bus.Lock()
+	defer bus.Unlock()
+	ch := make(chan *Event, eventsBuffer)
+	if bus.closed {
+		close(ch)
+		return ch
+	}
+	bus.subscribers = append(bus.subscribers, ch)
+	return ch
+}
+
+// assigns the event its sequence number and timestamp, then sends it to every subscriber
+func (bus *EventBus) publish(e *Event) {
+	bus.Lock()
+	defer bus.Unlock()
+	if bus.closed {
+		return
+	}
+	bus.seq++
+	e.Seq = bus.seq
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	for _, ch := range bus.subscribers {
+		ch <- e
+	}
+}
+
+func (bus *EventBus) close() {
+	bus.Lock()
+	defer bus.Unlock()
+	if bus.closed {
+		return
+	}
+	bus.closed = true
+	for _, ch := range bus.subscribers {
+		close(ch)
+	}
+}
+
+// called when a task starts or finishes
+func (engine *K8sEngine) publishTaskEvent(task *Task) {
+	var eventType string
+	switch task.Log.Status {
+	case running:
+		eventType = taskStartedEvent
+	case completed:
+		eventType = taskFinishedEvent
+	case failed:
+		eventType = taskFailedEvent
+	default:
+		return
+	}
+	engine.Events.publish(&Event{
+		Type:    eventType,
+		RunID:   engine.RunID,
+		TaskID:  task.Root.ID,
+		JobName: task.Log.JobName,
+		State:   wesState(task.Log.Status),
+	})
+}
+
+// called when a task's job failed and the task is going to run again, see retry.go
+// the task goes back to QUEUED until its next attempt starts
+func (engine *K8sEngine) publishTaskRetriedEvent(tool *Tool, backoff time.Duration) {
+	engine.Events.publish(&Event{
+		Type:    taskRetriedEvent,
+		RunID:   engine.RunID,
+		TaskID:  tool.Task.Root.ID,
+		JobName: tool.JobName,
+		State:   stateQueued,
+		Message: fmt.Sprintf("attempt %v failed: %v - retrying in %v", tool.Attempt, tool.Task.Log.FailureReason, backoff),
+	})
+}
+
+// called when the run starts and finishes
+func (engine *K8sEngine) publishRunEvent() {
+	engine.Events.publish(&Event{
+		Type:  runStateEvent,
+		RunID: engine.RunID,
+		State: runState(engine.Log),
+	})
+}
+
+// writes each event to s3 until the bus closes
+func (engine *K8sEngine) persistEvents(events <-chan *Event, done chan<- struct{}) {
+	defer close(done)
+	uploader := s3manager.NewUploader(engine.S3FileManager.newS3Session())
+	for e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			fmt.Println("failed to marshal event: ", err)
+			continue
+		}
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(engine.S3FileManager.S3BucketName),
+			Key:    aws.String(eventKey(engine.UserID, engine.RunID, e.Seq)),
+			Body:   bytes.NewReader(b),
+		})
+		if err != nil {
+			fmt.Println("failed to write event to s3: ", err)
+		}
+	}
+}
+
+// the seq of the last event written to s3 for the run - 0 if there are none
+func (engine *K8sEngine) lastEventSeq() (int, error) {
+	svc := s3.New(engine.S3FileManager.newS3Session())
+	key, err := lastEventKey(svc, engine.S3FileManager.S3BucketName, engine.UserID, engine.RunID)
+	if err != nil || key == "" {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSuffix(path.Base(key), ".json"))
+}
+
+// the key of the last event written to s3 for the run - "" if there are none
+// event keys are zero-padded, so they list in order
+func lastEventKey(svc *s3.S3, bucket, userID, runID string) (string, error) {
+	last := ""
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(eventsPrefix(userID, runID)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if n := len(page.Contents); n > 0 {
+			last = aws.StringValue(page.Contents[n-1].Key)
+		}
+		return true
+	})
+	return last, err
+}
+
+func eventsPrefix(userID, runID string) string {
+	return fmt.Sprintf(pathToUserRunsf, userID) + runID + "/" + eventsDir
+}
+
+func eventKey(userID, runID string, seq int) string {
+	return eventsPrefix(userID, runID) + fmt.Sprintf(eventKeyf, seq)
+}
+
+//// server side ////
+
+// eventHub keeps one poller per watched run
+type eventHub struct {
+	sync.Mutex
+	pollers map[string]*eventPoller
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{pollers: make(map[string]*eventPoller)}
+}
+
+// eventPoller fetches new events of one run from s3 and fans them out to the subscribed clients
+type eventPoller struct {
+	userID      string
+	runID       string
+	subscribers map[*eventSubscriber]bool
+}
+
+// eventSubscriber is one client watching a run
+// only the poller sends on or closes ch - done is closed when the client goes away
+type eventSubscriber struct {
+	ch   chan *Event
+	done chan struct{}
+}
+
+// subscribe to new events of the given run
+// the channel receives the events written after the poller started - the client replays the ones before, see handleRunEventsGET()
+// ----- a new poller finds where to start before subscribe returns, so the client's replay always reaches it
+// the returned func unsubscribes
+func (hub *eventHub) subscribe(fm *S3FileManager, userID, runID string) (<-chan *Event, func()) {
+	hub.Lock()
+	defer hub.Unlock()
+	key := userID + "/" + runID
+	poller, ok := hub.pollers[key]
+	if !ok {
+		poller = &eventPoller{
+			userID:      userID,
+			runID:       runID,
+			subscribers: make(map[*eventSubscriber]bool),
+		}
+		hub.pollers[key] = poller
+		svc := s3.New(fm.newS3Session())
+		startAfter, err := lastEventKey(svc, fm.S3BucketName, userID, runID)
+		if err != nil {
+			fmt.Println("error listing events: ", err)
+		}
+		go hub.poll(svc, fm.S3BucketName, key, poller, startAfter)
+	}
+	sub := &eventSubscriber{
+		ch:   make(chan *Event, eventsBuffer),
+		done: make(chan struct{}),
+	}
+	poller.subscribers[sub] = true
+	unsubscribe := func() {
+		hub.Lock()
+		defer hub.Unlock()
+		if poller.subscribers[sub] {
+			delete(poller.subscribers, sub)
+			close(sub.done)
+		}
+	}
+	return sub.ch, unsubscribe
+}
+
+// polls until there are no more subscribers, or the run is over
+// starts after startAfter, the run's last event when the poller was created - the subscribers replay everything up to there themselves
+func (hub *eventHub) poll(svc *s3.S3, bucket, key string, poller *eventPoller, startAfter string) {
+	for {
+		time.Sleep(eventsPollPeriod)
+		events, last, err := fetchEvents(svc, bucket, poller.userID, poller.runID, startAfter)
+		if err != nil {
+			fmt.Println("error polling events: ", err)
+		}
+		if last != "" {
+			startAfter = last
+		}
+
+		hub.Lock()
+		subscribers := make([]*eventSubscriber, 0, len(poller.subscribers))
+		for sub := range poller.subscribers {
+			subscribers = append(subscribers, sub)
+		}
+		hub.Unlock()
+
+		// a slow client holds up the others rather than missing events - the lock isn't held, so clients can still unsubscribe
+		over := false
+		for _, e := range events {
+			for _, sub := range subscribers {
+				select {
+				case sub.ch <- e:
+				case <-sub.done:
+				}
+			}
+			over = over || e.final()
+		}
+
+		hub.Lock()
+		if over || len(poller.subscribers) == 0 {
+			for sub := range poller.subscribers {
+				delete(poller.subscribers, sub)
+				close(sub.ch)
+			}
+			delete(hub.pollers, key)
+			hub.Unlock()
+			return
+		}
+		hub.Unlock()
+	}
+}
+
+// returns the run's events stored after the given key, and the key of the last one
+func fetchEvents(svc *s3.S3, bucket, userID, runID, startAfter string) ([]*Event, string, error) {
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(eventsPrefix(userID, runID)),
+	}
+	if startAfter != "" {
+		query.StartAfter = aws.String(startAfter)
+	}
+	keys := []string{}
+	err := svc.ListObjectsV2Pages(query, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	events := []*Event{}
+	last := ""
+	for _, key := range keys {
+		obj, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			// try again next time
+			return events, last, err
+		}
+		e := &Event{}
+		err = json.NewDecoder(obj.Body).Decode(e)
+		obj.Body.Close()
+		if err != nil {
+			fmt.Println("failed to decode event: ", key, err)
+		} else {
+			events = append(events, e)
+		}
+		last = key
+	}
+	return events, last, nil
+}
+
+// '/runs/{runID}/events' - GET
+// streams the run's events as Server-Sent Events - the event id is the event's seq
+// reconnecting clients can send the Last-Event-ID header to pick up where they left off
+// the stream ends after the run's final state
+func (server *Server) handleRunEventsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeRunError(w, err, "failed to fetch run log")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "streaming not supported")
+		return
+	}
+	lastSeq, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+	// subscribe before replaying the events so far, so nothing is missed in between
+	events, unsubscribe := server.events.subscribe(server.S3FileManager, userID, runID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e *Event) bool {
+		if e.Seq <= lastSeq {
+			return false
+		}
+		lastSeq = e.Seq
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", e.Seq, e.Type, b)
+		flusher.Flush()
+		return e.final()
+	}
+
+	svc := s3.New(server.S3FileManager.newS3Session())
+	startAfter := ""
+	if lastSeq > 0 {
+		startAfter = eventKey(userID, runID, lastSeq)
+	}
+	past, _, err := fetchEvents(svc, server.S3FileManager.S3BucketName, userID, runID, startAfter)
+	if err != nil {
+		fmt.Println("error fetching events: ", err)
+	}
+	for _, e := range past {
+		if send(e) {
+			return
+		}
+	}
+
+	// runs which finished before events were recorded don't have a final event
+	if finishedStatus(runLog.Main.Status) {
+		send(&Event{
+			Seq:   lastSeq + 1,
+			Time:  wesTime(runLog.Main.LastUpdated),
+			Type:  runStateEvent,
+			RunID: runID,
+			State: runState(runLog),
+		})
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlivePeriod)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if send(e) {
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
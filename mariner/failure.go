@@ -0,0 +1,163 @@
+package mariner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for task failures
+//
+// a task fails if its job fails - the command exits non-zero, the pod gets evicted or OOMKilled, ..
+// or if anything else about running it goes wrong (e.g., its inputs can't be set up)
+// - the task's log records why, in "failureReason" (and the command's "exitCode", if it got that far)
+// - steps which depend on the task get skipped, and so on downstream
+// - the workflow the task is a step of fails, and so on up to the run
+// the engine then exits non-zero, so the engine job fails too
+//
+// failures which may well not happen again (e.g., the pod got evicted) get retried first, see retry.go
+//
+// the run fails with WES state EXECUTOR_ERROR if a task failed, and SYSTEM_ERROR if the engine or the cluster failed it instead -
+// the engine panicked, couldn't load the request, couldn't create a task's job, .. - see runState()
+
+// records why the task failed - the first reason given sticks, since it's the most specific
+func (log *Log) fail(reason string) {
+	log.Status = failed
+	if log.FailureReason == "" {
+		log.FailureReason = reason
+	}
+	log.Event.errorf("task failed: %v", reason)
+}
+
+// records that the engine or the cluster failed the run - not a task
+// the first reason given sticks, as for tasks
+// no lock - it's called from a recovered panic too, see Engine()
+func (engine *K8sEngine) systemFailure(reason string) {
+	engine.Log.Main.SystemError = true // #race #ok
+	if engine.Log.Main.FailureReason == "" {
+		engine.Log.Main.FailureReason = reason // #race #ok
+	}
+}
+
+// marks a task which won't run because a step it depends on didn't complete
+func (engine *K8sEngine) skipTask(task *Task, reason string) {
+	engine.warnf("skipping task %v: %v", task.Root.ID, reason)
+	task.Log.Status = skipped
+	task.Log.FailureReason = reason
+	task.Log.Event.warnf("task skipped: %v", reason)
+	engine.finishTask(task)
+}
+
+// true if the task didn't produce its outputs - dependent steps can't run
+func (task *Task) failed() bool {
+	return task.Log.Status == failed || task.Log.Status == skipped
+}
+
+// returns an error listing the steps of a workflow, or the subtasks of a scatter, which failed or got skipped
+func (task *Task) childFailure() error {
+	ids := []string{}
+	for stepID, child := range task.Children {
+		if child.failed() {
+			ids = append(ids, stepID)
+		}
+	}
+	for i, subtask := range task.ScatterTasks {
+		if subtask.failed() {
+			ids = append(ids, fmt.Sprintf("%v[%v]", task.Root.ID, i))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Strings(ids)
+	return fmt.Errorf("failed or skipped: %v", strings.Join(ids, ", "))
+}
+
+// finds out why the task's job failed, from the job's conditions and the terminated containers of its pod
+// the reason and exit code go in the task's log, and whether the failure is worth a retry goes in the tool
+// a job which ran past its time limit fails with "timeout: ..." first, see timelimit.go
+func (engine *K8sEngine) recordJobFailure(tool *Tool) string {
+	reasons := []string{}
+	timedOut := false
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err == nil {
+		var job *batchv1.Job
+		if job, err = jobsClient.Get(tool.JobName, metav1.GetOptions{}); err == nil {
+			if timedOut = jobTimedOut(job); timedOut {
+				reasons = append(reasons, tool.timeoutReason())
+			}
+			for _, condition := range job.Status.Conditions {
+				if condition.Type == batchv1.JobFailed && condition.Status == k8sv1.ConditionTrue {
+					reasons = append(reasons, fmt.Sprintf("job failed: %v %v", condition.Reason, condition.Message))
+				}
+			}
+		}
+	}
+	if err != nil {
+		tool.Task.warnf("failed to fetch job of failed task: %v", err)
+	}
+
+	_, _, podsClient, _, err := k8sClient(k8sPodAPI)
+	if err == nil {
+		var pods *k8sv1.PodList
+		if pods, err = podsClient.List(metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%v", tool.JobName)}); err == nil {
+			for _, pod := range pods.Items {
+				reasons = append(reasons, tool.podFailure(&pod)...)
+			}
+		}
+	}
+	if err != nil {
+		tool.Task.warnf("failed to fetch pod of failed task: %v", err)
+	}
+
+	if timedOut {
+		// the containers got killed because the job ran over - that's not worth a retry, whatever they say
+		tool.TransientFailure = false
+	}
+
+	reason := strings.TrimSpace(strings.Join(reasons, "; "))
+	if reason == "" {
+		reason = "task job failed"
+	}
+	tool.Task.Log.FailureReason = reason
+	return reason
+}
+
+// e.g., "pod evicted: The node was low on resource: memory", "container mariner-task exited with code 137: OOMKilled"
+func (tool *Tool) podFailure(pod *k8sv1.Pod) []string {
+	reasons := []string{}
+	if pod.Status.Reason != "" {
+		reasons = append(reasons, fmt.Sprintf("pod %v: %v", strings.ToLower(pod.Status.Reason), pod.Status.Message))
+		tool.TransientFailure = tool.TransientFailure || transientPodReasons[pod.Status.Reason]
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated == nil {
+			continue
+		}
+		if status.Name == taskContainerName {
+			exitCode := terminated.ExitCode
+			tool.Task.Log.ExitCode = &exitCode
+		}
+		if terminated.ExitCode == 0 {
+			continue
+		}
+		if status.Name == Config.Containers.S3sidecar.Name {
+			// the sidecar failed to move the task's files
+			tool.TransientFailure = true
+		}
+		reason := fmt.Sprintf("container %v exited with code %v", status.Name, terminated.ExitCode)
+		if terminated.Reason != "" {
+			reason += ": " + terminated.Reason
+		}
+		if terminated.Message != "" {
+			reason += " " + terminated.Message
+		}
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
@@ -0,0 +1,59 @@
+package mariner
+
+import (
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+	k8sv1 "k8s.io/api/core/v1"
+)
+
+func TestPodFailure(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	Config = &MarinerConfig{Containers: Containers{S3sidecar: Container{Name: "mariner-s3sidecar"}}}
+
+	terminated := func(name string, exitCode int32, reason string) k8sv1.ContainerStatus {
+		return k8sv1.ContainerStatus{
+			Name:  name,
+			State: k8sv1.ContainerState{Terminated: &k8sv1.ContainerStateTerminated{ExitCode: exitCode, Reason: reason}},
+		}
+	}
+	cases := []struct {
+		name      string
+		status    k8sv1.PodStatus
+		transient bool
+		exitCode  *int32
+	}{
+		{"evicted", k8sv1.PodStatus{Reason: "Evicted", Message: "The node was low on resource: memory"}, true, nil},
+		{"node lost", k8sv1.PodStatus{Reason: "NodeLost"}, true, nil},
+		{"command exits non-zero", k8sv1.PodStatus{ContainerStatuses: []k8sv1.ContainerStatus{
+			terminated(taskContainerName, 1, "Error"),
+		}}, false, int32Ptr(1)},
+		{"OOMKilled", k8sv1.PodStatus{ContainerStatuses: []k8sv1.ContainerStatus{
+			terminated(taskContainerName, 137, "OOMKilled"),
+		}}, false, int32Ptr(137)},
+		{"sidecar fails", k8sv1.PodStatus{ContainerStatuses: []k8sv1.ContainerStatus{
+			terminated(taskContainerName, 0, "Completed"), terminated("mariner-s3sidecar", 1, "Error"),
+		}}, true, int32Ptr(0)},
+		{"unknown pod reason", k8sv1.PodStatus{Reason: "SomethingElse"}, false, nil},
+	}
+	for _, c := range cases {
+		tool := &Tool{Task: &Task{Root: &cwl.Root{ID: "#tool.cwl"}, Log: logger()}}
+		reasons := tool.podFailure(&k8sv1.Pod{Status: c.status})
+		if len(reasons) == 0 {
+			t.Errorf("%v: expected a failure reason", c.name)
+		}
+		if tool.TransientFailure != c.transient {
+			t.Errorf("%v: expected transient=%v, got %v", c.name, c.transient, tool.TransientFailure)
+		}
+		switch exitCode := tool.Task.Log.ExitCode; {
+		case (exitCode == nil) != (c.exitCode == nil):
+			t.Errorf("%v: expected exit code %v, got %v", c.name, c.exitCode, exitCode)
+		case exitCode != nil && *exitCode != *c.exitCode:
+			t.Errorf("%v: expected exit code %v, got %v", c.name, *c.exitCode, *exitCode)
+		}
+	}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
@@ -0,0 +1,199 @@
+package mariner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for the liveness and readiness endpoints
+// neither one sits behind the auth middleware
+//
+// '/_status' - liveness: the server is up and serving requests
+// '/_ready' - readiness: the server can reach everything it depends on
+// ----- each dependency gets checked concurrently, and the report lists
+// ----- the result and latency of each check - 503 if any check fails
+// ----- the report is cached for a few seconds - the endpoint has no auth, and each check hits s3, k8s, ..
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+
+	healthCheckTimeout = 5 * time.Second
+	readinessCacheTTL  = 5 * time.Second
+
+	// key of the object written (and then deleted) to check that the bucket is writable
+	healthCheckKeyf = "_mariner_health/%v"
+)
+
+// HealthJSON is the response object for the liveness and readiness endpoints
+type HealthJSON struct {
+	Status string                      `json:"status"`
+	Checks map[string]*HealthCheckJSON `json:"checks,omitempty"`
+}
+
+// HealthCheckJSON is the result of checking one dependency
+type HealthCheckJSON struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// the last readiness report - requests which come in while the checks run wait for their report
+type readinessCache struct {
+	sync.Mutex
+	report  *HealthJSON
+	checked time.Time
+}
+
+// '/_status' - GET
+func (server *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &HealthJSON{Status: healthOK})
+}
+
+// '/_ready' - GET
+func (server *Server) handleReadinessCheck(w http.ResponseWriter, r *http.Request) {
+	j := server.readiness()
+	if j.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, j)
+}
+
+// the cached report, if it's fresh - else checks again
+func (server *Server) readiness() *HealthJSON {
+	server.ready.Lock()
+	defer server.ready.Unlock()
+	if server.ready.report == nil || time.Since(server.ready.checked) > readinessCacheTTL {
+		server.ready.report = server.checkReadiness()
+		server.ready.checked = time.Now()
+	}
+	return server.ready.report
+}
+
+func (server *Server) checkReadiness() *HealthJSON {
+	checks := map[string]func() error{
+		"k8s":    checkK8s,
+		"s3":     server.checkS3,
+		"config": checkConfig,
+	}
+	// only check the auth backends that are in use, see auth.go
+	if server.jwksURL != "" {
+		checks["jwks"] = func() error { return checkURL(server.jwksURL) }
+	}
+	if _, ok := server.authz.(*arborist); ok {
+		checks["arborist"] = func() error { return checkURL(arboristHealthURL) }
+	}
+
+	j := &HealthJSON{Status: healthOK, Checks: make(map[string]*HealthCheckJSON)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check()
+			result := &HealthCheckJSON{
+				Status:    healthOK,
+				LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				fmt.Printf("readiness check %v failed: %v\n", name, err)
+				result.Status, result.Error = healthFail, err.Error()
+				j.Status = healthFail
+			}
+			j.Checks[name] = result
+		}(name, check)
+	}
+	wg.Wait()
+	return j
+}
+
+// the k8s API is reachable and we can list jobs
+func checkK8s() error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	timeout := int64(healthCheckTimeout / time.Second)
+	_, err = jobsClient.List(metav1.ListOptions{Limit: 1, TimeoutSeconds: &timeout})
+	return err
+}
+
+// the bucket is writable - put a small object and delete it again
+func (server *Server) checkS3() error {
+	if server.S3FileManager == nil || server.S3FileManager.AWSConfig == nil {
+		return fmt.Errorf("s3 not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	hostname, _ := os.Hostname()
+	key := aws.String(fmt.Sprintf(healthCheckKeyf, hostname))
+	bucket := aws.String(server.S3FileManager.S3BucketName)
+	svc := s3.New(server.S3FileManager.newS3Session())
+	_, err := svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    key,
+		Body:   bytes.NewReader([]byte(ts())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write to bucket %v: %v", *bucket, err)
+	}
+	_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete from bucket %v: %v", *bucket, err)
+	}
+	return nil
+}
+
+// the endpoint responds with a 2xx
+func checkURL(url string) error {
+	if url == "" {
+		return fmt.Errorf("no url configured")
+	}
+	client := &http.Client{Timeout: healthCheckTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%v responded with status %v", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// the mounted config parses, and has the bits the server can't do without
+func checkConfig() error {
+	config, err := readConfig(marinerConfigPath)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return fmt.Errorf("config is empty")
+	}
+	if config.Storage.S3.Name == "" {
+		return fmt.Errorf("config is missing storage.s3.name")
+	}
+	if _, err = config.Auth.tokenDecoder(""); err != nil {
+		return err
+	}
+	if _, err = config.Auth.authorizer(); err != nil {
+		return err
+	}
+	return nil
+}
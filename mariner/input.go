@@ -111,6 +111,15 @@ func (tool *Tool) processFile(f interface{}) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// DRS objects get downloaded by the sidecar from wherever they live, not from s3 - see drs.go
+	if strings.HasPrefix(obj.Path, drsPrefix) {
+		if err = tool.drsInput(obj); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
 	if !strings.HasPrefix(obj.Path, pathToCommonsData) {
 		tool.S3Input.Paths = append(tool.S3Input.Paths, obj.Path)
 	}
@@ -153,6 +162,7 @@ func processFile(f interface{}) (*File, error) {
 	// Mapping:
 	// ---- COMMONS/<guid> -> /commons-data/by-guid/<guid>
 	// ---- USER/<path> -> /user-data/<path> // not implemented yet
+	// ---- drs://<host>/<id> -> drs://<host>/<id> // resolved by tool.processFile(), see drs.go
 	// ---- <path> -> <path> // no path processing required, implies file lives in engine workspace
 	switch {
 	case strings.HasPrefix(path, commonsPrefix):
@@ -145,12 +145,12 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 		// update logdb
 		engine.writeLogToS3()
 
-		// wait out sampling period duration to next sample
-		time.Sleep(metricsSamplingPeriod * time.Second)
-
-		tool.Task.Lock()
-		done = *tool.Task.Done // #race #ok
-		tool.Task.Unlock()
+		// wait out sampling period duration to next sample - or stop as soon as the task job is done
+		select {
+		case <-tool.jobDone:
+			done = true
+		case <-time.After(metricsSamplingPeriod * time.Second):
+		}
 	}
 
 	engine.infof("end collect metrics for task: %v", tool.Task.Root.ID)
@@ -162,23 +162,44 @@ func (engine *K8sEngine) dispatchTaskJob(tool *Tool) error {
 	engine.infof("begin dispatch task job: %v", tool.Task.Root.ID)
 	batchJob, err := engine.taskJob(tool)
 	if err != nil {
-		return engine.errorf("failed to load job spec for task: %v; error: %v", tool.Task.Root.ID, err)
+		err = engine.errorf("failed to load job spec for task: %v; error: %v", tool.Task.Root.ID, err)
+		engine.systemFailure(err.Error())
+		return err
 	}
 	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
 	if err != nil {
-		return engine.errorf("%v", err)
+		err = engine.errorf("%v", err)
+		engine.systemFailure(err.Error())
+		return err
+	}
+	// hold the task back until it fits the user's quotas, see quota.go
+	engine.waitForQuota(tool, batchJob)
+	if engine.cancelRequested() {
+		taskAdmission.Unlock()
+		return engine.errorf("run cancelled - not creating job for task: %v", tool.Task.Root.ID)
+	}
+	// signed access URLs expire - so they're fetched once the task is about to run, see drs.go
+	if err = engine.resolveDRSAccess(tool); err != nil {
+		taskAdmission.Unlock()
+		return engine.errorf("failed to resolve DRS inputs for task: %v; error: %v", tool.Task.Root.ID, err)
 	}
 	newJob, err := jobsClient.Create(batchJob)
+	taskAdmission.Unlock()
 	if err != nil {
-		return engine.errorf("failed to create job for task: %v; error: %v", tool.Task.Root.ID, err)
+		err = engine.errorf("failed to create job for task: %v; error: %v", tool.Task.Root.ID, err)
+		engine.systemFailure(err.Error())
+		return err
 	}
 	engine.infof("created job with (name, id) (%v, %v) for task: %v", newJob.Name, newJob.GetUID(), tool.Task.Root.ID)
 
 	// probably can make this nicer to look at
 	tool.JobID = string(newJob.GetUID())
+	tool.JobCreated = newJob.CreationTimestamp.Time
+	metrics.inc(tasksDispatchedMetric, "")
 
 	tool.Task.Log.JobID = tool.JobID
 	tool.Task.Log.JobName = tool.JobName
+	engine.checkpointTool(tool, running)
 	engine.infof("end dispatch task job: %v", tool.Task.Root.ID)
 	return nil
 }
@@ -257,6 +278,7 @@ func k8sClient(k8sAPI string) (coreClient corev1.CoreV1Interface, jobsClient bat
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("failed to get k8s in-cluster config: %v", err)
 	}
+	config.WrapTransport = instrumentK8sTransport
 	if k8sAPI == k8sMetricsAPI {
 		clientSet, err := metricsClient.NewForConfig(config)
 		if err != nil {
@@ -348,6 +370,16 @@ func jobStatusToString(status *batchv1.JobStatus) string {
 	return unknown
 }
 
+// true once the job is done for good - its pod failing isn't enough, since the engine job may restart its pod, see recovery.go
+func jobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == k8sCore.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
 // background process that collects status of mariner jobs
 // jobs with status COMPLETED are deleted
 // ---> since all logs/other information are collected immmediately when the job finishes
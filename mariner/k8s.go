@@ -25,7 +25,7 @@ import (
 func workflowJob(workflowRequest *WorkflowRequest) (*batchv1.Job, error) {
 
 	// get job spec all populated except for pod volumes and containers
-	workflowJob := jobSpec(marinerEngine, workflowRequest.UserID, workflowRequest.JobName)
+	workflowJob := jobSpec(marinerEngine, workflowRequest.UserID, workflowRequest.JobName, workflowRequest.JobName)
 
 	// fill in the rest of the spec
 	workflowJob.Spec.Template.Spec.Volumes = engineVolumes()
@@ -149,12 +149,20 @@ type TokenUser struct {
 func (engine *K8sEngine) taskJob(tool *Tool) (job *batchv1.Job, err error) {
 	engine.infof("begin load job spec for task: %v", tool.Task.Root.ID)
 	tool.JobName = createJobName()
-	job = jobSpec(marinerTask, engine.UserID, tool.JobName)
+	job = jobSpec(marinerTask, engine.UserID, engine.RunID, tool.JobName)
 
 	if engine.Log.Request.ServiceAccountName != "" {
 		job.Spec.Template.Spec.ServiceAccountName = engine.Log.Request.ServiceAccountName
 	}
 
+	// k8s kills the job once it runs past the tool's ToolTimeLimit, see timelimit.go
+	if tool.TimeLimit, err = engine.toolTimeLimit(tool); err != nil {
+		return nil, engine.errorf("failed to load time limit for task: %v; error: %v", tool.Task.Root.ID, err)
+	}
+	if tool.TimeLimit > 0 {
+		job.Spec.ActiveDeadlineSeconds = &tool.TimeLimit
+	}
+
 	// #ebs
 	job.Spec.Template.Spec.Volumes = engine.taskVolumes(tool)
 
@@ -235,8 +243,12 @@ func (tool *Tool) taskContainer() (container *k8sv1.Container, err error) {
 // TOOL_WORKING_DIR is an envVar - no need to inject from go vars here
 // Q: how to handle case of different possible bash, depending on CLT image specified in CWL?
 // fixme
+// the command's stdout and stderr each get tee'd to a file in the task's log dir
+// so they're archived with the rest of the working dir when the task finishes
+// fifos instead of bash process substitution, since the image may only have /bin/sh
 func (tool *Tool) cltArgs() []string {
 	tool.Task.infof("begin load CommandLineTool container args")
+	logDir := tool.WorkingDir + taskLogDir
 	args := []string{
 		"-c",
 		fmt.Sprintf(`
@@ -247,9 +259,23 @@ func (tool *Tool) cltArgs() []string {
 			echo "Sidecar setup complete! Running command script now.."
 			cd %v
 			echo "running command $(cat %vrun.sh)"
-			%v %vrun.sh
-			touch %vdone
-			`, tool.WorkingDir, tool.WorkingDir, tool.WorkingDir, tool.cltBash(), tool.WorkingDir, tool.WorkingDir),
+			mkdir -p %v
+			mkfifo %vstdout.fifo %vstderr.fifo
+			tee -a %v < %vstdout.fifo &
+			tee -a %v < %vstderr.fifo >&2 &
+			%v %vrun.sh > %vstdout.fifo 2> %vstderr.fifo
+			exitCode=$?
+			wait
+			rm -f %vstdout.fifo %vstderr.fifo
+			echo $exitCode > %vdone
+			exit $exitCode
+			`, tool.WorkingDir, tool.WorkingDir, tool.WorkingDir, logDir,
+			logDir, logDir,
+			tool.taskLogPath(stdoutStream), logDir,
+			tool.taskLogPath(stderrStream), logDir,
+			tool.cltBash(), tool.WorkingDir, logDir, logDir,
+			logDir, logDir,
+			tool.WorkingDir),
 	}
 
 	// for debugging
@@ -309,6 +335,11 @@ func (tool *Tool) env() (env []k8sv1.EnvVar, err error) {
 // for marinerTask job
 func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 	engine.infof("load s3 sidecar env for task: %v", tool.Task.Root.ID)
+	// in a dry run the command isn't generated, see plan.go
+	var command string
+	if tool.Command != nil {
+		command = strings.Join(tool.Command.Args, " ")
+	}
 	env = []k8sv1.EnvVar{
 		{
 			Name:      "AWSCREDS",
@@ -328,7 +359,7 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 		},
 		{
 			Name:  "TOOL_COMMAND", // the command from the commandlinetool to actually execute
-			Value: strings.Join(tool.Command.Args, " "),
+			Value: command,
 		},
 		{
 			Name:  "TOOL_WORKING_DIR", // the tool's working directory - e.g., '/engine-workspace/workflowRuns/{runID}/{taskID}/'
@@ -431,7 +462,7 @@ func (tool *Tool) resourceReqs() (k8sv1.ResourceRequirements, error) {
 
 	// discern user specified settings
 	requests, limits := make(k8sv1.ResourceList), make(k8sv1.ResourceList)
-	for _, requirement := range tool.Task.Root.Requirements {
+	for _, requirement := range tool.requirements() {
 		if requirement.Class == CWLResourceRequirement {
 			// for info on quantities, see: https://godoc.org/k8s.io/apimachinery/pkg/api/resource#Quantity
 			if requirement.CoresMin > 0 {
@@ -528,7 +559,9 @@ func (engine *K8sEngine) taskVolumes(tool *Tool) []k8sv1.Volume {
 		v.Name = volName
 		if volName == engineWorkspaceVolumeName {
 			claimName = fmt.Sprintf("%s-claim", tool.JobName)
-			if err = engine.createPVC(claimName); err != nil {
+			if engine.DryRun {
+				// nothing gets created in a dry run, see plan.go
+			} else if err = engine.createPVC(claimName); err != nil {
 				// only for debugging / dev'ing
 				// don't actually handle the err like this
 				panic(fmt.Sprintf("failed to create PVC: %v", err))
@@ -579,14 +612,23 @@ func (engine *K8sEngine) createPVC(claimName string) error {
 }
 
 // returns marinerEngine/marinerTask job spec with all fields populated EXCEPT volumes and containers
-func jobSpec(component string, userID string, jobName string) (job *batchv1.Job) {
+// the engine job's name is the runID
+func jobSpec(component string, userID string, runID string, jobName string) (job *batchv1.Job) {
 
 	jobConfig := Config.jobConfig(component)
 	job = new(batchv1.Job)
 	job.Kind, job.APIVersion = "Job", "v1"
+
+	// the run's label lets the run's jobs and pods be found without the run log, see cancel.go
+	labels := make(map[string]string)
+	for k, v := range jobConfig.Labels {
+		labels[k] = v
+	}
+	labels[runIDLabel] = runID
+
 	// meta for pod and job objects are same
-	job.Name, job.Labels = jobName, jobConfig.Labels
-	job.Spec.Template.Name, job.Spec.Template.Labels = jobName, jobConfig.Labels
+	job.Name, job.Labels = jobName, labels
+	job.Spec.Template.Name, job.Spec.Template.Labels = jobName, labels
 	job.Spec.Template.Spec.RestartPolicy = jobConfig.restartPolicy()
 	job.Spec.Template.Spec.Tolerations = k8sTolerations
 
@@ -594,10 +636,13 @@ func jobSpec(component string, userID string, jobName string) (job *batchv1.Job)
 		job.Spec.Template.Spec.ServiceAccountName = jobConfig.ServiceAccount
 	}
 
-	// so it never restarts / retries
+	// so it never restarts / retries - except the engine, which picks up where it left off, see recovery.go
 	one := int32(1)
-	zero := int32(0)
-	job.Spec.BackoffLimit = &zero
+	backoffLimit := int32(0)
+	if component == marinerEngine {
+		backoffLimit = int32(jobConfig.MaxRestarts)
+	}
+	job.Spec.BackoffLimit = &backoffLimit
 	job.Spec.Completions = &one
 
 	// only one pod running for this job at a time
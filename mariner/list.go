@@ -0,0 +1,294 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// this file contains code for listing runs
+// i.e., the '/runs' GET endpoint - sorted newest first, filtered, paginated
+// by default a user's own runs are listed
+// with scope=all, every run the user may read is listed, see authz.go
+// ----- which runs those are is decided from the run index, before any run log is fetched
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	// runIDs are created by createJobName() - the first part is the submission time
+	runIDTimeLayout = "010206150405"
+
+	mineScope = "mine"
+	allScope  = "all"
+)
+
+// RunListQuery holds the filters and page parameters for listing runs
+// query params:
+// - state: WES state, e.g., "RUNNING"
+// - tag: "key:val" - may be given more than once, runs must match all of them
+// - created_before, created_after: RFC 3339 timestamps
+// - page_size, page_token
+// - scope: "mine" (default) or "all"
+type RunListQuery struct {
+	Scope         string
+	State         string
+	Tags          map[string]string
+	CreatedBefore *time.Time
+	CreatedAfter  *time.Time
+	PageSize      int
+	PageToken     string
+}
+
+// runListQuery parses the '/runs' GET query params
+func runListQuery(r *http.Request) (*RunListQuery, error) {
+	params := r.URL.Query()
+	q := &RunListQuery{
+		Scope:     params.Get("scope"),
+		State:     strings.ToUpper(params.Get("state")),
+		Tags:      make(map[string]string),
+		PageSize:  defaultPageSize,
+		PageToken: params.Get("page_token"),
+	}
+	switch q.Scope {
+	case "":
+		q.Scope = mineScope
+	case mineScope, allScope:
+	default:
+		return nil, fmt.Errorf("invalid scope %q - must be one of mine, all", q.Scope)
+	}
+	for _, tag := range params["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tag filter %q - expected key:val", tag)
+		}
+		q.Tags[kv[0]] = kv[1]
+	}
+	var err error
+	if q.CreatedBefore, err = timeParam(params.Get("created_before")); err != nil {
+		return nil, fmt.Errorf("invalid created_before: %v", err)
+	}
+	if q.CreatedAfter, err = timeParam(params.Get("created_after")); err != nil {
+		return nil, fmt.Errorf("invalid created_after: %v", err)
+	}
+	if size := params.Get("page_size"); size != "" {
+		if q.PageSize, err = strconv.Atoi(size); err != nil || q.PageSize < 1 {
+			return nil, fmt.Errorf("invalid page_size %q", size)
+		}
+		if q.PageSize > maxPageSize {
+			q.PageSize = maxPageSize
+		}
+	}
+	if q.PageToken != "" {
+		if _, err = runIDTime(q.PageToken); err != nil {
+			return nil, fmt.Errorf("invalid page_token %q", q.PageToken)
+		}
+	}
+	return q, nil
+}
+
+func timeParam(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// returns the time the run was submitted, as encoded in the runID
+func runIDTime(runID string) (time.Time, error) {
+	return time.ParseInLocation(runIDTimeLayout, strings.SplitN(runID, "-", 2)[0], time.Local)
+}
+
+// newest first - ties broken by runID so that the order is total
+// this matters since the page token is the last runID of the previous page
+func runIDBefore(a, b string) bool {
+	ta, _ := runIDTime(a)
+	tb, _ := runIDTime(b)
+	if !ta.Equal(tb) {
+		return ta.After(tb)
+	}
+	return a > b
+}
+
+// applies the filters which depend only on the runID
+func (q *RunListQuery) matchRunID(runID string) bool {
+	t, err := runIDTime(runID)
+	if err != nil {
+		// not a run
+		return false
+	}
+	if q.CreatedBefore != nil && !t.Before(*q.CreatedBefore) {
+		return false
+	}
+	if q.CreatedAfter != nil && !t.After(*q.CreatedAfter) {
+		return false
+	}
+	if q.PageToken != "" && !runIDBefore(q.PageToken, runID) {
+		return false
+	}
+	return true
+}
+
+// applies the filters which depend on the run log
+func (q *RunListQuery) matchSummary(summary *RunSummaryJSON) bool {
+	if q.State != "" && summary.State != q.State {
+		return false
+	}
+	for k, v := range q.Tags {
+		if summary.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// '/runs' - GET
+// visible decides which of other users' runs are listed - nil for scope=mine
+func (server *Server) fetchRuns(userID string, q *RunListQuery, visible authMapping) (*ListRunsJSON, error) {
+	refs, err := server.runRefs(userID, q.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []*runRef{}
+	for _, ref := range refs {
+		if ref.UserID != userID && !visible.allows(runResource(ref.Project, ref.RunID), readAction) {
+			continue
+		}
+		if q.matchRunID(ref.RunID) {
+			candidates = append(candidates, ref)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return runIDBefore(candidates[i].RunID, candidates[j].RunID)
+	})
+
+	// fetch summaries a batch at a time until the page is full
+	// so we only download the logs we need
+	// collect one extra run to know whether there's a next page
+	runs := []*RunSummaryJSON{}
+	for start := 0; start < len(candidates) && len(runs) <= q.PageSize; start += q.PageSize {
+		end := start + q.PageSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		for _, summary := range server.runSummaries(candidates[start:end]) {
+			if q.matchSummary(summary) {
+				runs = append(runs, summary)
+			}
+		}
+	}
+
+	j := &ListRunsJSON{Runs: runs}
+	if len(runs) > q.PageSize {
+		j.Runs = runs[:q.PageSize]
+		j.NextPageToken = j.Runs[q.PageSize-1].RunID
+	}
+	return j, nil
+}
+
+// the user's own runs - plus, for scope=all, every run in the run index
+func (server *Server) runRefs(userID, scope string) ([]*runRef, error) {
+	runIDs, err := server.listRuns(userID)
+	if err != nil {
+		return nil, err
+	}
+	refs := []*runRef{}
+	seen := make(map[string]bool)
+	for _, runID := range runIDs {
+		refs = append(refs, &runRef{UserID: userID, RunID: runID})
+		seen[runID] = true
+	}
+	if scope != allScope {
+		return refs, nil
+	}
+	indexed, err := server.listRunIndex("")
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range indexed {
+		if !seen[ref.RunID] {
+			refs = append(refs, ref)
+			seen[ref.RunID] = true
+		}
+	}
+	return refs, nil
+}
+
+// fetches the summary of each run concurrently
+// returned summaries are in the same order as the given runs
+func (server *Server) runSummaries(refs []*runRef) []*RunSummaryJSON {
+	summaries := make([]*RunSummaryJSON, len(refs))
+	var wg sync.WaitGroup
+	guard := make(chan struct{}, server.S3FileManager.MaxConcurrent)
+	for i, ref := range refs {
+		// blocks if guard channel is already full to capacity
+		guard <- struct{}{}
+
+		wg.Add(1)
+		go func(i int, ref *runRef) {
+			defer wg.Done()
+			summaries[i] = server.runSummary(ref.UserID, ref.RunID)
+			<-guard
+		}(i, ref)
+	}
+	wg.Wait()
+	return summaries
+}
+
+func (server *Server) runSummary(userID, runID string) *RunSummaryJSON {
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err == nil {
+		summary := runSummaryJSON(runID, runLog)
+		summary.User = userID
+		return summary
+	}
+
+	// the engine writes the run log once it starts
+	// if there's no log but there is a request, the run is queued
+	summary := &RunSummaryJSON{RunID: runID, State: stateUnknown, User: userID}
+	if request, err := server.fetchRequest(userID, runID); err == nil {
+		summary.State = stateQueued
+		summary.Tags = request.Tags
+		summary.Project = request.Project
+	}
+	return summary
+}
+
+// fetch the workflow request for this run from s3
+func (server *Server) fetchRequest(userID, runID string) (*WorkflowRequest, error) {
+	sess := server.S3FileManager.newS3Session()
+	downloader := s3manager.NewDownloader(sess)
+	buf := &aws.WriteAtBuffer{}
+
+	key := fmt.Sprintf("/%s/workflowRuns/%s/%s", userID, runID, requestFile)
+	_, err := downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errRunNotFound
+		}
+		return nil, fmt.Errorf("failed to download file, %v", err)
+	}
+
+	r := &WorkflowRequest{}
+	if err = json.Unmarshal(buf.Bytes(), r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling workflow request: %v", err)
+	}
+	return r, nil
+}
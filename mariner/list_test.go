@@ -0,0 +1,90 @@
+package mariner
+
+import (
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestRunListQuery(t *testing.T) {
+	cases := []struct {
+		query    string
+		valid    bool
+		pageSize int
+	}{
+		{"", true, defaultPageSize},
+		{"page_size=10", true, 10},
+		{"page_size=100000", true, maxPageSize},
+		{"page_size=0", false, 0},
+		{"page_size=ten", false, 0},
+		{"page_token=031524101500-abcde", true, defaultPageSize},
+		{"page_token=not-a-run", false, 0},
+		{"scope=all&tag=study:a&tag=batch:1", true, defaultPageSize},
+		{"scope=everyone", false, 0},
+		{"tag=study", false, 0},
+		{"created_after=2024-03-15T10:15:00Z", true, defaultPageSize},
+		{"created_before=yesterday", false, 0},
+	}
+	for _, c := range cases {
+		q, err := runListQuery(httptest.NewRequest("GET", "/runs?"+c.query, nil))
+		switch {
+		case c.valid && err != nil:
+			t.Errorf("%q: unexpected error: %v", c.query, err)
+		case !c.valid && err == nil:
+			t.Errorf("%q: expected an error", c.query)
+		case c.valid && q.PageSize != c.pageSize:
+			t.Errorf("%q: expected page size %v, got %v", c.query, c.pageSize, q.PageSize)
+		}
+	}
+}
+
+// paging through the runs with the page tokens lists every run once, newest first
+func TestPageTokens(t *testing.T) {
+	runIDs := []string{
+		"031524101500-aaaaa",
+		"031524101500-bbbbb", // same second as the one before
+		"031524101459-zzzzz",
+		"123123235959-ccccc",
+		"010125000000-ddddd", // jan 1 of the year after
+		"not-a-run",
+	}
+	expected := []string{
+		"010125000000-ddddd",
+		"031524101500-bbbbb", // ties are broken by runID, descending
+		"031524101500-aaaaa",
+		"031524101459-zzzzz",
+		"123123235959-ccccc", // dec 31 of the year before
+	}
+
+	for _, pageSize := range []int{1, 2, 3, 10} {
+		listed := []string{}
+		q := &RunListQuery{PageSize: pageSize}
+		for {
+			page := []string{}
+			for _, runID := range runIDs {
+				if q.matchRunID(runID) {
+					page = append(page, runID)
+				}
+			}
+			sort.Slice(page, func(i, j int) bool { return runIDBefore(page[i], page[j]) })
+			if len(page) > pageSize {
+				page = page[:pageSize]
+			}
+			listed = append(listed, page...)
+			if len(page) < pageSize {
+				break
+			}
+			q.PageToken = page[len(page)-1]
+		}
+		if len(listed) != len(expected) {
+			t.Errorf("page size %v: expected %v, got %v", pageSize, expected, listed)
+			continue
+		}
+		for i := range expected {
+			if listed[i] != expected[i] {
+				t.Errorf("page size %v: expected %v, got %v", pageSize, expected, listed)
+				break
+			}
+		}
+	}
+}
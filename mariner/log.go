@@ -23,6 +23,7 @@ type MainLog struct {
 	Request      *WorkflowRequest `json:"request"`
 	Main         *Log             `json:"main"`
 	ByProcess    map[string]*Log  `json:"byProcess"`
+	Callbacks    []*CallbackLog   `json:"callbacks,omitempty"`
 }
 
 // MainLogJSON gets written to workflowHistorydb
@@ -31,9 +32,11 @@ type MainLogJSON struct {
 	Request   *WorkflowRequest `json:"request"`
 	Main      *Log             `json:"main"`
 	ByProcess map[string]*Log  `json:"byProcess"`
+	Callbacks []*CallbackLog   `json:"callbacks,omitempty"`
 }
 
-// TODO - sort list - latest to oldest request
+// returns all of this user's runIDs, in no particular order
+// see list.go for sorting, filtering and pagination
 func (server *Server) listRuns(userID string) ([]string, error) {
 	sess := server.S3FileManager.newS3Session()
 	svc := s3.New(sess)
@@ -43,15 +46,18 @@ func (server *Server) listRuns(userID string) ([]string, error) {
 		Prefix:    aws.String(prefix),
 		Delimiter: aws.String("/"),
 	}
-	result, err := svc.ListObjectsV2(query)
+	// one call returns at most 1000 keys - page through all of them
+	runIDs := []string{}
+	err := svc.ListObjectsV2Pages(query, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, v := range page.CommonPrefixes {
+			runID := strings.Split(aws.StringValue(v.Prefix), "/")[2]
+			runIDs = append(runIDs, runID)
+		}
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
-	runIDs := []string{}
-	for _, v := range result.CommonPrefixes {
-		runID := strings.Split(v.String(), "/")[2]
-		runIDs = append(runIDs, runID)
-	}
 	return runIDs, nil
 }
 
@@ -78,6 +84,9 @@ func (server *Server) fetchMainLog(userID, runID string) (*MainLog, error) {
 	}
 	_, err = downloader.Download(buf, s3Obj)
 	if err != nil {
+		if isNotFound(err) {
+			return nil, errRunNotFound
+		}
 		return nil, fmt.Errorf("failed to download file, %v", err)
 	}
 	b := buf.Bytes()
@@ -118,6 +127,11 @@ func (engine *K8sEngine) writeLogToS3() error {
 		log.Engine.LastUpdated = t
 	*/
 
+	// a dry run has no log to write, see plan.go
+	if engine.DryRun {
+		return nil
+	}
+
 	engine.Log.RLock()
 	defer engine.Log.RUnlock()
 
@@ -129,6 +143,7 @@ func (engine *K8sEngine) writeLogToS3() error {
 		Request:   engine.Log.Request,
 		Main:      engine.Log.Main,
 		ByProcess: engine.Log.ByProcess,
+		Callbacks: engine.Log.Callbacks,
 	}
 	j, err := json.Marshal(mainLogJSON)
 	if err != nil {
@@ -159,6 +174,7 @@ func (server *Server) writeLog(mainLog *MainLog, userID string, runID string) er
 		Request:   mainLog.Request,
 		Main:      mainLog.Main,
 		ByProcess: mainLog.ByProcess,
+		Callbacks: mainLog.Callbacks,
 	}
 	j, err := json.Marshal(mainLogJSON)
 	if err != nil {
@@ -197,12 +213,20 @@ type Log struct {
 	JobID          string                 `json:"jobID,omitempty"`
 	JobName        string                 `json:"jobName,omitempty"`
 	ContainerImage string                 `json:"containerImage,omitempty"`
+	Command        []string               `json:"command,omitempty"`
+	WorkingDir     string                 `json:"workingDir,omitempty"`
 	Status         string                 `json:"status"`
 	Stats          *Stats                 `json:"stats"`
 	Event          *EventLog              `json:"eventLog,omitempty"`
 	Input          map[string]interface{} `json:"input"`
 	Output         map[string]interface{} `json:"output"`
 	Scatter        map[int]*Log           `json:"scatter,omitempty"`
+	ReusedFrom     string                 `json:"reusedFrom,omitempty"` // the run whose outputs this task reused, see resume.go
+	CallCache      *CallCacheLog          `json:"callCache,omitempty"`  // see cache.go
+	FailureReason  string                 `json:"failureReason,omitempty"`
+	SystemError    bool                   `json:"systemError,omitempty"` // the engine or the cluster failed the run - see failure.go
+	ExitCode       *int32                 `json:"exitCode,omitempty"`    // of the task's command
+	Attempts       []*AttemptLog          `json:"attempts,omitempty"`    // see retry.go
 }
 
 func (r *ResourceUsage) init() {
@@ -218,29 +242,48 @@ func (s *ResourceUsageSeries) append(p ResourceUsageSamplePoint) {
 func (engine *K8sEngine) startTaskLog(task *Task) {
 	task.Log.start()
 	engine.writeLogToS3()
+	engine.publishTaskEvent(task)
 }
 
 // called when a task finishes running
 func (engine *K8sEngine) finishTaskLog(task *Task) {
 	task.Log.finish()
+	if engine.cancelRequested() {
+		// the run isn't cancelled until its task pods are gone, see finishCancel()
+		if task.Log == engine.Log.Main {
+			task.Log.Status = canceling
+		} else {
+			task.Log.Status = cancelled
+		}
+	}
+	metrics.observe(taskDurationMetric, labels("class", task.Root.Class, "status", task.Log.Status), task.Log.Stats.Duration)
 	engine.writeLogToS3()
+	engine.publishTaskEvent(task)
 }
 
 // called when a task finishes running
+// tasks which failed or got skipped stay that way, see failure.go
 func (log *Log) finish() {
 	t := time.Now()
 	log.LastUpdatedObj = t
 	log.LastUpdated = timef(log.LastUpdatedObj)
-	log.Stats.DurationObj = t.Sub(log.CreatedObj)
-	log.Stats.Duration = log.Stats.DurationObj.Seconds()
-	log.Status = completed
+	if !log.CreatedObj.IsZero() {
+		log.Stats.DurationObj = t.Sub(log.CreatedObj)
+		log.Stats.Duration = log.Stats.DurationObj.Seconds()
+	}
+	if log.Status != failed && log.Status != skipped {
+		log.Status = completed
+	}
 }
 
 // called when a task is run
 func (log *Log) start() {
 	t := time.Now()
-	log.CreatedObj = t
-	log.Created = timef(t)
+	if log.CreatedObj.IsZero() {
+		// a log carried on from before the engine restarted keeps its start time, see recovery.go
+		log.CreatedObj = t
+		log.Created = timef(t)
+	}
 	log.LastUpdatedObj = t
 	log.LastUpdated = timef(t)
 	log.Status = running
@@ -0,0 +1,626 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for prometheus metrics
+// there's no prometheus client lib vendored, so metrics are kept in a small registry here
+// and written out in the prometheus text format
+//
+// server side:
+// '/metrics' exposes the server's own metrics - runs submitted, API latency, arborist/s3/k8s calls -
+// along with the engine metrics of all the runs, re-exported
+//
+// engine side:
+// the engine and task jobs are short-lived, so they can't be scraped
+// instead the engine writes a snapshot of its metrics next to the run log ("metrics.json")
+// every time a task or the run changes state
+// the server picks up the snapshots of the runs which have an engine job in the cluster
+// once a run is over, its last snapshot gets folded into the totals, so the counters keep going up
+//
+// the sidecar writes the number of bytes it moved to the task's log dir,
+// and the engine reads that file once the task finishes
+
+const (
+	metricsFile = "metrics.json"
+
+	// written by the sidecar to the task's log dir
+	sidecarMetricsFile = "sidecar_metrics.json"
+
+	// how often the server picks up the engine snapshots
+	metricsScrapePeriod = 30 * time.Second
+
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+
+	// server
+	runsSubmittedMetric      = "mariner_runs_submitted_total"
+	runsActiveMetric         = "mariner_runs_active"
+	runsFinishedMetric       = "mariner_runs_finished_total"
+	httpDurationMetric       = "mariner_http_request_duration_seconds"
+	dependencyDurationMetric = "mariner_dependency_request_duration_seconds"
+	dependencyErrorsMetric   = "mariner_dependency_errors_total"
+
+	// engine
+	tasksDispatchedMetric = "mariner_tasks_dispatched_total"
+	taskDurationMetric    = "mariner_task_duration_seconds"
+	taskQueueWaitMetric   = "mariner_task_queue_wait_seconds"
+	sidecarBytesMetric    = "mariner_sidecar_bytes_total"
+	callCacheMetric       = "mariner_call_cache_lookups_total"
+
+	// dependencies
+	arboristDependency = "arborist"
+	s3Dependency       = "s3"
+	k8sDependency      = "k8s"
+)
+
+var (
+	latencyBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 43200, 86400}
+)
+
+type metricDef struct {
+	kind    string
+	help    string
+	buckets []float64
+}
+
+var metricDefs = map[string]*metricDef{
+	runsSubmittedMetric:      {counterMetric, "Workflow runs submitted.", nil},
+	runsActiveMetric:         {gaugeMetric, "Workflow runs with an engine job in the cluster, by state.", nil},
+	runsFinishedMetric:       {counterMetric, "Workflow runs finished, by final state.", nil},
+	httpDurationMetric:       {histogramMetric, "Latency of mariner API requests, by route.", latencyBuckets},
+	dependencyDurationMetric: {histogramMetric, "Latency of calls to arborist, s3 and k8s.", latencyBuckets},
+	dependencyErrorsMetric:   {counterMetric, "Failed calls to arborist, s3 and k8s.", nil},
+	tasksDispatchedMetric:    {counterMetric, "Task jobs dispatched by the engine.", nil},
+	taskDurationMetric:       {histogramMetric, "Duration of tasks, by class and status.", durationBuckets},
+	taskQueueWaitMetric:      {histogramMetric, "Time from task job creation to the task container running.", durationBuckets},
+	sidecarBytesMetric:       {counterMetric, "Bytes moved between s3 and the task pods by the sidecar.", nil},
+	callCacheMetric:          {counterMetric, "Call cache lookups, by result (hit or miss).", nil},
+}
+
+// the metrics of this process - the server or the engine
+var metrics = newMetrics()
+
+// Metrics holds counters and histograms by metric name, then by label set
+// the label set is kept in its prometheus form, e.g., `{route="/runs",method="GET"}`
+type Metrics struct {
+	sync.Mutex `json:"-"`
+	Counters   map[string]map[string]float64    `json:"counters"`
+	Histograms map[string]map[string]*Histogram `json:"histograms"`
+}
+
+// Histogram ..
+// Counts[i] is the number of observations in (Buckets[i-1], Buckets[i]] - the last count is for (Buckets[n-1], +Inf)
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+// MetricsSnapshot is what the engine writes to s3
+type MetricsSnapshot struct {
+	RunID   string   `json:"run_id"`
+	State   string   `json:"state"`
+	Time    string   `json:"time"`
+	Metrics *Metrics `json:"metrics"`
+}
+
+// SidecarMetrics is written by the sidecar once it has uploaded the task's output
+type SidecarMetrics struct {
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		Counters:   make(map[string]map[string]float64),
+		Histograms: make(map[string]map[string]*Histogram),
+	}
+}
+
+// returns the prometheus form of the given label pairs, e.g., labels("route", "/runs") -> `{route="/runs"}`
+func labels(kv ...string) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", kv[i], kv[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metrics) inc(name, labels string) {
+	m.add(name, labels, 1)
+}
+
+func (m *Metrics) add(name, labels string, v float64) {
+	m.Lock()
+	defer m.Unlock()
+	if m.Counters[name] == nil {
+		m.Counters[name] = make(map[string]float64)
+	}
+	m.Counters[name][labels] += v
+}
+
+func (m *Metrics) observe(name, labels string, v float64) {
+	m.Lock()
+	defer m.Unlock()
+	if m.Histograms[name] == nil {
+		m.Histograms[name] = make(map[string]*Histogram)
+	}
+	h, ok := m.Histograms[name][labels]
+	if !ok {
+		buckets := latencyBuckets
+		if def, ok := metricDefs[name]; ok && def.buckets != nil {
+			buckets = def.buckets
+		}
+		h = &Histogram{Buckets: buckets, Counts: make([]uint64, len(buckets)+1)}
+		m.Histograms[name][labels] = h
+	}
+	i := sort.SearchFloat64s(h.Buckets, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+// adds the other metrics to these
+func (m *Metrics) merge(other *Metrics) {
+	other = other.copy()
+	m.Lock()
+	defer m.Unlock()
+	for name, series := range other.Counters {
+		if m.Counters[name] == nil {
+			m.Counters[name] = make(map[string]float64)
+		}
+		for l, v := range series {
+			m.Counters[name][l] += v
+		}
+	}
+	for name, series := range other.Histograms {
+		if m.Histograms[name] == nil {
+			m.Histograms[name] = make(map[string]*Histogram)
+		}
+		for l, h := range series {
+			mine, ok := m.Histograms[name][l]
+			if !ok {
+				m.Histograms[name][l] = h
+				continue
+			}
+			if len(mine.Counts) != len(h.Counts) {
+				// bucket layout changed between versions - can't add them up
+				continue
+			}
+			for i := range h.Counts {
+				mine.Counts[i] += h.Counts[i]
+			}
+			mine.Sum += h.Sum
+			mine.Count += h.Count
+		}
+	}
+}
+
+func (m *Metrics) copy() *Metrics {
+	m.Lock()
+	defer m.Unlock()
+	c := newMetrics()
+	for name, series := range m.Counters {
+		c.Counters[name] = make(map[string]float64)
+		for l, v := range series {
+			c.Counters[name][l] = v
+		}
+	}
+	for name, series := range m.Histograms {
+		c.Histograms[name] = make(map[string]*Histogram)
+		for l, h := range series {
+			c.Histograms[name][l] = &Histogram{
+				Buckets: append([]float64{}, h.Buckets...),
+				Counts:  append([]uint64{}, h.Counts...),
+				Sum:     h.Sum,
+				Count:   h.Count,
+			}
+		}
+	}
+	return c
+}
+
+// writes the metrics in the prometheus text format
+func (m *Metrics) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	for _, name := range sortedKeys(m.Counters) {
+		writeHeader(w, name, counterMetric)
+		writeSeries(w, name, m.Counters[name])
+	}
+	for _, name := range sortedKeys(m.Histograms) {
+		writeHeader(w, name, histogramMetric)
+		series := m.Histograms[name]
+		ls := make([]string, 0, len(series))
+		for l := range series {
+			ls = append(ls, l)
+		}
+		sort.Strings(ls)
+		for _, l := range ls {
+			h := series[l]
+			var cumulative uint64
+			for i, count := range h.Counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(h.Buckets) {
+					le = fmt.Sprint(h.Buckets[i])
+				}
+				fmt.Fprintf(w, "%v_bucket%v %v\n", name, withLabel(l, "le", le), cumulative)
+			}
+			fmt.Fprintf(w, "%v_sum%v %v\n", name, l, h.Sum)
+			fmt.Fprintf(w, "%v_count%v %v\n", name, l, h.Count)
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, kind string) {
+	if def, ok := metricDefs[name]; ok {
+		fmt.Fprintf(w, "# HELP %v %v\n", name, def.help)
+	}
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+func writeSeries(w io.Writer, name string, series map[string]float64) {
+	ls := make([]string, 0, len(series))
+	for l := range series {
+		ls = append(ls, l)
+	}
+	sort.Strings(ls)
+	for _, l := range ls {
+		fmt.Fprintf(w, "%v%v %v\n", name, l, series[l])
+	}
+}
+
+// adds one label to a label set
+func withLabel(l, k, v string) string {
+	if l == "" {
+		return labels(k, v)
+	}
+	return strings.TrimSuffix(l, "}") + "," + strings.TrimPrefix(labels(k, v), "{")
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch v := m.(type) {
+	case map[string]map[string]float64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*Histogram:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//// dependency calls ////
+
+func observeDependency(dependency, operation string, start time.Time, err error) {
+	l := labels("dependency", dependency, "operation", operation)
+	metrics.observe(dependencyDurationMetric, l, time.Since(start).Seconds())
+	if err != nil {
+		metrics.inc(dependencyErrorsMetric, l)
+	}
+}
+
+// times every request made with an s3 session
+func instrumentS3Session(r *request.Request) {
+	observeDependency(s3Dependency, r.Operation.Name, r.Time, r.Error)
+}
+
+// times every request made with a k8s client
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	if err == nil && resp.StatusCode >= 500 {
+		err = fmt.Errorf("k8s responded with status %v", resp.StatusCode)
+	}
+	observeDependency(k8sDependency, r.Method, start, err)
+	return resp, err
+}
+
+func instrumentK8sTransport(rt http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{next: rt}
+}
+
+//// engine side ////
+
+// writes a snapshot of the engine's metrics to s3 whenever there are new events, until the bus closes
+func (engine *K8sEngine) pushMetrics(events <-chan *Event, done chan<- struct{}) {
+	defer close(done)
+	for e := range events {
+		// a task finishing often sets off a bunch of events - write once for all of them
+		for drained := false; !drained; {
+			select {
+			case next, ok := <-events:
+				if !ok {
+					drained = true
+				} else {
+					e = next
+				}
+			default:
+				drained = true
+			}
+		}
+		state := runState(engine.Log)
+		if e.Type == runStateEvent {
+			state = e.State
+		}
+		if err := engine.writeMetricsToS3(state); err != nil {
+			fmt.Println("failed to write metrics to s3: ", err)
+		}
+	}
+}
+
+func (engine *K8sEngine) writeMetricsToS3(state string) error {
+	b, err := json.Marshal(&MetricsSnapshot{
+		RunID:   engine.RunID,
+		State:   state,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Metrics: metrics.copy(),
+	})
+	if err != nil {
+		return err
+	}
+	uploader := s3manager.NewUploader(engine.S3FileManager.newS3Session())
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(metricsKey(engine.UserID, engine.RunID)),
+		Body:   bytes.NewReader(b),
+	})
+	return err
+}
+
+func metricsKey(userID, runID string) string {
+	return fmt.Sprintf(pathToUserRunsf, userID) + runID + "/" + metricsFile
+}
+
+// called once a task job has finished - records the queue wait and the bytes moved by the sidecar
+func (engine *K8sEngine) collectTaskMetrics(tool *Tool) {
+	if wait, err := queueWait(tool); err != nil {
+		tool.Task.Log.Event.warnf("failed to get queue wait time: %v", err)
+	} else {
+		metrics.observe(taskQueueWaitMetric, "", wait.Seconds())
+	}
+
+	sidecar, err := engine.sidecarMetrics(tool)
+	if err != nil {
+		tool.Task.Log.Event.warnf("failed to get sidecar metrics: %v", err)
+		return
+	}
+	metrics.add(sidecarBytesMetric, labels("direction", "download"), float64(sidecar.BytesDownloaded))
+	metrics.add(sidecarBytesMetric, labels("direction", "upload"), float64(sidecar.BytesUploaded))
+}
+
+// time from the task job being created to the task container running
+func queueWait(tool *Tool) (time.Duration, error) {
+	_, _, podsClient, _, err := k8sClient(k8sPodAPI)
+	if err != nil {
+		return 0, err
+	}
+	pods, err := podsClient.List(metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%v", tool.JobName)})
+	if err != nil {
+		return 0, err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != taskContainerName {
+				continue
+			}
+			switch {
+			case status.State.Running != nil:
+				return status.State.Running.StartedAt.Sub(tool.JobCreated), nil
+			case status.State.Terminated != nil:
+				return status.State.Terminated.StartedAt.Sub(tool.JobCreated), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("task container of job %v never ran", tool.JobName)
+}
+
+func (engine *K8sEngine) sidecarMetrics(tool *Tool) (*SidecarMetrics, error) {
+	path := fmt.Sprintf("%v%v%v", tool.WorkingDir, taskLogDir, sidecarMetricsFile)
+	key := strings.TrimPrefix(engine.S3FileManager.s3Key(path, engine.UserID), "/")
+	buf := &aws.WriteAtBuffer{}
+	downloader := s3manager.NewDownloader(engine.S3FileManager.newS3Session())
+	_, err := downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sidecar := &SidecarMetrics{}
+	if err = json.Unmarshal(buf.Bytes(), sidecar); err != nil {
+		return nil, err
+	}
+	return sidecar, nil
+}
+
+//// server side ////
+
+// metricsScraper keeps the engine metrics of all the runs
+type metricsScraper struct {
+	sync.Mutex
+	retired  *Metrics                    // totals of the runs which are over
+	active   map[string]*MetricsSnapshot // latest snapshot of each run which is still going, by runID
+	finished map[string]bool             // runs already retired whose engine jobs are still in the cluster
+}
+
+func newMetricsScraper() *metricsScraper {
+	return &metricsScraper{
+		retired:  newMetrics(),
+		active:   make(map[string]*MetricsSnapshot),
+		finished: make(map[string]bool),
+	}
+}
+
+func (server *Server) scrapeMetrics() {
+	for {
+		if err := server.scraper.scrape(server.S3FileManager); err != nil {
+			fmt.Println("error scraping engine metrics: ", err)
+		}
+		time.Sleep(metricsScrapePeriod)
+	}
+}
+
+// picks up the latest snapshot of each run with an engine job in the cluster
+func (scraper *metricsScraper) scrape(fm *S3FileManager) error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	engines, err := jobsClient.List(metav1.ListOptions{LabelSelector: "app=mariner-engine"})
+	if err != nil {
+		return err
+	}
+	svc := s3.New(fm.newS3Session())
+
+	scraper.Lock()
+	defer scraper.Unlock()
+	inCluster := make(map[string]bool)
+	for _, job := range engines.Items {
+		runID, userID := job.Name, job.Spec.Template.Annotations["gen3username"]
+		inCluster[runID] = true
+		if scraper.finished[runID] {
+			continue
+		}
+		snapshot, err := fetchMetricsSnapshot(svc, fm.S3BucketName, userID, runID)
+		if err != nil {
+			if !isNotFound(err) {
+				fmt.Println("error fetching metrics snapshot: ", runID, err)
+			}
+			continue
+		}
+		scraper.active[runID] = snapshot
+		if finalState(snapshot.State) {
+			scraper.retire(runID)
+			metrics.inc(runsFinishedMetric, labels("state", snapshot.State))
+		}
+	}
+
+	// engine jobs which are gone without a final snapshot, e.g., cancelled runs
+	for runID := range scraper.active {
+		if !inCluster[runID] {
+			scraper.retire(runID)
+		}
+	}
+	for runID := range scraper.finished {
+		if !inCluster[runID] {
+			delete(scraper.finished, runID)
+		}
+	}
+	return nil
+}
+
+func (scraper *metricsScraper) retire(runID string) {
+	scraper.retired.merge(scraper.active[runID].Metrics)
+	delete(scraper.active, runID)
+	scraper.finished[runID] = true
+}
+
+func fetchMetricsSnapshot(svc *s3.S3, bucket, userID, runID string) (*MetricsSnapshot, error) {
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(metricsKey(userID, runID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	snapshot := &MetricsSnapshot{}
+	if err = json.NewDecoder(obj.Body).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Metrics == nil {
+		snapshot.Metrics = newMetrics()
+	}
+	return snapshot, nil
+}
+
+// the engine metrics of all the runs, and the number of active runs by state
+func (scraper *metricsScraper) engineMetrics() (*Metrics, map[string]float64) {
+	scraper.Lock()
+	defer scraper.Unlock()
+	m := scraper.retired.copy()
+	active := make(map[string]float64)
+	for _, snapshot := range scraper.active {
+		m.merge(snapshot.Metrics)
+		active[labels("state", snapshot.State)]++
+	}
+	return m, active
+}
+
+// '/metrics' - GET
+func (server *Server) handleMetricsGET(w http.ResponseWriter, r *http.Request) {
+	m, active := server.scraper.engineMetrics()
+	m.merge(metrics)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+	writeHeader(w, runsActiveMetric, gaugeMetric)
+	writeSeries(w, runsActiveMetric, active)
+}
+
+// times every API request, by route
+func (server *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		l := labels("route", route, "method", r.Method, "code", fmt.Sprint(sw.status))
+		metrics.observe(httpDurationMetric, l, time.Since(start).Seconds())
+	})
+}
+
+// records the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// task logs and run events get streamed, so pass flushes along
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
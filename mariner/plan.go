@@ -0,0 +1,363 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	cwl "github.com/uc-cdis/cwl.go"
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+)
+
+// this file contains code for dry runs
+// i.e., 'POST /runs?dry_run=true' and 'mariner plan'
+//
+// a dry run resolves the task graph of the workflow, like the engine does, but dispatches nothing
+// and returns the plan - every task with
+// ----- its dependencies (the steps whose outputs it takes)
+// ----- the fan-out of scattered steps - if the scattered inputs come from the workflow inputs
+// ----- the docker image, resource requests/limits and the rendered job spec of each CommandLineTool
+// plus the job spec of the engine, and everything it found wrong with the workflow and inputs:
+// ----- errors: required inputs with no value, step inputs wired to nothing, multiple sources per step input
+// ----- warnings: unknown inputs, tasks which ask for more than the user's quota
+//
+// job specs are rendered as they'd be for one instance of the task -
+// the command and whatever depends on the input values is only known at run time
+
+// PlanJSON is the result of a dry run
+type PlanJSON struct {
+	Valid     bool            `json:"valid"`
+	Errors    []string        `json:"errors"`
+	Warnings  []string        `json:"warnings"`
+	Tasks     []*PlanTaskJSON `json:"tasks"`
+	EngineJob *batchv1.Job    `json:"engine_job,omitempty"`
+}
+
+// PlanTaskJSON is a task in the plan - a step of a workflow, or the main process
+type PlanTaskJSON struct {
+	ID        string                      `json:"id"`      // step ID, or "#main"
+	Process   string                      `json:"process"` // the ID of the CWL process the step runs
+	Class     string                      `json:"class"`
+	Parent    string                      `json:"parent,omitempty"` // the workflow the step belongs to
+	DependsOn []string                    `json:"depends_on"`       // steps of the same workflow whose outputs this step takes
+	Scatter   *PlanScatterJSON            `json:"scatter,omitempty"`
+	Image     string                      `json:"image,omitempty"`
+	Resources *k8sv1.ResourceRequirements `json:"resources,omitempty"`
+	Job       *batchv1.Job                `json:"job,omitempty"`
+	JobError  string                      `json:"job_error,omitempty"`
+}
+
+// PlanScatterJSON describes the fan-out of a scattered step
+type PlanScatterJSON struct {
+	Inputs []string `json:"inputs"`
+	Method string   `json:"method,omitempty"`
+	Size   *int     `json:"size"` // null if it depends on the output of another step
+}
+
+// runs resolveGraph on the workflow and inputs of the request, and returns the plan
+// the request should already be validated
+func planWorkflow(request *WorkflowRequest) *PlanJSON {
+	engine := &K8sEngine{
+		FinishedProcs:   make(map[string]bool),
+		UnfinishedProcs: make(map[string]bool),
+		CleanupProcs:    make(map[CleanupKey]bool),
+		RunID:           request.JobName,
+		UserID:          request.UserID,
+		Manifest:        &request.Manifest,
+		Log:             mainLog(""),
+		DryRun:          true,
+	}
+	engine.Log.Request = request
+	// so the planned task jobs get the ToolTimeLimits (and other hints the cwl lib doesn't parse) - the request is valid, so no error here
+	engine.processes, _ = packedProcesses(request.Workflow)
+
+	p := &planner{
+		engine: engine,
+		plan: &PlanJSON{
+			Errors:   []string{},
+			Warnings: []string{},
+			Tasks:    []*PlanTaskJSON{},
+		},
+		known: make(map[string]interface{}),
+	}
+	if job, err := workflowJob(request); err == nil {
+		p.plan.EngineJob = job
+	} else {
+		p.complain("failed to render engine job: %v", err)
+	}
+
+	mainTask, err := engine.taskGraph()
+	if err != nil {
+		p.complain("%v", err)
+		return p.plan
+	}
+	p.mainInputs(mainTask)
+	p.planTask(mainTask, mainProcessID, "", []string{})
+	p.plan.Valid = len(p.plan.Errors) == 0
+	return p.plan
+}
+
+type planner struct {
+	engine *K8sEngine
+	plan   *PlanJSON
+	known  map[string]interface{} // values of input params which are known before the run - by param ID
+}
+
+func (p *planner) complain(f string, v ...interface{}) {
+	p.plan.Errors = append(p.plan.Errors, fmt.Sprintf(f, v...))
+}
+
+func (p *planner) warn(f string, v ...interface{}) {
+	p.plan.Warnings = append(p.plan.Warnings, fmt.Sprintf(f, v...))
+}
+
+// checks the inputs given for the main process
+func (p *planner) mainInputs(mainTask *Task) {
+	for _, input := range mainTask.Root.Inputs {
+		if val, ok := mainTask.Parameters[input.ID]; ok && val != nil {
+			p.known[input.ID] = val
+		} else if input.Default != nil {
+			p.known[input.ID] = input.Default.Self
+		}
+	}
+	for _, grievance := range mainInputGrievances(mainTask.Root, mainTask.Parameters) {
+		p.complain("%v", grievance)
+	}
+}
+
+// what's wrong with the inputs given for the main process - a required input with no value, or a value for an input the workflow doesn't have
+// params are keyed by input ID, i.e., "#main/{input}" - also used to validate the workflow request, see request.go
+func mainInputGrievances(main *cwl.Root, params cwl.Parameters) []string {
+	grievances := []string{}
+	ids := make(map[string]bool)
+	for _, input := range main.Inputs {
+		ids[input.ID] = true
+		if val, ok := params[input.ID]; (!ok || val == nil) && input.Default == nil && required(input) {
+			grievances = append(grievances, fmt.Sprintf("missing value for required input %v", strings.TrimPrefix(input.ID, mainProcessID+"/")))
+		}
+	}
+	unknown := []string{}
+	for id := range params {
+		if !ids[id] {
+			unknown = append(unknown, strings.TrimPrefix(id, mainProcessID+"/"))
+		}
+	}
+	sort.Strings(unknown)
+	for _, id := range unknown {
+		grievances = append(grievances, fmt.Sprintf("input %v is not an input of the workflow", id))
+	}
+	return grievances
+}
+
+func required(input *cwl.Input) bool {
+	for _, t := range input.Types {
+		if t.Type == CWLNullType {
+			return false
+		}
+	}
+	return true
+}
+
+// adds the task, and its steps if it's a workflow, to the plan
+func (p *planner) planTask(task *Task, id, parent string, deps []string) {
+	entry := &PlanTaskJSON{
+		ID:        id,
+		Process:   task.Root.ID,
+		Class:     task.Root.Class,
+		Parent:    parent,
+		DependsOn: deps,
+	}
+	if step := task.OriginalStep; step != nil && len(step.Scatter) > 0 {
+		entry.Scatter = p.scatter(step)
+	}
+	p.plan.Tasks = append(p.plan.Tasks, entry)
+
+	switch task.Root.Class {
+	case CWLWorkflow:
+		p.planSteps(task)
+	case CWLCommandLineTool:
+		p.planTool(task, entry)
+	}
+}
+
+// checks the wiring of the workflow's steps, then plans each of them
+func (p *planner) planSteps(task *Task) {
+	task.setupOutputMap()
+	inputs := make(map[string]bool)
+	for _, input := range task.Root.Inputs {
+		inputs[input.ID] = true
+	}
+
+	for i := range task.Root.Steps {
+		step := &task.Root.Steps[i]
+		child, ok := task.Children[step.ID]
+		if !ok {
+			// resolveGraph already complained
+			continue
+		}
+		deps := []string{}
+		connected := make(map[string]bool)
+		for _, in := range step.In {
+			param := step2taskID(step, in.ID)
+			if len(in.Source) > 0 || in.Default != nil || in.ValueFrom != "" {
+				connected[param] = true
+			}
+			if len(in.Source) > 1 {
+				p.complain("step %v: input %v has more than one source, which the engine doesn't support", step.ID, in.ID)
+			}
+			for _, source := range in.Source {
+				depStepID, fromStep := task.OutputIDMap[source]
+				switch {
+				case fromStep:
+					if !contains(deps, depStepID) {
+						deps = append(deps, depStepID)
+					}
+				case inputs[source]:
+					if val, ok := p.known[source]; ok && in.ValueFrom == "" {
+						p.known[param] = val
+					}
+				default:
+					p.complain("step %v: input %v has source %v, which is neither an input of %v nor an output of one of its steps", step.ID, in.ID, source, task.Root.ID)
+				}
+			}
+			if _, ok := p.known[param]; !ok && len(in.Source) == 0 && in.Default != nil && in.ValueFrom == "" {
+				p.known[param] = in.Default.Self
+			}
+		}
+		for _, input := range child.Root.Inputs {
+			if !connected[input.ID] && input.Default == nil && required(input) {
+				p.complain("step %v: required input %v is not connected", step.ID, strings.TrimPrefix(input.ID, child.Root.ID+"/"))
+			}
+		}
+		sort.Strings(deps)
+		p.planTask(child, step.ID, task.Root.ID, deps)
+	}
+
+	for _, output := range task.Root.Outputs {
+		for _, source := range output.Source {
+			if _, ok := task.OutputIDMap[source]; !ok && !inputs[source] {
+				p.complain("output %v of %v has source %v, which is neither an input of %v nor an output of one of its steps", output.ID, task.Root.ID, source, task.Root.ID)
+			}
+		}
+	}
+}
+
+// the fan-out of a scattered step - known if the scattered inputs are known before the run
+func (p *planner) scatter(step *cwl.Step) *PlanScatterJSON {
+	s := &PlanScatterJSON{Inputs: step.Scatter, Method: step.ScatterMethod}
+	sizes := []int{}
+	for _, in := range step.Scatter {
+		val, ok := p.known[step2taskID(step, in)]
+		if !ok {
+			return s
+		}
+		arr, ok := val.([]interface{})
+		if !ok {
+			p.complain("step %v: scattered input %v is not an array", step.ID, in)
+			return s
+		}
+		sizes = append(sizes, len(arr))
+	}
+	size := 1
+	switch step.ScatterMethod {
+	case "", "dotproduct":
+		for _, n := range sizes {
+			if n != sizes[0] {
+				p.complain("step %v: dotproduct scatter over inputs of different lengths: %v", step.ID, sizes)
+				return s
+			}
+		}
+		size = sizes[0]
+	default:
+		for _, n := range sizes {
+			size *= n
+		}
+	}
+	s.Size = &size
+	return s
+}
+
+// renders the tool's job spec - nothing is created in the cluster in a dry run
+func (p *planner) planTool(task *Task, entry *PlanTaskJSON) {
+	tool := task.tool(p.engine.RunID, 1)
+	tool.Resources = p.engine.stepResources(task)
+	entry.Image = tool.dockerImage()
+
+	resources, err := tool.resourceReqs()
+	if err != nil {
+		p.complain("step %v: failed to resolve resource requirements: %v", entry.ID, err)
+		return
+	}
+	entry.Resources = &resources
+
+	// input values aren't known yet - expressions in the tool's env see null inputs
+	if err = tool.inputsToVM(); err == nil {
+		entry.Job, err = p.engine.taskJob(tool)
+	}
+	if err != nil {
+		entry.JobError = err.Error()
+		return
+	}
+	p.checkQuota(entry)
+}
+
+// a task which asks for more than the user's quota runs only once it's the user's only task, see quota.go
+func (p *planner) checkQuota(entry *PlanTaskJSON) {
+	quota := Config.Quotas.userQuota(p.engine.UserID)
+	if quota == nil {
+		return
+	}
+	usage := jobUsage(entry.Job, marinerTask)
+	if quota.MaxCPU != nil && usage.CPU.Cmp(*quota.MaxCPU) > 0 {
+		p.warn("step %v: asks for %v cpu, more than the max_cpu quota of %v - it will only run when it's your only task", entry.ID, usage.CPU.String(), quota.MaxCPU.String())
+	}
+	if quota.MaxMemory != nil && usage.Memory.Cmp(*quota.MaxMemory) > 0 {
+		p.warn("step %v: asks for %v memory, more than the max_memory quota of %v - it will only run when it's your only task", entry.ID, usage.Memory.String(), quota.MaxMemory.String())
+	}
+}
+
+// '/runs?dry_run=true' - POST
+// needs the same authorization as submitting the run - checked in handleRunsPOST()
+func (server *Server) handleDryRun(w http.ResponseWriter, r *http.Request, workflowRequest *WorkflowRequest) {
+	workflowRequest.UserID = server.userID(r)
+	workflowRequest.JobName = createJobName()
+	writeJSON(w, planWorkflow(workflowRequest))
+}
+
+// Plan is 'mariner plan' - does a dry run of the workflow request in the file, and prints the plan
+// the mariner config is read from the usual place, like for the server and the engine
+func Plan(requestPath string) error {
+	b, err := ioutil.ReadFile(requestPath)
+	if err != nil {
+		return fmt.Errorf("failed to read workflow request: %v", err)
+	}
+	request := &WorkflowRequest{}
+	if err = json.Unmarshal(b, request); err != nil {
+		return fmt.Errorf("failed to unmarshal workflow request: %v", err)
+	}
+	// a workflow in a tool registry gets fetched here, like on submission - see trs.go
+	if err = resolveTRSWorkflow(request); err != nil {
+		return err
+	}
+	plan := &PlanJSON{Errors: request.validate(), Warnings: []string{}, Tasks: []*PlanTaskJSON{}}
+	if len(plan.Errors) == 0 {
+		if request.JobName == "" {
+			request.JobName = createJobName()
+		}
+		plan = planWorkflow(request)
+	}
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %v", err)
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+	if !plan.Valid {
+		return fmt.Errorf("the workflow request has %v error(s)", len(plan.Errors))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package mariner
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+func TestRequired(t *testing.T) {
+	cases := []struct {
+		name     string
+		types    []cwl.Type
+		required bool
+	}{
+		{"File", []cwl.Type{{Type: CWLFileType}}, true},
+		{"optional File", []cwl.Type{{Type: CWLNullType}, {Type: CWLFileType}}, false},
+		{"null last", []cwl.Type{{Type: "int"}, {Type: CWLNullType}}, false},
+		{"array", []cwl.Type{{Type: "array", Items: []cwl.Type{{Type: CWLNullType}}}}, true},
+	}
+	for _, c := range cases {
+		if required := required(&cwl.Input{Types: c.types}); required != c.required {
+			t.Errorf("%v: expected required=%v, got %v", c.name, c.required, required)
+		}
+	}
+}
+
+func TestMainInputGrievances(t *testing.T) {
+	main := &cwl.Root{ID: mainProcessID, Inputs: cwl.Inputs{
+		{ID: "#main/file", Types: []cwl.Type{{Type: CWLFileType}}},
+		{ID: "#main/optional", Types: []cwl.Type{{Type: CWLNullType}, {Type: "int"}}},
+		{ID: "#main/defaulted", Types: []cwl.Type{{Type: "int"}}, Default: &cwl.InputDefault{Self: 1.0}},
+	}}
+	file := map[string]interface{}{"class": CWLFileType, "location": "/a.txt"}
+	cases := []struct {
+		name       string
+		params     cwl.Parameters
+		grievances []string
+	}{
+		{"required input given", cwl.Parameters{"#main/file": file}, nil},
+		{"all inputs given", cwl.Parameters{"#main/file": file, "#main/optional": 1.0, "#main/defaulted": 2.0}, nil},
+		{"required input missing", cwl.Parameters{"#main/optional": 1.0}, []string{"missing value for required input file"}},
+		{"required input null", cwl.Parameters{"#main/file": nil}, []string{"missing value for required input file"}},
+		{"no inputs", nil, []string{"missing value for required input file"}},
+		{"unknown inputs - sorted", cwl.Parameters{"#main/file": file, "#main/z": 1.0, "#main/a": 2.0}, []string{
+			"input a is not an input of the workflow", "input z is not an input of the workflow",
+		}},
+		{"missing and unknown", cwl.Parameters{"#main/fiel": file}, []string{
+			"missing value for required input file", "input fiel is not an input of the workflow",
+		}},
+	}
+	for _, c := range cases {
+		grievances := mainInputGrievances(main, c.params)
+		if len(grievances) == 0 && len(c.grievances) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(grievances, c.grievances) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.grievances, grievances)
+		}
+	}
+}
+
+func TestPlanScatter(t *testing.T) {
+	step := func(method string, inputs ...string) *cwl.Step {
+		s := &cwl.Step{ID: "#main/step", Run: cwl.Run{Value: "#tool.cwl"}, ScatterMethod: method}
+		for _, in := range inputs {
+			s.Scatter = append(s.Scatter, "#main/step/"+in)
+		}
+		return s
+	}
+	known := map[string]interface{}{
+		"#tool.cwl/two":   []interface{}{1.0, 2.0},
+		"#tool.cwl/three": []interface{}{1.0, 2.0, 3.0},
+		"#tool.cwl/also2": []interface{}{"a", "b"},
+		"#tool.cwl/empty": []interface{}{},
+		"#tool.cwl/file":  map[string]interface{}{"class": CWLFileType},
+	}
+	size := func(n int) *int { return &n }
+	cases := []struct {
+		name  string
+		step  *cwl.Step
+		size  *int   // nil - unknown before the run
+		error string // "" - no error
+	}{
+		{"single input", step("", "three"), size(3), ""},
+		{"dotproduct", step("dotproduct", "two", "also2"), size(2), ""},
+		{"dotproduct - length mismatch", step("dotproduct", "two", "three"), nil, "dotproduct scatter over inputs of different lengths: [2 3]"},
+		{"no method - dotproduct length mismatch", step("", "three", "two"), nil, "different lengths"},
+		{"flat_crossproduct", step("flat_crossproduct", "two", "three"), size(6), ""},
+		{"nested_crossproduct", step("nested_crossproduct", "two", "three", "also2"), size(12), ""},
+		{"crossproduct with an empty array", step("flat_crossproduct", "two", "empty"), size(0), ""},
+		{"not an array", step("", "file"), nil, "scattered input #main/step/file is not an array"},
+		{"step-sourced - unknown", step("flat_crossproduct", "two", "from_step"), nil, ""},
+	}
+	for _, c := range cases {
+		p := &planner{plan: &PlanJSON{}, known: known}
+		s := p.scatter(c.step)
+		switch {
+		case c.error == "" && len(p.plan.Errors) > 0:
+			t.Errorf("%v: unexpected errors: %v", c.name, p.plan.Errors)
+		case c.error != "" && (len(p.plan.Errors) != 1 || !strings.Contains(p.plan.Errors[0], c.error)):
+			t.Errorf("%v: expected error %q, got %v", c.name, c.error, p.plan.Errors)
+		}
+		switch {
+		case c.size == nil && s.Size != nil:
+			t.Errorf("%v: expected no size, got %v", c.name, *s.Size)
+		case c.size != nil && (s.Size == nil || *s.Size != *c.size):
+			t.Errorf("%v: expected size %v, got %v", c.name, *c.size, s.Size)
+		}
+		if !reflect.DeepEqual(s.Inputs, c.step.Scatter) || s.Method != c.step.ScatterMethod {
+			t.Errorf("%v: expected inputs %v and method %q, got %v and %q", c.name, c.step.Scatter, c.step.ScatterMethod, s.Inputs, s.Method)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package mariner
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// this file contains code for the '/runs/{runID}/outputs' endpoint
+// every File and Directory in the top-level workflow output
+// gets resolved to its s3 location and a presigned download URL
+// so that users can fetch their results without AWS credentials
+
+const (
+	defaultURLExpiry = 1 * time.Hour
+	// s3 presigned URLs are valid for at most 7 days
+	maxURLExpiry = 7 * 24 * time.Hour
+)
+
+// OutputsJSON is the response object for the outputs endpoint
+// same shape as the WES outputs object, but with each File/Directory replaced by an OutputFileJSON
+type OutputsJSON struct {
+	RunID   string                 `json:"run_id"`
+	Outputs map[string]interface{} `json:"outputs"`
+}
+
+// OutputFileJSON describes one output file and how to download it
+// checksum is "md5$<hex>" when the s3 ETag is the md5, otherwise "etag$<etag>" (multipart uploads)
+// url is omitted for files which don't live in the user's workspace, e.g., commons data
+type OutputFileJSON struct {
+	Class          string            `json:"class"`
+	Basename       string            `json:"basename"`
+	Path           string            `json:"path"`
+	S3Key          string            `json:"s3_key,omitempty"`
+	Size           *int64            `json:"size,omitempty"`
+	Checksum       string            `json:"checksum,omitempty"`
+	URL            string            `json:"url,omitempty"`
+	URLExpires     string            `json:"url_expires,omitempty"`
+	Listing        []*OutputFileJSON `json:"listing,omitempty"`
+	SecondaryFiles []*OutputFileJSON `json:"secondaryFiles,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// resolves output files for one run
+type outputResolver struct {
+	svc     *s3.S3
+	bucket  string
+	userID  string
+	fm      *S3FileManager
+	expiry  time.Duration
+	expires string
+}
+
+// '/runs/{runID}/outputs' - GET
+// optional query param 'expires_in' - URL lifetime in seconds
+func (server *Server) handleRunOutputsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	expiry, err := urlExpiry(r.URL.Query().Get("expires_in"))
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	j, err := server.fetchOutputs(userID, runID, expiry)
+	if err != nil {
+		fmt.Println("error fetching outputs: ", err)
+		writeRunError(w, err, "failed to fetch outputs")
+		return
+	}
+	writeJSON(w, j)
+}
+
+func urlExpiry(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultURLExpiry, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 1 {
+		return 0, fmt.Errorf("invalid expires_in %q", v)
+	}
+	expiry := time.Duration(seconds) * time.Second
+	if expiry > maxURLExpiry {
+		expiry = maxURLExpiry
+	}
+	return expiry, nil
+}
+
+func (server *Server) fetchOutputs(userID, runID string, expiry time.Duration) (*OutputsJSON, error) {
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &outputResolver{
+		svc:     s3.New(server.S3FileManager.newS3Session()),
+		bucket:  server.S3FileManager.S3BucketName,
+		userID:  userID,
+		fm:      server.S3FileManager,
+		expiry:  expiry,
+		expires: time.Now().Add(expiry).UTC().Format(time.RFC3339),
+	}
+	j := &OutputsJSON{
+		RunID:   runID,
+		Outputs: make(map[string]interface{}),
+	}
+	for id, val := range wesOutputs(runLog.Main.Output) {
+		j.Outputs[id] = resolver.resolve(val)
+	}
+	return j, nil
+}
+
+// walks an output value - File and Directory objects get resolved
+// arrays and records are walked recursively, everything else is returned as is
+func (resolver *outputResolver) resolve(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = resolver.resolve(e)
+		}
+		return out
+	case map[string]interface{}:
+		switch v["class"] {
+		case CWLFileType:
+			return resolver.file(v)
+		case CWLDirectoryType:
+			return resolver.directory(v)
+		}
+		out := make(map[string]interface{})
+		for k, e := range v {
+			out[k] = resolver.resolve(e)
+		}
+		return out
+	}
+	return val
+}
+
+// the local path of a File or Directory object
+func localPath(obj map[string]interface{}) string {
+	if p, ok := obj["path"].(string); ok && p != "" {
+		return p
+	}
+	p, _ := obj["location"].(string)
+	return p
+}
+
+// only files in the engine workspace map to the user's s3 space
+func (resolver *outputResolver) s3Key(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/"+engineWorkspaceVolumeName+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(resolver.fm.s3Key(p, resolver.userID), "/"), true
+}
+
+func (resolver *outputResolver) file(obj map[string]interface{}) *OutputFileJSON {
+	f := resolver.fileAtPath(localPath(obj))
+	if secondaryFiles, ok := obj["secondaryFiles"].([]interface{}); ok {
+		for _, sf := range secondaryFiles {
+			if sfObj, ok := sf.(map[string]interface{}); ok {
+				switch sfObj["class"] {
+				case CWLDirectoryType:
+					f.SecondaryFiles = append(f.SecondaryFiles, resolver.directory(sfObj))
+				default:
+					f.SecondaryFiles = append(f.SecondaryFiles, resolver.file(sfObj))
+				}
+			}
+		}
+	}
+	return f
+}
+
+func (resolver *outputResolver) fileAtPath(p string) *OutputFileJSON {
+	f := &OutputFileJSON{
+		Class:    CWLFileType,
+		Basename: path.Base(p),
+		Path:     p,
+	}
+	key, ok := resolver.s3Key(p)
+	if !ok {
+		return f
+	}
+	f.S3Key = key
+	head, err := resolver.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(resolver.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		f.Error = fmt.Sprintf("failed to find file in s3: %v", err)
+		return f
+	}
+	f.Size = head.ContentLength
+	f.Checksum = checksum(aws.StringValue(head.ETag))
+	if f.URL, err = resolver.presign(key); err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	f.URLExpires = resolver.expires
+	return f
+}
+
+// a directory is resolved to the listing of all the files under its prefix
+func (resolver *outputResolver) directory(obj map[string]interface{}) *OutputFileJSON {
+	p := localPath(obj)
+	d := &OutputFileJSON{
+		Class:    CWLDirectoryType,
+		Basename: path.Base(p),
+		Path:     p,
+	}
+	prefix, ok := resolver.s3Key(strings.TrimSuffix(p, "/") + "/")
+	if !ok {
+		return d
+	}
+	d.S3Key = prefix
+	err := resolver.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(resolver.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			f := &OutputFileJSON{
+				Class:    CWLFileType,
+				Basename: path.Base(key),
+				Path:     path.Join(p, strings.TrimPrefix(key, prefix)),
+				S3Key:    key,
+				Size:     obj.Size,
+				Checksum: checksum(aws.StringValue(obj.ETag)),
+			}
+			if url, err := resolver.presign(key); err != nil {
+				f.Error = err.Error()
+			} else {
+				f.URL, f.URLExpires = url, resolver.expires
+			}
+			d.Listing = append(d.Listing, f)
+		}
+		return true
+	})
+	if err != nil {
+		d.Error = fmt.Sprintf("failed to list directory in s3: %v", err)
+	}
+	return d
+}
+
+func (resolver *outputResolver) presign(key string) (string, error) {
+	req, _ := resolver.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(resolver.bucket),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(resolver.expiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign url: %v", err)
+	}
+	return url, nil
+}
+
+// the ETag of an object uploaded in one part is the md5 of its contents
+// multipart upload ETags look like "<hex>-<nparts>" and are not an md5
+func checksum(etag string) string {
+	etag = strings.Trim(etag, "\"")
+	if etag == "" {
+		return ""
+	}
+	if strings.Contains(etag, "-") {
+		return "etag$" + etag
+	}
+	return "md5$" + etag
+}
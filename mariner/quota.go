@@ -0,0 +1,490 @@
+package mariner
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	k8sResource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for per-user and per-group quotas
+//
+// a quota caps the concurrent runs, the concurrent task pods,
+// and the total cpu and memory requested by the pods of a user's runs (engines and tasks)
+// ----- a user's own quota is the one under "users", or else the "default" one
+// ----- a group quota caps the combined usage of all the users in the group
+// ----- no quota (or a zero/missing field) means no limit
+//
+// runs - the server only dispatches a run's engine job if it fits the quotas
+// ----- otherwise the run goes in the queue, and shows up as QUEUED
+// ----- the server checks the queue periodically and admits queued runs in FIFO order as capacity frees up
+// ----- the queue lives in s3: "_mariner/queue/{runID}/{userID}" (empty objects), so it survives server restarts
+// tasks - the engine holds back each task job until it fits the quotas
+// ----- counting only task jobs - a run's engine is already there by the time its tasks wait,
+// ----- so counting engines could keep a task which fits the quota waiting forever
+//
+// usage is counted from the mariner jobs in the cluster which haven't finished yet
+// NOTE: the limits are soft - two servers (or two engines) checking at the same time may both go ahead
+
+const (
+	runQueuePrefix = "_mariner/queue/"
+
+	admissionPeriod = 15 * time.Second
+	taskQuotaPeriod = 15 * time.Second
+)
+
+// QuotaConfig is the "quotas" block of the mariner config
+type QuotaConfig struct {
+	Default *Quota            `json:"default,omitempty"`
+	Users   map[string]*Quota `json:"users,omitempty"`
+	Groups  []*GroupQuota     `json:"groups,omitempty"`
+}
+
+// Quota - a zero/missing field means no limit
+// cpu and memory are k8s quantities, e.g., "16" and "64Gi"
+type Quota struct {
+	MaxRuns   int                   `json:"max_concurrent_runs,omitempty"`
+	MaxTasks  int                   `json:"max_concurrent_tasks,omitempty"`
+	MaxCPU    *k8sResource.Quantity `json:"max_cpu,omitempty"`
+	MaxMemory *k8sResource.Quantity `json:"max_memory,omitempty"`
+}
+
+// GroupQuota caps the combined usage of the users in the group
+type GroupQuota struct {
+	Name  string   `json:"name"`
+	Users []string `json:"users"`
+	Quota *Quota   `json:"quota"`
+}
+
+// Usage is what a user (or group) has going in the cluster
+// cpu and memory are what the pods request - or their limits, if they don't request anything
+type Usage struct {
+	Runs   int                  `json:"runs"`
+	Tasks  int                  `json:"tasks"`
+	CPU    k8sResource.Quantity `json:"cpu"`
+	Memory k8sResource.Quantity `json:"memory"`
+}
+
+// QuotaUsageJSON is the user's usage and quotas - reported on '/runs' GET
+type QuotaUsageJSON struct {
+	Usage      *Usage            `json:"usage"`
+	Limits     *Quota            `json:"limits,omitempty"`
+	QueuedRuns int               `json:"queued_runs"`
+	Groups     []*GroupUsageJSON `json:"groups,omitempty"`
+}
+
+// GroupUsageJSON is the combined usage of a group the user is in
+type GroupUsageJSON struct {
+	Name   string `json:"name"`
+	Usage  *Usage `json:"usage"`
+	Limits *Quota `json:"limits"`
+}
+
+func (conf *QuotaConfig) enabled() bool {
+	return conf.Default != nil || len(conf.Users) > 0 || len(conf.Groups) > 0
+}
+
+// the user's own quota - nil if there isn't one
+func (conf *QuotaConfig) userQuota(userID string) *Quota {
+	if quota, ok := conf.Users[userID]; ok {
+		return quota
+	}
+	return conf.Default
+}
+
+// the groups the user is in
+func (conf *QuotaConfig) groupsOf(userID string) []*GroupQuota {
+	groups := []*GroupQuota{}
+	for _, group := range conf.Groups {
+		for _, member := range group.Users {
+			if member == userID {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// true if the users count against any of the same quotas
+func (conf *QuotaConfig) shareQuota(a, b string) bool {
+	if a == b {
+		return true
+	}
+	for _, group := range conf.groupsOf(a) {
+		for _, member := range group.Users {
+			if member == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// true if the user's usage plus extra stays within the user's quota and the quota of each of the user's groups
+func (conf *QuotaConfig) fits(userID string, usage map[string]*Usage, extra *Usage) bool {
+	if !conf.userQuota(userID).fits(usage[userID], extra) {
+		return false
+	}
+	for _, group := range conf.groupsOf(userID) {
+		if !group.Quota.fits(group.usage(usage), extra) {
+			return false
+		}
+	}
+	return true
+}
+
+// true if usage plus extra stays within the quota
+func (quota *Quota) fits(usage, extra *Usage) bool {
+	if quota == nil {
+		return true
+	}
+	total := &Usage{}
+	total.add(usage)
+	total.add(extra)
+	switch {
+	case quota.MaxRuns > 0 && total.Runs > quota.MaxRuns:
+		return false
+	case quota.MaxTasks > 0 && total.Tasks > quota.MaxTasks:
+		return false
+	case quota.MaxCPU != nil && total.CPU.Cmp(*quota.MaxCPU) > 0:
+		return false
+	case quota.MaxMemory != nil && total.Memory.Cmp(*quota.MaxMemory) > 0:
+		return false
+	}
+	return true
+}
+
+// the combined usage of the group's users
+func (group *GroupQuota) usage(usage map[string]*Usage) *Usage {
+	total := &Usage{}
+	for _, member := range group.Users {
+		total.add(usage[member])
+	}
+	return total
+}
+
+func (u *Usage) add(v *Usage) {
+	if v == nil {
+		return
+	}
+	u.Runs += v.Runs
+	u.Tasks += v.Tasks
+	u.CPU.Add(v.CPU)
+	u.Memory.Add(v.Memory)
+}
+
+//// usage ////
+
+// the usage of each user with mariner jobs in the cluster
+// counts the engine and task jobs - or only the given components' jobs
+func clusterUsage(components ...string) (map[string]*Usage, error) {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]*Usage)
+	selectors := map[string]string{
+		marinerEngine: "app=mariner-engine",
+		marinerTask:   "app=mariner-task",
+	}
+	if len(components) > 0 {
+		only := make(map[string]string)
+		for _, component := range components {
+			only[component] = selectors[component]
+		}
+		selectors = only
+	}
+	for component, selector := range selectors {
+		jobs, err := jobsClient.List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range jobs.Items {
+			if jobFinished(&job) {
+				continue
+			}
+			userID := job.Spec.Template.Annotations["gen3username"]
+			if usage[userID] == nil {
+				usage[userID] = &Usage{}
+			}
+			usage[userID].add(jobUsage(&job, component))
+		}
+	}
+	return usage, nil
+}
+
+// what the job counts against a quota
+// component is marinerEngine or marinerTask
+func jobUsage(job *batchv1.Job, component string) *Usage {
+	u := &Usage{}
+	switch component {
+	case marinerEngine:
+		u.Runs = 1
+	case marinerTask:
+		u.Tasks = 1
+	}
+	for _, container := range job.Spec.Template.Spec.Containers {
+		u.CPU.Add(requested(container.Resources, k8sv1.ResourceCPU))
+		u.Memory.Add(requested(container.Resources, k8sv1.ResourceMemory))
+	}
+	return u
+}
+
+// what the run's engine job adds to the usage - the run, and the engine pod's resources
+func engineUsage(request *WorkflowRequest) (*Usage, error) {
+	job, err := workflowJob(request)
+	if err != nil {
+		return nil, err
+	}
+	return jobUsage(job, marinerEngine), nil
+}
+
+// k8s defaults the request to the limit if only the limit is given
+func requested(resources k8sv1.ResourceRequirements, name k8sv1.ResourceName) k8sResource.Quantity {
+	if q, ok := resources.Requests[name]; ok {
+		return q
+	}
+	return resources.Limits[name]
+}
+
+//// runs ////
+
+// dispatches the run's engine job - or puts the run in the queue, if it doesn't fit the quotas
+func (server *Server) submitRun(request *WorkflowRequest) (queued bool, err error) {
+	quotas := &Config.Quotas
+	if !quotas.enabled() {
+		return false, dispatchWorkflowJob(request)
+	}
+
+	server.admission.Lock()
+	defer server.admission.Unlock()
+	queue, err := server.listRunRefs(runQueuePrefix, "")
+	if err != nil {
+		return false, fmt.Errorf("error listing run queue: %v", err)
+	}
+	usage, err := clusterUsage()
+	if err != nil {
+		return false, fmt.Errorf("error counting usage: %v", err)
+	}
+
+	// FIFO - a run doesn't jump ahead of queued runs which count against the same quotas
+	ahead := false
+	for _, ref := range queue {
+		if quotas.shareQuota(request.UserID, ref.UserID) {
+			ahead = true
+			break
+		}
+	}
+	extra, err := engineUsage(request)
+	if err != nil {
+		return false, err
+	}
+	if !ahead && quotas.fits(request.UserID, usage, extra) {
+		return false, dispatchWorkflowJob(request)
+	}
+	fmt.Printf("queueing run %v of user %v\n", request.JobName, request.UserID)
+	return true, server.putRunRef(runQueuePrefix, request.UserID, request.JobName)
+}
+
+// background process that admits queued runs, oldest first, as capacity frees up
+func (server *Server) admitQueuedRuns() {
+	for {
+		if err := server.admitRuns(); err != nil {
+			fmt.Println("error admitting queued runs: ", err)
+		}
+		time.Sleep(admissionPeriod)
+	}
+}
+
+func (server *Server) admitRuns() error {
+	server.admission.Lock()
+	defer server.admission.Unlock()
+	queue, err := server.listRunRefs(runQueuePrefix, "")
+	if err != nil || len(queue) == 0 {
+		return err
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return runIDBefore(queue[j].RunID, queue[i].RunID)
+	})
+	usage, err := clusterUsage()
+	if err != nil {
+		return err
+	}
+	quotas := &Config.Quotas
+	for _, ref := range queue {
+		request, err := server.fetchRequest(ref.UserID, ref.RunID)
+		switch {
+		case err == errRunNotFound:
+			fmt.Printf("dropping queued run %v - no workflow request\n", ref.RunID)
+			server.deleteRunRef(runQueuePrefix, ref.UserID, ref.RunID)
+			continue
+		case err != nil:
+			fmt.Println("error fetching workflow request: ", err)
+			continue
+		}
+		extra, err := engineUsage(request)
+		if err != nil {
+			fmt.Println("error building engine job: ", err)
+			continue
+		}
+		if !quotas.fits(ref.UserID, usage, extra) {
+			continue
+		}
+		if err = dispatchWorkflowJob(request); err != nil {
+			fmt.Println("error dispatching queued run: ", err)
+			continue
+		}
+		fmt.Printf("admitted queued run %v of user %v\n", ref.RunID, ref.UserID)
+		if err = server.deleteRunRef(runQueuePrefix, ref.UserID, ref.RunID); err != nil {
+			fmt.Println("error removing run from queue: ", err)
+		}
+		if usage[ref.UserID] == nil {
+			usage[ref.UserID] = &Usage{}
+		}
+		usage[ref.UserID].add(extra)
+	}
+	return nil
+}
+
+// takes the run out of the queue, if it's there, and marks it cancelled
+// returns false if the run isn't queued
+func (server *Server) cancelQueuedRun(userID, runID string) (bool, error) {
+	server.admission.Lock()
+	defer server.admission.Unlock()
+	queued, err := server.listRunRefs(runQueuePrefix, runID+"/")
+	if err != nil || len(queued) == 0 {
+		return false, err
+	}
+	if err = server.deleteRunRef(runQueuePrefix, userID, runID); err != nil {
+		return false, err
+	}
+
+	// the engine never ran, so there's no run log yet
+	runLog := mainLog(fmt.Sprintf(pathToLogf, runID))
+	runLog.Request, err = server.fetchRequest(userID, runID)
+	if err != nil {
+		return true, err
+	}
+	runLog.Main.Status = cancelled
+	runLog.Main.Event.info("cancelled while queued")
+	if err = server.writeLog(runLog, userID, runID); err != nil {
+		return true, err
+	}
+	if len(runLog.Request.Callbacks) > 0 {
+		go func() {
+			secrets, err := server.callbackSecrets(userID, runID)
+			runLog.Callbacks = notifyCallbacks(runID, runLog, secrets, err)
+			server.writeLog(runLog, userID, runID)
+		}()
+	}
+	return true, nil
+}
+
+func (server *Server) putRunRef(root, userID, runID string) error {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(root + runID + "/" + userID),
+		Body:   bytes.NewReader([]byte{}),
+	})
+	return err
+}
+
+func (server *Server) deleteRunRef(root, userID, runID string) error {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(root + runID + "/" + userID),
+	})
+	return err
+}
+
+// the user's usage and quotas - nil if no quotas are configured
+func (server *Server) quotaUsage(userID string) (*QuotaUsageJSON, error) {
+	quotas := &Config.Quotas
+	if !quotas.enabled() {
+		return nil, nil
+	}
+	usage, err := clusterUsage()
+	if err != nil {
+		return nil, err
+	}
+	queue, err := server.listRunRefs(runQueuePrefix, "")
+	if err != nil {
+		return nil, err
+	}
+	j := &QuotaUsageJSON{
+		Usage:  &Usage{},
+		Limits: quotas.userQuota(userID),
+		Groups: []*GroupUsageJSON{},
+	}
+	j.Usage.add(usage[userID])
+	for _, ref := range queue {
+		if ref.UserID == userID {
+			j.QueuedRuns++
+		}
+	}
+	for _, group := range quotas.groupsOf(userID) {
+		j.Groups = append(j.Groups, &GroupUsageJSON{
+			Name:   group.Name,
+			Usage:  group.usage(usage),
+			Limits: group.Quota,
+		})
+	}
+	return j, nil
+}
+
+//// tasks ////
+
+// taskAdmission serializes checking a task job against the quotas and creating it,
+// so the next task of the run counts the job - it's held from the check until the job is created, never while waiting
+var taskAdmission sync.Mutex
+
+// blocks until the task job fits the user's quotas, or the run is cancelled
+// returns holding taskAdmission - the caller unlocks it once the job is created
+func (engine *K8sEngine) waitForQuota(tool *Tool, job *batchv1.Job) {
+	quotas := &Config.Quotas
+	taskAdmission.Lock()
+	if !quotas.enabled() {
+		return
+	}
+	task := jobUsage(job, marinerTask)
+	waiting := false
+	for !engine.cancelRequested() {
+		usage, err := clusterUsage(marinerTask)
+		if err != nil {
+			// don't hold up the run because we can't count
+			tool.Task.warnf("failed to check quota, dispatching anyway: %v", err)
+			return
+		}
+		if quotas.fits(engine.UserID, usage, task) {
+			break
+		}
+		// a task which alone is more than the quota would never fit
+		// so it runs once it's the only task the user has going
+		if !quotas.fits(engine.UserID, nil, task) && (usage[engine.UserID] == nil || usage[engine.UserID].Tasks == 0) {
+			tool.Task.warnf("task requests more than the quota allows - dispatching it on its own")
+			break
+		}
+		if !waiting {
+			tool.Task.infof("waiting for quota")
+			waiting = true
+		}
+		// the other tasks of the run get their turn meanwhile
+		taskAdmission.Unlock()
+		time.Sleep(taskQuotaPeriod)
+		taskAdmission.Lock()
+	}
+	if waiting {
+		tool.Task.infof("done waiting for quota")
+	}
+}
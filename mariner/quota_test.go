@@ -0,0 +1,115 @@
+package mariner
+
+import (
+	"encoding/json"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8sv1 "k8s.io/api/core/v1"
+	k8sResource "k8s.io/apimachinery/pkg/api/resource"
+)
+
+const testQuotas = `{
+	"default": {"max_concurrent_runs": 2, "max_cpu": "4"},
+	"users": {"big": {"max_concurrent_runs": 10, "max_concurrent_tasks": 20, "max_memory": "64Gi"}, "unlimited": {}},
+	"groups": [{"name": "lab", "users": ["alice", "bob"], "quota": {"max_concurrent_runs": 3}}]
+}`
+
+func testUsage(runs, tasks int, cpu, memory string) *Usage {
+	return &Usage{Runs: runs, Tasks: tasks, CPU: k8sResource.MustParse(cpu), Memory: k8sResource.MustParse(memory)}
+}
+
+func TestQuotaFits(t *testing.T) {
+	conf := &QuotaConfig{}
+	if err := json.Unmarshal([]byte(testQuotas), conf); err != nil {
+		t.Fatal(err)
+	}
+	oneRun := testUsage(1, 0, "1", "1Gi")
+	cases := []struct {
+		name   string
+		userID string
+		usage  map[string]*Usage
+		extra  *Usage
+		fits   bool
+	}{
+		{"nothing running", "carol", map[string]*Usage{}, oneRun, true},
+		{"default quota - runs to spare", "carol", map[string]*Usage{"carol": testUsage(1, 0, "1", "1Gi")}, oneRun, true},
+		{"default quota - at max runs", "carol", map[string]*Usage{"carol": testUsage(2, 0, "1", "1Gi")}, oneRun, false},
+		{"default quota - over max cpu", "carol", map[string]*Usage{"carol": testUsage(1, 0, "3500m", "1Gi")}, oneRun, false},
+		{"default quota - exactly max cpu", "carol", map[string]*Usage{"carol": testUsage(1, 0, "3", "1Gi")}, oneRun, true},
+		{"user quota over the default", "big", map[string]*Usage{"big": testUsage(5, 0, "100", "1Gi")}, oneRun, true},
+		{"user quota - over max tasks", "big", map[string]*Usage{"big": testUsage(1, 20, "1", "1Gi")}, testUsage(0, 1, "1", "1Gi"), false},
+		{"user quota - over max memory", "big", map[string]*Usage{"big": testUsage(1, 0, "1", "64Gi")}, oneRun, false},
+		{"empty user quota - no limit", "unlimited", map[string]*Usage{"unlimited": testUsage(100, 100, "100", "1Ti")}, oneRun, true},
+		{"group quota - other members' runs count", "alice", map[string]*Usage{"bob": testUsage(2, 0, "1", "1Gi"), "alice": testUsage(1, 0, "1", "1Gi")}, oneRun, false},
+		{"group quota - room left", "alice", map[string]*Usage{"bob": testUsage(1, 0, "1", "1Gi")}, oneRun, true},
+		{"group quota - others outside the group don't count", "alice", map[string]*Usage{"carol": testUsage(2, 0, "1", "1Gi")}, oneRun, true},
+		{"usage of other users doesn't count", "carol", map[string]*Usage{"dave": testUsage(2, 0, "4", "1Gi")}, oneRun, true},
+	}
+	for _, c := range cases {
+		if fits := conf.fits(c.userID, c.usage, c.extra); fits != c.fits {
+			t.Errorf("%v: expected fits=%v, got %v", c.name, c.fits, fits)
+		}
+	}
+
+	if (&QuotaConfig{}).enabled() {
+		t.Errorf("empty quota config should be disabled")
+	}
+	if !conf.shareQuota("alice", "bob") || conf.shareQuota("alice", "carol") {
+		t.Errorf("expected alice to share a quota with bob, and not with carol")
+	}
+}
+
+func TestJobUsage(t *testing.T) {
+	resources := func(requests, limits k8sv1.ResourceList) k8sv1.ResourceRequirements {
+		return k8sv1.ResourceRequirements{Requests: requests, Limits: limits}
+	}
+	cpu := func(q string) k8sv1.ResourceList {
+		return k8sv1.ResourceList{k8sv1.ResourceCPU: k8sResource.MustParse(q)}
+	}
+	cases := []struct {
+		name       string
+		component  string
+		containers []k8sv1.ResourceRequirements
+		expected   *Usage
+	}{
+		{"engine", marinerEngine, []k8sv1.ResourceRequirements{resources(cpu("1"), nil)}, testUsage(1, 0, "1", "0")},
+		{"task", marinerTask, []k8sv1.ResourceRequirements{resources(cpu("2"), cpu("4"))}, testUsage(0, 1, "2", "0")},
+		{"limit only - counts the limit", marinerTask, []k8sv1.ResourceRequirements{resources(nil, cpu("3"))}, testUsage(0, 1, "3", "0")},
+		{"task and sidecar containers add up", marinerTask, []k8sv1.ResourceRequirements{
+			resources(cpu("2"), nil), resources(cpu("500m"), nil),
+		}, testUsage(0, 1, "2500m", "0")},
+	}
+	for _, c := range cases {
+		job := &batchv1.Job{}
+		for _, r := range c.containers {
+			job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, k8sv1.Container{Resources: r})
+		}
+		u := jobUsage(job, c.component)
+		if u.Runs != c.expected.Runs || u.Tasks != c.expected.Tasks || u.CPU.Cmp(c.expected.CPU) != 0 || u.Memory.Cmp(c.expected.Memory) != 0 {
+			t.Errorf("%v: expected %+v, got %+v", c.name, c.expected, u)
+		}
+	}
+}
+
+func TestEngineUsage(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	cases := []struct {
+		name      string
+		resources Resources
+		expected  *Usage
+	}{
+		{"no resources", Resources{}, testUsage(1, 0, "0", "0")},
+		{"limits", Resources{Limits: Resource{CPU: "2", Memory: "2Gi"}}, testUsage(1, 0, "2", "2Gi")},
+	}
+	for _, c := range cases {
+		Config = &MarinerConfig{Containers: Containers{Engine: Container{Resources: c.resources}}}
+		u, err := engineUsage(&WorkflowRequest{UserID: "user", JobName: "run-1"})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if u.Runs != c.expected.Runs || u.Tasks != c.expected.Tasks || u.CPU.Cmp(c.expected.CPU) != 0 || u.Memory.Cmp(c.expected.Memory) != 0 {
+			t.Errorf("%v: expected %+v, got %+v", c.name, c.expected, u)
+		}
+	}
+}
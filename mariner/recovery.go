@@ -0,0 +1,436 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for recovering a run when the engine restarts
+//
+// the engine job may restart the engine - "max_restarts" in the engine's job config - e.g., if its pod gets evicted
+// or its node gets drained. The task jobs keep running meanwhile, so the engine checkpoints the state of the run
+// to "{userID}/workflowRuns/{runID}/checkpoint.json" as it goes:
+// - the state of each tool - running (with its job and working dir) or completed (with its outputs) or failed
+// - when the run started, and how many times the engine has restarted
+// - the state of the run, once it's finished
+//
+// an engine which finds a checkpoint picks up the run where it left off:
+// - the run log carries on - its events, and the logs of the tasks which ran before the restart
+// ----- new events are numbered on from the last event written, so none get overwritten and pollers see them, see events.go
+// - a task which completed doesn't run again - its outputs are taken from the checkpoint
+// - a task whose job is still around takes the job over, instead of creating a new one
+// ----- jobs are found by the run label, see cancel.go
+// ----- a job which is gone finished while the engine was down if its command exited 0 - the server deletes jobs which succeed
+// ----- the task's command leaves its exit code in the "done" file of its working dir, see cltArgs()
+// - everything else runs as it would have - so a task whose job is gone (and didn't succeed) runs again
+// - task jobs which are running but which the checkpoint doesn't know about get deleted - nothing is going to collect their outputs
+//
+// an engine which finds the run already finished exits right away, with the run's outcome
+//
+// NOTE: a task is identified by its step ID (and scatter index), as in the run log - workflows and scatters aren't checkpointed,
+// ----- they just run again around their tools
+
+const checkpointFile = "checkpoint.json"
+
+// CheckpointJSON is the state of a run, as the engine last saw it
+type CheckpointJSON struct {
+	Status   string                         `json:"status"`   // of the run
+	Started  string                         `json:"started"`  // when the engine first started the run - max_runtime counts from here
+	Restarts int                            `json:"restarts"` // times the engine has restarted
+	Updated  string                         `json:"updated"`
+	Tasks    map[string]*TaskCheckpointJSON `json:"tasks"` // by task key, see taskKey()
+}
+
+// TaskCheckpointJSON is the state of one tool
+type TaskCheckpointJSON struct {
+	Status     string                 `json:"status"` // running, completed or failed
+	Attempt    int                    `json:"attempt"`
+	WorkingDir string                 `json:"workingDir"`
+	JobName    string                 `json:"jobName,omitempty"`
+	JobID      string                 `json:"jobID,omitempty"`
+	Input      map[string]interface{} `json:"input"`
+	Output     map[string]interface{} `json:"output,omitempty"`
+}
+
+type runCheckpoint struct {
+	sync.Mutex
+	CheckpointJSON
+}
+
+func checkpointKey(userID, runID string) string {
+	return fmt.Sprintf(pathToUserRunsf, userID) + runID + "/" + checkpointFile
+}
+
+// "#main/step_id", or "#main/step_id[2]" for a scattered subtask
+func taskKey(task *Task) string {
+	key := task.Root.ID
+	if task.OriginalStep != nil {
+		key = task.OriginalStep.ID
+	}
+	if task.ScatterIndex > 0 {
+		key = fmt.Sprintf("%v[%v]", key, task.ScatterIndex)
+	}
+	return key
+}
+
+//// restart ////
+
+// called first thing - loads the checkpoint, if there is one, and returns true if the run already finished
+// no log gets written before the run log from before the restart is loaded - it would overwrite it
+func (engine *K8sEngine) recoverRun() (finished bool, err error) {
+	checkpoint, err := engine.fetchCheckpoint()
+	switch {
+	case err == errRunNotFound:
+		// first start
+		engine.checkpoint = &runCheckpoint{CheckpointJSON: CheckpointJSON{
+			Status:  running,
+			Started: timef(time.Now()),
+			Tasks:   make(map[string]*TaskCheckpointJSON),
+		}}
+		return false, nil
+	case err != nil:
+		// starting over would run everything twice - the engine job restarts the engine to try again
+		return true, fmt.Errorf("failed to load checkpoint: %v", err)
+	case finishedStatus(checkpoint.Status):
+		fmt.Printf("run %v already %v - nothing to do\n", engine.RunID, checkpoint.Status)
+		if checkpoint.Status == failed {
+			return true, fmt.Errorf("run failed before the engine restarted")
+		}
+		return true, nil
+	}
+
+	// events must not start over at seq 1 - that would overwrite the run's event history
+	seq, err := engine.lastEventSeq()
+	if err != nil {
+		return true, fmt.Errorf("failed to find the run's last event: %v", err)
+	}
+	engine.Events.continueFrom(seq)
+
+	checkpoint.Restarts++
+	if checkpoint.Tasks == nil {
+		checkpoint.Tasks = make(map[string]*TaskCheckpointJSON)
+	}
+	engine.checkpoint = &runCheckpoint{CheckpointJSON: *checkpoint}
+
+	// the run log carries on from where it was
+	// (the task logs get replaced as the task graph gets resolved, so they're copied)
+	engine.recovered, err = engine.fetchRunLog(engine.RunID)
+	if err == nil && engine.recovered.Main == nil {
+		err = fmt.Errorf("run log has no main log")
+	}
+	if err != nil {
+		fmt.Println("error loading run log from before the restart: ", err)
+		engine.recovered = nil
+	} else {
+		if engine.recovered.Main.Event == nil {
+			engine.recovered.Main.Event = &EventLog{}
+		}
+		engine.Log.Request = engine.recovered.Request
+		engine.Log.Main = engine.recovered.Main
+		for id, log := range engine.recovered.ByProcess {
+			engine.Log.ByProcess[id] = log
+		}
+		engine.Log.Callbacks = engine.recovered.Callbacks
+	}
+	engine.warnf("engine restarted (restart %v) - picking up the run from its checkpoint", checkpoint.Restarts)
+	engine.deleteOrphanedJobs()
+	engine.writeCheckpoint()
+	return false, nil
+}
+
+func (engine *K8sEngine) fetchCheckpoint() (*CheckpointJSON, error) {
+	svc := s3.New(engine.S3FileManager.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(checkpointKey(engine.UserID, engine.RunID)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errRunNotFound
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	checkpoint := &CheckpointJSON{}
+	if err = json.NewDecoder(obj.Body).Decode(checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// deletes the run's task jobs which are running but which no task is going to take over
+func (engine *K8sEngine) deleteOrphanedJobs() {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		engine.warnf("failed to list task jobs: %v", err)
+		return
+	}
+	jobs, err := jobsClient.List(metav1.ListOptions{LabelSelector: runSelector(engine.RunID, marinerTask)})
+	if err != nil {
+		engine.warnf("failed to list task jobs: %v", err)
+		return
+	}
+	known := make(map[string]bool)
+	for _, task := range engine.checkpoint.Tasks {
+		if task.Status == running {
+			known[task.JobID] = true
+		}
+	}
+	for _, job := range jobs.Items {
+		if known[string(job.GetUID())] || jobStatusToString(&job.Status) != running {
+			continue
+		}
+		engine.warnf("deleting task job %v - it isn't in the checkpoint", job.Name)
+		if err = deleteTaskJob(job.Name); err != nil {
+			engine.warnf("failed to delete task job %v: %v", job.Name, err)
+		}
+	}
+}
+
+// the engine's own log of the run gets replaced along with the main task, see taskGraph() - this carries it on
+func (engine *K8sEngine) recoverMainLog(log *Log) {
+	if engine.recovered == nil {
+		return
+	}
+	prior := engine.recovered.Main
+	log.Created = prior.Created
+	log.CreatedObj, _ = time.Parse(timefLayout, prior.Created)
+	prior.Event.RLock()
+	log.Event.Events = append(append([]string{}, prior.Event.Events...), log.Event.Events...)
+	prior.Event.RUnlock()
+}
+
+// returns the task's tool as it was before the engine restarted - set up, and
+// - with its outputs, and Reused set, if the task completed
+// - with its job, if the task was running and its job is still around (or succeeded)
+// returns nil if the task has to run again
+func (engine *K8sEngine) recoveredTool(task *Task) *Tool {
+	if engine.checkpoint == nil || engine.checkpoint.Restarts == 0 {
+		return nil
+	}
+	engine.checkpoint.Lock()
+	checkpoint := engine.checkpoint.Tasks[taskKey(task)]
+	engine.checkpoint.Unlock()
+	if checkpoint == nil || (checkpoint.Status != running && checkpoint.Status != completed) {
+		return nil
+	}
+
+	engine.Lock()
+	tool := task.tool(engine.RunID, checkpoint.Attempt) // #race #ok
+	tool.Resources = engine.stepResources(task)
+	tool.WorkingDir = checkpoint.WorkingDir
+	task.Log.WorkingDir = checkpoint.WorkingDir
+	engine.Unlock()
+	tool.JSVM = tool.newJSVM()
+
+	if err := engine.loadInputs(tool); err != nil {
+		task.warnf("failed to load inputs to recover task - running it again: %v", err)
+		return nil
+	}
+	if err := tool.inputsToVM(); err != nil {
+		task.warnf("failed to load inputs to js vm to recover task - running it again: %v", err)
+		return nil
+	}
+	if !sameJSON(checkpoint.Input, task.Log.Input) {
+		task.warnf("inputs changed since the checkpoint - running the task again")
+		if checkpoint.Status == running {
+			if err := deleteTaskJob(checkpoint.JobName); err != nil {
+				task.warnf("failed to delete job %v: %v", checkpoint.JobName, err)
+			}
+		}
+		return nil
+	}
+
+	switch checkpoint.Status {
+	case completed:
+		engine.restoreTaskLog(task, checkpoint)
+		tool.reuse(&Log{
+			Output:     checkpoint.Output,
+			WorkingDir: checkpoint.WorkingDir,
+			JobName:    checkpoint.JobName,
+		})
+		tool.Reused = true
+		task.infof("task completed before the engine restarted - taking its outputs from the checkpoint")
+	case running:
+		if !engine.adoptJob(tool, checkpoint) {
+			return nil
+		}
+		engine.restoreTaskLog(task, checkpoint)
+		task.Log.JobID, task.Log.JobName = tool.JobID, tool.JobName
+	}
+	return tool
+}
+
+// carries on the task's log from before the restart - its events, attempts, timing, ..
+func (engine *K8sEngine) restoreTaskLog(task *Task, checkpoint *TaskCheckpointJSON) {
+	if engine.recovered == nil {
+		return
+	}
+	var prior *Log
+	candidates := []*Log{engine.recovered.Main}
+	if task.OriginalStep != nil {
+		candidates = []*Log{engine.recovered.ByProcess[task.OriginalStep.ID]}
+		if candidates[0] != nil {
+			for _, subtask := range candidates[0].Scatter {
+				candidates = append(candidates, subtask)
+			}
+		}
+	}
+	for _, log := range candidates {
+		if log != nil && log.WorkingDir == checkpoint.WorkingDir {
+			prior = log
+		}
+	}
+	if prior == nil {
+		return
+	}
+
+	engine.Log.Lock()
+	defer engine.Log.Unlock()
+	restored := *prior
+	restored.CreatedObj, _ = time.Parse(timefLayout, prior.Created)
+	restored.Status = running
+	restored.Input, restored.Output = task.Log.Input, task.Log.Output
+	if restored.Event == nil {
+		restored.Event = &EventLog{}
+	}
+	if restored.Stats == nil {
+		restored.Stats = &Stats{}
+	}
+	*task.Log = restored
+}
+
+// takes the job over - returns false if the job is gone without having succeeded
+func (engine *K8sEngine) adoptJob(tool *Tool, checkpoint *TaskCheckpointJSON) bool {
+	tool.JobName, tool.JobID = checkpoint.JobName, checkpoint.JobID
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		tool.Task.warnf("failed to look for job %v - running the task again: %v", checkpoint.JobName, err)
+		return false
+	}
+	jobs, err := jobsClient.List(metav1.ListOptions{LabelSelector: runSelector(engine.RunID, marinerTask)})
+	if err != nil {
+		tool.Task.warnf("failed to look for job %v - running the task again: %v", checkpoint.JobName, err)
+		return false
+	}
+	for _, job := range jobs.Items {
+		if string(job.GetUID()) != checkpoint.JobID {
+			continue
+		}
+		tool.JobCreated = job.CreationTimestamp.Time
+		if job.Spec.ActiveDeadlineSeconds != nil {
+			tool.TimeLimit = *job.Spec.ActiveDeadlineSeconds
+		}
+		// the job watch may not have listed the job yet
+		engine.jobs.update(checkpoint.JobID, jobStatusToString(&job.Status))
+		tool.Task.infof("took over job %v from before the engine restarted", checkpoint.JobName)
+		return true
+	}
+
+	exitCode, err := engine.taskExitCode(checkpoint.WorkingDir)
+	if err != nil || exitCode != 0 {
+		tool.Task.warnf("job %v is gone, and didn't succeed - running the task again", checkpoint.JobName)
+		return false
+	}
+	engine.jobs.update(checkpoint.JobID, completed)
+	tool.Task.infof("job %v succeeded while the engine was down", checkpoint.JobName)
+	return true
+}
+
+// the exit code of the task's command, from the "done" file it leaves in its working dir
+func (engine *K8sEngine) taskExitCode(workingDir string) (int, error) {
+	svc := s3.New(engine.S3FileManager.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(filepath.Join(engine.S3FileManager.s3Key(workingDir, engine.UserID), doneFlag)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Body.Close()
+	b, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+//// checkpoint ////
+
+// records the state of the tool
+func (engine *K8sEngine) checkpointTool(tool *Tool, status string) {
+	if engine.checkpoint == nil || engine.DryRun {
+		return
+	}
+	task := &TaskCheckpointJSON{
+		Status:     status,
+		Attempt:    tool.Attempt,
+		WorkingDir: tool.WorkingDir,
+		JobName:    tool.JobName,
+		JobID:      tool.JobID,
+		Input:      tool.Task.Log.Input,
+	}
+	if status == completed {
+		task.Output = tool.Task.Outputs
+	}
+	engine.checkpoint.Lock()
+	engine.checkpoint.Tasks[taskKey(tool.Task)] = task
+	engine.checkpoint.Unlock()
+	engine.writeCheckpoint()
+}
+
+// records the state of the run, once it's finished
+func (engine *K8sEngine) checkpointRun() {
+	if engine.checkpoint == nil || engine.DryRun {
+		return
+	}
+	engine.checkpoint.Lock()
+	engine.checkpoint.Status = engine.Log.Main.Status
+	engine.checkpoint.Unlock()
+	engine.writeCheckpoint()
+}
+
+// writes are serialized, so an older checkpoint never overwrites a newer one
+func (engine *K8sEngine) writeCheckpoint() {
+	engine.checkpoint.Lock()
+	defer engine.checkpoint.Unlock()
+	engine.checkpoint.Updated = timef(time.Now())
+	b, err := json.Marshal(engine.checkpoint.CheckpointJSON)
+	if err != nil {
+		fmt.Println("error marshalling checkpoint: ", err)
+		return
+	}
+	svc := s3.New(engine.S3FileManager.newS3Session())
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(engine.S3FileManager.S3BucketName),
+		Key:         aws.String(checkpointKey(engine.UserID, engine.RunID)),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		fmt.Println("error writing checkpoint: ", err)
+	}
+}
+
+// how long since the engine first started the run
+func (engine *K8sEngine) runElapsed() time.Duration {
+	if engine.checkpoint == nil {
+		return 0
+	}
+	started, err := time.Parse(timefLayout, engine.checkpoint.Started)
+	if err != nil {
+		return 0
+	}
+	return time.Since(started)
+}
@@ -0,0 +1,112 @@
+package mariner
+
+import (
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+func TestTaskKey(t *testing.T) {
+	cases := []struct {
+		name string
+		task *Task
+		key  string
+	}{
+		{"main process", &Task{Root: &cwl.Root{ID: mainProcessID}}, "#main"},
+		{"step", &Task{Root: &cwl.Root{ID: "#tool.cwl"}, OriginalStep: &cwl.Step{ID: "#main/align"}}, "#main/align"},
+		{"scattered subtask", &Task{Root: &cwl.Root{ID: "#tool.cwl"}, OriginalStep: &cwl.Step{ID: "#main/align"}, ScatterIndex: 2}, "#main/align[2]"},
+		{"step of a nested workflow", &Task{Root: &cwl.Root{ID: "#tool.cwl"}, OriginalStep: &cwl.Step{ID: "#sub.cwl/align"}}, "#sub.cwl/align"},
+	}
+	for _, c := range cases {
+		if key := taskKey(c.task); key != c.key {
+			t.Errorf("%v: expected %v, got %v", c.name, c.key, key)
+		}
+	}
+	if key := checkpointKey("alice", "run-1"); key != "alice/workflowRuns/run-1/checkpoint.json" {
+		t.Errorf("unexpected checkpoint key %v", key)
+	}
+}
+
+// the cases in which a task runs again without the engine looking for its job or its files
+func TestRecoveredToolRunsAgain(t *testing.T) {
+	step := &cwl.Step{ID: "#main/align"}
+	checkpoint := func(restarts int, tasks map[string]*TaskCheckpointJSON) *runCheckpoint {
+		return &runCheckpoint{CheckpointJSON: CheckpointJSON{Status: running, Restarts: restarts, Tasks: tasks}}
+	}
+	cases := []struct {
+		name       string
+		checkpoint *runCheckpoint
+	}{
+		{"no checkpoint", nil},
+		{"first start", checkpoint(0, map[string]*TaskCheckpointJSON{"#main/align": {Status: completed}})},
+		{"task not in the checkpoint", checkpoint(1, map[string]*TaskCheckpointJSON{"#main/other": {Status: completed}})},
+		{"task failed", checkpoint(1, map[string]*TaskCheckpointJSON{"#main/align": {Status: failed}})},
+		{"other scatter index", checkpoint(1, map[string]*TaskCheckpointJSON{"#main/align[1]": {Status: completed}})},
+	}
+	for _, c := range cases {
+		engine := &K8sEngine{checkpoint: c.checkpoint}
+		task := &Task{Root: &cwl.Root{ID: "#tool.cwl"}, OriginalStep: step, ScatterIndex: 2, Log: logger()}
+		if tool := engine.recoveredTool(task); tool != nil {
+			t.Errorf("%v: expected the task to run again", c.name)
+		}
+	}
+}
+
+func TestRestoreTaskLog(t *testing.T) {
+	prior := func(workingDir string) *Log {
+		log := logger()
+		log.WorkingDir = workingDir
+		log.Status = completed
+		log.Event.info("from before the restart: " + workingDir)
+		return log
+	}
+	step := prior("/engine-workspace/workflowRuns/run-1/align/")
+	step.Scatter = map[int]*Log{1: prior("/engine-workspace/workflowRuns/run-1/align-scatter-1/")}
+	recovered := &MainLog{
+		Main:      prior("/engine-workspace/workflowRuns/run-1/"),
+		ByProcess: map[string]*Log{"#main/align": step},
+	}
+
+	cases := []struct {
+		name       string
+		task       *Task
+		workingDir string
+		restored   bool
+	}{
+		{"step", &Task{OriginalStep: &cwl.Step{ID: "#main/align"}}, "/engine-workspace/workflowRuns/run-1/align/", true},
+		{"scattered subtask", &Task{OriginalStep: &cwl.Step{ID: "#main/align"}, ScatterIndex: 1}, "/engine-workspace/workflowRuns/run-1/align-scatter-1/", true},
+		{"main process", &Task{}, "/engine-workspace/workflowRuns/run-1/", true},
+		{"other working dir - a retry", &Task{OriginalStep: &cwl.Step{ID: "#main/align"}}, "/engine-workspace/workflowRuns/run-1/align-attempt-2/", false},
+		{"step not in the run log", &Task{OriginalStep: &cwl.Step{ID: "#main/other"}}, "/engine-workspace/workflowRuns/run-1/other/", false},
+	}
+	for _, c := range cases {
+		engine := &K8sEngine{recovered: recovered, Log: mainLog("")}
+		c.task.Root = &cwl.Root{ID: "#tool.cwl"}
+		c.task.Log = logger()
+		c.task.Log.Input = map[string]interface{}{"n": 1.0}
+		engine.restoreTaskLog(c.task, &TaskCheckpointJSON{WorkingDir: c.workingDir})
+
+		// a fresh log has no working dir yet
+		restored := c.task.Log.WorkingDir != ""
+		switch {
+		case restored != c.restored:
+			t.Errorf("%v: expected restored=%v, got %v", c.name, c.restored, restored)
+		case restored && c.task.Log.WorkingDir != c.workingDir:
+			t.Errorf("%v: restored the log of %v", c.name, c.task.Log.WorkingDir)
+		case restored && (c.task.Log.Status != running || c.task.Log.Input["n"] != 1.0):
+			t.Errorf("%v: expected the restored log to be running, with the task's inputs", c.name)
+		}
+	}
+}
+
+// events carry on numbering from the last one written before the restart
+func TestContinueFrom(t *testing.T) {
+	bus := newEventBus()
+	ch := bus.subscribe()
+	bus.continueFrom(41)
+	bus.publish(&Event{})
+	if e := <-ch; e.Seq != 42 {
+		t.Errorf("expected seq 42, got %v", e.Seq)
+	}
+	bus.close()
+}
@@ -0,0 +1,499 @@
+package mariner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains code for the workflow registry
+// i.e., packed workflows registered under a name and a semantic version, so clients don't have to inline them in every request
+//
+// POST /workflows - register a version: {"name": "align", "version": "1.2.0", "workflow": <packed workflow>}
+// GET /workflows - the registered workflows and their versions
+// GET /workflows/{name} - the versions of a workflow, newest first, with their digests
+// GET /workflows/{name}/versions/{version} - a version, with its workflow
+//
+// a workflow request then gives "workflow_ref": "align@1.2.0" (or "align@latest") instead of "workflow"
+// ----- every run records the digest of its workflow ("sha256:<hex>" of the compacted packed json) in its request
+//
+// versions are immutable - registering an existing version is a 409
+// registering needs "register" on "/mariner/workflows/{name}" - reading the registry needs only a valid token
+//
+// each version is an object in s3 - "_mariner/workflows/{name}/{version}.json"
+// whose body is the compacted workflow, with the digest and who registered it in the object metadata
+
+const (
+	marinerWorkflowsResource = "/mariner/workflows"
+
+	workflowRegistryPrefix = "_mariner/workflows/"
+	registeredWorkflowKeyf = workflowRegistryPrefix + "%v/%v.json" // fill with name, version
+
+	latestVersion = "latest"
+
+	digestMetadataKey       = "Digest"
+	registeredByMetadataKey = "Registered-By"
+)
+
+var (
+	workflowNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+	// semver 2.0.0, see https://semver.org
+	semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+
+	errWorkflowNotFound = errors.New("workflow not found")
+)
+
+// RegisterWorkflowJSON is the body of a '/workflows' POST
+type RegisterWorkflowJSON struct {
+	Name     string          `json:"name"`
+	Version  string          `json:"version"`
+	Workflow json.RawMessage `json:"workflow"`
+}
+
+// RegisteredWorkflowJSON is a version of a workflow in the registry
+type RegisteredWorkflowJSON struct {
+	Name         string          `json:"name"`
+	Version      string          `json:"version"`
+	Digest       string          `json:"digest"`
+	RegisteredBy string          `json:"registered_by,omitempty"`
+	Created      string          `json:"created,omitempty"`
+	Workflow     json.RawMessage `json:"workflow,omitempty"`
+}
+
+// WorkflowVersionsJSON lists the versions of a workflow, newest first
+type WorkflowVersionsJSON struct {
+	Name     string                    `json:"name"`
+	Versions []*RegisteredWorkflowJSON `json:"versions"`
+}
+
+// WorkflowListJSON lists the registered workflows
+type WorkflowListJSON struct {
+	Workflows []*WorkflowNameJSON `json:"workflows"`
+}
+
+// WorkflowNameJSON is a registered workflow and its versions, newest first
+type WorkflowNameJSON struct {
+	Name     string   `json:"name"`
+	Versions []string `json:"versions"`
+}
+
+func workflowResource(name string) string {
+	return marinerWorkflowsResource + "/" + name
+}
+
+// "sha256:<hex>" of the compacted workflow
+func workflowDigest(workflow json.RawMessage) (compacted []byte, digest string, err error) {
+	buf := &bytes.Buffer{}
+	if err = json.Compact(buf, workflow); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+//// handlers ////
+
+// '/workflows' - POST
+func (server *Server) handleWorkflowsPOST(w http.ResponseWriter, r *http.Request) {
+	reg := &RegisterWorkflowJSON{}
+	if err := unmarshalBody(r, reg); err != nil {
+		writeError(w, 400, fmt.Sprintf("invalid workflow registration: %v", err))
+		return
+	}
+	if grievances := reg.validate(); len(grievances) > 0 {
+		writeError(w, 400, fmt.Sprintf("invalid workflow registration: %v", strings.Join(grievances, "; ")))
+		return
+	}
+
+	ok, err := server.authorize(r, workflowResource(reg.Name), registerAction)
+	if err != nil {
+		fmt.Println("error checking auth: ", err)
+		writeError(w, 500, "failed to check authorization")
+		return
+	}
+	if !ok {
+		writeError(w, 403, fmt.Sprintf("user not authorized to register workflow %v", reg.Name))
+		return
+	}
+
+	registered, err := server.registerWorkflow(reg, server.userID(r))
+	switch {
+	case err == errWorkflowExists:
+		writeError(w, 409, fmt.Sprintf("workflow %v@%v is already registered - versions can't be changed", reg.Name, reg.Version))
+		return
+	case err != nil:
+		fmt.Println("error registering workflow: ", err)
+		writeError(w, 500, fmt.Sprintf("failed to register workflow: %v", err))
+		return
+	}
+	writeJSON(w, registered)
+}
+
+// '/workflows' - GET
+func (server *Server) handleWorkflowsGET(w http.ResponseWriter, r *http.Request) {
+	list, err := server.listWorkflows()
+	if err != nil {
+		fmt.Println("error listing workflows: ", err)
+		writeError(w, 500, "failed to list workflows")
+		return
+	}
+	writeJSON(w, list)
+}
+
+// '/workflows/{name}' - GET
+func (server *Server) handleWorkflowVersionsGET(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := checkWorkflowName(name); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	versions, err := server.workflowVersions(name)
+	if err != nil {
+		fmt.Println("error listing workflow versions: ", err)
+		writeError(w, 500, "failed to list workflow versions")
+		return
+	}
+	if len(versions.Versions) == 0 {
+		writeError(w, 404, errWorkflowNotFound.Error())
+		return
+	}
+	writeJSON(w, versions)
+}
+
+// '/workflows/{name}/versions/{version}' - GET
+func (server *Server) handleWorkflowVersionGET(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := checkWorkflowRef(vars["name"], vars["version"]); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	registered, err := server.fetchWorkflow(vars["name"], vars["version"])
+	switch {
+	case err == errWorkflowNotFound:
+		writeError(w, 404, err.Error())
+		return
+	case err != nil:
+		fmt.Println("error fetching workflow: ", err)
+		writeError(w, 500, "failed to fetch workflow")
+		return
+	}
+	writeJSON(w, registered)
+}
+
+// names and versions from clients go into s3 keys - so they're checked before they're used, e.g., no "../"
+func checkWorkflowName(name string) error {
+	if !workflowNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid workflow name %q - may only contain letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// version may be "latest"
+func checkWorkflowRef(name, version string) error {
+	if err := checkWorkflowName(name); err != nil {
+		return err
+	}
+	if version != latestVersion && !semverPattern.MatchString(version) {
+		return fmt.Errorf("invalid workflow version %q - must be a semantic version, e.g., 1.2.0, or %q", version, latestVersion)
+	}
+	return nil
+}
+
+// returns what's wrong with the registration
+func (reg *RegisterWorkflowJSON) validate() []string {
+	grievances := []string{}
+	complain := func(f string, v ...interface{}) {
+		grievances = append(grievances, fmt.Sprintf(f, v...))
+	}
+	if !workflowNamePattern.MatchString(reg.Name) {
+		complain("invalid name %q - may only contain letters, digits, '_', '.' and '-'", reg.Name)
+	}
+	if !semverPattern.MatchString(reg.Version) {
+		complain("invalid version %q - must be a semantic version, e.g., 1.2.0", reg.Version)
+	}
+	if len(reg.Workflow) == 0 {
+		complain("missing workflow")
+	} else if valid, g := wflib.ValidateJSON([]byte(reg.Workflow), nil); !valid {
+		wfGrievances := workflowGrievances(g)
+		if len(wfGrievances) == 0 {
+			complain("invalid workflow")
+		}
+		for _, grievance := range wfGrievances {
+			complain("invalid workflow: %v", grievance)
+		}
+	}
+	return grievances
+}
+
+//// storage ////
+
+var errWorkflowExists = errors.New("workflow version already exists")
+
+func (server *Server) registerWorkflow(reg *RegisterWorkflowJSON, userID string) (*RegisteredWorkflowJSON, error) {
+	compacted, digest, err := workflowDigest(reg.Workflow)
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(server.S3FileManager.newS3Session())
+	key := fmt.Sprintf(registeredWorkflowKeyf, reg.Name, reg.Version)
+
+	// fixme - two registrations of the same version at the same moment can both go through
+	_, err = svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(key),
+	})
+	switch {
+	case err == nil:
+		return nil, errWorkflowExists
+	case !isNotFound(err):
+		return nil, err
+	}
+
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(server.S3FileManager.S3BucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(compacted),
+		ContentType: aws.String("application/json"),
+		Metadata: map[string]*string{
+			digestMetadataKey:       aws.String(digest),
+			registeredByMetadataKey: aws.String(userID),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RegisteredWorkflowJSON{
+		Name:         reg.Name,
+		Version:      reg.Version,
+		Digest:       digest,
+		RegisteredBy: userID,
+	}, nil
+}
+
+// version may be "latest" - the newest version which isn't a pre-release
+func (server *Server) fetchWorkflow(name, version string) (*RegisteredWorkflowJSON, error) {
+	if version == latestVersion {
+		versions, err := server.workflowVersions(name)
+		if err != nil {
+			return nil, err
+		}
+		version = ""
+		for _, v := range versions.Versions {
+			if !strings.Contains(strings.SplitN(v.Version, "+", 2)[0], "-") {
+				version = v.Version
+				break
+			}
+		}
+		if version == "" {
+			return nil, errWorkflowNotFound
+		}
+	}
+	svc := s3.New(server.S3FileManager.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(fmt.Sprintf(registeredWorkflowKeyf, name, version)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errWorkflowNotFound
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	buf := &bytes.Buffer{}
+	if _, err = buf.ReadFrom(obj.Body); err != nil {
+		return nil, err
+	}
+	return &RegisteredWorkflowJSON{
+		Name:         name,
+		Version:      version,
+		Digest:       aws.StringValue(obj.Metadata[digestMetadataKey]),
+		RegisteredBy: aws.StringValue(obj.Metadata[registeredByMetadataKey]),
+		Created:      timef(aws.TimeValue(obj.LastModified)),
+		Workflow:     buf.Bytes(),
+	}, nil
+}
+
+func (server *Server) listWorkflows() (*WorkflowListJSON, error) {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	byName := make(map[string][]string)
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Prefix: aws.String(workflowRegistryPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if name, version, ok := parseRegistryKey(aws.StringValue(obj.Key)); ok {
+				byName[name] = append(byName[name], version)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := &WorkflowListJSON{Workflows: []*WorkflowNameJSON{}}
+	for name, versions := range byName {
+		sort.Slice(versions, func(i, j int) bool { return compareSemver(versions[i], versions[j]) > 0 })
+		list.Workflows = append(list.Workflows, &WorkflowNameJSON{Name: name, Versions: versions})
+	}
+	sort.Slice(list.Workflows, func(i, j int) bool { return list.Workflows[i].Name < list.Workflows[j].Name })
+	return list, nil
+}
+
+// the versions of the workflow, newest first - without their workflows
+func (server *Server) workflowVersions(name string) (*WorkflowVersionsJSON, error) {
+	svc := s3.New(server.S3FileManager.newS3Session())
+	versions := &WorkflowVersionsJSON{Name: name, Versions: []*RegisteredWorkflowJSON{}}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Prefix: aws.String(workflowRegistryPrefix + name + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if _, version, ok := parseRegistryKey(aws.StringValue(obj.Key)); ok {
+				versions.Versions = append(versions.Versions, &RegisteredWorkflowJSON{
+					Name:    name,
+					Version: version,
+					Created: timef(aws.TimeValue(obj.LastModified)),
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the digests are in the object metadata
+	for _, v := range versions.Versions {
+		head, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(server.S3FileManager.S3BucketName),
+			Key:    aws.String(fmt.Sprintf(registeredWorkflowKeyf, name, v.Version)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		v.Digest = aws.StringValue(head.Metadata[digestMetadataKey])
+		v.RegisteredBy = aws.StringValue(head.Metadata[registeredByMetadataKey])
+	}
+	sort.Slice(versions.Versions, func(i, j int) bool {
+		return compareSemver(versions.Versions[i].Version, versions.Versions[j].Version) > 0
+	})
+	return versions, nil
+}
+
+// "_mariner/workflows/{name}/{version}.json" -> name, version
+func parseRegistryKey(key string) (name, version string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(key, workflowRegistryPrefix), "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".json") {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSuffix(parts[1], ".json"), true
+}
+
+// compares semantic versions a and b, by semver precedence - returns -1, 0 or 1
+func compareSemver(a, b string) int {
+	ma, mb := semverPattern.FindStringSubmatch(a), semverPattern.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return strings.Compare(a, b)
+	}
+	for i := 1; i <= 3; i++ {
+		x, _ := strconv.Atoi(ma[i])
+		y, _ := strconv.Atoi(mb[i])
+		if x != y {
+			return compareInts(x, y)
+		}
+	}
+	// a pre-release comes before the release
+	switch preA, preB := ma[4], mb[4]; {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	default:
+		return comparePrerelease(preA, preB)
+	}
+}
+
+func comparePrerelease(a, b string) int {
+	idsA, idsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(idsA) && i < len(idsB); i++ {
+		x, errX := strconv.Atoi(idsA[i])
+		y, errY := strconv.Atoi(idsB[i])
+		switch {
+		case errX == nil && errY == nil:
+			if x != y {
+				return compareInts(x, y)
+			}
+		case errX == nil:
+			// numeric identifiers come before alphanumeric ones
+			return -1
+		case errY == nil:
+			return 1
+		default:
+			if c := strings.Compare(idsA[i], idsB[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(len(idsA), len(idsB))
+}
+
+func compareInts(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+//// workflow requests ////
+
+// fills in the workflow of a request which gives a workflow_ref, and the digest of every request's workflow
+// the ref is pinned to the version it resolved to, e.g., "align@latest" -> "align@1.2.0"
+func (server *Server) resolveWorkflowRef(r *WorkflowRequest) error {
+	if r.WorkflowRef == "" {
+		if len(r.Workflow) > 0 {
+			// an invalid workflow gets caught by validate()
+			_, r.WorkflowDigest, _ = workflowDigest(r.Workflow)
+		}
+		return nil
+	}
+	if len(r.Workflow) > 0 {
+		return fmt.Errorf("give either workflow or workflow_ref, not both")
+	}
+	parts := strings.SplitN(r.WorkflowRef, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid workflow_ref %q - must be name@version", r.WorkflowRef)
+	}
+	if err := checkWorkflowRef(parts[0], parts[1]); err != nil {
+		return fmt.Errorf("invalid workflow_ref %q: %v", r.WorkflowRef, err)
+	}
+	registered, err := server.fetchWorkflow(parts[0], parts[1])
+	switch {
+	case err == errWorkflowNotFound:
+		return fmt.Errorf("workflow %v not found in the registry", r.WorkflowRef)
+	case err != nil:
+		return fmt.Errorf("failed to fetch workflow %v: %v", r.WorkflowRef, err)
+	}
+	r.Workflow = registered.Workflow
+	r.WorkflowRef = registered.Name + "@" + registered.Version
+	r.WorkflowDigest = registered.Digest
+	return nil
+}
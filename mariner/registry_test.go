@@ -0,0 +1,86 @@
+package mariner
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestCompareSemver(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0", "2.0.0", -1},
+		{"1.10.0", "1.9.0", 1}, // numerically, not lexically
+		{"1.0.10", "1.0.9", 1},
+		{"1.0.0-alpha", "1.0.0", -1}, // a pre-release comes before the release
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},      // more identifiers come after fewer
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1}, // numeric identifiers come before alphanumeric ones
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta", "1.0.0-alpha", 1},
+		{"1.0.0+build.1", "1.0.0+build.2", 0}, // build metadata doesn't count
+	}
+	for _, c := range cases {
+		if cmp := compareSemver(c.a, c.b); cmp != c.expected {
+			t.Errorf("%v vs %v: expected %v, got %v", c.a, c.b, c.expected, cmp)
+		}
+		if cmp := compareSemver(c.b, c.a); cmp != -c.expected {
+			t.Errorf("%v vs %v: expected %v, got %v", c.b, c.a, -c.expected, cmp)
+		}
+	}
+
+	// the precedence example of the semver spec
+	versions := []string{"1.0.0", "1.0.0-rc.1", "1.0.0-beta.11", "1.0.0-beta.2", "1.0.0-beta", "1.0.0-alpha.beta", "1.0.0-alpha.1", "1.0.0-alpha"}
+	sort.Slice(versions, func(i, j int) bool { return compareSemver(versions[i], versions[j]) < 0 })
+	expected := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0"}
+	for i := range expected {
+		if versions[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, versions)
+			break
+		}
+	}
+}
+
+func TestCheckWorkflowRef(t *testing.T) {
+	cases := []struct {
+		name, version string
+		valid         bool
+	}{
+		{"align", "1.2.0", true},
+		{"align", latestVersion, true},
+		{"align_v2.bwa-mem", "1.2.0-rc.1+build.5", true},
+		{"align", "1.2", false},
+		{"align", "v1.2.0", false},
+		{"align", "01.2.0", false},
+		{"..", "1.2.0", false},
+		{"a/b", "1.2.0", false},
+		{"", "1.2.0", false},
+		{"align", "../1.2.0", false},
+	}
+	for _, c := range cases {
+		if err := checkWorkflowRef(c.name, c.version); (err == nil) != c.valid {
+			t.Errorf("%v@%v: expected valid=%v, got %v", c.name, c.version, c.valid, err)
+		}
+	}
+}
+
+func TestParseRegistryKey(t *testing.T) {
+	cases := []struct {
+		key           string
+		name, version string
+		ok            bool
+	}{
+		{workflowRegistryPrefix + "align/1.2.0.json", "align", "1.2.0", true},
+		{workflowRegistryPrefix + "align/1.2.0", "", "", false},
+		{workflowRegistryPrefix + "align/sub/1.2.0.json", "", "", false},
+		{workflowRegistryPrefix + "align", "", "", false},
+	}
+	for _, c := range cases {
+		name, version, ok := parseRegistryKey(c.key)
+		if name != c.name || version != c.version || ok != c.ok {
+			t.Errorf("%v: expected %q, %q, %v - got %q, %q, %v", c.key, c.name, c.version, c.ok, name, version, ok)
+		}
+	}
+}
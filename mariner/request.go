@@ -0,0 +1,151 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	cwl "github.com/uc-cdis/cwl.go"
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains code for validating a workflow request
+// the whole request gets validated before anything is written to s3 or dispatched
+
+const (
+	maxTags        = 50
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// returns a list of everything wrong with the request - empty if the request is valid
+func (r *WorkflowRequest) validate() []string {
+	grievances := []string{}
+	complain := func(f string, v ...interface{}) {
+		grievances = append(grievances, fmt.Sprintf(f, v...))
+	}
+
+	// workflow
+	validWorkflow := false
+	if len(r.Workflow) == 0 {
+		complain("missing workflow")
+	} else if valid, g := wflib.ValidateJSON([]byte(r.Workflow), nil); !valid {
+		wfGrievances := workflowGrievances(g)
+		if len(wfGrievances) == 0 {
+			complain("invalid workflow")
+		}
+		for _, grievance := range wfGrievances {
+			complain("invalid workflow: %v", grievance)
+		}
+	} else if v := cwlVersion(r.Workflow); !contains(supportedCWLVersions, v) {
+		complain("unsupported cwlVersion %q - must be one of %v", v, strings.Join(supportedCWLVersions, ", "))
+	} else {
+		validWorkflow = true
+	}
+
+	// input - the inputs mapping is a json object, with a value for each required input of the workflow, and none for inputs it doesn't have
+	input := make(map[string]interface{})
+	if len(r.Input) > 0 {
+		if err := json.Unmarshal(r.Input, &input); err != nil {
+			complain("input must be a json object: %v", err)
+			validWorkflow = false
+		}
+	}
+	if validWorkflow {
+		grievances = append(grievances, inputGrievances(r.Workflow, input)...)
+	}
+
+	// tags
+	if len(r.Tags) > maxTags {
+		complain("too many tags: %v - max is %v", len(r.Tags), maxTags)
+	}
+	for k, v := range r.Tags {
+		switch {
+		case k == "":
+			complain("tag keys must be nonempty")
+		case len(k) > maxTagKeyLen:
+			complain("tag key %q is too long - max length is %v", k, maxTagKeyLen)
+		case len(v) > maxTagValueLen:
+			complain("value of tag %q is too long - max length is %v", k, maxTagValueLen)
+		}
+	}
+
+	// manifest
+	for i, entry := range r.Manifest {
+		if strings.TrimSpace(entry.GUID) == "" {
+			complain("manifest entry %v is missing object_id", i)
+		}
+	}
+
+	// project
+	if r.Project != "" && !projectPattern.MatchString(r.Project) {
+		complain("invalid project %q - may only contain letters, digits, '_', '.' and '-'", r.Project)
+	}
+
+	// service account - only the configured ones can be used
+	if r.ServiceAccountName != "" && !serviceAccountAllowed(r.ServiceAccountName) {
+		complain("service account %q is not allowed", r.ServiceAccountName)
+	}
+
+	// callbacks
+	for i, callback := range r.Callbacks {
+		if err := checkCallbackURL(callback.URL); err != nil {
+			complain("callback %v: %v", i, err)
+		}
+	}
+
+	// max runtime
+	if r.MaxRuntime < 0 {
+		complain("max_runtime must not be negative, got %v", r.MaxRuntime)
+	}
+
+	// step resource overrides
+	grievances = append(grievances, r.stepResourceGrievances()...)
+
+	return grievances
+}
+
+// the task job's default service account, plus those on the allow-list in the mariner config
+func serviceAccountAllowed(name string) bool {
+	return name == Config.Jobs.Task.ServiceAccount || contains(Config.Jobs.Task.AllowedServiceAccounts, name)
+}
+
+// flattens the grievances from wflib.ValidateJSON into a list of messages
+func workflowGrievances(g *wflib.WorkflowGrievances) []string {
+	out := []string{}
+	if g == nil {
+		return out
+	}
+	out = append(out, g.Main...)
+	ids := make([]string, 0, len(g.ByProcess))
+	for id := range g.ByProcess {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, grievance := range g.ByProcess[id] {
+			out = append(out, fmt.Sprintf("%v: %v", id, grievance))
+		}
+	}
+	return out
+}
+
+// checks the inputs mapping against the inputs of the workflow's main process, see mainInputGrievances()
+func inputGrievances(workflow json.RawMessage, input map[string]interface{}) []string {
+	var root cwl.Root
+	if err := json.Unmarshal(workflow, &root); err != nil {
+		return []string{fmt.Sprintf("failed to unmarshal workflow: %v", err)}
+	}
+	for _, process := range root.Graphs {
+		if process.ID != mainProcessID {
+			continue
+		}
+		params := make(cwl.Parameters)
+		for id, val := range input {
+			params[mainProcessID+"/"+id] = val
+		}
+		return mainInputGrievances(process, params)
+	}
+	return []string{"workflow has no main process"}
+}
@@ -0,0 +1,133 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// a valid request for a workflow with two required File inputs, "commons_file_1" and "commons_file_2"
+const commonsInputRequest = "../testdata/commons_input_test/request_body.json"
+
+func TestValidateInputs(t *testing.T) {
+	b, err := ioutil.ReadFile(commonsInputRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := `{"class": "File", "location": "COMMONS/8bc9f306-5b5d-4b6b-b34e-f90680824b17"}`
+	cases := []struct {
+		name       string
+		input      string
+		grievances []string // substrings of the expected grievances, in order
+	}{
+		{"all required inputs", `{"commons_file_1": ` + file + `, "commons_file_2": ` + file + `}`, nil},
+		{"missing required input", `{"commons_file_1": ` + file + `}`, []string{"missing value for required input commons_file_2"}},
+		{"null for a required input", `{"commons_file_1": ` + file + `, "commons_file_2": null}`, []string{"missing value for required input commons_file_2"}},
+		{"no input", ``, []string{"input commons_file_1", "input commons_file_2"}},
+		{"unknown inputs", `{"commons_file_1": ` + file + `, "commons_file_2": ` + file + `, "b": 1, "a": 2}`, []string{
+			"input a is not an input of the workflow", "input b is not an input of the workflow",
+		}},
+		{"not an object", `[1]`, []string{"input must be a json object"}},
+	}
+	for _, c := range cases {
+		r := &WorkflowRequest{}
+		if err = json.Unmarshal(b, r); err != nil {
+			t.Fatal(err)
+		}
+		r.Input = json.RawMessage(c.input)
+		grievances := r.validate()
+		if len(grievances) != len(c.grievances) {
+			t.Errorf("%v: expected %v grievances, got %v", c.name, len(c.grievances), grievances)
+			continue
+		}
+		for i, expected := range c.grievances {
+			if !strings.Contains(grievances[i], expected) {
+				t.Errorf("%v: expected %q, got %q", c.name, expected, grievances[i])
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	Config = &MarinerConfig{Jobs: Jobs{Task: JobConfig{ServiceAccount: "default-sa", AllowedServiceAccounts: []string{"lab-sa"}}}}
+	b, err := ioutil.ReadFile(commonsInputRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooManyTags := map[string]string{}
+	for i := 0; i <= maxTags; i++ {
+		tooManyTags[fmt.Sprintf("tag-%v", i)] = "v"
+	}
+	cases := []struct {
+		name       string
+		edit       func(r *WorkflowRequest)
+		grievances []string // substrings of the expected grievances, in order
+	}{
+		{"valid request", func(r *WorkflowRequest) {}, nil},
+		{"valid optional fields", func(r *WorkflowRequest) {
+			r.Tags = map[string]string{"study": "abc"}
+			r.Project = "lab_1.a-b"
+			r.ServiceAccountName = "lab-sa"
+			r.Callbacks = []*Callback{{URL: "https://hooks.example.org/mariner"}}
+			r.MaxRuntime = 3600
+			r.StepResources = map[string]*StepResources{"#main/read_from_commons": {CoresMin: 1, CoresMax: 2, RAMMin: 512}}
+		}, nil},
+		{"too many tags", func(r *WorkflowRequest) { r.Tags = tooManyTags }, []string{"too many tags"}},
+		{"empty tag key", func(r *WorkflowRequest) { r.Tags = map[string]string{"": "v"} }, []string{"tag keys must be nonempty"}},
+		{"tag key too long", func(r *WorkflowRequest) {
+			r.Tags = map[string]string{strings.Repeat("k", maxTagKeyLen+1): "v"}
+		}, []string{"is too long - max length is 128"}},
+		{"tag value too long", func(r *WorkflowRequest) {
+			r.Tags = map[string]string{"k": strings.Repeat("v", maxTagValueLen+1)}
+		}, []string{`value of tag "k" is too long`}},
+		{"manifest entry without object_id", func(r *WorkflowRequest) {
+			r.Manifest = append(r.Manifest, ManifestEntry{GUID: " "})
+		}, []string{"manifest entry 2 is missing object_id"}},
+		{"invalid project", func(r *WorkflowRequest) { r.Project = "lab/1" }, []string{`invalid project "lab/1"`}},
+		{"default service account", func(r *WorkflowRequest) { r.ServiceAccountName = "default-sa" }, nil},
+		{"service account not allowed", func(r *WorkflowRequest) { r.ServiceAccountName = "admin-sa" }, []string{`service account "admin-sa" is not allowed`}},
+		{"relative callback url", func(r *WorkflowRequest) {
+			r.Callbacks = []*Callback{{URL: "https://hooks.example.org/"}, {URL: "/hooks"}}
+		}, []string{"callback 1: invalid url"}},
+		{"internal callback url", func(r *WorkflowRequest) {
+			r.Callbacks = []*Callback{{URL: "http://169.254.169.254/"}}
+		}, []string{"callback 0: host 169.254.169.254 is internal"}},
+		{"negative max_runtime", func(r *WorkflowRequest) { r.MaxRuntime = -1 }, []string{"max_runtime must not be negative"}},
+		{"step_resources for an unknown step", func(r *WorkflowRequest) {
+			r.StepResources = map[string]*StepResources{"#main/nope": {CoresMin: 1}}
+		}, []string{`step_resources: no step "#main/nope"`}},
+		{"step_resources without resources", func(r *WorkflowRequest) {
+			r.StepResources = map[string]*StepResources{"#main/read_from_commons": nil}
+		}, []string{"step_resources: no resources given"}},
+		{"negative step_resources", func(r *WorkflowRequest) {
+			r.StepResources = map[string]*StepResources{"#main/read_from_commons": {RAMMin: -1}}
+		}, []string{"step_resources: negative resources"}},
+		{"step_resources max less than min", func(r *WorkflowRequest) {
+			r.StepResources = map[string]*StepResources{"#main/read_from_commons": {CoresMin: 4, CoresMax: 2}}
+		}, []string{"step_resources: max less than min"}},
+		{"several grievances", func(r *WorkflowRequest) {
+			r.Project = "lab 1"
+			r.MaxRuntime = -5
+		}, []string{"invalid project", "max_runtime must not be negative"}},
+	}
+	for _, c := range cases {
+		r := &WorkflowRequest{}
+		if err = json.Unmarshal(b, r); err != nil {
+			t.Fatal(err)
+		}
+		c.edit(r)
+		grievances := r.validate()
+		if len(grievances) != len(c.grievances) {
+			t.Errorf("%v: expected %v grievances, got %v", c.name, len(c.grievances), grievances)
+			continue
+		}
+		for i, expected := range c.grievances {
+			if !strings.Contains(grievances[i], expected) {
+				t.Errorf("%v: expected %q, got %q", c.name, expected, grievances[i])
+			}
+		}
+	}
+}
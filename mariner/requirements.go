@@ -0,0 +1,89 @@
+package mariner
+
+import "strings"
+
+// this file contains code for the requirements and hints a process inherits from the workflows and steps it's in
+// see: https://www.commonwl.org/v1.2/CommandLineTool.html#Requirements_and_hints
+//
+// - requirements and hints of a workflow apply to its steps, and on down to the processes the steps run
+// - the most specific one of a class wins: the process' own over its step's, the step's over its workflow's, and so on up
+// - a requirement of a class wins over a hint of that class, wherever each of them is given
+//
+// the cwl lib only parses the requirements of the process itself (Root.Requirements) - this works off the packed CWL,
+// for the requirements the engine reads itself, e.g., ToolTimeLimit (see timelimit.go), and for the cache key (see cache.go)
+// NOTE: inherited requirements are resolved when the task graph is, see resolveGraph()
+
+// ProcessRequirements are the requirements and hints in effect for a process, by class
+type ProcessRequirements struct {
+	Requirements map[string]map[string]interface{}
+	Hints        map[string]map[string]interface{}
+}
+
+func newProcessRequirements() *ProcessRequirements {
+	return &ProcessRequirements{
+		Requirements: make(map[string]map[string]interface{}),
+		Hints:        make(map[string]map[string]interface{}),
+	}
+}
+
+// returns a copy of reqs with the requirements and hints of the given process (or step) on top
+func (reqs *ProcessRequirements) with(process map[string]interface{}) *ProcessRequirements {
+	merged := newProcessRequirements()
+	if reqs != nil {
+		for class, req := range reqs.Requirements {
+			merged.Requirements[class] = req
+		}
+		for class, hint := range reqs.Hints {
+			merged.Hints[class] = hint
+		}
+	}
+	for _, req := range cwlRequirements(process["requirements"]) {
+		if class, ok := req["class"].(string); ok {
+			merged.Requirements[class] = req
+		}
+	}
+	for _, hint := range cwlRequirements(process["hints"]) {
+		if class, ok := hint["class"].(string); ok {
+			merged.Hints[class] = hint
+		}
+	}
+	return merged
+}
+
+// the requirement of the class, else the hint - nil if there's neither
+func (reqs *ProcessRequirements) find(class string) map[string]interface{} {
+	if req, ok := reqs.Requirements[class]; ok {
+		return req
+	}
+	return reqs.Hints[class]
+}
+
+// the requirements and hints a step's process inherits - those of the workflow, on top of what the workflow inherits, then the step's own
+func (engine *K8sEngine) stepRequirements(workflow *Task, stepID string) *ProcessRequirements {
+	process := engine.processes[workflow.Root.ID]
+	return workflow.Inherited.with(process).with(packedStep(process, stepID))
+}
+
+// the requirements and hints in effect for the task's process
+func (engine *K8sEngine) effectiveRequirements(task *Task) *ProcessRequirements {
+	return task.Inherited.with(engine.processes[task.Root.ID])
+}
+
+// the step's entry in the packed workflow - steps may be a list, or a map keyed by id
+func packedStep(workflow map[string]interface{}, stepID string) map[string]interface{} {
+	switch steps := workflow["steps"].(type) {
+	case []interface{}:
+		for _, item := range steps {
+			if step, ok := item.(map[string]interface{}); ok && step["id"] == stepID {
+				return step
+			}
+		}
+	case map[string]interface{}:
+		for id, item := range steps {
+			if step, ok := item.(map[string]interface{}); ok && (id == stepID || strings.HasSuffix(stepID, "/"+id)) {
+				return step
+			}
+		}
+	}
+	return nil
+}
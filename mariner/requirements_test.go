@@ -0,0 +1,60 @@
+package mariner
+
+import (
+	"fmt"
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+// a workflow whose step "#main/step" runs "#tool.cwl" - fill with the workflow's, the step's and the tool's requirements/hints
+const inheritanceWorkflowf = `{
+	"cwlVersion": "v1.1",
+	"$graph": [
+		{"id": "#main", "class": "Workflow", %v "steps": [{"id": "#main/step", "run": "#tool.cwl", %v "in": [], "out": []}]},
+		{"id": "#tool.cwl", "class": "CommandLineTool", %v "inputs": [], "outputs": []}
+	]
+}`
+
+// a ToolTimeLimit in the given field - "requirements" or "hints"
+func timeLimitIn(field string, seconds int) string {
+	return fmt.Sprintf(`"%v": [{"class": "ToolTimeLimit", "timelimit": %v}],`, field, seconds)
+}
+
+func TestEffectiveRequirements(t *testing.T) {
+	cases := []struct {
+		name                 string
+		workflow, step, tool string
+		limit                float64 // 0 - no ToolTimeLimit
+	}{
+		{"none", "", "", "", 0},
+		{"tool requirement", "", "", timeLimitIn("requirements", 10), 10},
+		{"tool hint", "", "", timeLimitIn("hints", 10), 10},
+		{"inherited from the workflow", timeLimitIn("requirements", 20), "", "", 20},
+		{"inherited from the step", "", timeLimitIn("requirements", 30), "", 30},
+		{"workflow hint", timeLimitIn("hints", 20), "", "", 20},
+		{"step over workflow", timeLimitIn("requirements", 20), timeLimitIn("requirements", 30), "", 30},
+		{"tool over step", "", timeLimitIn("requirements", 30), timeLimitIn("requirements", 10), 10},
+		{"workflow requirement over tool hint", timeLimitIn("requirements", 20), "", timeLimitIn("hints", 10), 20},
+		{"tool hint over workflow hint", timeLimitIn("hints", 20), "", timeLimitIn("hints", 10), 10},
+	}
+	for _, c := range cases {
+		processes, err := packedProcesses([]byte(fmt.Sprintf(inheritanceWorkflowf, c.workflow, c.step, c.tool)))
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		engine := &K8sEngine{processes: processes}
+		main := &Task{Root: &cwl.Root{ID: mainProcessID}}
+		step := &Task{Root: &cwl.Root{ID: "#tool.cwl"}, Inherited: engine.stepRequirements(main, "#main/step")}
+
+		req := engine.effectiveRequirements(step).find(toolTimeLimitClass)
+		switch {
+		case c.limit == 0 && req != nil:
+			t.Errorf("%v: expected no ToolTimeLimit, got %v", c.name, req)
+		case c.limit != 0 && req == nil:
+			t.Errorf("%v: expected a ToolTimeLimit", c.name)
+		case req != nil && req["timelimit"] != c.limit:
+			t.Errorf("%v: expected timelimit %v, got %v", c.name, c.limit, req["timelimit"])
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+// this file contains code for resuming a run
+// i.e., the '/runs/{runID}/resume' endpoint, and the engine side of it
+//
+// resuming a run creates a new run, from the same workflow request, whose engine loads the log of the prior run
+// a task which completed in the prior run with the same inputs doesn't run again - its recorded outputs are reused
+// ----- so only failed tasks, and the tasks downstream of them (whose inputs change), get run
+// ----- the reused outputs still live in the prior run's working dirs, under the owner's prefix in s3
+// ----- so only the owner of a run can resume it
+//
+// the request body is optional:
+// {
+//   "input": {..}, // replaces the given top-level inputs
+//   "step_resources": {"#main/step_id": {"coresMin": 4, "ramMin": 16384}}, // overrides a step's ResourceRequirement
+//   "tags": {..} // added to the prior run's tags
+// }
+
+// ResumeRequestJSON is the (optional) body of a '/runs/{runID}/resume' POST
+type ResumeRequestJSON struct {
+	Input         map[string]json.RawMessage `json:"input,omitempty"`
+	StepResources map[string]*StepResources  `json:"step_resources,omitempty"`
+	Tags          map[string]string          `json:"tags,omitempty"`
+}
+
+// StepResources overrides the CWL ResourceRequirement of a workflow step
+// same fields and units as the CWL - ram is in mebibytes
+type StepResources struct {
+	CoresMin int `json:"coresMin,omitempty"`
+	CoresMax int `json:"coresMax,omitempty"`
+	RAMMin   int `json:"ramMin,omitempty"`
+	RAMMax   int `json:"ramMax,omitempty"`
+}
+
+// '/runs/{runID}/resume' - POST
+func (server *Server) handleResumeRunPOST(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	if userID != server.userID(r) {
+		writeError(w, 403, "only the owner of a run can resume it")
+		return
+	}
+	resume := &ResumeRequestJSON{}
+	b, err := body(r)
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, resume); err != nil {
+			writeError(w, 400, fmt.Sprintf("invalid resume request: %v", err))
+			return
+		}
+	}
+
+	priorLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		fmt.Println("error fetching log: ", err)
+		writeRunError(w, err, "failed to fetch run log")
+		return
+	}
+	if !finishedStatus(priorLog.Main.Status) {
+		writeError(w, 409, fmt.Sprintf("run %v hasn't finished - cancel it before resuming it", runID))
+		return
+	}
+	prior := priorLog.Request
+	if prior == nil {
+		if prior, err = server.fetchRequest(userID, runID); err != nil {
+			fmt.Println("error fetching workflow request: ", err)
+			writeRunError(w, err, "failed to fetch workflow request")
+			return
+		}
+	}
+
+	workflowRequest, err := resumeRequest(runID, prior, resume)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("invalid resume request: %v", err))
+		return
+	}
+	if grievances := workflowRequest.validate(); len(grievances) > 0 {
+		writeError(w, 400, fmt.Sprintf("invalid workflow request: %v", strings.Join(grievances, "; ")))
+		return
+	}
+	// the prior run's callbacks keep their secrets
+	secrets, err := server.callbackSecrets(userID, runID)
+	if err != nil {
+		writeError(w, 500, "failed to fetch callback secrets")
+		return
+	}
+	workflowRequest.restoreCallbackSecrets(secrets)
+	server.startRun(w, r, workflowRequest)
+}
+
+// the workflow request for a new run which resumes the prior one
+func resumeRequest(runID string, prior *WorkflowRequest, resume *ResumeRequestJSON) (*WorkflowRequest, error) {
+	r := *prior
+	r.ResumeFrom = runID
+	if resume.StepResources != nil {
+		r.StepResources = resume.StepResources
+	}
+
+	if len(resume.Input) > 0 {
+		input := make(map[string]json.RawMessage)
+		if len(prior.Input) > 0 {
+			if err := json.Unmarshal(prior.Input, &input); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal input of prior run: %v", err)
+			}
+		}
+		for k, v := range resume.Input {
+			input[k] = v
+		}
+		b, err := json.Marshal(input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal input: %v", err)
+		}
+		r.Input = b
+	}
+
+	if len(resume.Tags) > 0 {
+		r.Tags = make(map[string]string)
+		for k, v := range prior.Tags {
+			r.Tags[k] = v
+		}
+		for k, v := range resume.Tags {
+			r.Tags[k] = v
+		}
+	}
+	return &r, nil
+}
+
+// the IDs of all the steps of all the workflows in a packed workflow
+func workflowStepIDs(workflow json.RawMessage) (map[string]bool, error) {
+	var root cwl.Root
+	if err := json.Unmarshal(workflow, &root); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, process := range root.Graphs {
+		for _, step := range process.Steps {
+			ids[step.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+// returns what's wrong with the step resource overrides
+func (r *WorkflowRequest) stepResourceGrievances() []string {
+	grievances := []string{}
+	if len(r.StepResources) == 0 {
+		return grievances
+	}
+	steps, err := workflowStepIDs(r.Workflow)
+	for id, res := range r.StepResources {
+		switch {
+		case err == nil && !steps[id]:
+			grievances = append(grievances, fmt.Sprintf("step_resources: no step %q in the workflow", id))
+		case res == nil:
+			grievances = append(grievances, fmt.Sprintf("step_resources: no resources given for step %q", id))
+		case res.CoresMin < 0 || res.CoresMax < 0 || res.RAMMin < 0 || res.RAMMax < 0:
+			grievances = append(grievances, fmt.Sprintf("step_resources: negative resources for step %q", id))
+		case res.CoresMax > 0 && res.CoresMax < res.CoresMin, res.RAMMax > 0 && res.RAMMax < res.RAMMin:
+			grievances = append(grievances, fmt.Sprintf("step_resources: max less than min for step %q", id))
+		}
+	}
+	return grievances
+}
+
+//// engine ////
+
+// loads the log of the run being resumed
+func (engine *K8sEngine) loadPriorRun() error {
+	runID := engine.Log.Request.ResumeFrom
+	engine.infof("begin load log of prior run: %v", runID)
+	prior, err := engine.fetchRunLog(runID)
+	if err != nil {
+		return fmt.Errorf("failed to load log of prior run: %v", err)
+	}
+	engine.Prior = prior
+	engine.infof("end load log of prior run: %v", runID)
+	return nil
+}
+
+// fetches the log of one of the user's runs - a prior run, or this run, if the engine restarted (see recovery.go)
+func (engine *K8sEngine) fetchRunLog(runID string) (*MainLog, error) {
+	downloader := s3manager.NewDownloader(engine.S3FileManager.newS3Session())
+	buf := &aws.WriteAtBuffer{}
+	_, err := downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(engine.S3FileManager.S3BucketName),
+		Key:    aws.String(fmt.Sprintf(pathToUserRunLogf, engine.UserID, runID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download run log: %v", err)
+	}
+	runLog := &MainLog{}
+	if err = json.Unmarshal(buf.Bytes(), runLog); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal run log: %v", err)
+	}
+	return runLog, nil
+}
+
+// the resource overrides for the task's step, if any
+func (engine *K8sEngine) stepResources(task *Task) *StepResources {
+	if task.OriginalStep == nil {
+		return nil
+	}
+	return engine.Log.Request.StepResources[task.OriginalStep.ID]
+}
+
+// the tool's CWL requirements, then the resource overrides for its step - which come last, so they win
+func (tool *Tool) requirements() []cwl.Requirement {
+	if tool.Resources == nil {
+		return tool.Task.Root.Requirements
+	}
+	reqs := make([]cwl.Requirement, 0, len(tool.Task.Root.Requirements)+1)
+	reqs = append(reqs, tool.Task.Root.Requirements...)
+	return append(reqs, cwl.Requirement{
+		Class: CWLResourceRequirement,
+		ResourceRequirement: cwl.ResourceRequirement{
+			CoresMin: tool.Resources.CoresMin,
+			CoresMax: tool.Resources.CoresMax,
+			RAMMin:   tool.Resources.RAMMin,
+			RAMMax:   tool.Resources.RAMMax,
+		},
+	})
+}
+
+// called once the tool's inputs are loaded
+// if the task completed in the prior run with the same inputs, takes its outputs from there and returns true
+func (engine *K8sEngine) reuseOutputs(tool *Tool) bool {
+	if engine.Prior == nil {
+		return false
+	}
+	for _, prior := range engine.priorLogs(tool.Task) {
+		if !engine.reusable(tool, prior) {
+			continue
+		}
+		reusedFrom := prior.ReusedFrom
+		if reusedFrom == "" {
+			reusedFrom = engine.Log.Request.ResumeFrom
+		}
+		tool.reuse(prior)
+		tool.Task.Log.ReusedFrom = reusedFrom
+		tool.Task.infof("reusing outputs of this task from run %v", reusedFrom)
+		return true
+	}
+	return false
+}
+
+// takes the outputs, working dir, job and command of the tool from an earlier run of it
+// the call cache (see cache.go) reuses outputs this way too
+func (tool *Tool) reuse(prior *Log) {
+	outputs := make(map[string]interface{})
+	for id, val := range prior.Output {
+		outputs[id] = restoreOutput(val)
+	}
+	tool.WorkingDir = prior.WorkingDir
+	tool.Task.Outputs = outputs
+	log := tool.Task.Log
+	log.Output = outputs
+	log.WorkingDir = prior.WorkingDir
+	log.JobName = prior.JobName
+	log.ContainerImage = prior.ContainerImage
+	log.Command = prior.Command
+}
+
+// the task's logs from the prior run - all the scattered subtasks, for a scattered task
+func (engine *K8sEngine) priorLogs(task *Task) []*Log {
+	var prior *Log
+	if task.OriginalStep == nil {
+		prior = engine.Prior.Main
+	} else {
+		prior = engine.Prior.ByProcess[task.OriginalStep.ID]
+	}
+	switch {
+	case prior == nil:
+		return nil
+	case task.ScatterIndex > 0:
+		logs := []*Log{}
+		for _, subtask := range prior.Scatter {
+			logs = append(logs, subtask)
+		}
+		return logs
+	}
+	return []*Log{prior}
+}
+
+// true if the prior run of the task completed cleanly, with the same inputs, and its outputs are all still there
+func (engine *K8sEngine) reusable(tool *Tool, prior *Log) bool {
+	if prior == nil || prior.Status != completed || prior.Output == nil {
+		return false
+	}
+	if prior.Event != nil {
+		for _, event := range prior.Event.Events {
+			if strings.Contains(event, fmt.Sprintf(" - %v - ", errorLogLevel)) {
+				return false
+			}
+		}
+	}
+	if !sameJSON(prior.Input, tool.Task.Log.Input) {
+		return false
+	}
+	for _, output := range tool.Task.Root.Outputs {
+		val, ok := prior.Output[output.ID]
+		if !ok {
+			return false
+		}
+		if !engine.outputFilesExist(val) {
+			tool.Task.warnf("can't reuse prior outputs - some output files are gone")
+			return false
+		}
+	}
+	return true
+}
+
+// compares the values as json
+func sameJSON(a, b interface{}) bool {
+	na, err := normalizeJSON(a)
+	if err != nil {
+		return false
+	}
+	nb, err := normalizeJSON(b)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(na, nb)
+}
+
+// the value as it comes back from json - e.g., a *File becomes a map[string]interface{}
+func normalizeJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err = json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// true if every file in the output value is in s3
+func (engine *K8sEngine) outputFilesExist(val interface{}) bool {
+	switch v := val.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if !engine.outputFilesExist(item) {
+				return false
+			}
+		}
+	case map[string]interface{}:
+		if !isFile(v) {
+			return true
+		}
+		path, err := filePath(v)
+		if err != nil {
+			return false
+		}
+		if strings.HasPrefix(path, pathToCommonsData) {
+			return true
+		}
+		exists, err := engine.fileExists(path)
+		return err == nil && exists
+	}
+	return true
+}
+
+// outputs are *File or []*File when the engine collects them - this turns their json back into those
+func restoreOutput(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if f := restoreFile(v); f != nil {
+			return f
+		}
+	case []interface{}:
+		files := []*File{}
+		for _, item := range v {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return val
+			}
+			f := restoreFile(m)
+			if f == nil {
+				return val
+			}
+			files = append(files, f)
+		}
+		if len(files) > 0 {
+			return files
+		}
+	}
+	return val
+}
+
+func restoreFile(m map[string]interface{}) *File {
+	if !isFile(m) {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	f := &File{}
+	if err = json.Unmarshal(b, f); err != nil {
+		return nil
+	}
+	return f
+}
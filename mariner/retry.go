@@ -0,0 +1,216 @@
+package mariner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for retrying tasks
+//
+// a task whose job fails for a reason which may well not happen again -
+// the pod got evicted, the node got lost, the image couldn't be pulled, the s3 sidecar failed to move the task's files -
+// gets run again, after a backoff which doubles with each retry
+// - "retries" in the config sets how many times, for every task
+// - a tool may set its own number of retries with a hint, e.g.,
+//
+//     hints:
+//       - class: mariner:RetryPolicy
+//         maxRetries: 3
+//
+// failures of the tool itself (e.g., the command exits non-zero, or gets OOMKilled) aren't retried
+//
+// each attempt is a fresh job, with a fresh working dir - "{task working dir}-attempt-{n}/" for retries
+// and each attempt's status, timing and resource usage go in the task log's "attempts",
+// so flaky infrastructure can be told apart from broken tools
+
+const (
+	retryPolicyHint = "RetryPolicy" // the hint's class, in whatever namespace - "mariner:RetryPolicy" is what we document
+
+	defaultRetryBackoff    = 30 * time.Second
+	defaultMaxRetryBackoff = 10 * time.Minute
+
+	// how often the engine checks on the pod of a running task for problems the job status doesn't show, e.g., image pull errors
+	podCheckPeriod = 30 * time.Second
+)
+
+// pod status reasons which say the pod's node failed it, not the tool
+var transientPodReasons = map[string]bool{
+	"Evicted":                  true,
+	"NodeLost":                 true,
+	"Shutdown":                 true,
+	"Terminated":               true,
+	"UnexpectedAdmissionError": true,
+}
+
+// RetryConfig ..
+type RetryConfig struct {
+	MaxRetries        int `json:"max_retries"`
+	BackoffSeconds    int `json:"backoff_seconds,omitempty"`     // before the first retry - doubles with each retry
+	MaxBackoffSeconds int `json:"max_backoff_seconds,omitempty"` // the backoff never gets longer than this
+}
+
+// AttemptLog records one attempt at running a task's job
+type AttemptLog struct {
+	Attempt       int           `json:"attempt"`
+	JobName       string        `json:"jobName,omitempty"`
+	JobID         string        `json:"jobID,omitempty"`
+	WorkingDir    string        `json:"workingDir,omitempty"`
+	Status        string        `json:"status"`
+	Created       string        `json:"created,omitempty"`
+	Finished      string        `json:"finished,omitempty"`
+	Duration      float64       `json:"duration"`
+	FailureReason string        `json:"failureReason,omitempty"`
+	ExitCode      *int32        `json:"exitCode,omitempty"`
+	Transient     bool          `json:"transient,omitempty"` // true if the failure may well not happen again - i.e., the attempt got retried
+	ResourceUsage ResourceUsage `json:"resourceUsage"`
+}
+
+// the number of times the tool may be retried - its RetryPolicy hint, else the config
+func (engine *K8sEngine) maxRetries(tool *Tool) int {
+	process := engine.processes[tool.Task.Root.ID]
+	for _, hint := range cwlRequirements(process["hints"]) {
+		class, _ := hint["class"].(string)
+		if !strings.HasSuffix(class, ":"+retryPolicyHint) && !strings.HasSuffix(class, "#"+retryPolicyHint) && class != retryPolicyHint {
+			continue
+		}
+		if n, ok := hint["maxRetries"].(float64); ok && n >= 0 {
+			return int(n)
+		}
+		tool.Task.warnf("ignoring %v hint without a valid maxRetries", class)
+	}
+	return Config.Retries.MaxRetries
+}
+
+// 30s, 1m, 2m, .. - unless the config says otherwise
+func retryBackoff(retry int) time.Duration {
+	backoff, maxBackoff := defaultRetryBackoff, defaultMaxRetryBackoff
+	if Config.Retries.BackoffSeconds > 0 {
+		backoff = time.Duration(Config.Retries.BackoffSeconds) * time.Second
+	}
+	if Config.Retries.MaxBackoffSeconds > 0 {
+		maxBackoff = time.Duration(Config.Retries.MaxBackoffSeconds) * time.Second
+	}
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// true if the tool's job failed in a way which is worth another attempt, and it has attempts left
+func (engine *K8sEngine) retryable(tool *Tool) bool {
+	if !tool.TransientFailure || engine.cancelRequested() {
+		return false
+	}
+	if max := engine.maxRetries(tool); tool.Attempt > max {
+		tool.Task.warnf("not retrying task - already retried %v times", max)
+		return false
+	}
+	return true
+}
+
+// adds the attempt which just finished to the task log
+func (engine *K8sEngine) recordAttempt(tool *Tool, err error) {
+	if tool.JobName == "" {
+		// not a job - i.e., an ExpressionTool
+		return
+	}
+	t := time.Now()
+	attempt := &AttemptLog{
+		Attempt:       tool.Attempt,
+		JobName:       tool.JobName,
+		JobID:         tool.JobID,
+		WorkingDir:    tool.WorkingDir,
+		Status:        completed,
+		Finished:      timef(t),
+		FailureReason: tool.Task.Log.FailureReason,
+		ExitCode:      tool.Task.Log.ExitCode,
+		Transient:     tool.TransientFailure,
+	}
+	if !tool.JobCreated.IsZero() {
+		attempt.Created = timef(tool.JobCreated)
+		attempt.Duration = t.Sub(tool.JobCreated).Seconds()
+	}
+
+	engine.Lock()
+	defer engine.Unlock()
+	stats := tool.Task.Log.Stats
+	attempt.ResourceUsage = ResourceUsage{
+		Series:         append(ResourceUsageSeries{}, stats.ResourceUsage.Series...), // #race #ok
+		SamplingPeriod: stats.ResourceUsage.SamplingPeriod,
+	}
+	if err != nil {
+		attempt.Status = failed
+		stats.NFailures++
+		if attempt.FailureReason == "" {
+			attempt.FailureReason = err.Error()
+		}
+	}
+	stats.NRetries = tool.Attempt - 1
+	tool.Task.Log.Attempts = append(tool.Task.Log.Attempts, attempt)
+}
+
+// waits out the backoff, and sets up the task to run again as a new tool - with a new working dir
+func (engine *K8sEngine) retryTool(prev *Tool) (*Tool, error) {
+	task := prev.Task
+	backoff := retryBackoff(prev.Attempt)
+	task.warnf("task job failed (%v) - retrying in %v", task.Log.FailureReason, backoff)
+	engine.publishTaskRetriedEvent(prev, backoff)
+	select {
+	case <-time.After(backoff):
+	case <-engine.cancelled:
+		return nil, fmt.Errorf("run cancelled")
+	}
+
+	engine.Lock()
+	task.Log.FailureReason = "" // #race #ok
+	task.Log.ExitCode = nil
+	tool := task.tool(engine.RunID, prev.Attempt+1)
+	tool.Resources = prev.Resources
+	engine.Unlock()
+
+	if err := engine.setupTool(tool); err != nil {
+		return nil, err
+	}
+	return tool, nil
+}
+
+// returns a reason if a container of the tool's pod can't start because its image can't be pulled
+// the job doesn't fail in that case - the pod just waits, so the job gets deleted here and the task retried
+func (engine *K8sEngine) checkTaskPod(tool *Tool) (string, bool) {
+	_, _, podsClient, _, err := k8sClient(k8sPodAPI)
+	if err != nil {
+		return "", false
+	}
+	pods, err := podsClient.List(metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%v", tool.JobName)})
+	if err != nil {
+		return "", false
+	}
+	for _, pod := range pods.Items {
+		statuses := append([]k8sv1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+		for _, status := range append(statuses, pod.Status.ContainerStatuses...) {
+			if waiting := status.State.Waiting; waiting != nil && waiting.Reason == "ImagePullBackOff" {
+				return fmt.Sprintf("container %v can't pull its image %v: %v", status.Name, status.Image, waiting.Message), true
+			}
+		}
+	}
+	return "", false
+}
+
+// deletes the job of a task which won't finish on its own
+func deleteTaskJob(jobName string) error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	deleteOption := metav1.NewDeleteOptions(0)
+	var deletionPropagation metav1.DeletionPropagation = "Background"
+	deleteOption.PropagationPolicy = &deletionPropagation
+	return jobsClient.Delete(jobName, deleteOption)
+}
@@ -0,0 +1,64 @@
+package mariner
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	cases := []struct {
+		name     string
+		config   RetryConfig
+		retry    int
+		expected time.Duration
+	}{
+		{"default - first retry", RetryConfig{}, 1, defaultRetryBackoff},
+		{"default - doubles", RetryConfig{}, 3, 4 * defaultRetryBackoff},
+		{"default - capped", RetryConfig{}, 20, defaultMaxRetryBackoff},
+		{"configured", RetryConfig{BackoffSeconds: 5}, 2, 10 * time.Second},
+		{"configured cap", RetryConfig{BackoffSeconds: 5, MaxBackoffSeconds: 12}, 3, 12 * time.Second},
+		{"backoff over the cap", RetryConfig{BackoffSeconds: 60, MaxBackoffSeconds: 30}, 1, 30 * time.Second},
+	}
+	for _, c := range cases {
+		Config = &MarinerConfig{Retries: c.config}
+		if backoff := retryBackoff(c.retry); backoff != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, backoff)
+		}
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	Config = &MarinerConfig{Retries: RetryConfig{MaxRetries: 2}}
+	hint := func(class, maxRetries string) string {
+		return fmt.Sprintf(`"hints": [{"class": "%v", "maxRetries": %v}],`, class, maxRetries)
+	}
+	cases := []struct {
+		name     string
+		tool     string
+		expected int
+	}{
+		{"no hint - the config", "", 2},
+		{"namespaced hint", hint("mariner:RetryPolicy", "5"), 5},
+		{"expanded namespace", hint("https://github.com/uc-cdis/mariner#RetryPolicy", "1"), 1},
+		{"bare class", hint("RetryPolicy", "0"), 0},
+		{"another class", hint("mariner:RetryPolicyX", "5"), 2},
+		{"negative maxRetries - the config", hint("mariner:RetryPolicy", "-1"), 2},
+		{"maxRetries not a number - the config", hint("mariner:RetryPolicy", `"3"`), 2},
+	}
+	for _, c := range cases {
+		processes, err := packedProcesses([]byte(fmt.Sprintf(inheritanceWorkflowf, "", "", c.tool)))
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		engine := &K8sEngine{processes: processes}
+		tool := &Tool{Task: &Task{Root: &cwl.Root{ID: "#tool.cwl"}, Log: logger()}}
+		if max := engine.maxRetries(tool); max != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, max)
+		}
+	}
+}
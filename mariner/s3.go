@@ -65,7 +65,9 @@ func (fm *S3FileManager) setup() (err error) {
 }
 
 func (fm *S3FileManager) newS3Session() *session.Session {
-	return session.Must(session.NewSession(fm.AWSConfig))
+	sess := session.Must(session.NewSession(fm.AWSConfig))
+	sess.Handlers.Complete.PushBack(instrumentS3Session)
+	return sess
 }
 
 /*
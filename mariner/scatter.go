@@ -86,9 +86,8 @@ func (engine *K8sEngine) gatherScatterOutputs(task *Task) (err error) {
 		mtx := &sync.Mutex{}
 		go func(scatterTask *Task, totalOutput map[string][]interface{}) {
 			defer wg.Done()
-			for !*scatterTask.Done {
-				// wait for scattered task to finish
-			}
+			// wait for scattered task to finish
+			scatterTask.wait()
 			for _, param := range task.Root.Outputs {
 				mtx.Lock()
 				totalOutput[param.ID][scatterTask.ScatterIndex-1] = scatterTask.Outputs[param.ID]
@@ -203,6 +202,7 @@ func (task *Task) dotproduct(scatterParams map[string][]interface{}) (err error)
 			Root:         task.Root,
 			Parameters:   make(cwl.Parameters),
 			OriginalStep: task.OriginalStep,
+			Inherited:    task.Inherited,
 			Done:         &falseVal,
 			Log:          logger(),
 			ScatterIndex: i + 1, // count starts from 1, not 0, so that we can check if the ScatterIndex is nil (0 if nil)
@@ -245,6 +245,7 @@ func (task *Task) flatCrossproduct(scatterParams map[string][]interface{}) (err
 			Root:         task.Root,
 			Parameters:   make(cwl.Parameters),
 			OriginalStep: task.OriginalStep,
+			Inherited:    task.Inherited,
 			Done:         &falseVal,
 			Log:          logger(),
 			ScatterIndex: scatterIndex, // count starts from 1, not 0, so that we can check if the ScatterIndex is nil (0 if nil)
@@ -3,6 +3,7 @@ package mariner
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,17 +12,15 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	batchv1 "k8s.io/api/batch/v1"
-	batchtypev1 "k8s.io/client-go/kubernetes/typed/batch/v1"
-
-	"github.com/uc-cdis/go-authutils/authutils"
-	wflib "github.com/uc-cdis/mariner/wflib"
 )
 
 // this file contains code for setting up the mariner-server
@@ -39,6 +38,30 @@ type WorkflowRequest struct {
 
 	// new: specify a service account for the workflow job
 	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// WES requests only - the workflow_url the workflow was submitted with
+	WorkflowURL string `json:"workflowURL,omitempty"`
+
+	// optional - URLs to notify when the run finishes, see callbacks.go
+	Callbacks []*Callback `json:"callbacks,omitempty"`
+
+	// optional - seconds the run may run for before it gets cancelled, see timelimit.go
+	MaxRuntime int64 `json:"max_runtime,omitempty"`
+
+	// optional - the project the run belongs to, which decides who else can see it, see authz.go
+	Project string `json:"project,omitempty"`
+
+	// resumed runs only - the run being resumed, and the resource overrides by step ID, see resume.go
+	ResumeFrom    string                    `json:"resumeFrom,omitempty"`
+	StepResources map[string]*StepResources `json:"stepResources,omitempty"`
+
+	// optional - a workflow from the registry, "name@version", instead of an inline workflow, see registry.go
+	// resolved on submission, when the workflow and its digest get filled in
+	WorkflowRef    string `json:"workflow_ref,omitempty"`
+	WorkflowDigest string `json:"workflowDigest,omitempty"`
+
+	// requests whose workflowURL points to a tool registry only - the tool version the workflow was fetched from, see trs.go
+	TRS *TRSDescriptor `json:"trs,omitempty"`
 }
 
 type Manifest []ManifestEntry
@@ -47,14 +70,16 @@ type ManifestEntry struct {
 	GUID string `json:"object_id"`
 }
 
-type JWTDecoder interface {
-	Decode(string) (*map[string]interface{}, error)
-}
-
 type Server struct {
-	jwtApp        JWTDecoder
+	jwtApp        TokenDecoder
+	authz         Authorizer
+	jwksURL       string // "" unless tokens are verified against a JWKS endpoint
 	logger        *LogHandler
 	S3FileManager *S3FileManager
+	events        *eventHub
+	scraper       *metricsScraper
+	admission     sync.Mutex // guards the run queue, see quota.go
+	ready         readinessCache
 }
 
 // see Arborist's logging.go
@@ -63,12 +88,6 @@ type LogHandler struct {
 	logger *log.Logger
 }
 
-type AuthHTTPRequest struct {
-	URL         string
-	ContentType string
-	Body        io.Reader
-}
-
 type RequestJSON struct {
 	User    *UserJSON    `json:"user"`
 	Request *AuthRequest `json:"request"`
@@ -88,27 +107,6 @@ type UserJSON struct {
 	Token string `json:"token"`
 }
 
-type RunLogJSON struct {
-	Log *MainLog `json:"log"`
-}
-
-type StatusJSON struct {
-	Status string `json:"status"`
-}
-
-type CancelRunJSON struct {
-	RunID  string `json:"runID"`
-	Result string `json:"result"` // success or failed
-}
-
-type ListRunsJSON struct {
-	RunIDs []string `json:"runIDs"`
-}
-
-type RunIDJSON struct {
-	RunID string `json:"runID"`
-}
-
 type ArboristResponse struct {
 	Auth bool `json:"auth"`
 }
@@ -130,19 +128,36 @@ func runServer() {
 	)
 	logFlags := log.Ldate | log.Ltime
 	logger := log.New(os.Stdout, "", logFlags)
-	jwtApp := authutils.NewJWTApplication(*jwkEndpoint)
+	authConfig := &AuthConfig{}
+	if Config != nil {
+		authConfig = &Config.Auth
+	}
+	jwtApp, err := authConfig.tokenDecoder(*jwkEndpoint)
+	if err != nil {
+		log.Fatal("error setting up token decoder: ", err)
+	}
+	authz, err := authConfig.authorizer()
+	if err != nil {
+		log.Fatal("error setting up authorizer: ", err)
+	}
 	fm := &S3FileManager{}
 	fm.setup()
-	server := server().withLogger(logger).withJWTApp(jwtApp).withS3FileManager(fm)
+	server := server().withLogger(logger).withJWTApp(jwtApp).withAuthorizer(authz).withS3FileManager(fm)
+	if authConfig.tokenDecoderName() == jwksTokenDecoder {
+		server = server.withJWKSEndpoint(*jwkEndpoint)
+	}
+	go server.scrapeMetrics()
+	go server.admitQueuedRuns()
+	go server.sweepCancelledRuns()
 	router := server.makeRouter(os.Stdout)
 	addr := fmt.Sprintf(":%d", *port)
 	httpLogger := log.New(os.Stdout, "", log.LstdFlags)
 	httpServer := &http.Server{
-		Addr:         addr,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		ErrorLog:     httpLogger,
-		Handler:      router,
+		Addr:        addr,
+		ReadTimeout: 10 * time.Second,
+		// no WriteTimeout - task logs and run events are streamed for as long as the run goes
+		ErrorLog: httpLogger,
+		Handler:  router,
 	}
 	httpLogger.Println(fmt.Sprintf("mariner serving at %s", httpServer.Addr))
 	httpLogger.Fatal(httpServer.ListenAndServe())
@@ -153,11 +168,22 @@ func (server *Server) withS3FileManager(fm *S3FileManager) *Server {
 	return server
 }
 
-func (server *Server) withJWTApp(jwtApp JWTDecoder) *Server {
+func (server *Server) withJWTApp(jwtApp TokenDecoder) *Server {
 	server.jwtApp = jwtApp
 	return server
 }
 
+func (server *Server) withAuthorizer(authz Authorizer) *Server {
+	server.authz = authz
+	return server
+}
+
+// the readiness check makes sure the JWKS endpoint responds
+func (server *Server) withJWKSEndpoint(url string) *Server {
+	server.jwksURL = url
+	return server
+}
+
 // TODO - see logging in mariner - implement server logging for mariner
 func (server *Server) withLogger(logger *log.Logger) *Server {
 	server.logger = &LogHandler{logger: logger}
@@ -165,22 +191,41 @@ func (server *Server) withLogger(logger *log.Logger) *Server {
 }
 
 func server() (server *Server) {
-	return &Server{}
+	return &Server{events: newEventHub(), scraper: newMetricsScraper()}
 }
 
-// first just getting the endpoints to work, then will make nice and WES-ish
+// see WES spec for endpoints and response objects - response objects are defined in wes.go
 func (server *Server) makeRouter(out io.Writer) http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/runs", server.handleRunsPOST).Methods("POST")
-	router.HandleFunc("/runs", server.handleRunsGET).Methods("GET")
-	router.HandleFunc("/runs/{runID}", server.handleRunLogGET).Methods("GET")
-	router.HandleFunc("/runs/{runID}/status", server.handleRunStatusGET).Methods("GET")
-	router.HandleFunc("/runs/{runID}/cancel", server.handleCancelRunPOST).Methods("POST")
-	router.HandleFunc("/_status", server.handleHealthCheck).Methods("GET") // TO CHECK
+
+	// liveness and readiness - no auth, see health.go
+	router.HandleFunc("/_status", server.handleHealthCheck).Methods("GET")
+	router.HandleFunc("/_ready", server.handleReadinessCheck).Methods("GET")
+
+	// prometheus - no auth, see metrics.go
+	router.HandleFunc("/metrics", server.handleMetricsGET).Methods("GET")
+
+	api := router.PathPrefix("/").Subrouter()
+	api.HandleFunc("/service-info", server.handleServiceInfoGET).Methods("GET")
+	api.HandleFunc("/runs", server.handleRunsPOST).Methods("POST")
+	api.HandleFunc("/runs", server.handleRunsGET).Methods("GET")
+	api.HandleFunc("/runs/{runID}", server.handleRunLogGET).Methods("GET")
+	api.HandleFunc("/runs/{runID}", server.handleRunDELETE).Methods("DELETE")
+	api.HandleFunc("/runs/{runID}/status", server.handleRunStatusGET).Methods("GET")
+	api.HandleFunc("/runs/{runID}/outputs", server.handleRunOutputsGET).Methods("GET")
+	api.HandleFunc("/runs/{runID}/events", server.handleRunEventsGET).Methods("GET")
+	api.HandleFunc("/runs/{runID}/tasks/{taskID}/logs", server.handleTaskLogsGET).Methods("GET")
+	api.HandleFunc("/runs/{runID}/cancel", server.handleCancelRunPOST).Methods("POST")
+	api.HandleFunc("/runs/{runID}/resume", server.handleResumeRunPOST).Methods("POST")
+	api.HandleFunc("/workflows", server.handleWorkflowsPOST).Methods("POST")
+	api.HandleFunc("/workflows", server.handleWorkflowsGET).Methods("GET")
+	api.HandleFunc("/workflows/{name}", server.handleWorkflowVersionsGET).Methods("GET")
+	api.HandleFunc("/workflows/{name}/versions/{version}", server.handleWorkflowVersionGET).Methods("GET")
 
 	// router.NotFoundHandler = http.HandlerFunc(handleNotFound) // TODO
 
-	router.Use(server.handleAuth)        // use auth middleware function - right now access to mariner API is all-or-nothing
+	router.Use(server.instrument)        // API latency metrics, see metrics.go
+	api.Use(server.handleAuth)           // use auth middleware function - right now access to mariner API is all-or-nothing
 	router.Use(server.setResponseHeader) // set "Content-Type: application/json" header - every endpoint returns JSON
 
 	// remove trailing slashes sent in URLs
@@ -198,25 +243,61 @@ func (server *Server) makeRouter(out io.Writer) http.Handler {
 
 //// handlers ////
 
+// '/service-info' - GET
+func (server *Server) handleServiceInfoGET(w http.ResponseWriter, r *http.Request) {
+	userID := server.userID(r)
+	j := serviceInfo()
+	counts, err := server.stateCounts(userID)
+	if err != nil {
+		fmt.Println("error counting run states: ", err)
+	}
+	j.SystemStateCounts = counts
+	writeJSON(w, j)
+}
+
+// number of this user's runs in each WES state
+func (server *Server) stateCounts(userID string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	runIDs, err := server.listRuns(userID)
+	if err != nil {
+		return counts, err
+	}
+	refs := []*runRef{}
+	for _, runID := range runIDs {
+		refs = append(refs, &runRef{UserID: userID, RunID: runID})
+	}
+	for _, summary := range server.runSummaries(refs) {
+		counts[summary.State]++
+	}
+	return counts, nil
+}
+
 // '/runs/{runID}' - GET
 func (server *Server) handleRunLogGET(w http.ResponseWriter, r *http.Request) {
 	userID, runID := server.uniqueKey(r)
 	j, err := server.fetchLog(userID, runID)
+	if err == errRunNotFound {
+		// the run may have been deleted, see delete.go
+		if tombstone, tErr := server.fetchTombstone(userID, runID); tErr == nil {
+			writeError(w, 410, fmt.Sprintf("run was deleted by %v at %v", tombstone.DeletedBy, tombstone.Deleted))
+			return
+		}
+	}
 	if err != nil {
 		fmt.Println("error fetching log: ", err)
-		// handle
+		writeRunError(w, err, "failed to fetch run log")
+		return
 	}
 	writeJSON(w, j)
 }
 
 func (server *Server) fetchLog(userID, runID string) (*RunLogJSON, error) {
-	j := &RunLogJSON{}
 	runLog, err := server.fetchMainLog(userID, runID)
 	if err != nil {
 		return nil, err
 	}
-	j.Log = runLog
-	return j, nil
+	server.checkCanceling(userID, runID, runLog)
+	return runLogJSON(runID, runLog), nil
 }
 
 // '/runs/{runID}/status' - GET
@@ -225,175 +306,180 @@ func (server *Server) handleRunStatusGET(w http.ResponseWriter, r *http.Request)
 	j, err := server.fetchStatus(userID, runID)
 	if err != nil {
 		fmt.Println("error fetching status: ", err)
-		// handle
+		writeRunError(w, err, "failed to fetch run status")
+		return
 	}
 	writeJSON(w, j)
 }
 
 func (server *Server) fetchStatus(userID, runID string) (*StatusJSON, error) {
-	j := &StatusJSON{}
 	runLog, err := server.fetchMainLog(userID, runID)
-	if err != nil {
+	switch {
+	case err == errRunNotFound:
+		// no log yet - the run may still be queued
+		summary := server.runSummary(userID, runID)
+		if summary.State == stateUnknown {
+			return nil, errRunNotFound
+		}
+		return &StatusJSON{RunID: runID, State: summary.State}, nil
+	case err != nil:
 		return nil, err
 	}
-	j.Status = runLog.Main.Status
+	server.checkCanceling(userID, runID, runLog)
+	j := &StatusJSON{
+		RunID: runID,
+		State: runState(runLog),
+	}
 	return j, nil
 }
 
 // '/runs/{runID}/cancel' - POST
 func (server *Server) handleCancelRunPOST(w http.ResponseWriter, r *http.Request) {
 	userID, runID := server.uniqueKey(r)
-	j, err := server.cancelRun(userID, runID)
+	j, err := server.cancelRun(userID, runID, server.userID(r))
 	if err != nil {
 		fmt.Println("error cancelling run: ", err)
+		writeRunError(w, err, "failed to cancel run")
+		return
 	}
 	writeJSON(w, j)
 }
 
-// FIXME - try to kill as many processes as possible
-// i.e., don't return at each possible error - run the whole thing (attempt everything)
-// and return errors at end
-// TODO - LOG this event
-func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
-	j := &CancelRunJSON{}
-	j.RunID = runID
-	j.Result = failed
-	runLog, err := server.fetchMainLog(userID, runID)
+// '/runs' - GET
+func (server *Server) handleRunsGET(w http.ResponseWriter, r *http.Request) {
+	userID := server.userID(r)
+	q, err := runListQuery(r)
 	if err != nil {
-		return j, err
+		writeError(w, 400, err.Error())
+		return
 	}
-
-	// log
-	runLog.Main.Event.info("cancelling run")
-
-	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
-	if err != nil {
-		return nil, err
+	var visible authMapping
+	if q.Scope == allScope {
+		if visible, err = server.authMapping(r); err != nil {
+			fmt.Println("error fetching auth mapping: ", err)
+			writeError(w, 500, "failed to check authorization")
+			return
+		}
 	}
-	engineJob, err := jobByID(jobsClient, runLog.Main.JobID)
+	j, err := server.fetchRuns(userID, q, visible)
 	if err != nil {
-		return j, err
+		fmt.Println("error fetching runs: ", err)
+		writeError(w, 500, "failed to list runs")
+		return
+	}
+	if j.Quota, err = server.quotaUsage(userID); err != nil {
+		fmt.Println("error counting quota usage: ", err)
 	}
+	writeJSON(w, j)
+}
 
-	// first kill engine job
-	fmt.Println("deleting engine job..")
-	err = deleteJobs([]batchv1.Job{*engineJob}, running, jobsClient)
+// `/runs` - POST
+func (server *Server) handleRunsPOST(w http.ResponseWriter, r *http.Request) {
+	// WES clients submit runs as multipart/form-data
+	// our own clients still POST the workflow request as JSON
+	var workflowRequest *WorkflowRequest
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		workflowRequest, err = wesWorkflowRequest(r)
+	} else {
+		workflowRequest = &WorkflowRequest{}
+		err = unmarshalBody(r, workflowRequest)
+	}
 	if err != nil {
-		// log
-		runLog.Main.Event.errorf("error killing engine job: %v", err)
-		return j, err
-	}
-
-	// log
-	runLog.Main.Event.info("successfully killed engine job")
-
-	// update status of 'main' (i.e., the engine process, the top-level workflow process)
-	runLog.Main.Status = cancelled
-
-	// write to logdb
-	server.writeLog(runLog, userID, runID)
-
-	// then wait til engine job is killed, and kill all associated task jobs
-	go func(runLog *MainLog, jobsClient batchtypev1.JobInterface) {
-		fmt.Println("sleeping out grace period..")
-		time.Sleep(150 * time.Second)
-
-		fmt.Println("collecting running tasks..")
-		taskJobs := []batchv1.Job{}
-		for taskID, task := range runLog.ByProcess {
-			fmt.Println("handling task ", taskID)
-			if task.JobID != "" {
-				fmt.Println("nonempty jobID: ", task.JobName)
-				job, err := jobByID(jobsClient, task.JobID)
-				if err != nil {
-					fmt.Println("failed to fetch job with ID ", task.JobID)
-				}
-				fmt.Println("collected this running job: ", task.JobName)
-				taskJobs = append(taskJobs, *job)
-
-				// log
-				task.Event.info("task process killed")
-
-				// update status of each task process to be killed
-				task.Status = cancelled
-			} else if task.Status == running {
-				// some running tasks may finish in this grace period
-				// although those task processes finish, output is not collected from them
-				// because the engine process has already been killed
-				// so the most appropriate status for these tasks is 'cancelled'
-				task.Status = cancelled
-			}
-		}
-		switch l := len(taskJobs); l {
-		case 0:
-			fmt.Print("no running task jobs to kill")
-		default:
-			fmt.Println("deleting task jobs..")
-			err = deleteJobs(taskJobs, running, jobsClient)
-			if err != nil {
-				fmt.Println("error deleting task jobs: ", err)
-			}
-			fmt.Println("successfully deleted task jobs")
-		}
-		// update logdb with cancelled tasks
-		server.writeLog(runLog, userID, runID)
-	}(runLog, jobsClient)
+		writeError(w, 400, fmt.Sprintf("invalid workflow request: %v", err))
+		return
+	}
 
-	j.Result = success
-	return j, nil
-}
+	// nothing gets fetched on behalf of a user who may not submit runs
+	if !server.authorizeSubmit(w, r, workflowRequest.Project) {
+		return
+	}
 
-// '/runs' - GET
-func (server *Server) handleRunsGET(w http.ResponseWriter, r *http.Request) {
-	userID := server.userID(r)
-	j, err := server.fetchRuns(userID)
-	if err != nil {
-		fmt.Println("error fetching runs: ", err)
+	// fetch the workflow from a tool registry if the workflowURL points to one
+	if err = resolveTRSWorkflow(workflowRequest); err != nil {
+		writeError(w, 400, fmt.Sprintf("invalid workflow request: %v", err))
+		return
 	}
-	writeJSON(w, j)
-}
 
-func (server *Server) fetchRuns(userID string) (*ListRunsJSON, error) {
-	j := &ListRunsJSON{}
-	runIDs, err := server.listRuns(userID)
-	if err != nil {
-		return nil, err
+	// fetch the workflow from the registry if the request gives a workflow_ref
+	if err = server.resolveWorkflowRef(workflowRequest); err != nil {
+		writeError(w, 400, fmt.Sprintf("invalid workflow request: %v", err))
+		return
 	}
-	j.RunIDs = runIDs
-	return j, nil
-}
 
-// `/runs` - POST
-func (server *Server) handleRunsPOST(w http.ResponseWriter, r *http.Request) {
-	// fixme: return and handle err here
-	workflowRequest := unmarshalBody(r, &WorkflowRequest{}).(*WorkflowRequest)
-
-	// really, all json needs to get validated some way or another by the server
-	// in particular for a workflow request
-	// validate against WorkflowRequest struct schema
-
-	// right now just validating the workflow itself, not the whole request
-	// fixme: validate whole request
-	valid, _ := wflib.ValidateJSON([]byte(workflowRequest.Workflow), nil)
-	if !valid {
-		http.Error(w, "invalid workflow request", 400)
+	// validate the whole request before anything gets written or dispatched
+	if grievances := workflowRequest.validate(); len(grievances) > 0 {
+		writeError(w, 400, fmt.Sprintf("invalid workflow request: %v", strings.Join(grievances, "; ")))
+		return
+	}
+
+	// dry run - plan the run without dispatching anything, see plan.go
+	if r.URL.Query().Get("dry_run") == "true" {
+		server.handleDryRun(w, r, workflowRequest)
 		return
 	}
+	server.startRun(w, r, workflowRequest)
+}
 
+// checks the user may submit runs to the project - before anything about the request is fetched or written
+// writes the error response if not
+func (server *Server) authorizeSubmit(w http.ResponseWriter, r *http.Request, project string) bool {
+	if project != "" && !projectPattern.MatchString(project) {
+		writeError(w, 400, fmt.Sprintf("invalid workflow request: invalid project %q - may only contain letters, digits, '_', '.' and '-'", project))
+		return false
+	}
+	ok, err := server.authorize(r, runsResource(project), submitAction)
+	if err != nil {
+		fmt.Println("error checking auth: ", err)
+		writeError(w, 500, "failed to check authorization")
+		return false
+	}
+	if !ok {
+		writeError(w, 403, fmt.Sprintf("user not authorized to submit runs to %v", runsResource(project)))
+		return false
+	}
+	return true
+}
+
+// creates the run for a validated workflow request, and responds with its runID
+// new runs and resumed runs both start here - the submission has been authorized already,
+// see handleRunsPOST() and runAction()
+func (server *Server) startRun(w http.ResponseWriter, r *http.Request, workflowRequest *WorkflowRequest) {
 	workflowRequest.UserID = server.userID(r)
 	workflowRequest.JobName = createJobName()
 
+	// the callback secrets don't go in request.json - which ends up in the run log, see callbacks.go
+	if secrets := workflowRequest.takeCallbackSecrets(); secrets != nil {
+		if err := writeCallbackSecrets(server.S3FileManager, workflowRequest.UserID, workflowRequest.JobName, secrets); err != nil {
+			fmt.Println("error writing callback secrets to s3: ", err)
+			writeError(w, 500, "failed to write callback secrets to s3")
+			return
+		}
+	}
+
 	err := server.writeWorkflowRequestToS3(workflowRequest)
 	if err != nil {
-		http.Error(w, "failed to write workflow request to s3", 500)
+		fmt.Println("error writing workflow request to s3: ", err)
+		writeError(w, 500, "failed to write workflow request to s3")
 		return
 	}
 
-	err = dispatchWorkflowJob(workflowRequest)
+	// the owner can find the run without the index - so the run goes ahead even if this fails
+	if err = server.writeRunIndex(workflowRequest.UserID, workflowRequest.JobName, workflowRequest.Project); err != nil {
+		fmt.Println("error writing run index: ", err)
+	}
+
+	// over quota -> the run is queued, and dispatched later, see quota.go
+	queued, err := server.submitRun(workflowRequest)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		fmt.Println("error dispatching workflow job: ", err)
+		writeError(w, 500, fmt.Sprintf("failed to dispatch workflow job: %v", err))
 		return
 	}
+	if queued {
+		fmt.Printf("run %v is queued\n", workflowRequest.JobName)
+	}
+	metrics.inc(runsSubmittedMetric, "")
 	j := &RunIDJSON{RunID: workflowRequest.JobName}
 	writeJSON(w, j)
 }
@@ -435,92 +521,46 @@ func (server *Server) setResponseHeader(next http.Handler) http.Handler {
 	})
 }
 
-// auth middleware - processes every request, checks auth with arborist
-// if arborist says 'okay', then process the request
-// if arborist says 'not okay', then http error 'not authorized'
+// auth middleware - processes every request
+// no token, or a token we can't decode -> 401
+// no mariner policy at all -> 403, see authz.go
+// requests on a run get checked with arborist here too
+// submitting and listing runs get checked in their handlers
 func (server *Server) handleAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if server.authZ(r) {
-			// fmt.Println("user has access") // log
-			next.ServeHTTP(w, r)
+		if _, err := server.tokenInfo(r); err != nil {
+			fmt.Println("error authenticating request: ", err)
+			writeError(w, 401, "missing or invalid token")
+			return
+		}
+		ok, err := server.mayUseMariner(r)
+		if err != nil {
+			fmt.Println("error checking auth: ", err)
+			writeError(w, 500, "failed to check authorization")
+			return
+		}
+		if !ok {
+			writeError(w, 403, "user not authorized to access mariner")
 			return
 		}
-		// fmt.Println("user does NOT have access") // log
-		http.Error(w, "user not authorized to access this resource", 403)
+		if mux.Vars(r)["runID"] != "" {
+			var ok bool
+			if r, ok = server.authorizeRun(w, r); !ok {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
-// polish this
-func authHTTPRequest(r *http.Request) (*AuthHTTPRequest, error) {
-	authHeader := r.Header.Get(authHeader)
-	if authHeader == "" {
-		return nil, fmt.Errorf("no token in Authorization header")
-	}
-	userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-	userJWT = strings.TrimPrefix(userJWT, "bearer ")
-	user := &UserJSON{
-		Token: userJWT,
-	}
-	authRequest := &AuthRequest{
-		Resource: "/mariner",
-	}
-	authAction := &AuthAction{
-		Service: "mariner",
-		Method:  "access",
-	}
-	authRequest.Action = authAction
-	requestJSON := &RequestJSON{
-		User:    user,
-		Request: authRequest,
-	}
-	b, err := json.Marshal(requestJSON)
-	if err != nil {
-		fmt.Println("error marhsaling authRequest to json: ", err)
-	}
-	authHTTPRequest := &AuthHTTPRequest{
-		URL:         "http://arborist-service/auth/request",
-		ContentType: "application/json",
-		Body:        bytes.NewBuffer(b),
-	}
-	return authHTTPRequest, nil
-}
-
-func (server *Server) authZ(r *http.Request) bool {
-	authHTTPRequest, err := authHTTPRequest(r)
-	if err != nil {
-		fmt.Println("error building auth request: ", err)
-		return false
-	}
-	resp, err := http.Post(
-		authHTTPRequest.URL,
-		authHTTPRequest.ContentType,
-		authHTTPRequest.Body,
-	)
-	if err != nil {
-		// insert better error and logging handling here
-		fmt.Println("error asking arborist: ", err)
-		return false
-	}
-	authResponse := &ArboristResponse{}
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("error reading arborist response body: ", err)
-		return false
-	}
-	resp.Body.Close()
-	err = json.Unmarshal(b, authResponse)
+// asks the authorizer whether the user may do the method on the resource
+// returns an error if the authorizer couldn't be asked
+func (server *Server) authZ(r *http.Request, resource, method string) (bool, error) {
+	user, err := server.tokenInfo(r)
 	if err != nil {
-		fmt.Println("error unmarshalling arborist response to struct: ", err)
-		return false
+		return false, err
 	}
-	return authResponse.Auth
-}
-
-// HandleHealthcheck registers root endpoint
-// fixme
-func (server *Server) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.URL)
-	return
+	return server.authz.Authorize(user, resource, method)
 }
 
 //// Server utility functions ////
@@ -531,31 +571,64 @@ func writeJSON(w http.ResponseWriter, j interface{}) {
 	e.Encode(j)
 }
 
+// writes a WES ErrorResponse with the given status code
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, &ErrorResponseJSON{Msg: msg, StatusCode: code})
+}
+
+// 404 if the run doesn't exist, 500 otherwise
+func writeRunError(w http.ResponseWriter, err error, msg string) {
+	if err == errRunNotFound {
+		writeError(w, 404, err.Error())
+		return
+	}
+	writeError(w, 500, fmt.Sprintf("%v: %v", msg, err))
+}
+
+// the run's log or request isn't in s3
+var errRunNotFound = errors.New("run not found")
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
 // a run's unique key is the pair (userID, runID)
+// userID is the run's owner - which is the caller, unless the caller may see other users' runs
 func (server *Server) uniqueKey(r *http.Request) (userID, runID string) {
 	runID = mux.Vars(r)["runID"]
+	if owner, ok := r.Context().Value(runOwnerKey).(string); ok {
+		return owner, runID
+	}
 	userID = server.userID(r)
 	return userID, runID
 }
 
 // unmarshal the request body to the given go struct
-// fixme: return error
-func unmarshalBody(r *http.Request, v interface{}) interface{} {
-	b := body(r)
-	err := json.Unmarshal(b, v)
+func unmarshalBody(r *http.Request, v interface{}) error {
+	b, err := body(r)
 	if err != nil {
-		fmt.Println("error unmarshalling: ", err)
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error unmarshalling body: %v", err)
 	}
-	return v
+	return nil
 }
 
-// fixme: return error
-func body(r *http.Request) []byte {
+func body(r *http.Request) ([]byte, error) {
 	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
 	if err != nil {
-		fmt.Println("error reading body: ", err)
+		return nil, fmt.Errorf("error reading body: %v", err)
 	}
-	r.Body.Close()
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-	return b
+	return b, nil
 }
@@ -0,0 +1,186 @@
+package mariner
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for the '/runs/{runID}/tasks/{taskID}/logs' endpoint
+// which serves the stdout/stderr of a task
+//
+// a task is identified by its k8s job name, i.e., Log.JobName
+// so only CommandLineTools have task logs
+//
+// running task -> stream the task container logs from the k8s pods API
+// NOTE: k8s doesn't keep stdout and stderr separate,
+// ----- so the live stream is the combined output of the container, whichever stream is asked for
+// finished task -> serve the archived copy of the requested stream
+// ----- the task container tees the command's stdout and stderr to files in the task's log dir
+// ----- and the s3 sidecar uploads them along with the rest of the working dir
+
+const (
+	// dir under the task working dir which holds the task's stdout/stderr
+	taskLogDir = "_mariner_logs/"
+
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+
+	// prefix of the WES API, as routed by revproxy
+	wesBasePath = "/ga4gh/wes/v1"
+)
+
+// path to the file where the given stream gets archived
+func (tool *Tool) taskLogPath(stream string) string {
+	return fmt.Sprintf("%v%v%v.log", tool.WorkingDir, taskLogDir, stream)
+}
+
+// the URL of the task logs endpoint for the given stream - used in the WES task logs
+func taskLogURL(runID, jobName, stream string) string {
+	return fmt.Sprintf("%v/runs/%v/tasks/%v/logs?stream=%v", wesBasePath, runID, jobName, stream)
+}
+
+// '/runs/{runID}/tasks/{taskID}/logs' - GET
+// query params:
+// - stream: "stdout" (default) or "stderr"
+// - follow: "true" to keep the stream open while the task is running
+func (server *Server) handleTaskLogsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	jobName := mux.Vars(r)["taskID"]
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		stream = stdoutStream
+	}
+	if stream != stdoutStream && stream != stderrStream {
+		writeError(w, 400, fmt.Sprintf("invalid stream %q - must be one of stdout, stderr", stream))
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+
+	runLog, err := server.fetchMainLog(userID, runID)
+	if err != nil {
+		writeRunError(w, err, "failed to fetch run log")
+		return
+	}
+	task := taskByJobName(runLog, jobName)
+	if task == nil {
+		writeError(w, 404, "task not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if task.Status == running {
+		if err = streamPodLogs(w, jobName, follow); err != nil {
+			fmt.Println("error streaming task logs: ", err)
+			writeError(w, 500, "failed to fetch task logs")
+		}
+		return
+	}
+
+	err = server.archivedTaskLogs(w, userID, task, stream)
+	if err == nil {
+		return
+	}
+	// the archived copy isn't there (e.g., the task failed before the sidecar uploaded it)
+	// fall back to the container logs, for as long as the pod is still around
+	fmt.Println("error fetching archived task logs: ", err)
+	if err = streamPodLogs(w, jobName, false); err != nil {
+		fmt.Println("error fetching task pod logs: ", err)
+		writeError(w, 404, "task logs not found")
+	}
+}
+
+// returns the log of the task (or scattered subtask) with the given job name
+// the job of an earlier attempt at a task which got retried gets a log of its own - with the attempt's working dir, see retry.go
+func taskByJobName(runLog *MainLog, jobName string) *Log {
+	if jobName == "" {
+		return nil
+	}
+	for _, task := range runLog.ByProcess {
+		if log := logByJobName(task, jobName); log != nil {
+			return log
+		}
+	}
+	return nil
+}
+
+func logByJobName(task *Log, jobName string) *Log {
+	if task.JobName == jobName {
+		return task
+	}
+	for _, attempt := range task.Attempts {
+		if attempt.JobName == jobName {
+			return &Log{JobName: attempt.JobName, JobID: attempt.JobID, WorkingDir: attempt.WorkingDir, Status: attempt.Status}
+		}
+	}
+	for _, subtask := range task.Scatter {
+		if log := logByJobName(subtask, jobName); log != nil {
+			return log
+		}
+	}
+	return nil
+}
+
+func (server *Server) archivedTaskLogs(w http.ResponseWriter, userID string, task *Log, stream string) error {
+	if task.WorkingDir == "" {
+		return fmt.Errorf("task has no working dir")
+	}
+	path := fmt.Sprintf("%v%v%v.log", task.WorkingDir, taskLogDir, stream)
+	key := strings.TrimPrefix(server.S3FileManager.s3Key(path, userID), "/")
+	svc := s3.New(server.S3FileManager.newS3Session())
+	obj, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(server.S3FileManager.S3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	_, err = io.Copy(w, obj.Body)
+	return err
+}
+
+func streamPodLogs(w http.ResponseWriter, jobName string, follow bool) error {
+	_, _, podsClient, _, err := k8sClient(k8sPodAPI)
+	if err != nil {
+		return err
+	}
+	label := fmt.Sprintf("job-name=%v", jobName)
+	pods, err := podsClient.List(metav1.ListOptions{LabelSelector: label})
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no pod found for job %v", jobName)
+	}
+	logs, err := podsClient.GetLogs(pods.Items[0].Name, &k8sv1.PodLogOptions{
+		Container: taskContainerName,
+		Follow:    follow,
+	}).Stream()
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	_, err = io.Copy(flushWriter{w}, logs)
+	return err
+}
+
+// flushes after each write, so followed logs reach the client as they're written
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,42 @@
+package mariner
+
+import "testing"
+
+func TestTaskByJobName(t *testing.T) {
+	runLog := &MainLog{ByProcess: map[string]*Log{
+		"#main/a": {JobName: "task-a-2", WorkingDir: "/a-2/", Status: running, Attempts: []*AttemptLog{
+			{JobName: "task-a-1", WorkingDir: "/a-1/", Status: failed},
+		}},
+		"#main/b": {Scatter: map[int]*Log{
+			1: {JobName: "task-b-1", WorkingDir: "/b-1/", Status: completed},
+			2: {JobName: "task-b-2-2", WorkingDir: "/b-2-2/", Status: completed, Attempts: []*AttemptLog{
+				{JobName: "task-b-2-1", WorkingDir: "/b-2-1/", Status: failed},
+				{JobName: "task-b-2-2", WorkingDir: "/b-2-2/", Status: completed},
+			}},
+		}},
+	}}
+	cases := []struct {
+		jobName    string
+		workingDir string // "" - not found
+		status     string
+	}{
+		{"task-a-2", "/a-2/", running},
+		{"task-a-1", "/a-1/", failed},
+		{"task-b-1", "/b-1/", completed},
+		{"task-b-2-2", "/b-2-2/", completed},
+		{"task-b-2-1", "/b-2-1/", failed},
+		{"task-c", "", ""},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		task := taskByJobName(runLog, c.jobName)
+		switch {
+		case c.workingDir == "" && task != nil:
+			t.Errorf("%q: expected no task, got %+v", c.jobName, task)
+		case c.workingDir != "" && task == nil:
+			t.Errorf("%q: task not found", c.jobName)
+		case c.workingDir != "" && (task.WorkingDir != c.workingDir || task.Status != c.status):
+			t.Errorf("%q: expected working dir %v and status %v, got %v and %v", c.jobName, c.workingDir, c.status, task.WorkingDir, task.Status)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package mariner
+
+import (
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// this file contains code for time limits
+//
+// a tool's ToolTimeLimit (CWL v1.1+), in its requirements or hints - or those of a workflow or step it's in, see requirements.go -
+// caps how long the tool's job may run, e.g.,
+//
+//     requirements:
+//       - class: ToolTimeLimit
+//         timelimit: 3600
+//
+// the limit (seconds, or an expression which returns seconds - 0 means no limit) becomes the task job's activeDeadlineSeconds,
+// so k8s kills the job once it runs over - NOTE: the clock starts with the job, so it includes the s3 sidecar staging the task's files
+// a task which runs over fails with a failure reason which starts with "timeout:" - timeouts aren't retried, see retry.go
+//
+// a run may be given a wall-clock limit too - "max_runtime" in the workflow request, in seconds
+// once the engine has been running the workflow that long, it cancels the run, see cancel.go
+
+const (
+	toolTimeLimitClass = "ToolTimeLimit"
+
+	// the job condition reason k8s gives a job killed for running past its activeDeadlineSeconds
+	deadlineExceededReason = "DeadlineExceeded"
+)
+
+// returns the tool's time limit in seconds, 0 if it has none - a requirement takes precedence over a hint
+func (engine *K8sEngine) toolTimeLimit(tool *Tool) (int64, error) {
+	req := engine.effectiveRequirements(tool.Task).find(toolTimeLimitClass)
+	if req == nil {
+		return 0, nil
+	}
+	limit, err := tool.timeLimit(req["timelimit"])
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v: %v", toolTimeLimitClass, err)
+	}
+	return limit, nil
+}
+
+// the timelimit field is a number, or an expression which evaluates to a number
+func (tool *Tool) timeLimit(val interface{}) (int64, error) {
+	var err error
+	if exp, ok := val.(string); ok {
+		if val, err = tool.evalExpression(exp); err != nil {
+			return 0, err
+		}
+	}
+	var limit int64
+	switch v := val.(type) {
+	case float64:
+		limit = int64(v)
+	case int64:
+		limit = v
+	case int:
+		limit = int64(v)
+	default:
+		return 0, fmt.Errorf("timelimit must be a number of seconds, got %v", val)
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("timelimit must not be negative, got %v", limit)
+	}
+	return limit, nil
+}
+
+// true if k8s killed the job for running past its deadline
+func jobTimedOut(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Reason == deadlineExceededReason {
+			return true
+		}
+	}
+	return false
+}
+
+func (tool *Tool) timeoutReason() string {
+	return fmt.Sprintf("timeout: task exceeded its time limit of %vs", tool.TimeLimit)
+}
+
+// cancels the run once it has been running for longer than its max_runtime
+// returns a func which stops the clock - to be called once the workflow is done
+func (engine *K8sEngine) enforceMaxRuntime() (stop func()) {
+	maxRuntime := time.Duration(engine.Log.Request.MaxRuntime) * time.Second
+	if maxRuntime <= 0 {
+		return func() {}
+	}
+	engine.infof("run will be cancelled if it runs for longer than its max_runtime of %v", maxRuntime)
+	// the clock doesn't start over if the engine restarts, see recovery.go
+	timer := time.AfterFunc(maxRuntime-engine.runElapsed(), func() {
+		if engine.cancelRequested() {
+			return
+		}
+		reason := fmt.Sprintf("timeout: run exceeded its max_runtime of %v", maxRuntime)
+		engine.Log.Main.FailureReason = reason // #race #ok
+		engine.warnf("%v - cancelling the run", reason)
+		engine.cancel()
+	})
+	return func() { timer.Stop() }
+}
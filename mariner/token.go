@@ -9,23 +9,32 @@ import (
 
 type TokenInfo struct {
 	UserID string
+	Token  string // the encoded token - arborist wants it
 }
 
+// returns "" if the request has no valid token
+// NOTE: the auth middleware already turns away requests without a valid token
 func (server *Server) userID(r *http.Request) (userID string) {
-	authHeader := r.Header.Get(authHeader)
-	if authHeader == "" {
-		fmt.Println("no token in Authorization header")
-	}
-	userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-	userJWT = strings.TrimPrefix(userJWT, "bearer ")
-	info, err := server.decodeToken(userJWT)
+	info, err := server.tokenInfo(r)
 	if err != nil {
 		// log error
 		fmt.Println("error decoding token: ", err)
+		return ""
 	}
 	return info.UserID
 }
 
+// decodes the token in the Authorization header
+func (server *Server) tokenInfo(r *http.Request) (*TokenInfo, error) {
+	authHeader := r.Header.Get(authHeader)
+	if authHeader == "" {
+		return nil, errors.New("no token in Authorization header")
+	}
+	userJWT := strings.TrimPrefix(authHeader, "Bearer ")
+	userJWT = strings.TrimPrefix(userJWT, "bearer ")
+	return server.decodeToken(userJWT)
+}
+
 func (server *Server) decodeToken(token string) (*TokenInfo, error) {
 	missingRequiredField := func(field string) error {
 		msg := fmt.Sprintf(
@@ -45,7 +54,7 @@ func (server *Server) decodeToken(token string) (*TokenInfo, error) {
 
 	claims, err := server.jwtApp.Decode(token)
 	if err != nil {
-		fmt.Println("error decoding token: ", err)
+		return nil, fmt.Errorf("failed to decode token: %v", err)
 	}
 	contextInterface, exists := (*claims)["context"]
 	if !exists {
@@ -73,6 +82,7 @@ func (server *Server) decodeToken(token string) (*TokenInfo, error) {
 	}
 	info := TokenInfo{
 		UserID: username,
+		Token:  token,
 	}
 	return &info, nil
 }
@@ -0,0 +1,288 @@
+package mariner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains code for running workflows published in a GA4GH Tool Registry Service (TRS), e.g., Dockstore
+// see https://github.com/ga4gh/tool-registry-service-schemas
+//
+// instead of a workflow, a workflow request may give a workflow_url which is either
+// - a TRS URI: "trs://{host}/{tool-id}/versions/{version}" - which points to "https://{host}/ga4gh/trs/v2"
+// - a TRS URL: "https://{host}/{base path}/tools/{tool-id}/versions/{version}"
+// ----- plain "http://" works too, for a TRS running locally
+// tool IDs may contain "/" (e.g., "#workflow/github.com/org/repo") - they may be given URL-escaped or not
+//
+// only the registries in "allowed_hosts" of the "trs" config are fetched from - the server makes the requests, so it mustn't be pointed anywhere else
+// ----- redirects are only followed to allowed hosts too
+// the submission is authorized before anything is fetched, see handleRunsPOST()
+//
+// the server fetches the CWL descriptors of the tool version - the primary descriptor and the secondary ones it refers to -
+// packs them in memory, validates the packed workflow and submits it like any other
+// the request in the run log records the tool version and a sha256 of every descriptor it was packed from,
+// so the run stays reproducible even if the tool version changes in the registry later
+
+const (
+	trsScheme      = "trs://"
+	trsAPIBasePath = "/ga4gh/trs/v2"
+
+	trsDescriptorType    = "CWL"
+	trsPrimaryFileType   = "PRIMARY_DESCRIPTOR"
+	trsSecondaryFileType = "SECONDARY_DESCRIPTOR"
+
+	trsTimeout         = 30 * time.Second
+	trsMaxFiles        = 100
+	trsMaxResponseSize = 10 << 20 // 10MiB
+)
+
+// TRSConfig lists the registries workflows may be fetched from, e.g.,
+//
+//	"trs": {"allowed_hosts": ["dockstore.org"]}
+//
+// hosts are matched exactly - give the port too, if the registry isn't on the default one
+// no hosts means no registries
+type TRSConfig struct {
+	AllowedHosts []string `json:"allowed_hosts"`
+}
+
+// true if the host is one of the allowed registries
+func (config *TRSConfig) allowed(host string) bool {
+	for _, allowed := range config.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// TRSDescriptor records the TRS tool version a workflow was fetched from
+type TRSDescriptor struct {
+	URL               string     `json:"url"` // the tool version in the TRS API
+	ToolID            string     `json:"toolID"`
+	Version           string     `json:"version"`
+	PrimaryDescriptor string     `json:"primaryDescriptor"`
+	Files             []*TRSFile `json:"files"`
+}
+
+// TRSFile is a descriptor the workflow was packed from
+type TRSFile struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"` // "sha256:<hex>" of the file's contents
+}
+
+// ToolFile in the TRS API
+type trsToolFile struct {
+	Path     string `json:"path"`
+	FileType string `json:"file_type"`
+}
+
+// FileWrapper in the TRS API
+type trsFileWrapper struct {
+	Content  string `json:"content"`
+	URL      string `json:"url"`
+	Checksum []struct {
+		Checksum string `json:"checksum"`
+		Type     string `json:"type"`
+	} `json:"checksum"`
+}
+
+// fills in the workflow of a request whose workflow_url points to a TRS tool version
+func resolveTRSWorkflow(r *WorkflowRequest) error {
+	if len(r.Workflow) > 0 || !isTRSURL(r.WorkflowURL) {
+		return nil
+	}
+	if r.WorkflowRef != "" {
+		return fmt.Errorf("give either workflow_url or workflow_ref, not both")
+	}
+	workflow, descriptor, err := fetchTRSWorkflow(r.WorkflowURL)
+	if err != nil {
+		fmt.Println("error fetching workflow from TRS: ", err)
+		return fmt.Errorf("failed to fetch workflow %v: %v", r.WorkflowURL, err)
+	}
+	r.Workflow = workflow
+	r.TRS = descriptor
+	return nil
+}
+
+func isTRSURL(workflowURL string) bool {
+	if strings.HasPrefix(workflowURL, trsScheme) {
+		return true
+	}
+	if !strings.HasPrefix(workflowURL, "https://") && !strings.HasPrefix(workflowURL, "http://") {
+		return false
+	}
+	return strings.Contains(workflowURL, "/tools/") && strings.Contains(workflowURL, "/versions/")
+}
+
+// returns the TRS API base URL, the tool ID and the version which the workflow_url points to
+func parseTRSURL(workflowURL string) (base, toolID, version string, err error) {
+	var rest string
+	switch {
+	case strings.HasPrefix(workflowURL, trsScheme):
+		rest = strings.TrimPrefix(workflowURL, trsScheme)
+		i := strings.Index(rest, "/")
+		if i < 1 {
+			return "", "", "", fmt.Errorf("invalid TRS URI %q - must be trs://{host}/{tool-id}/versions/{version}", workflowURL)
+		}
+		base, rest = "https://"+rest[:i]+trsAPIBasePath, rest[i+1:]
+	default:
+		i := strings.Index(workflowURL, "/tools/")
+		if i < 0 {
+			return "", "", "", fmt.Errorf("invalid TRS URL %q - must be {TRS API}/tools/{tool-id}/versions/{version}", workflowURL)
+		}
+		base, rest = workflowURL[:i], workflowURL[i+len("/tools/"):]
+	}
+
+	rest = strings.TrimSuffix(rest, "/")
+	i := strings.LastIndex(rest, "/versions/")
+	if i < 1 {
+		return "", "", "", fmt.Errorf("invalid TRS reference %q - missing tool ID or version", workflowURL)
+	}
+	if toolID, err = url.PathUnescape(rest[:i]); err != nil {
+		return "", "", "", fmt.Errorf("invalid tool ID in %q: %v", workflowURL, err)
+	}
+	if version, err = url.PathUnescape(rest[i+len("/versions/"):]); err != nil {
+		return "", "", "", fmt.Errorf("invalid version in %q: %v", workflowURL, err)
+	}
+	if version == "" || strings.Contains(version, "/") {
+		return "", "", "", fmt.Errorf("invalid version in %q", workflowURL)
+	}
+	return base, toolID, version, nil
+}
+
+// fetches the CWL descriptors of the tool version and packs them
+func fetchTRSWorkflow(workflowURL string) (json.RawMessage, *TRSDescriptor, error) {
+	base, toolID, version, err := parseTRSURL(workflowURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkTRSHost(base); err != nil {
+		return nil, nil, err
+	}
+	descriptor := &TRSDescriptor{
+		URL:     fmt.Sprintf("%v/tools/%v/versions/%v", base, url.PathEscape(toolID), url.PathEscape(version)),
+		ToolID:  toolID,
+		Version: version,
+		Files:   []*TRSFile{},
+	}
+	client := &http.Client{
+		Timeout: trsTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return checkTRSHost(req.URL.String())
+		},
+	}
+
+	toolFiles := []*trsToolFile{}
+	if err = trsGet(client, descriptor.URL+"/"+trsDescriptorType+"/files", &toolFiles); err != nil {
+		return nil, nil, fmt.Errorf("failed to list descriptors: %v", err)
+	}
+	if len(toolFiles) > trsMaxFiles {
+		return nil, nil, fmt.Errorf("tool version has %v files - at most %v are supported", len(toolFiles), trsMaxFiles)
+	}
+
+	files := make(map[string][]byte)
+	for _, toolFile := range toolFiles {
+		switch toolFile.FileType {
+		case trsPrimaryFileType:
+			if descriptor.PrimaryDescriptor != "" {
+				return nil, nil, fmt.Errorf("tool version has more than one primary descriptor")
+			}
+			descriptor.PrimaryDescriptor = toolFile.Path
+		case trsSecondaryFileType:
+		default:
+			// test parameter files, dockerfiles, ..
+			continue
+		}
+		content, err := fetchTRSDescriptor(client, descriptor.URL, toolFile.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		sum := sha256.Sum256(content)
+		descriptor.Files = append(descriptor.Files, &TRSFile{
+			Path:   toolFile.Path,
+			Digest: "sha256:" + hex.EncodeToString(sum[:]),
+		})
+		files[toolFile.Path] = content
+	}
+	if descriptor.PrimaryDescriptor == "" {
+		return nil, nil, fmt.Errorf("tool version has no primary %v descriptor", trsDescriptorType)
+	}
+
+	wf, err := wflib.PackFiles(files, descriptor.PrimaryDescriptor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pack workflow: %v", err)
+	}
+	b, err := json.Marshal(wf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal packed workflow: %v", err)
+	}
+	return json.RawMessage(b), descriptor, nil
+}
+
+// returns an error unless the url is on one of the allowed registries
+func checkTRSHost(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid TRS URL %q: %v", rawURL, err)
+	}
+	if !Config.TRS.allowed(u.Host) {
+		return fmt.Errorf("TRS host %q is not allowed", u.Host)
+	}
+	return nil
+}
+
+// fetches a descriptor, and checks it against its sha256 checksum, if the TRS gives one
+func fetchTRSDescriptor(client *http.Client, toolVersionURL, path string) ([]byte, error) {
+	wrapper := &trsFileWrapper{}
+	descriptorURL := fmt.Sprintf("%v/%v/descriptor/%v", toolVersionURL, trsDescriptorType, url.PathEscape(strings.TrimPrefix(path, "/")))
+	if err := trsGet(client, descriptorURL, wrapper); err != nil {
+		return nil, fmt.Errorf("failed to fetch descriptor %v: %v", path, err)
+	}
+	if wrapper.Content == "" {
+		return nil, fmt.Errorf("descriptor %v has no content", path)
+	}
+	content := []byte(wrapper.Content)
+	sum := sha256.Sum256(content)
+	for _, checksum := range wrapper.Checksum {
+		t := strings.ToLower(strings.Replace(checksum.Type, "-", "", -1))
+		if t == "sha256" && !strings.EqualFold(checksum.Checksum, hex.EncodeToString(sum[:])) {
+			return nil, fmt.Errorf("descriptor %v doesn't match its sha256 checksum", path)
+		}
+	}
+	return content, nil
+}
+
+func trsGet(client *http.Client, resourceURL string, v interface{}) error {
+	req, err := http.NewRequest("GET", resourceURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", resourceURL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, trsMaxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > trsMaxResponseSize {
+		return fmt.Errorf("GET %v: response is larger than %v bytes", resourceURL, trsMaxResponseSize)
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,108 @@
+package mariner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTRSURL(t *testing.T) {
+	cases := []struct {
+		url                   string
+		base, toolID, version string
+		valid                 bool
+	}{
+		{"trs://dockstore.org/%23workflow%2Fgithub.com%2Forg%2Frepo/versions/1.0", "https://dockstore.org/ga4gh/trs/v2", "#workflow/github.com/org/repo", "1.0", true},
+		{"trs://dockstore.org/#workflow/github.com/org/repo/versions/1.0", "https://dockstore.org/ga4gh/trs/v2", "#workflow/github.com/org/repo", "1.0", true},
+		{"https://dockstore.org/api/ga4gh/trs/v2/tools/%23workflow%2Forg%2Frepo/versions/main/", "https://dockstore.org/api/ga4gh/trs/v2", "#workflow/org/repo", "main", true},
+		{"http://localhost:8080/ga4gh/trs/v2/tools/tool-1/versions/v2", "http://localhost:8080/ga4gh/trs/v2", "tool-1", "v2", true},
+		{"trs://dockstore.org", "", "", "", false},
+		{"trs:///tool/versions/1.0", "", "", "", false},
+		{"trs://dockstore.org/tool-1", "", "", "", false},
+		{"trs://dockstore.org/tool-1/versions/", "", "", "", false},
+		{"trs://dockstore.org/versions/1.0", "", "", "", false},
+		{"https://dockstore.org/api/ga4gh/trs/v2/tools/tool-1/versions/1.0%2Fx", "", "", "", false},
+		{"https://dockstore.org/api/ga4gh/trs/v2/tools/tool-1/versions/%zz", "", "", "", false},
+		{"https://dockstore.org/workflows/tool-1", "", "", "", false},
+	}
+	for _, c := range cases {
+		base, toolID, version, err := parseTRSURL(c.url)
+		switch {
+		case c.valid && err != nil:
+			t.Errorf("%v: unexpected error: %v", c.url, err)
+		case !c.valid && err == nil:
+			t.Errorf("%v: expected an error, got %v, %v, %v", c.url, base, toolID, version)
+		case c.valid && (base != c.base || toolID != c.toolID || version != c.version):
+			t.Errorf("%v: expected %v, %v, %v - got %v, %v, %v", c.url, c.base, c.toolID, c.version, base, toolID, version)
+		}
+	}
+}
+
+func TestIsTRSURL(t *testing.T) {
+	cases := []struct {
+		url string
+		trs bool
+	}{
+		{"trs://dockstore.org/tool-1/versions/1.0", true},
+		{"https://dockstore.org/api/ga4gh/trs/v2/tools/tool-1/versions/1.0", true},
+		{"https://example.org/workflow.cwl", false},
+		{"ftp://example.org/tools/tool-1/versions/1.0", false},
+		{"workflow.json", false},
+	}
+	for _, c := range cases {
+		if trs := isTRSURL(c.url); trs != c.trs {
+			t.Errorf("%v: expected %v, got %v", c.url, c.trs, trs)
+		}
+	}
+}
+
+func TestCheckTRSHost(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	Config = &MarinerConfig{TRS: TRSConfig{AllowedHosts: []string{"dockstore.org", "localhost:8080"}}}
+	cases := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://dockstore.org/api/ga4gh/trs/v2", true},
+		{"https://DOCKSTORE.org/api/ga4gh/trs/v2", true},
+		{"http://localhost:8080/ga4gh/trs/v2", true},
+		{"http://localhost/ga4gh/trs/v2", false}, // the port is part of the host
+		{"https://dockstore.org.evil.com/api", false},
+		{"https://evil.com/dockstore.org", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"https://evil.com@dockstore.org/", true}, // userinfo - the request goes to dockstore.org
+	}
+	for _, c := range cases {
+		if err := checkTRSHost(c.url); (err == nil) != c.allowed {
+			t.Errorf("%v: expected allowed=%v, got %v", c.url, c.allowed, err)
+		}
+	}
+
+	Config = &MarinerConfig{}
+	if err := checkTRSHost("https://dockstore.org/api/ga4gh/trs/v2"); err == nil {
+		t.Errorf("expected no hosts to be allowed without a trs config")
+	}
+}
+
+// redirects to a host which isn't allowed don't get followed
+func TestTRSRedirect(t *testing.T) {
+	defer func(config *MarinerConfig) { Config = config }(Config)
+	hit := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer internal.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer registry.Close()
+
+	Config = &MarinerConfig{TRS: TRSConfig{AllowedHosts: []string{strings.TrimPrefix(registry.URL, "http://")}}}
+	if _, _, err := fetchTRSWorkflow(registry.URL + trsAPIBasePath + "/tools/tool-1/versions/1.0"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if hit {
+		t.Errorf("followed a redirect to a host which isn't allowed")
+	}
+}
@@ -57,3 +57,13 @@ func getRandString(n int) string {
 	}
 	return string(b)
 }
+
+// returns true if s is in the list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
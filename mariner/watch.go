@@ -0,0 +1,158 @@
+package mariner
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// this file contains code for watching the run's task jobs
+//
+// instead of each task polling k8s for the status of its job, the engine keeps one watch
+// on the run's task jobs (selected by the run label, see cancel.go)
+// and hands each job's status transitions to the task waiting on that job, over a channel
+//
+// the watch gets re-established whenever k8s closes it - a list first, so no transition is missed in between
+
+const (
+	// status of a job which got deleted before it finished
+	jobDeleted = "deleted"
+
+	jobWatchRetryPeriod = 5 * time.Second
+)
+
+type jobWatcher struct {
+	sync.Mutex
+	selector string
+	subs     map[string]chan string // job UID -> the job's latest status
+	last     map[string]string      // job UID -> the job's latest status, for tasks which subscribe late
+}
+
+func newJobWatcher(selector string) *jobWatcher {
+	return &jobWatcher{
+		selector: selector,
+		subs:     make(map[string]chan string),
+		last:     make(map[string]string),
+	}
+}
+
+// returns a channel which gets the job's status every time it changes
+// a status which isn't read before the next one arrives gets replaced - only the latest status matters
+func (w *jobWatcher) subscribe(jobID string) <-chan string {
+	w.Lock()
+	defer w.Unlock()
+	ch := make(chan string, 1)
+	w.subs[jobID] = ch
+	if status, ok := w.last[jobID]; ok {
+		ch <- status
+	}
+	return ch
+}
+
+func (w *jobWatcher) unsubscribe(jobID string) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.subs, jobID)
+	delete(w.last, jobID)
+}
+
+func (w *jobWatcher) subscribed() []string {
+	w.Lock()
+	defer w.Unlock()
+	jobIDs := make([]string, 0, len(w.subs))
+	for jobID := range w.subs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs
+}
+
+func (w *jobWatcher) update(jobID, status string) {
+	w.Lock()
+	defer w.Unlock()
+	if status == jobDeleted {
+		// the server deletes jobs once they're done, see deleteCompletedJobs()
+		// - a job which finished stays finished
+		if last := w.last[jobID]; last == completed || last == failed {
+			return
+		}
+		if _, ok := w.subs[jobID]; !ok {
+			delete(w.last, jobID)
+			return
+		}
+	}
+	if w.last[jobID] == status {
+		return
+	}
+	w.last[jobID] = status
+	if ch, ok := w.subs[jobID]; ok {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
+
+// background process which keeps the watch going
+func (w *jobWatcher) run() {
+	for {
+		if err := w.watch(); err != nil {
+			fmt.Println("error watching task jobs: ", err)
+		}
+		time.Sleep(jobWatchRetryPeriod)
+	}
+}
+
+// lists the jobs, then watches them until k8s closes the watch
+func (w *jobWatcher) watch() error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	// jobs subscribed to before the list which aren't in it got deleted while there was no watch
+	// e.g., jobs taken over by an engine which restarted, see recovery.go
+	subscribed := w.subscribed()
+	jobs, err := jobsClient.List(metav1.ListOptions{LabelSelector: w.selector})
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, job := range jobs.Items {
+		listed[string(job.GetUID())] = true
+		w.update(string(job.GetUID()), jobStatusToString(&job.Status))
+	}
+	for _, jobID := range subscribed {
+		if !listed[jobID] {
+			w.update(jobID, jobDeleted)
+		}
+	}
+
+	watcher, err := jobsClient.Watch(metav1.ListOptions{
+		LabelSelector:   w.selector,
+		ResourceVersion: jobs.ResourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for e := range watcher.ResultChan() {
+		switch e.Type {
+		case watch.Added, watch.Modified:
+			if job, ok := e.Object.(*batchv1.Job); ok {
+				w.update(string(job.GetUID()), jobStatusToString(&job.Status))
+			}
+		case watch.Deleted:
+			if job, ok := e.Object.(*batchv1.Job); ok {
+				w.update(string(job.GetUID()), jobDeleted)
+			}
+		case watch.Error:
+			// e.g., the resource version is too old - list again
+			return fmt.Errorf("watch error: %v", e.Object)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	wflib "github.com/uc-cdis/mariner/wflib"
+)
+
+// this file contains the WES API response objects
+// and the functions for converting mariner logs into them
+// WES spec: https://github.com/ga4gh/workflow-execution-service-schemas/blob/master/openapi/workflow_execution_service.swagger.yaml
+
+// RunIDJSON is the WES RunId object
+type RunIDJSON struct {
+	RunID string `json:"run_id"`
+}
+
+// StatusJSON is the WES RunStatus object
+type StatusJSON struct {
+	RunID string `json:"run_id"`
+	State string `json:"state"`
+}
+
+// ListRunsJSON is the WES RunListResponse object
+// quota is not in the spec - the user's usage against their quotas, if quotas are configured, see quota.go
+type ListRunsJSON struct {
+	Runs          []*RunSummaryJSON `json:"runs"`
+	NextPageToken string            `json:"next_page_token"`
+	Quota         *QuotaUsageJSON   `json:"quota,omitempty"`
+}
+
+// RunSummaryJSON is the WES RunSummary object (WES 1.1)
+// it's a RunStatus plus some details, so listing runs doesn't require fetching each one
+type RunSummaryJSON struct {
+	RunID     string            `json:"run_id"`
+	State     string            `json:"state"`
+	StartTime string            `json:"start_time,omitempty"`
+	EndTime   string            `json:"end_time,omitempty"`
+	Tags      map[string]string `json:"tags"`
+	User      string            `json:"user,omitempty"`
+	Project   string            `json:"project,omitempty"`
+}
+
+// RunLogJSON is the WES RunLog object
+type RunLogJSON struct {
+	RunID    string                 `json:"run_id"`
+	Request  *RunRequestJSON        `json:"request"`
+	State    string                 `json:"state"`
+	RunLog   *WESLogJSON            `json:"run_log"`
+	TaskLogs []*WESLogJSON          `json:"task_logs"`
+	Outputs  map[string]interface{} `json:"outputs"`
+}
+
+// RunRequestJSON is the WES RunRequest object
+// i.e., the workflow request as it was submitted, echoed back in the run log
+type RunRequestJSON struct {
+	WorkflowParams           json.RawMessage   `json:"workflow_params"`
+	WorkflowType             string            `json:"workflow_type"`
+	WorkflowTypeVersion      string            `json:"workflow_type_version"`
+	Tags                     map[string]string `json:"tags"`
+	WorkflowEngineParameters map[string]string `json:"workflow_engine_parameters"`
+	WorkflowURL              string            `json:"workflow_url"`
+}
+
+// WESLogJSON is the WES Log object - used for the run_log and for each of the task_logs
+// id and system_logs are not in WES 1.0, but they are in later versions of the spec
+// system_logs is the natural place for the mariner event log
+// id is the task's job name - it's the taskID for the task logs endpoint
+type WESLogJSON struct {
+	ID         string   `json:"id,omitempty"`
+	Name       string   `json:"name"`
+	Cmd        []string `json:"cmd"`
+	StartTime  string   `json:"start_time"`
+	EndTime    string   `json:"end_time"`
+	Stdout     string   `json:"stdout"`
+	Stderr     string   `json:"stderr"`
+	ExitCode   *int32   `json:"exit_code"`
+	SystemLogs []string `json:"system_logs,omitempty"`
+}
+
+// ServiceInfoJSON is the WES ServiceInfo object
+type ServiceInfoJSON struct {
+	WorkflowTypeVersions            map[string]*WorkflowTypeVersionJSON   `json:"workflow_type_versions"`
+	SupportedWESVersions            []string                              `json:"supported_wes_versions"`
+	SupportedFilesystemProtocols    []string                              `json:"supported_filesystem_protocols"`
+	WorkflowEngineVersions          map[string]string                     `json:"workflow_engine_versions"`
+	DefaultWorkflowEngineParameters []*DefaultWorkflowEngineParameterJSON `json:"default_workflow_engine_parameters"`
+	SystemStateCounts               map[string]int64                      `json:"system_state_counts"`
+	AuthInstructionsURL             string                                `json:"auth_instructions_url"`
+	ContactInfoURL                  string                                `json:"contact_info_url,omitempty"`
+	Tags                            map[string]string                     `json:"tags"`
+}
+
+// WorkflowTypeVersionJSON is the WES WorkflowTypeVersion object
+type WorkflowTypeVersionJSON struct {
+	WorkflowTypeVersion []string `json:"workflow_type_version"`
+}
+
+// DefaultWorkflowEngineParameterJSON is the WES DefaultWorkflowEngineParameter object
+type DefaultWorkflowEngineParameterJSON struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	DefaultValue string `json:"default_value"`
+}
+
+// ErrorResponseJSON is the WES ErrorResponse object
+// every endpoint returns one of these on error
+type ErrorResponseJSON struct {
+	Msg        string `json:"msg"`
+	StatusCode int    `json:"status_code"`
+}
+
+// maps a mariner process status to a WES State
+func wesState(status string) string {
+	switch status {
+	case notStarted:
+		return stateInitializing
+	case running:
+		return stateRunning
+	case completed:
+		return stateComplete
+	case failed:
+		return stateExecutorError
+	case canceling:
+		return stateCanceling
+	case cancelled, skipped:
+		return stateCanceled
+	}
+	return stateUnknown
+}
+
+// the WES state of the run - a failed run is a SYSTEM_ERROR if the engine or the cluster failed it, or if none of its tasks failed
+func runState(runLog *MainLog) string {
+	if runLog.Main.Status != failed {
+		return wesState(runLog.Main.Status)
+	}
+	if runLog.Main.SystemError {
+		return stateSystemError
+	}
+	for _, task := range runLog.ByProcess {
+		if taskFailed(task) {
+			return stateExecutorError
+		}
+	}
+	return stateSystemError
+}
+
+// true if the task, or one of its scattered subtasks, failed - skipped ones don't count
+func taskFailed(task *Log) bool {
+	if task.Status == failed {
+		return true
+	}
+	for _, subtask := range task.Scatter {
+		if taskFailed(subtask) {
+			return true
+		}
+	}
+	return false
+}
+
+// a process has an end time iff it's in one of these states
+func finishedStatus(status string) bool {
+	switch status {
+	case completed, failed, cancelled, skipped:
+		return true
+	}
+	return false
+}
+
+// converts a timestamp as written by timef() to RFC 3339
+// returns "" if the timestamp is empty or can't be parsed
+func wesTime(ts string) string {
+	if ts == "" {
+		return ""
+	}
+	t, err := time.Parse(timefLayout, ts)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// converts a mariner run log into the WES RunLog object
+func runLogJSON(runID string, runLog *MainLog) *RunLogJSON {
+	j := &RunLogJSON{
+		RunID:    runID,
+		Request:  runRequestJSON(runLog.Request),
+		State:    runState(runLog),
+		RunLog:   wesLogJSON(runID, runLog.Main),
+		TaskLogs: []*WESLogJSON{},
+		Outputs:  wesOutputs(runLog.Main.Output),
+	}
+
+	// byProcess is a map - sort the keys so task_logs is in a stable order
+	taskIDs := make([]string, 0, len(runLog.ByProcess))
+	for taskID := range runLog.ByProcess {
+		taskIDs = append(taskIDs, taskID)
+	}
+	sort.Strings(taskIDs)
+	for _, taskID := range taskIDs {
+		task := runLog.ByProcess[taskID]
+		j.TaskLogs = append(j.TaskLogs, taskLogJSON(runID, taskID, task))
+
+		// scattered subtasks each get their own entry
+		for i := 1; i <= len(task.Scatter); i++ {
+			if subtask, ok := task.Scatter[i]; ok {
+				j.TaskLogs = append(j.TaskLogs, taskLogJSON(runID, fmt.Sprintf("%v[%v]", taskID, i), subtask))
+			}
+		}
+	}
+	return j
+}
+
+func runSummaryJSON(runID string, runLog *MainLog) *RunSummaryJSON {
+	j := &RunSummaryJSON{
+		RunID:     runID,
+		State:     runState(runLog),
+		StartTime: wesTime(runLog.Main.Created),
+	}
+	if finishedStatus(runLog.Main.Status) {
+		j.EndTime = wesTime(runLog.Main.LastUpdated)
+	}
+	if runLog.Request != nil {
+		j.Tags = runLog.Request.Tags
+		j.User = runLog.Request.UserID
+		j.Project = runLog.Request.Project
+	}
+	return j
+}
+
+// tasks which ran as k8s jobs have stdout/stderr, served by the task logs endpoint
+func taskLogJSON(runID, name string, log *Log) *WESLogJSON {
+	j := wesLogJSON(name, log)
+	if log.JobName != "" {
+		j.ID = log.JobName
+		j.Stdout = taskLogURL(runID, log.JobName, stdoutStream)
+		j.Stderr = taskLogURL(runID, log.JobName, stderrStream)
+	}
+	return j
+}
+
+func wesLogJSON(name string, log *Log) *WESLogJSON {
+	j := &WESLogJSON{
+		Name:      name,
+		Cmd:       log.Command,
+		StartTime: wesTime(log.Created),
+		ExitCode:  log.ExitCode,
+	}
+	if finishedStatus(log.Status) {
+		j.EndTime = wesTime(log.LastUpdated)
+	}
+	if log.Event != nil {
+		j.SystemLogs = log.Event.Events
+	}
+	return j
+}
+
+// strips the "#main/" prefix from the top-level workflow output IDs
+func wesOutputs(output map[string]interface{}) map[string]interface{} {
+	outputs := make(map[string]interface{})
+	for id, val := range output {
+		outputs[strings.TrimPrefix(id, mainProcessID+"/")] = val
+	}
+	return outputs
+}
+
+func runRequestJSON(r *WorkflowRequest) *RunRequestJSON {
+	if r == nil {
+		return nil
+	}
+	j := &RunRequestJSON{
+		WorkflowParams:           r.Input,
+		WorkflowType:             workflowTypeCWL,
+		WorkflowTypeVersion:      cwlVersion(r.Workflow),
+		Tags:                     r.Tags,
+		WorkflowEngineParameters: make(map[string]string),
+		WorkflowURL:              r.WorkflowURL,
+	}
+	if r.ServiceAccountName != "" {
+		j.WorkflowEngineParameters[serviceAccountNameParam] = r.ServiceAccountName
+	}
+	if r.Project != "" {
+		j.WorkflowEngineParameters[projectParam] = r.Project
+	}
+	if r.ResumeFrom != "" {
+		j.WorkflowEngineParameters[resumedFromParam] = r.ResumeFrom
+	}
+	if j.WorkflowURL == "" {
+		j.WorkflowURL = r.WorkflowRef
+	}
+	if r.WorkflowDigest != "" {
+		j.WorkflowEngineParameters[workflowDigestParam] = r.WorkflowDigest
+	}
+	if r.MaxRuntime > 0 {
+		j.WorkflowEngineParameters[maxRuntimeParam] = strconv.FormatInt(r.MaxRuntime, 10)
+	}
+	return j
+}
+
+// returns the cwlVersion of a packed workflow
+func cwlVersion(workflow json.RawMessage) string {
+	wf := struct {
+		CWLVersion string `json:"cwlVersion"`
+	}{}
+	json.Unmarshal(workflow, &wf)
+	return wf.CWLVersion
+}
+
+func serviceInfo() *ServiceInfoJSON {
+	return &ServiceInfoJSON{
+		WorkflowTypeVersions: map[string]*WorkflowTypeVersionJSON{
+			workflowTypeCWL: {WorkflowTypeVersion: supportedCWLVersions},
+		},
+		SupportedWESVersions:         supportedWESVersions,
+		SupportedFilesystemProtocols: supportedFilesystemProtocols,
+		WorkflowEngineVersions: map[string]string{
+			"mariner": marinerVersion,
+		},
+		DefaultWorkflowEngineParameters: []*DefaultWorkflowEngineParameterJSON{
+			{Name: manifestParam, Type: "string", DefaultValue: "[]"},
+			{Name: serviceAccountNameParam, Type: "string", DefaultValue: ""},
+			{Name: callbacksParam, Type: "string", DefaultValue: "[]"},
+			{Name: maxRuntimeParam, Type: "int", DefaultValue: ""},
+		},
+		SystemStateCounts:   make(map[string]int64),
+		AuthInstructionsURL: authInstructionsURL,
+		Tags:                map[string]string{},
+	}
+}
+
+// max memory used for parsing a multipart run request - the rest goes to temp files
+const maxRunRequestMemory = 32 << 20
+
+// builds a WorkflowRequest from a WES multipart/form-data RunRequest
+// workflow_url must name one of the workflow_attachment files
+// if that file is not already packed JSON, it gets packed along with the other attachments
+func wesWorkflowRequest(r *http.Request) (*WorkflowRequest, error) {
+	if err := r.ParseMultipartForm(maxRunRequestMemory); err != nil {
+		return nil, fmt.Errorf("failed to parse multipart form: %v", err)
+	}
+	form := r.MultipartForm
+	defer form.RemoveAll()
+	field := func(name string) string {
+		if v := form.Value[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	if t := field("workflow_type"); t != workflowTypeCWL {
+		return nil, fmt.Errorf("unsupported workflow_type: %q", t)
+	}
+	if v := field("workflow_type_version"); v != "" && !contains(supportedCWLVersions, v) {
+		return nil, fmt.Errorf("unsupported workflow_type_version: %q", v)
+	}
+
+	workflowRequest := &WorkflowRequest{
+		WorkflowURL: field("workflow_url"),
+	}
+
+	params := field("workflow_params")
+	if params == "" {
+		params = "{}"
+	}
+	if !json.Valid([]byte(params)) {
+		return nil, fmt.Errorf("workflow_params is not valid json")
+	}
+	workflowRequest.Input = json.RawMessage(params)
+
+	if tags := field("tags"); tags != "" {
+		if err := json.Unmarshal([]byte(tags), &workflowRequest.Tags); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tags: %v", err)
+		}
+	}
+
+	if p := field("workflow_engine_parameters"); p != "" {
+		engineParams := make(map[string]string)
+		if err := json.Unmarshal([]byte(p), &engineParams); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal workflow_engine_parameters: %v", err)
+		}
+		if m, ok := engineParams[manifestParam]; ok {
+			if err := json.Unmarshal([]byte(m), &workflowRequest.Manifest); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal manifest: %v", err)
+			}
+		}
+		workflowRequest.ServiceAccountName = engineParams[serviceAccountNameParam]
+		workflowRequest.Project = engineParams[projectParam]
+		if c, ok := engineParams[callbacksParam]; ok {
+			if err := json.Unmarshal([]byte(c), &workflowRequest.Callbacks); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal callbacks: %v", err)
+			}
+		}
+		if m, ok := engineParams[maxRuntimeParam]; ok && m != "" {
+			maxRuntime, err := strconv.ParseInt(m, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("max_runtime must be a number of seconds: %v", err)
+			}
+			workflowRequest.MaxRuntime = maxRuntime
+		}
+	}
+
+	// a workflow in a tool registry gets fetched when the run is submitted, see trs.go
+	if isTRSURL(workflowRequest.WorkflowURL) && len(form.File["workflow_attachment"]) == 0 {
+		return workflowRequest, nil
+	}
+
+	workflow, err := attachedWorkflow(workflowRequest.WorkflowURL, form.File["workflow_attachment"])
+	if err != nil {
+		return nil, err
+	}
+	workflowRequest.Workflow = workflow
+	return workflowRequest, nil
+}
+
+// writes the attachments to a temp dir, preserving their relative paths
+// then returns the packed workflow which workflowURL points to
+func attachedWorkflow(workflowURL string, attachments []*multipart.FileHeader) (json.RawMessage, error) {
+	if workflowURL == "" {
+		return nil, fmt.Errorf("missing workflow_url")
+	}
+	if len(attachments) == 0 {
+		return nil, fmt.Errorf("missing workflow_attachment - workflow_url must reference an attached file")
+	}
+	dir, err := ioutil.TempDir("", "wes-run-request")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, attachment := range attachments {
+		name, err := attachmentPath(attachment)
+		if err != nil {
+			return nil, err
+		}
+		if err = saveAttachment(attachment, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	name, ok := relativePath(strings.TrimPrefix(workflowURL, "file://"))
+	if !ok {
+		return nil, fmt.Errorf("invalid workflow_url %q - must be the relative path of an attached file", workflowURL)
+	}
+	path := filepath.Join(dir, name)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("workflow_url %q does not reference an attached file", workflowURL)
+	}
+
+	// already packed
+	if valid, _ := wflib.ValidateJSON(b, nil); valid {
+		return json.RawMessage(b), nil
+	}
+
+	wf, err := wflib.PackWorkflow(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack workflow: %v", err)
+	}
+	b, err = json.Marshal(wf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal packed workflow: %v", err)
+	}
+	return json.RawMessage(b), nil
+}
+
+// the attachment's path relative to the workflow, e.g., "tools/align.cwl"
+// the filename is taken from the raw Content-Disposition header - multipart drops everything but the last path element
+func attachmentPath(attachment *multipart.FileHeader) (string, error) {
+	filename := attachment.Filename
+	if _, params, err := mime.ParseMediaType(attachment.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	name, ok := relativePath(filename)
+	if !ok {
+		return "", fmt.Errorf("invalid workflow_attachment filename: %q", filename)
+	}
+	return name, nil
+}
+
+// cleans the path, and returns false if it isn't a path inside the dir it's relative to - e.g., "../x" or "/x"
+func relativePath(p string) (string, bool) {
+	name := filepath.Clean(filepath.FromSlash(p))
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return name, true
+}
+
+func saveAttachment(attachment *multipart.FileHeader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save attachment: %v", err)
+	}
+	src, err := attachment.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open attachment: %v", err)
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to save attachment: %v", err)
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to save attachment: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package mariner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const noInputWorkflowDir = "../testdata/no_input_test/workflow/"
+
+// attachments of a WES run request - attachment filename -> file on disk
+func multipartAttachments(t *testing.T, attachments map[string]string) []*multipart.FileHeader {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for name, path := range attachments {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %v: %v", path, err)
+		}
+		part, err := w.CreateFormFile("workflow_attachment", name)
+		if err != nil {
+			t.Fatalf("failed to create part: %v", err)
+		}
+		part.Write(b)
+	}
+	w.Close()
+	r := httptest.NewRequest("POST", "/ga4gh/wes/v1/runs", body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	if err := r.ParseMultipartForm(maxRunRequestMemory); err != nil {
+		t.Fatalf("failed to parse multipart form: %v", err)
+	}
+	return r.MultipartForm.File["workflow_attachment"]
+}
+
+func TestAttachedWorkflow(t *testing.T) {
+	cwlFiles, _ := filepath.Glob(noInputWorkflowDir + "cwl/*.cwl")
+	nested := map[string]string{}
+	for _, path := range cwlFiles {
+		nested["cwl/"+filepath.Base(path)] = path
+	}
+
+	cases := []struct {
+		name        string
+		attachments map[string]string
+		workflowURL string
+		valid       bool
+	}{
+		{"nested cwl files", nested, "cwl/gen3_test.cwl", true},
+		{"packed workflow in a subdirectory", map[string]string{"a/b/workflow.json": noInputWorkflowDir + "workflow.json"}, "a/b/workflow.json", true},
+		{"file:// workflow url", map[string]string{"a/workflow.json": noInputWorkflowDir + "workflow.json"}, "file://a/workflow.json", true},
+		{"workflow url not attached", map[string]string{"a/workflow.json": noInputWorkflowDir + "workflow.json"}, "workflow.json", false},
+		{"attachment outside the workflow dir", map[string]string{"../workflow.json": noInputWorkflowDir + "workflow.json"}, "workflow.json", false},
+		{"nested attachment outside the workflow dir", map[string]string{"a/../../workflow.json": noInputWorkflowDir + "workflow.json"}, "workflow.json", false},
+		{"absolute attachment", map[string]string{"/tmp/workflow.json": noInputWorkflowDir + "workflow.json"}, "/tmp/workflow.json", false},
+		{"workflow url outside the workflow dir", map[string]string{"workflow.json": noInputWorkflowDir + "workflow.json"}, "../../etc/passwd", false},
+	}
+	for _, c := range cases {
+		workflow, err := attachedWorkflow(c.workflowURL, multipartAttachments(t, c.attachments))
+		switch {
+		case c.valid && err != nil:
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+		case c.valid && len(workflow) == 0:
+			t.Errorf("%v: no workflow", c.name)
+		case !c.valid && err == nil:
+			t.Errorf("%v: expected an error", c.name)
+		}
+	}
+}
+
+func TestRunState(t *testing.T) {
+	cases := []struct {
+		name  string
+		main  *Log
+		tasks map[string]*Log
+		state string
+	}{
+		{"running", &Log{Status: running}, nil, stateRunning},
+		{"complete", &Log{Status: completed}, map[string]*Log{"#main/a": {Status: completed}}, stateComplete},
+		{"cancelled", &Log{Status: cancelled}, map[string]*Log{"#main/a": {Status: cancelled}}, stateCanceled},
+		{"task failed", &Log{Status: failed, FailureReason: "failed or skipped: #main/a"}, map[string]*Log{
+			"#main/a": {Status: failed}, "#main/b": {Status: skipped},
+		}, stateExecutorError},
+		{"scattered subtask failed", &Log{Status: failed}, map[string]*Log{
+			"#main/a": {Status: failed, Scatter: map[int]*Log{1: {Status: completed}, 2: {Status: failed}}},
+		}, stateExecutorError},
+		{"no task failed", &Log{Status: failed}, map[string]*Log{"#main/a": {Status: completed}}, stateSystemError},
+		{"no tasks - e.g., the request couldn't be loaded", &Log{Status: failed, FailureReason: "failed to load workflow request"}, nil, stateSystemError},
+		{"engine panicked", &Log{Status: failed, SystemError: true, FailureReason: "mariner panicked"}, map[string]*Log{
+			"#main/a": {Status: running},
+		}, stateSystemError},
+		{"task job couldn't be created", &Log{Status: failed, SystemError: true}, map[string]*Log{
+			"#main/a": {Status: failed},
+		}, stateSystemError},
+		{"only skipped tasks", &Log{Status: failed}, map[string]*Log{"#main/a": {Status: skipped}}, stateSystemError},
+	}
+	for _, c := range cases {
+		if state := runState(&MainLog{Main: c.main, ByProcess: c.tasks}); state != c.state {
+			t.Errorf("%v: expected %v, got %v", c.name, c.state, state)
+		}
+	}
+}
@@ -22,7 +22,7 @@ import (
 // ----- probably the config will be put in the manifest which holds the config for all the other services
 // ----- and the configmap name might change to `manifest-mariner`
 // ----- when this happens, need to update 1. mariner-config.json 2. mariner-deploy.yaml 3. engine job spec (DispatchWorkflowJob)
-var Config = loadConfig("/mariner-config/mariner-config.json")
+var Config = loadConfig(marinerConfigPath)
 
 /*
  	a Task is a process is a node on the graph is one of [Workflow, CommandLineTool, ExpressionTool, ...]
@@ -50,11 +50,28 @@ type Task struct {
 	Children      map[string]*Task       // if task is a workflow; the Task objects of the workflow steps are stored here; {taskID: task} pairs
 	OutputIDMap   map[string]string      // if task is a workflow; a map of {outputID: stepID} pairs in order to trace i/o dependencies between steps
 	InputIDMap    map[string]string
-	OriginalStep  *cwl.Step // if this task is a step in a workflow, this is the information from this task's step entry in the parent workflow's cwl file
-	Done          *bool     // false until all output for this task has been collected, then true
+	OriginalStep  *cwl.Step     // if this task is a step in a workflow, this is the information from this task's step entry in the parent workflow's cwl file
+	Done          *bool         // false until all output for this task has been collected, then true
+	finished      chan struct{} // closed when Done becomes true - see wait()
 	// --- New Fields ---
-	Log           *Log           // contains Status, Stats, Event
-	CleanupByStep *CleanupByStep // if task is a workflow; info for deleting intermediate files after they are no longer needed
+	Log           *Log                 // contains Status, Stats, Event
+	CleanupByStep *CleanupByStep       // if task is a workflow; info for deleting intermediate files after they are no longer needed
+	Inherited     *ProcessRequirements // if task is a step in a workflow; the requirements and hints it inherits from its workflow and step, see requirements.go
+}
+
+// the channel which gets closed once the task is done, see finishTask()
+func (task *Task) finishedChan() chan struct{} {
+	task.Lock()
+	defer task.Unlock()
+	if task.finished == nil {
+		task.finished = make(chan struct{})
+	}
+	return task.finished
+}
+
+// blocks until all output for this task has been collected
+func (task *Task) wait() {
+	<-task.finishedChan()
 }
 
 // fileParam returns a bool indicating whether the given step-level input param corresponds to a set of files
@@ -136,6 +153,7 @@ func (engine *K8sEngine) resolveGraph(rootMap map[string]*cwl.Root, curTask *Tas
 				OriginalStep: &curTask.Root.Steps[i],
 				Log:          logger(),
 				Done:         &falseVal,
+				Inherited:    engine.stepRequirements(curTask, step.ID),
 			}
 			engine.Log.ByProcess[step.ID] = newTask.Log
 
@@ -154,6 +172,32 @@ func (engine *K8sEngine) resolveGraph(rootMap map[string]*cwl.Root, curTask *Tas
 func (engine *K8sEngine) runWorkflow() error {
 	engine.infof("begin run workflow")
 
+	mainTask, err := engine.taskGraph()
+	if err != nil {
+		return err
+	}
+
+	mainTask.Log.JobName = engine.Log.Request.JobName
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return engine.errorf("%v", err)
+	}
+	mainTask.Log.JobID = engineJobID(jobsClient, engine.Log.Request.JobName)
+
+	// run the workflow
+	if err = engine.run(mainTask); err != nil {
+		return engine.errorf("failed to run main task: %v", err)
+	}
+
+	engine.infof("end run workflow")
+	engine.writeLogToS3()
+	return nil
+}
+
+// taskGraph parses the workflow and inputs of the request
+// and returns the task object for the top level workflow, populated with the task objects for the rest of the graph
+// nothing gets dispatched here - a dry run (see plan.go) stops here
+func (engine *K8sEngine) taskGraph() (*Task, error) {
 	var root cwl.Root
 	var err error
 	var originalParams cwl.Parameters
@@ -164,12 +208,12 @@ func (engine *K8sEngine) runWorkflow() error {
 
 	// unmarshal the packed workflow JSON from the request body
 	if err = json.Unmarshal(engine.Log.Request.Workflow, &root); err != nil {
-		return engine.errorf("failed to unmarshal workflow JSON: %v", err)
+		return nil, engine.errorf("failed to unmarshal workflow JSON: %v", err)
 	}
 
 	// unmarshal the inputs JSON from the request body
 	if err = json.Unmarshal(engine.Log.Request.Input, &originalParams); err != nil {
-		return engine.errorf("failed to unmarshal inputs JSON: %v", err)
+		return nil, engine.errorf("failed to unmarshal inputs JSON: %v", err)
 	}
 
 	// small preprocessing step to get the right input param IDs for the top level workflow
@@ -200,32 +244,18 @@ func (engine *K8sEngine) runWorkflow() error {
 		}
 	}
 	if mainTask == nil {
-		return engine.errorf("failed to find main process")
+		return nil, engine.errorf("failed to find main process")
 	}
 
 	// fixme: refactor
 	engine.Log.Main = mainTask.Log
-
-	mainTask.Log.JobName = engine.Log.Request.JobName
-	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
-	if err != nil {
-		return engine.errorf("%v", err)
-	}
-	mainTask.Log.JobID = engineJobID(jobsClient, engine.Log.Request.JobName)
+	engine.recoverMainLog(mainTask.Log)
 
 	// recursively populate `mainTask` with Task objects for the rest of the nodes in the workflow graph
 	if err = engine.resolveGraph(flatRoots, mainTask); err != nil {
-		return engine.errorf("failed to resolve graph: %v", err)
-	}
-
-	// run the workflow
-	if err = engine.run(mainTask); err != nil {
-		return engine.errorf("failed to run main task: %v", err)
+		return nil, engine.errorf("failed to resolve graph: %v", err)
 	}
-
-	engine.infof("end run workflow")
-	engine.writeLogToS3()
-	return nil
+	return mainTask, nil
 }
 
 /*
@@ -243,21 +273,30 @@ func (engine *K8sEngine) run(task *Task) (err error) {
 	engine.startTask(task)
 	switch {
 	case task.Scatter != nil:
-		engine.runScatter(task)
-		engine.gatherScatterOutputs(task) // Q. does this mean final log doesn't get written for scattered tasks?
+		if err = engine.runScatter(task); err == nil {
+			if err = task.childFailure(); err == nil {
+				engine.gatherScatterOutputs(task) // Q. does this mean final log doesn't get written for scattered tasks?
+			}
+		}
 	case task.Root.Class == "Workflow":
 		// this is not a leaf in the graph
 		engine.runSteps(task)
-		if err = engine.mergeChildParams(task); err != nil {
-			return engine.errorf("failed to merge child params for task: %v; error: %v", task.Root.ID, err)
+		if err = task.childFailure(); err == nil {
+			if err = engine.mergeChildParams(task); err != nil {
+				err = engine.errorf("failed to merge child params for task: %v; error: %v", task.Root.ID, err)
+			}
 		}
 	default:
 		// this is a leaf in the graph
-		engine.dispatchTask(task)
+		err = engine.dispatchTask(task)
+	}
+	// the task always gets finished, so whatever waits on it doesn't wait forever - see failure.go
+	if err != nil {
+		task.Log.fail(err.Error())
 	}
 	engine.finishTask(task)
 	engine.infof("end run task: %v", task.Root.ID)
-	return nil
+	return err
 }
 
 func (engine *K8sEngine) mergeChildParams(task *Task) (err error) {
@@ -339,23 +378,20 @@ func (engine *K8sEngine) runStep(curStepID string, parentTask *Task, task *Task)
 			outputID := depTask.Root.ID + strings.TrimPrefix(source, depStepID)
 
 			engine.infof("begin step %v wait for dependency step %v to finish", curStepID, depStepID)
-			done := false
-			for inputPresent := false; !inputPresent; _, inputPresent = task.Parameters[taskInput] {
-				done = *depTask.Done
-				if done {
-					task.Parameters[taskInput] = depTask.Outputs[outputID] // #race #ok (?)
-					if task.Parameters[taskInput] == nil {
-						if input.Default != nil {
-							task.Parameters[taskInput] = input.Default.Self
-						} else {
-							engine.warnf("source returned null and no default provided for step input: %v", input.ID)
-						}
-					}
-					// fmt.Println("\tDependency task complete!")
-					// fmt.Println("\tSuccessfully collected output from dependency task.")
-					engine.infof("end step %v wait for dependency step %v to finish", curStepID, depStepID)
+			depTask.wait()
+			if depTask.failed() {
+				engine.skipTask(task, fmt.Sprintf("dependency step %v failed", depStepID))
+				return
+			}
+			task.Parameters[taskInput] = depTask.Outputs[outputID] // #race #ok (?)
+			if task.Parameters[taskInput] == nil {
+				if input.Default != nil {
+					task.Parameters[taskInput] = input.Default.Self
+				} else {
+					engine.warnf("source returned null and no default provided for step input: %v", input.ID)
 				}
 			}
+			engine.infof("end step %v wait for dependency step %v to finish", curStepID, depStepID)
 		} else if strings.HasPrefix(source, parentTask.Root.ID) {
 			// if the input source to this step is not the outputID of another step
 			// but is an input of the parent workflow
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DRS objects are downloaded from their access URLs, not from s3
+// see mariner/drs.go for how the engine resolves them
+
+const (
+	// DRS inputs go in "<task working dir>/_mariner_drs/" - which doesn't get uploaded with the task output
+	drsInputDir = "_mariner_drs"
+
+	drsDownloadTimeout = 6 * time.Hour
+)
+
+// DRSInput ..
+type DRSInput struct {
+	URI       string         `json:"uri"`
+	Path      string         `json:"path"`
+	URL       string         `json:"url"`
+	Headers   []string       `json:"headers,omitempty"`
+	Size      int64          `json:"size"`
+	Checksums []*DRSChecksum `json:"checksums"`
+}
+
+// DRSChecksum ..
+type DRSChecksum struct {
+	Checksum string `json:"checksum"`
+	Type     string `json:"type"`
+}
+
+// checksum types we can verify, by their DRS name - see https://ga4gh.github.io/data-repository-service-schemas/
+var drsHashes = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+	"md5":     md5.New,
+}
+
+// 2b. download this task's DRS inputs
+// unlike s3 inputs, any DRS input which fails to download or to match its checksums fails the task
+func (fm *S3FileManager) downloadDRSInputs(taskS3Input *TaskS3Input) error {
+	client := &http.Client{Timeout: drsDownloadTimeout}
+	for _, input := range taskS3Input.DRS {
+		fmt.Println("trying to download DRS object:", input.URI)
+		n, err := downloadDRSInput(client, input)
+		atomic.AddInt64(&fm.BytesDownloaded, n)
+		if err != nil {
+			return fmt.Errorf("failed to download DRS object %v: %v", input.URI, err)
+		}
+		fmt.Printf("DRS object downloaded, %d bytes\n", n)
+	}
+	return nil
+}
+
+func downloadDRSInput(client *http.Client, input *DRSInput) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(input.Path), os.ModeDir); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", input.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, header := range input.Headers {
+		kv := strings.SplitN(header, ":", 2)
+		if len(kv) == 2 {
+			req.Header.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET access URL: %v", resp.Status)
+	}
+
+	f, err := os.Create(input.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// hash the object as it downloads
+	hashes := make(map[string]hash.Hash)
+	writers := []io.Writer{f}
+	for _, checksum := range input.Checksums {
+		t := strings.ToLower(checksum.Type)
+		if newHash, ok := drsHashes[t]; ok && hashes[t] == nil {
+			hashes[t] = newHash()
+			writers = append(writers, hashes[t])
+		}
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if input.Size > 0 && n != input.Size {
+		return n, fmt.Errorf("downloaded %v bytes, expected %v", n, input.Size)
+	}
+	verified := false
+	for _, checksum := range input.Checksums {
+		h, ok := hashes[strings.ToLower(checksum.Type)]
+		if !ok {
+			fmt.Printf("skipping checksum of unsupported type %v\n", checksum.Type)
+			continue
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum.Checksum) {
+			return n, fmt.Errorf("%v checksum mismatch - got %v, expected %v", checksum.Type, sum, checksum.Checksum)
+		}
+		verified = true
+	}
+	if !verified {
+		fmt.Println("WARNING: no checksum could be verified for DRS object:", input.URI)
+	}
+	return n, nil
+}
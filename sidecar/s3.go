@@ -29,6 +29,10 @@ const (
 	// resides in the task's working dir in s3
 	// contains list of files that need to be downloaded from s3 in order for this task to run
 	inputFileListName = "_mariner_s3_input.json"
+
+	// the sidecar writes the number of bytes it moved to "<task working dir>/_mariner_logs/sidecar_metrics.json"
+	taskLogDir         = "_mariner_logs"
+	sidecarMetricsFile = "sidecar_metrics.json"
 )
 
 // S3FileManager manages interactions with S3
@@ -40,6 +44,13 @@ type S3FileManager struct {
 	SharedVolumeMountPath string
 	TaskWorkingDir        string
 	MaxConcurrent         int
+
+	// bytes moved - updated concurrently, so use atomic
+	BytesDownloaded int64
+	BytesUploaded   int64
+
+	// set if an input which the task can't run without failed to download - see drs.go
+	InputError error
 }
 
 type awsCredentials struct {
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -16,7 +18,14 @@ import (
 
 // TaskS3Input ..
 type TaskS3Input struct {
-	Paths []string `json:"paths"`
+	Paths []string    `json:"paths"`
+	DRS   []*DRSInput `json:"drs,omitempty"` // see drs.go
+}
+
+// SidecarMetrics ..
+type SidecarMetrics struct {
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
 }
 
 func main() {
@@ -24,16 +33,30 @@ func main() {
 	fm := &S3FileManager{}
 	fm.setup()
 
+	// if the sidecar fails to move the task's files, it exits non-zero once it's done - which fails the task job
+	// the engine retries tasks which fail this way, see mariner/retry.go
+	s3Failed := false
+
 	// 1. read in the target s3 paths
 	taskS3Input, err := fm.fetchTaskS3InputList()
 	if err != nil {
 		fmt.Println("readMarinerS3Paths failed:", err)
+		s3Failed = true
 	}
 
 	// 2. download those files to the shared volume
 	err = fm.downloadInputFiles(taskS3Input)
 	if err != nil {
 		fmt.Println("downloadFiles failed:", err)
+		s3Failed = true
+	}
+
+	// 2b. download DRS objects to the task working dir
+	if taskS3Input != nil {
+		if err = fm.downloadDRSInputs(taskS3Input); err != nil {
+			fmt.Println("downloadDRSInputs failed:", err)
+			fm.InputError = err
+		}
 	}
 
 	// 3. signal main container to run
@@ -52,8 +75,18 @@ func main() {
 	err = fm.uploadOutputFiles()
 	if err != nil {
 		fmt.Println("uploadOutputFiles failed:", err)
+		s3Failed = true
 	}
 
+	// 6. let the engine know how much data got moved
+	err = fm.uploadMetrics()
+	if err != nil {
+		fmt.Println("uploadMetrics failed:", err)
+	}
+
+	if s3Failed {
+		os.Exit(1)
+	}
 	return
 }
 
@@ -95,8 +128,8 @@ func (fm *S3FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error
 	sess := fm.newS3Session()
 	downloader := s3manager.NewDownloader(sess)
 
-	var n int64
 	var wg sync.WaitGroup
+	var failures int64
 	guard := make(chan struct{}, fm.MaxConcurrent)
 	for _, p := range taskS3Input.Paths {
 		// blocks if guard channel is already full to capacity
@@ -121,13 +154,15 @@ func (fm *S3FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error
 			fmt.Println("trying to download obj with key:", fm.s3Key(path))
 
 			// write s3 object content into file
-			n, err = downloader.Download(f, &s3.GetObjectInput{
+			n, err := downloader.Download(f, &s3.GetObjectInput{
 				Bucket: aws.String(fm.S3BucketName),
 				Key:    aws.String(strings.TrimPrefix(fm.s3Key(path), "/")),
 			})
 			if err != nil {
 				fmt.Println("failed to download file:", path, err)
+				atomic.AddInt64(&failures, 1)
 			}
+			atomic.AddInt64(&fm.BytesDownloaded, n)
 
 			// close file - very important
 			if err = f.Close(); err != nil {
@@ -142,6 +177,9 @@ func (fm *S3FileManager) downloadInputFiles(taskS3Input *TaskS3Input) (err error
 		}(p)
 	}
 	wg.Wait()
+	if failures > 0 {
+		return fmt.Errorf("failed to download %v of %v files", failures, len(taskS3Input.Paths))
+	}
 	return nil
 }
 
@@ -157,6 +195,12 @@ func (fm *S3FileManager) signalTaskToRun() error {
 	// fixme - make these strings constants
 	cmd := os.Getenv("TOOL_COMMAND")
 
+	// the task can't run without its inputs - so fail it, with the reason in its stderr
+	if fm.InputError != nil {
+		msg := fmt.Sprintf("mariner: failed to fetch task inputs: %v", fm.InputError)
+		cmd = fmt.Sprintf("echo '%v' >&2\nexit 1\n", strings.Replace(msg, "'", `'\''`, -1))
+	}
+
 	pathToTaskCommand := filepath.Join(fm.TaskWorkingDir, "run.sh")
 
 	// create necessary dirs
@@ -211,9 +255,15 @@ func (fm *S3FileManager) waitForTaskToFinish() error {
 func (fm *S3FileManager) uploadOutputFiles() (err error) {
 	// collect paths of all files in the task working directory
 	paths := []string{}
+	sizes := make(map[string]int64)
 	_ = filepath.Walk(fm.TaskWorkingDir, func(path string, info os.FileInfo, err error) error {
+		// DRS inputs live elsewhere already
+		if info.IsDir() && path == filepath.Join(fm.TaskWorkingDir, drsInputDir) {
+			return filepath.SkipDir
+		}
 		if !info.IsDir() {
 			paths = append(paths, path)
+			sizes[path] = info.Size()
 		}
 		return nil
 	})
@@ -224,6 +274,7 @@ func (fm *S3FileManager) uploadOutputFiles() (err error) {
 
 	var result *s3manager.UploadOutput
 	var wg sync.WaitGroup
+	var failures int64
 	guard := make(chan struct{}, fm.MaxConcurrent)
 	for _, p := range paths {
 		// blocks if guard channel is already full to capacity
@@ -252,9 +303,11 @@ func (fm *S3FileManager) uploadOutputFiles() (err error) {
 			})
 			if err != nil {
 				fmt.Println("failed to upload file:", path, err)
+				atomic.AddInt64(&failures, 1)
 				return
 			}
 			fmt.Println("file uploaded to location:", result.Location)
+			atomic.AddInt64(&fm.BytesUploaded, sizes[path])
 
 			// seems that files are already closed by this point
 			// close the file - very important
@@ -269,5 +322,27 @@ func (fm *S3FileManager) uploadOutputFiles() (err error) {
 		}(p)
 	}
 	wg.Wait()
+	if failures > 0 {
+		return fmt.Errorf("failed to upload %v of %v files", failures, len(paths))
+	}
 	return nil
 }
+
+// 6. write the number of bytes moved to the task's log dir in s3
+// the engine picks this up once the task job finishes
+func (fm *S3FileManager) uploadMetrics() error {
+	b, err := json.Marshal(&SidecarMetrics{
+		BytesDownloaded: atomic.LoadInt64(&fm.BytesDownloaded),
+		BytesUploaded:   atomic.LoadInt64(&fm.BytesUploaded),
+	})
+	if err != nil {
+		return err
+	}
+	uploader := s3manager.NewUploader(fm.newS3Session())
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(fm.S3BucketName),
+		Key:    aws.String(fm.s3Key(filepath.Join(fm.TaskWorkingDir, taskLogDir, sidecarMetricsFile))),
+		Body:   bytes.NewReader(b),
+	})
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"strings"
 
@@ -19,6 +20,10 @@ type Packer struct {
 	Graph        *[]map[string]interface{}
 	FilesPacked  map[string]string // {path: id}
 	VersionCheck map[string][]string
+
+	// optional - cwl files in memory, by path
+	// if set, files are read from here instead of from disk, see PackFiles
+	Files map[string][]byte
 }
 
 // PackWorkflow ..
@@ -41,6 +46,32 @@ func PackWorkflow(inPath string) (wf *WorkflowJSON, err error) {
 	return wf, nil
 }
 
+// PackFiles packs a workflow whose cwl files are in memory - e.g., fetched from a tool registry
+// 'files' maps the path of each file to its contents, and 'mainPath' is the path of the main workflow file
+// paths are slash-separated, and 'run' fields are resolved relative to the file they're in
+func PackFiles(files map[string][]byte, mainPath string) (wf *WorkflowJSON, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("pack routine panicked")
+		}
+	}()
+
+	packer := &Packer{
+		Graph:        &[]map[string]interface{}{},
+		FilesPacked:  make(map[string]string),
+		VersionCheck: make(map[string][]string),
+		Files:        make(map[string][]byte),
+	}
+	for path, cwl := range files {
+		packer.Files[memPath(path, "")] = cwl
+	}
+
+	if wf, err = packer.PackWorkflow(mainPath); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
 // Pack is the top level function for the packing routine
 func Pack(inPath string, outPath string) (err error) {
 	var wd string
@@ -194,7 +225,9 @@ func (p *Packer) PackCWLFile(path string, prevPath string) (string, error) {
 	if filepath.Ext(path) != ".cwl" {
 		return "", fmt.Errorf("input %v is not a cwl file", path)
 	}
-	if path, err = absPath(path, prevPath); err != nil {
+	if p.Files != nil {
+		path = memPath(path, prevPath)
+	} else if path, err = absPath(path, prevPath); err != nil {
 		return "", err
 	}
 
@@ -204,7 +237,7 @@ func (p *Packer) PackCWLFile(path string, prevPath string) (string, error) {
 		return packedID, nil
 	}
 
-	cwl, err := ioutil.ReadFile(path)
+	cwl, err := p.readFile(path)
 	if err != nil {
 		return "", err
 	}
@@ -236,6 +269,26 @@ func (p *Packer) PackCWLFile(path string, prevPath string) (string, error) {
 	return id, nil
 }
 
+func (p *Packer) readFile(path string) ([]byte, error) {
+	if p.Files == nil {
+		return ioutil.ReadFile(path)
+	}
+	cwl, ok := p.Files[path]
+	if !ok {
+		return nil, fmt.Errorf("file %v not found", path)
+	}
+	return cwl, nil
+}
+
+// in-memory counterpart of absPath - 'path' is relative to the file 'refPath'
+// paths are rooted at "/", so ".." can't climb out of the set of files
+func memPath(path string, refPath string) string {
+	if refPath == "" {
+		return pathpkg.Clean("/" + path)
+	}
+	return pathpkg.Join(pathpkg.Dir(refPath), path)
+}
+
 // this feels like a sin
 // but not sure offhand how to otherwise handle resolving paths
 func absPath(path string, refPath string) (string, error) {
@@ -1,7 +1,11 @@
 package wflib
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -24,3 +28,47 @@ func TestPack(t *testing.T) {
 	p(noInputCWL)
 	p(userDataCWL)
 }
+
+func TestPackFiles(t *testing.T) {
+	// packing from memory should give the same objects as packing from disk
+	// the order of the graph and of the fields mapped to arrays depends on map iteration, so just compare ids
+	ids := func(wf *WorkflowJSON) []string {
+		ids := []string{}
+		for _, obj := range *wf.Graph {
+			ids = append(ids, obj["id"].(string))
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	p := func(cwl string) {
+		fromDisk, err := PackWorkflow(cwl)
+		if err != nil {
+			t.Fatalf("failed to pack cwl %v\nerror: %v", cwl, err)
+		}
+		paths, _ := filepath.Glob(filepath.Join(filepath.Dir(cwl), "*.cwl"))
+		files := make(map[string][]byte)
+		for _, path := range paths {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read %v\nerror: %v", path, err)
+			}
+			files["cwl/"+filepath.Base(path)] = b
+		}
+		fromMemory, err := PackFiles(files, "cwl/"+filepath.Base(cwl))
+		if err != nil {
+			t.Fatalf("failed to pack cwl %v from memory\nerror: %v", cwl, err)
+		}
+		if !reflect.DeepEqual(ids(fromDisk), ids(fromMemory)) {
+			t.Errorf("packing %v from memory gave objects %v, from disk %v", cwl, ids(fromMemory), ids(fromDisk))
+		}
+		if valid, grievances := ValidateWorkflow(fromMemory); !valid {
+			t.Errorf("workflow %v packed from memory is not valid: %v", cwl, grievances)
+		}
+	}
+	p(noInputCWL)
+	p(userDataCWL)
+
+	if _, err := PackFiles(map[string][]byte{}, "missing.cwl"); err == nil {
+		t.Errorf("expected an error packing a file which isn't there")
+	}
+}